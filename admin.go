@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// BanDomainRequest is the json body accepted when banning a destination domain
+type BanDomainRequest struct {
+	Domain string `json:"domain"`
+}
+
+// BanDomainResponse reports a ban and how many existing urls it disabled
+type BanDomainResponse struct {
+	Domain   string `json:"domain"`
+	Disabled int    `json:"disabled"`
+}
+
+// BannedDomainList is every banned destination domain
+type BannedDomainList struct {
+	Domains []string `json:"domains"`
+}
+
+// SearchURLs responds with a page of every owner's urls, the q query parameter restricts them to urls
+// whose slug or destination contains it. Paging and sorting match ListURLs.
+func (h *Handlers) SearchURLs(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	q, err := listQuery(r)
+	if err != nil {
+		h.RespondError(w, ErrInvalidListQuery, http.StatusBadRequest)
+		return
+	}
+
+	q.AllOwners = true
+	q.Search = r.URL.Query().Get("q")
+
+	h.respondURLList(w, r, q)
+}
+
+// DisableURL stops a url from redirecting without deleting it
+func (h *Handlers) DisableURL(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	h.setDisabled(w, r, h.canonicalSlug(params["slug"]), true)
+}
+
+// EnableURL lets a disabled url redirect again
+func (h *Handlers) EnableURL(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	h.setDisabled(w, r, h.canonicalSlug(params["slug"]), false)
+}
+
+// setDisabled updates the disabled flag of the url stored under slug and responds with the url
+func (h *Handlers) setDisabled(w http.ResponseWriter, r *http.Request, slug string, disabled bool) {
+	logSlug(r, slug)
+
+	u, err := h.store.FindBySlug(r.Context(), slug)
+	if err != nil {
+		if err == ErrNotFound {
+			h.RespondError(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		h.RespondError(w, ErrUnableToUpdateURL, http.StatusInternalServerError)
+		return
+	}
+
+	if u.Disabled != disabled {
+		u.Disabled = disabled
+		if err := h.store.Update(r.Context(), u); err != nil {
+			h.RespondError(w, ErrUnableToUpdateURL, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	h.RespondJSON(w, u, http.StatusOK)
+}
+
+// BanURL deletes a url regardless of its owner and tombstones the slug so it is never handed out
+// again
+func (h *Handlers) BanURL(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	slug := h.canonicalSlug(params["slug"])
+	logSlug(r, slug)
+
+	if err := h.store.Delete(r.Context(), slug, true); err != nil {
+		if err == ErrNotFound {
+			h.RespondError(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		h.RespondError(w, ErrUnableToDeleteURL, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BanDomain stops urls pointing at a domain, or its subdomains, from being created and disables the
+// existing ones
+func (h *Handlers) BanDomain(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	req := BanDomainRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondBodyError(w, err, ErrInvalidRequest)
+		return
+	}
+
+	domain := normalizeDomain(req.Domain)
+	if domain == "" {
+		h.RespondError(w, ErrInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.bans.BanDomain(domain, time.Now().UTC()); err != nil {
+		h.RespondError(w, ErrUnableToBanDomain, http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.reloadBannedDomains(); err != nil {
+		log.Printf("Unable to reload banned domains: %v", err)
+	}
+
+	disabled, err := h.disableDomain(r.Context(), domain)
+	if err != nil {
+		log.Printf("Unable to disable urls pointing at %s: %v", domain, err)
+	}
+
+	h.RespondJSON(w, BanDomainResponse{Domain: domain, Disabled: disabled}, http.StatusCreated)
+}
+
+// UnbanDomain lifts a domain ban, urls disabled by the ban stay disabled
+func (h *Handlers) UnbanDomain(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if err := h.bans.UnbanDomain(normalizeDomain(params["domain"])); err != nil {
+		if err == ErrNotFound {
+			h.RespondError(w, ErrDomainNotBanned, http.StatusNotFound)
+			return
+		}
+
+		h.RespondError(w, ErrUnableToBanDomain, http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.reloadBannedDomains(); err != nil {
+		log.Printf("Unable to reload banned domains: %v", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BannedDomains responds with every banned domain
+func (h *Handlers) BannedDomains(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	domains, err := h.bans.BannedDomains()
+	if err != nil {
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	h.RespondJSON(w, BannedDomainList{Domains: domains}, http.StatusOK)
+}
+
+// reloadBannedDomains applies the stored bans to the domain policy straight away instead of waiting
+// for the next refresh
+func (h *Handlers) reloadBannedDomains() error {
+	domains, err := h.bans.BannedDomains()
+	if err != nil {
+		return err
+	}
+
+	h.domains.SetBanned(domains)
+
+	return nil
+}
+
+// disableDomain disables every enabled url pointing at domain or its subdomains, returning the number
+// disabled
+func (h *Handlers) disableDomain(ctx context.Context, domain string) (int, error) {
+	disabled := 0
+
+	for skip := 0; ; skip += maxPerPage {
+		urls, _, err := h.store.List(ctx, ListQuery{
+			AllOwners: true,
+			Search:    domain,
+			Sort:      "created_at",
+			Skip:      skip,
+			Limit:     maxPerPage,
+		})
+		if err != nil {
+			return disabled, err
+		}
+
+		for i := range urls {
+			u := &urls[i]
+			parsed, err := url.Parse(u.OriginalURL)
+			if u.Disabled || err != nil || !matchesDomain(normalizeDomain(parsed.Hostname()), domain) {
+				continue
+			}
+
+			u.Disabled = true
+			if err := h.store.Update(ctx, u); err != nil {
+				return disabled, err
+			}
+
+			disabled++
+		}
+
+		if len(urls) < maxPerPage {
+			return disabled, nil
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const statsDayFormat = "2006-01-02"
+const statsTopReferrers = 10
+
+// Click is a single recorded redirect
+type Click struct {
+	Slug      string    `json:"slug" bson:"slug"`
+	Timestamp time.Time `json:"timestamp" bson:"timestamp"`
+	Referrer  string    `json:"referrer" bson:"referrer"`
+	UserAgent string    `json:"user_agent" bson:"user_agent"`
+	Country   string    `json:"country,omitempty" bson:"country,omitempty"`
+	Variant   string    `json:"variant,omitempty" bson:"variant,omitempty"`
+	// ReferrerDomain is the host of Referrer without a leading www
+	ReferrerDomain string `json:"referrer_domain,omitempty" bson:"referrer_domain,omitempty"`
+	// UTMSource, UTMMedium and UTMCampaign are the utm parameters the short url was followed with
+	UTMSource   string `json:"utm_source,omitempty" bson:"utm_source,omitempty"`
+	UTMMedium   string `json:"utm_medium,omitempty" bson:"utm_medium,omitempty"`
+	UTMCampaign string `json:"utm_campaign,omitempty" bson:"utm_campaign,omitempty"`
+}
+
+// DailyClicks is the number of clicks a url received on a single day
+type DailyClicks struct {
+	Day    string `json:"day" bson:"_id"`
+	Clicks int    `json:"clicks" bson:"clicks"`
+}
+
+// ReferrerClicks is the number of clicks a url received from a single referrer
+type ReferrerClicks struct {
+	Referrer string `json:"referrer" bson:"_id"`
+	Clicks   int    `json:"clicks" bson:"clicks"`
+}
+
+// Stats is the click summary for a url
+type Stats struct {
+	Slug           string           `json:"slug"`
+	TotalClicks    int              `json:"total_clicks"`
+	UniqueVisitors int              `json:"unique_visitors"`
+	ClicksPerDay   []DailyClicks    `json:"clicks_per_day"`
+	TopReferrers   []ReferrerClicks `json:"top_referrers"`
+	Variants       []VariantClicks  `json:"variants,omitempty"`
+	BotClicks      map[string]int   `json:"bot_clicks,omitempty"`
+	LinkStatus     string           `json:"link_status"`
+	LinkCheckedAt  *time.Time       `json:"link_checked_at,omitempty"`
+	DeadAt         *time.Time       `json:"dead_at,omitempty"`
+}
+
+// ClickStore defines the persistence operations for click analytics
+type ClickStore interface {
+	// RecordClick stores a single redirect
+	RecordClick(c *Click) error
+	// Stats summarises the clicks recorded for slug
+	Stats(slug string) (*Stats, error)
+	// Clicks returns the clicks recorded for slug from from up to before to, oldest first, skipping the
+	// first skip and returning at most limit
+	Clicks(slug string, from, to time.Time, skip, limit int) ([]Click, error)
+	// HourlyClicks counts the clicks recorded for slug in every hour from from up to before to, keyed by
+	// the unix time the hour starts at, hours without clicks are left out
+	HourlyClicks(slug string, from, to time.Time) (map[int64]int, error)
+	// CountClicksBy counts the clicks recorded for slug per value of field, one of referrer,
+	// utm_source, utm_medium or utm_campaign, clicks without a value are left out
+	CountClicksBy(slug, field string) (map[string]int, error)
+	// RecordBotClick counts a redirect through slug served to bot
+	RecordBotClick(slug, bot string) error
+	// BotClicks returns the redirects through slug served to bots, per bot
+	BotClicks(slug string) (map[string]int, error)
+	// AddVisitor adds the hash of a visitor to the unique visitor sketch of slug
+	AddVisitor(slug string, visitor uint64) error
+	// UniqueVisitors estimates the number of distinct visitors added to the sketch of slug
+	UniqueVisitors(slug string) (int, error)
+	// PurgeClicks removes the click events recorded before before, returning the number removed. Stores
+	// that roll clicks up keep counting them in stats.
+	PurgeClicks(before time.Time) (int, error)
+}
+
+// URLStats responds with the click statistics for a url
+func (h *Handlers) URLStats(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	slug := h.canonicalSlug(params["slug"])
+	logSlug(r, slug)
+
+	u, err := h.store.FindBySlug(r.Context(), slug)
+	if err != nil {
+		h.RespondError(w, ErrNotFound, http.StatusNotFound)
+		return
+	}
+
+	stats, err := h.clicks.Stats(slug)
+	if err != nil {
+		h.RespondError(w, ErrUnableToLoadStats, http.StatusInternalServerError)
+		return
+	}
+
+	if stats.UniqueVisitors, err = h.clicks.UniqueVisitors(slug); err != nil {
+		h.RespondError(w, ErrUnableToLoadStats, http.StatusInternalServerError)
+		return
+	}
+
+	if stats.BotClicks, err = h.clicks.BotClicks(slug); err != nil {
+		h.RespondError(w, ErrUnableToLoadStats, http.StatusInternalServerError)
+		return
+	}
+
+	stats.LinkStatus = linkStatus(u)
+	stats.LinkCheckedAt = u.LinkCheckedAt
+	stats.DeadAt = u.DeadAt
+
+	h.RespondJSON(w, stats, http.StatusOK)
+}
+
+// recordClick stores a redirect through u to destination that served variant and publishes it when
+// an event bus is configured, it is called off the request path so failures are only logged. Unless
+// URL_COUNT_BOTS is set redirects served to bots are only counted per bot, HEAD requests never count
+// as clicks.
+func (h *Handlers) recordClick(u *URL, destination, variant string, r *http.Request) {
+	slug := u.Slug
+	if bot := detectBot(r); bot != "" && (!h.countBots || r.Method == http.MethodHead) {
+		h.recordBotClick(slug, bot)
+		return
+	}
+
+	c := Click{
+		Slug:      slug,
+		Timestamp: time.Now().UTC(),
+		Referrer:  r.Referer(),
+		UserAgent: r.UserAgent(),
+		Country:   h.country(r),
+		Variant:   variant,
+
+		ReferrerDomain: referrerDomain(r.Referer()),
+		UTMSource:      utmParam(r.URL.Query(), "utm_source"),
+		UTMMedium:      utmParam(r.URL.Query(), "utm_medium"),
+		UTMCampaign:    utmParam(r.URL.Query(), "utm_campaign"),
+	}
+
+	visitor := h.visitorHash(r)
+	// the click is counted after the response is sent, when the request's context is already cancelled
+	ctx := context.WithoutCancel(r.Context())
+	analytics := h.features.Enabled(featureAnalytics)
+	go func() {
+		clicks, err := h.store.IncrementClicks(ctx, slug)
+		if err != nil && err != ErrNotFound {
+			log.Printf("Unable to count click for %s: %v", slug, err)
+		}
+
+		if u.KeyID != "" {
+			h.countUsage(u.KeyID, usageRedirects)
+		}
+
+		if err == nil && h.webhooks != nil && h.webhooks.Milestone(clicks) {
+			counted := *u
+			counted.Clicks = clicks
+			h.webhooks.Notify(u.Owner, WebhookEvent{Event: EventLinkMilestone, URL: &counted, Clicks: clicks})
+		}
+
+		// the click counter is kept without analytics, the click events and visitors are not
+		if analytics {
+			if err := h.clicks.RecordClick(&c); err != nil {
+				log.Printf("Unable to record click for %s: %v", slug, err)
+			}
+
+			if err := h.clicks.AddVisitor(slug, visitor); err != nil {
+				log.Printf("Unable to count visitor for %s: %v", slug, err)
+			}
+		}
+
+		if h.events != nil {
+			err := h.events.Publish(&ClickEvent{
+				Slug:        slug,
+				Owner:       u.Owner,
+				Destination: destination,
+				Variant:     variant,
+				Timestamp:   c.Timestamp,
+				Referrer:    c.Referrer,
+				UserAgent:   c.UserAgent,
+				Country:     c.Country,
+				UTMSource:   c.UTMSource,
+				UTMMedium:   c.UTMMedium,
+				UTMCampaign: c.UTMCampaign,
+			})
+			if err != nil {
+				log.Printf("Unable to publish click for %s: %v", slug, err)
+			}
+		}
+	}()
+}
+
+// requestCountry returns the client country when a fronting proxy or cdn has supplied it
+func requestCountry(r *http.Request) string {
+	for _, header := range []string{"CF-IPCountry", "X-Country-Code", "X-AppEngine-Country"} {
+		if country := r.Header.Get(header); country != "" {
+			return country
+		}
+	}
+
+	return ""
+}
+
+// summarizeClicks builds stats from raw clicks for stores that cannot aggregate themselves
+func summarizeClicks(slug string, clicks []Click) *Stats {
+	days := map[string]int{}
+	referrers := map[string]int{}
+	variants := map[string]int{}
+	for _, c := range clicks {
+		days[c.Timestamp.UTC().Format(statsDayFormat)]++
+		if c.Referrer != "" {
+			referrers[c.Referrer]++
+		}
+		if c.Variant != "" {
+			variants[c.Variant]++
+		}
+	}
+
+	return newStats(slug, len(clicks), days, referrers, variants)
+}
+
+// newStats creates stats from per day, per referrer and per variant counts, sorting days
+// chronologically and keeping only the top referrers
+func newStats(slug string, total int, days, referrers, variants map[string]int) *Stats {
+	stats := Stats{
+		Slug:         slug,
+		TotalClicks:  total,
+		ClicksPerDay: []DailyClicks{},
+		TopReferrers: []ReferrerClicks{},
+	}
+
+	for day, count := range days {
+		stats.ClicksPerDay = append(stats.ClicksPerDay, DailyClicks{Day: day, Clicks: count})
+	}
+	sort.Slice(stats.ClicksPerDay, func(i, j int) bool {
+		return stats.ClicksPerDay[i].Day < stats.ClicksPerDay[j].Day
+	})
+
+	for referrer, count := range referrers {
+		stats.TopReferrers = append(stats.TopReferrers, ReferrerClicks{Referrer: referrer, Clicks: count})
+	}
+	sort.Slice(stats.TopReferrers, func(i, j int) bool {
+		if stats.TopReferrers[i].Clicks == stats.TopReferrers[j].Clicks {
+			return stats.TopReferrers[i].Referrer < stats.TopReferrers[j].Referrer
+		}
+
+		return stats.TopReferrers[i].Clicks > stats.TopReferrers[j].Clicks
+	})
+	if len(stats.TopReferrers) > statsTopReferrers {
+		stats.TopReferrers = stats.TopReferrers[:statsTopReferrers]
+	}
+
+	for variant, count := range variants {
+		stats.Variants = append(stats.Variants, VariantClicks{Variant: variant, Clicks: count})
+	}
+	sort.Slice(stats.Variants, func(i, j int) bool {
+		return stats.Variants[i].Variant < stats.Variants[j].Variant
+	})
+
+	return &stats
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/dimfeld/httptreemux"
+)
+
+// apiVersion is the current version of the json api, its routes are served under /api/v1
+const apiVersion = "v1"
+
+// Envelope wraps every response of the versioned api. Successful responses carry the resource in
+// data and pagination details in meta, failed ones carry only error.
+type Envelope struct {
+	Data  interface{} `json:"data,omitempty"`
+	Error *APIError   `json:"error,omitempty"`
+	Meta  interface{} `json:"meta,omitempty"`
+}
+
+// APIError describes why a versioned api request failed
+type APIError struct {
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Field     string `json:"field,omitempty"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// PageMeta is the meta of a paged list
+type PageMeta struct {
+	Page    int `json:"page"`
+	PerPage int `json:"per_page"`
+	Total   int `json:"total"`
+}
+
+// paged is implemented by list responses, the versioned api moves their pagination into meta
+type paged interface {
+	envelope() (interface{}, PageMeta)
+}
+
+// envelopeWriter marks a response to a versioned api route
+type envelopeWriter struct {
+	http.ResponseWriter
+}
+
+// Unwrap returns the writer w wraps
+func (w *envelopeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// unwrapWriter returns the writer middleware wrapped w around, nil when w does not wrap one
+func unwrapWriter(w http.ResponseWriter) http.ResponseWriter {
+	if u, ok := w.(interface{ Unwrap() http.ResponseWriter }); ok {
+		return u.Unwrap()
+	}
+
+	return nil
+}
+
+// enveloped reports whether responses written to w, or a writer it wraps, are wrapped in an Envelope
+func enveloped(w http.ResponseWriter) bool {
+	for ; w != nil; w = unwrapWriter(w) {
+		if _, ok := w.(*envelopeWriter); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// envelope wraps a successful response body
+func envelope(data interface{}) Envelope {
+	if p, ok := data.(paged); ok {
+		data, meta := p.envelope()
+		return Envelope{Data: data, Meta: meta}
+	}
+
+	return Envelope{Data: data}
+}
+
+// Versioned serves next as a versioned api route
+func (h *Handlers) Versioned(next httptreemux.HandlerFunc) httptreemux.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		next(&envelopeWriter{ResponseWriter: w}, r, params)
+	}
+}
+
+// Deprecated serves next on an unversioned api route with the bodies it had before the api was
+// versioned, pointing clients at the versioned route that replaces it
+func (h *Handlers) Deprecated(next httptreemux.HandlerFunc) httptreemux.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		successor := "/api/" + apiVersion + strings.TrimPrefix(r.URL.Path, "/api")
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+">; rel=\"successor-version\"")
+
+		next(w, r, params)
+	}
+}
+
+// apiRoute registers handler for op under /api/v1 and, for existing clients, under the unversioned
+// /api prefix. Only the versioned route is documented. Json responses to GET requests carry an ETag,
+// downloads are streamed and are not tagged.
+func (h *Handlers) apiRoute(r *httptreemux.TreeMux, op Operation, handler httptreemux.HandlerFunc) {
+	if op.Method != http.MethodGet {
+		handler = h.ReadOnly(handler)
+	}
+
+	handler = h.LimitBody(op.MaxBody, handler)
+	if op.Text {
+		// outside every other middleware so the errors they respond with are plain text too
+		handler = h.TextOnRequest(handler)
+	}
+
+	deprecated, versioned := h.Deprecated(handler), h.Versioned(handler)
+	if op.Method == http.MethodGet && op.Produces == "" {
+		deprecated, versioned = h.ETag(deprecated), h.ETag(versioned)
+	}
+
+	r.Handle(op.Method, "/api"+op.Path, deprecated)
+
+	op.Path = "/api/" + apiVersion + op.Path
+	op.versioned = true
+	h.route(r, op, versioned)
+}
+
+func (l URLList) envelope() (interface{}, PageMeta) {
+	return l.URLs, PageMeta{Page: l.Page, PerPage: l.PerPage, Total: l.Total}
+}
+
+func (l ReportList) envelope() (interface{}, PageMeta) {
+	return l.Reports, PageMeta{Page: l.Page, PerPage: l.PerPage, Total: l.Total}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+)
+
+// clickArchiveInterval is how often click events that reached the archive age are archived
+const clickArchiveInterval = time.Hour
+
+// clickArchivePrefix starts the name of every click archive
+const clickArchivePrefix = "clicks/"
+
+// ClickArchiveStore is implemented by stores whose click events can be archived
+type ClickArchiveStore interface {
+	// EachClick calls fn with every click event of every url recorded from from up to before to, in no
+	// particular order, stopping at the first error
+	EachClick(from, to time.Time, fn func(c *Click) error) error
+}
+
+// ClickArchive moves click events older than an age to an object store, as a gzipped file of one json
+// click per line for every day, so the store stays small while the history is kept
+type ClickArchive struct {
+	clicks  ClickStore
+	events  ClickArchiveStore
+	objects ObjectStore
+	age     time.Duration
+}
+
+// NewClickArchive returns an archive of the click events of clicks older than age
+func NewClickArchive(clicks ClickStore, events ClickArchiveStore, objects ObjectStore, age time.Duration) *ClickArchive {
+	return &ClickArchive{clicks: clicks, events: events, objects: objects, age: age}
+}
+
+// Run archives and removes the click events recorded on the days that ended age before now, returning
+// the number archived. Days are archived whole, the archive of a day is named after it and its first
+// click, e.g. clicks/2024/05/01/000012.345678901.jsonl.gz, so clicks of a day left behind by an earlier
+// run never replace its archive.
+func (a *ClickArchive) Run(now time.Time) (int, error) {
+	before := now.Add(-a.age).UTC().Truncate(24 * time.Hour)
+
+	type day struct {
+		buf   bytes.Buffer
+		gz    *gzip.Writer
+		enc   *json.Encoder
+		first time.Time
+	}
+
+	days := map[time.Time]*day{}
+	n := 0
+	err := a.events.EachClick(time.Time{}, before, func(c *Click) error {
+		start := c.Timestamp.UTC().Truncate(24 * time.Hour)
+		d := days[start]
+		if d == nil {
+			d = &day{first: c.Timestamp}
+			d.gz = gzip.NewWriter(&d.buf)
+			d.enc = json.NewEncoder(d.gz)
+			days[start] = d
+		}
+
+		if c.Timestamp.Before(d.first) {
+			d.first = c.Timestamp
+		}
+		n++
+
+		return d.enc.Encode(c)
+	})
+	if err != nil || n == 0 {
+		return 0, err
+	}
+
+	starts := make([]time.Time, 0, len(days))
+	for start := range days {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+
+	for _, start := range starts {
+		d := days[start]
+		if err := d.gz.Close(); err != nil {
+			return 0, err
+		}
+
+		name := clickArchivePrefix + start.Format("2006/01/02/") + d.first.UTC().Format("150405.000000000") + ".jsonl.gz"
+		if err := a.objects.Put(name, d.buf.Bytes()); err != nil {
+			return 0, err
+		}
+	}
+
+	// the clicks are only removed once every day they fall on has been archived
+	if _, err := a.clicks.PurgeClicks(before); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// archiveClicks archives the click events that reached the archive age every interval
+func archiveClicks(archive *ClickArchive, interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := archive.Run(time.Now())
+		if err != nil {
+			log.Printf("Unable to archive clicks: %v", err)
+		}
+
+		if n > 0 {
+			log.Printf("Archived %d clicks", n)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dimfeld/httptreemux"
+)
+
+type contextKey string
+
+const apiKeyContextKey contextKey = "api_key"
+const userContextKey contextKey = "user_id"
+const orgContextKey contextKey = "org"
+
+// APIKey is a credential allowed to use the write endpoints. Only a hash of the secret is stored. Keys
+// minted by logging in belong to a user and act on behalf of them.
+type APIKey struct {
+	ID        string     `json:"id" bson:"key_id"`
+	Name      string     `json:"name" bson:"name"`
+	Hash      string     `json:"-" bson:"hash"`
+	UserID    string     `json:"user_id,omitempty" bson:"user_id,omitempty"`
+	CreatedAt time.Time  `json:"created_at" bson:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+	// MonthlyQuota is the number of shorten calls the key may make per calendar month, 0 for no limit
+	MonthlyQuota int `json:"monthly_quota,omitempty" bson:"monthly_quota,omitempty"`
+}
+
+// NewAPIKeyResponse is returned when a key is minted, it is the only time the secret is visible
+type NewAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// NewAPIKeyRequest is the json body accepted when minting a key, only admins may choose its quota
+// instead of URL_KEY_MONTHLY_QUOTA
+type NewAPIKeyRequest struct {
+	Name         string `json:"name"`
+	MonthlyQuota *int   `json:"monthly_quota"`
+}
+
+// KeyStore defines the persistence operations for api keys
+type KeyStore interface {
+	// SaveKey inserts a new api key
+	SaveKey(k *APIKey) error
+	// FindKeyByHash returns the key with the given secret hash or ErrNotFound
+	FindKeyByHash(hash string) (*APIKey, error)
+	// RevokeKey marks the key with id as revoked or returns ErrNotFound
+	RevokeKey(id string, at time.Time) error
+	// FindKeyByID returns the key with id or ErrNotFound
+	FindKeyByID(id string) (*APIKey, error)
+	// SetKeyQuota changes the monthly quota of the key with id or returns ErrNotFound
+	SetKeyQuota(id string, quota int) error
+}
+
+// GenerateAPIKey creates a new key named name, returning the record to store and the secret to hand
+// to the caller. Secrets take the form <id>.<random hex>.
+func GenerateAPIKey(name string) (*APIKey, string, error) {
+	id := make([]byte, 4)
+	secret := make([]byte, 24)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+
+	key := hex.EncodeToString(id) + "." + hex.EncodeToString(secret)
+
+	return &APIKey{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		Hash:      hashAPIKey(key),
+		CreatedAt: time.Now().UTC(),
+	}, key, nil
+}
+
+// hashAPIKey returns the stored representation of a key secret
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerToken extracts the token from an Authorization: Bearer header
+func bearerToken(r *http.Request) string {
+	return parseBearer(r.Header.Get("Authorization"))
+}
+
+// parseBearer returns the token of a "Bearer <token>" authorization value
+func parseBearer(header string) string {
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return ""
+	}
+
+	return strings.TrimSpace(header[7:])
+}
+
+// requestAPIKey returns the api key that authenticated the request, if any
+func requestAPIKey(r *http.Request) *APIKey {
+	return contextAPIKey(r.Context())
+}
+
+// requestUserID returns the user that authenticated the request with a session token or an api key
+// minted for them, if any
+func requestUserID(r *http.Request) string {
+	if id, _ := r.Context().Value(userContextKey).(string); id != "" {
+		return id
+	}
+
+	if k := requestAPIKey(r); k != nil {
+		return k.UserID
+	}
+
+	return ""
+}
+
+// requestOwner returns the owner recorded on urls created by the request, the organization it acts
+// for, the authenticated user or the api key itself for keys minted by an admin. It is empty for
+// anonymous requests.
+func requestOwner(r *http.Request) string {
+	if m := requestOrg(r); m != nil {
+		return m.OrgID
+	}
+
+	if id := requestUserID(r); id != "" {
+		return id
+	}
+
+	if k := requestAPIKey(r); k != nil {
+		return k.ID
+	}
+
+	return ""
+}
+
+// RequireAPIKey rejects requests without a valid, unrevoked api key when keys are required for
+// creating urls. Requests that present a key or select an organization anyway are authenticated so the
+// url has an owner.
+func (h *Handlers) RequireAPIKey(next httptreemux.HandlerFunc) httptreemux.HandlerFunc {
+	authed := h.RequireAuth(next)
+
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if !h.requireAPIKey && bearerToken(r) == "" && r.Header.Get(orgHeader) == "" {
+			next(w, r, params)
+			return
+		}
+
+		authed(w, r, params)
+	}
+}
+
+// RequireAuth rejects requests without a valid session token or a valid, unrevoked api key. Requests
+// that select an organization with the X-Organization header act for it when the caller is a member
+// whose role allows the request.
+func (h *Handlers) RequireAuth(next httptreemux.HandlerFunc) httptreemux.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		id, k, err := h.authenticateToken(bearerToken(r))
+		if err != nil {
+			h.respondUnauthorized(w)
+			return
+		}
+
+		if k == nil {
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey, id))
+		} else {
+			r = r.WithContext(context.WithValue(r.Context(), apiKeyContextKey, k))
+		}
+
+		if org := r.Header.Get(orgHeader); org != "" {
+			m, err := h.orgMember(r, org, roleViewer)
+			if err == nil && !m.allows(r.Method) {
+				err = ErrInsufficientRole
+			}
+
+			if err != nil {
+				h.RespondError(w, err, orgStatus(err))
+				return
+			}
+
+			r = r.WithContext(context.WithValue(r.Context(), orgContextKey, m))
+		}
+
+		next(w, r, params)
+	}
+}
+
+// authenticateToken checks a session token or api key. It returns the user a session token was
+// issued to, or the api key.
+func (h *Handlers) authenticateToken(token string) (string, *APIKey, error) {
+	if token == "" {
+		return "", nil, ErrUnauthorized
+	}
+
+	if isJWT(token) {
+		claims, err := h.tokens.Verify(token, time.Now())
+		if err != nil {
+			return "", nil, ErrUnauthorized
+		}
+
+		return claims.Subject, nil, nil
+	}
+
+	k, err := h.keys.FindKeyByHash(hashAPIKey(token))
+	if err != nil || k.RevokedAt != nil {
+		return "", nil, ErrUnauthorized
+	}
+
+	return "", k, nil
+}
+
+// RequireAdmin rejects requests that do not carry the configured admin token
+func (h *Handlers) RequireAdmin(next httptreemux.HandlerFunc) httptreemux.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		token := bearerToken(r)
+		if h.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) != 1 {
+			h.respondUnauthorized(w)
+			return
+		}
+
+		next(w, r, params)
+	}
+}
+
+// respondUnauthorized writes a 401 asking for bearer credentials
+func (h *Handlers) respondUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	h.RespondError(w, ErrUnauthorized, http.StatusUnauthorized)
+}
+
+// CreateAPIKey mints a new api key
+func (h *Handlers) CreateAPIKey(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	req := NewAPIKeyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		h.respondBodyError(w, err, ErrInvalidRequest)
+		return
+	}
+
+	if req.MonthlyQuota != nil && *req.MonthlyQuota < 0 {
+		h.RespondError(w, ErrInvalidQuota, http.StatusBadRequest)
+		return
+	}
+
+	k, secret, err := GenerateAPIKey(req.Name)
+	if err != nil {
+		h.RespondError(w, ErrUnableToCreateKey, http.StatusInternalServerError)
+		return
+	}
+
+	k.MonthlyQuota = h.keyQuota
+	if req.MonthlyQuota != nil {
+		k.MonthlyQuota = *req.MonthlyQuota
+	}
+
+	if err := h.keys.SaveKey(k); err != nil {
+		h.RespondError(w, ErrUnableToCreateKey, http.StatusInternalServerError)
+		return
+	}
+
+	h.RespondJSON(w, NewAPIKeyResponse{APIKey: *k, Key: secret}, http.StatusCreated)
+}
+
+// RevokeAPIKey revokes an api key so it can no longer be used
+func (h *Handlers) RevokeAPIKey(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if err := h.keys.RevokeKey(params["id"], time.Now().UTC()); err != nil {
+		if err == ErrNotFound {
+			h.RespondError(w, ErrKeyNotFound, http.StatusNotFound)
+			return
+		}
+
+		h.RespondError(w, ErrUnableToRevokeKey, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// defaultBackupKeep is the number of backups kept unless URL_BACKUP_KEEP is set
+const defaultBackupKeep = 7
+
+// backupPrefix starts the name of every backup, they sort by the time they were taken
+const backupPrefix = "urls-"
+
+// Backup writes every url to a gzipped file in an object store and removes the oldest backups. Json
+// backups hold one url per line in the fallback snapshot format, with every stored field, csv backups
+// hold the columns of an export.
+type Backup struct {
+	objects ObjectStore
+	format  string
+	keep    int
+}
+
+// NewBackup returns a backup written to objects as json or csv, keeping the newest keep backups or
+// all of them when keep is 0
+func NewBackup(objects ObjectStore, format string, keep int) *Backup {
+	return &Backup{objects: objects, format: format, keep: keep}
+}
+
+// Run backs up the urls of store, returning the name of the backup and the number of urls in it
+func (b *Backup) Run(store Store) (string, int, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+
+	n := 0
+	var write func(u *URL) error
+	if b.format == "csv" {
+		out := newExportWriter(gz, "csv", exportColumns)
+		write = func(u *URL) error {
+			return out.write(exportedURL(u).record(), nil)
+		}
+	} else {
+		enc := json.NewEncoder(gz)
+		write = func(u *URL) error {
+			return encodeSnapshotRecord(enc, u)
+		}
+	}
+
+	err := eachURL(store, func(u *URL) error {
+		n++
+		return write(u)
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	if err := gz.Close(); err != nil {
+		return "", 0, err
+	}
+
+	name := backupPrefix + time.Now().UTC().Format("20060102T150405Z") + ".jsonl.gz"
+	if b.format == "csv" {
+		name = strings.TrimSuffix(name, ".jsonl.gz") + ".csv.gz"
+	}
+
+	if err := b.objects.Put(name, buf.Bytes()); err != nil {
+		return "", 0, err
+	}
+
+	return name, n, b.prune()
+}
+
+// prune removes all but the newest keep backups
+func (b *Backup) prune() error {
+	if b.keep == 0 {
+		return nil
+	}
+
+	names, err := b.objects.List(backupPrefix)
+	if err != nil {
+		return err
+	}
+
+	for len(names) > b.keep {
+		if err := b.objects.Delete(names[0]); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+
+	return nil
+}
+
+// runBackups backs up the urls of store every interval
+func runBackups(store Store, backup *Backup, interval time.Duration) {
+	for range time.Tick(interval) {
+		start := time.Now()
+		name, n, err := backup.Run(store)
+		if err != nil {
+			log.Printf("Unable to back up urls: %v", err)
+			continue
+		}
+
+		log.Printf("Backed up %d urls to %s in %s", n, name, time.Since(start))
+	}
+}
+
+// eachURL calls fn with every live url of store, oldest first, stopping at the first error
+func eachURL(store Store, fn func(u *URL) error) error {
+	for skip := 0; ; skip += snapshotBatchSize {
+		page, _, err := store.List(context.Background(), ListQuery{AllOwners: true, Sort: "created_at", Skip: skip, Limit: snapshotBatchSize})
+		if err != nil {
+			return err
+		}
+
+		for i := range page {
+			if err := fn(&page[i]); err != nil {
+				return err
+			}
+		}
+
+		if len(page) < snapshotBatchSize {
+			return nil
+		}
+	}
+}
+
+// newBackup returns the backup configured by URL_BACKUP_LOCATION
+func newBackup(c *Config) (*Backup, error) {
+	objects, err := newObjectStore(c.BackupLocation, s3Config(c))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBackup(objects, c.BackupFormat, c.BackupKeep), nil
+}
+
+// runBackupCommand backs up every url of the configured store once
+func runBackupCommand(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("%s", usage)
+	}
+
+	config, err := LoadConfig(false)
+	if err != nil {
+		return err
+	}
+
+	if config.BackupLocation == "" {
+		return fmt.Errorf("URL_BACKUP_LOCATION is not set")
+	}
+
+	store, err := newStore(config)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	backup, err := newBackup(config)
+	if err != nil {
+		return err
+	}
+
+	name, n, err := backup.Run(store)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("backed up %d urls to %s\n", n, name)
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+const maxBatchSize = 100
+
+// BatchResult is the outcome of shortening one entry of a batch, Status is the code the single
+// shorten endpoint would have responded with
+type BatchResult struct {
+	Status int    `json:"status"`
+	URL    *URL   `json:"url,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Code   string `json:"code,omitempty"`
+	Field  string `json:"field,omitempty"`
+}
+
+// failedResult is the result of an entry that could not be shortened because of err
+func failedResult(err error, status int) BatchResult {
+	code, field := errorCode(err, status)
+
+	return BatchResult{Status: status, Error: err.Error(), Code: code, Field: field}
+}
+
+// ShortenBatch creates the urls in a json array of shorten requests and responds with a result for
+// each entry in the same order
+func (h *Handlers) ShortenBatch(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	reqs := []ShortenRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		h.respondBodyError(w, err, ErrInvalidRequest)
+		return
+	}
+
+	if len(reqs) == 0 || len(reqs) > maxBatchSize {
+		h.RespondError(w, ErrInvalidBatchSize, http.StatusBadRequest)
+		return
+	}
+
+	forceNew := r.URL.Query().Get("force_new") == "true"
+	for i := range reqs {
+		reqs[i].ForceNew = reqs[i].ForceNew || forceNew
+		reqs[i].Domain = h.requestDomain(r, reqs[i].Domain)
+	}
+
+	q, ok := h.reserveEntries(w, r, len(reqs))
+	if !ok {
+		return
+	}
+
+	results := h.shortenMany(r.Context(), requestOwner(r), reqs)
+	h.useEntries(w, q, shortened(results))
+
+	h.respondBatch(w, results)
+}
+
+// shortened returns the number of entries of results that were shortened
+func shortened(results []BatchResult) int {
+	n := 0
+	for _, result := range results {
+		if result.URL != nil {
+			n++
+		}
+	}
+
+	return n
+}
+
+// shortenMany creates the urls in reqs for owner and returns a result for each entry in the same
+// order. The new urls are written to the store in a single batch.
+func (h *Handlers) shortenMany(ctx context.Context, owner string, reqs []ShortenRequest) []BatchResult {
+	// destinations are screened in the normalized form the urls are built with
+	destinations := []string{}
+	for _, req := range reqs {
+		destinations = append(destinations, canonicalURL(req.URL))
+		for _, target := range req.GeoTargets {
+			destinations = append(destinations, canonicalURL(target))
+		}
+		for _, target := range req.DeviceTargets {
+			destinations = append(destinations, canonicalURL(target))
+		}
+		for _, v := range req.Variants {
+			destinations = append(destinations, canonicalURL(v.URL))
+		}
+	}
+	flagged := h.unsafeURLs(destinations...)
+
+	results := make([]BatchResult, len(reqs))
+	pending := []*URL{}
+	pendingIndex := []int{}
+	slugs := map[string]bool{}
+	// entries repeating a url on a domain that is also being created in this batch share its result
+	shared := map[string]int{}
+	repeats := map[int]int{}
+
+	for i, req := range reqs {
+		dedup := req.Slug == "" && req.ExpiresAt == nil && req.TTLSeconds == 0 && req.StartsAt == nil && req.RedirectCode == 0 && req.Password == "" && req.MaxClicks == 0 && len(req.GeoTargets) == 0 && len(req.DeviceTargets) == 0 && len(req.Variants) == 0 && len(req.Tags) == 0 && req.Campaign == "" && !req.ForceNew
+		if first, ok := shared[req.Domain+" "+canonicalURL(req.URL)]; ok && dedup {
+			repeats[i] = first
+			continue
+		}
+
+		u, existing, err := h.newURL(ctx, owner, req)
+		if err != nil {
+			results[i] = failedResult(err, shortenStatus(err))
+			continue
+		}
+
+		if flaggedURL(flagged, u) {
+			results[i] = failedResult(ErrUnsafeURL, http.StatusUnprocessableEntity)
+			continue
+		}
+
+		if existing {
+			results[i] = BatchResult{Status: http.StatusOK, URL: u}
+			continue
+		}
+
+		if slugs[u.Slug] {
+			results[i] = failedResult(ErrSlugTaken, http.StatusConflict)
+			continue
+		}
+
+		slugs[u.Slug] = true
+		if dedup {
+			shared[req.Domain+" "+u.OriginalURL] = i
+		}
+
+		pending = append(pending, u)
+		pendingIndex = append(pendingIndex, i)
+	}
+
+	for j, err := range h.store.SaveMany(ctx, pending) {
+		i := pendingIndex[j]
+		if err == ErrSlugTaken && reqs[i].Slug == "" {
+			err = h.saveUnderNewSlug(ctx, pending[j])
+		}
+
+		switch err {
+		case nil:
+			results[i] = BatchResult{Status: http.StatusCreated, URL: pending[j]}
+			h.metrics.ShortensCreated.Inc()
+			h.notify(EventLinkCreated, pending[j])
+		case ErrSlugTaken:
+			results[i] = failedResult(ErrSlugTaken, http.StatusConflict)
+		case ErrUnableToCreateSlug:
+			results[i] = failedResult(ErrUnableToCreateSlug, http.StatusInternalServerError)
+		default:
+			results[i] = failedResult(ErrUnableToShortenUrl, http.StatusInternalServerError)
+		}
+	}
+
+	for i, first := range repeats {
+		results[i] = results[first]
+		if results[i].Status == http.StatusCreated {
+			results[i].Status = http.StatusOK
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func BenchmarkGenerateSlug(b *testing.B) {
+	generator := &SlugGenerator{random: rand.New(rand.NewSource(1))}
+
+	for i := 0; i < b.N; i++ {
+		generator.GenerateSlug(defaultRandomSlugLength)
+	}
+}
+
+func BenchmarkEncodeSlug(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		encodeSlug(uint64(i), base62Chars)
+	}
+}
+
+func BenchmarkValidateSlug(b *testing.B) {
+	h := &Handlers{}
+
+	for i := 0; i < b.N; i++ {
+		h.ValidateSlug("spring-sale_2024")
+	}
+}
+
+func BenchmarkNormalizeURL(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		normalizeURL("HTTP://Example.COM:80/a/../b?utm_source=news#top")
+	}
+}
+
+func BenchmarkNextSlug(b *testing.B) {
+	h, _ := newTestHandlers(b)
+
+	for i := 0; i < b.N; i++ {
+		if _, err := h.slugifier.NextSlug(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSave(b *testing.B) {
+	store := NewMemoryStore()
+
+	for i := 0; i < b.N; i++ {
+		u := &URL{Slug: fmt.Sprintf("save-%d", i), OriginalURL: "https://example.com/bench", CreatedAt: time.Now().UTC()}
+		if err := store.Save(context.Background(), u); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkRedirect serves redirects through the RedirectURL handler, the click is recorded in the
+// background as it is by the server
+func BenchmarkRedirect(b *testing.B) {
+	h, store := newTestHandlers(b)
+	u := &URL{Slug: "redirect", OriginalURL: "https://example.com/bench", CreatedAt: time.Now().UTC()}
+	if err := store.Save(context.Background(), u); err != nil {
+		b.Fatal(err)
+	}
+
+	params := map[string]string{"slug": u.Slug}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/"+u.Slug, nil)
+		r.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i%250+1)
+		w := httptest.NewRecorder()
+
+		h.RedirectURL(w, r, params)
+
+		if w.Code != http.StatusFound {
+			b.Fatalf("status %d, want %d", w.Code, http.StatusFound)
+		}
+	}
+}
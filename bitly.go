@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// bitlyTimeFormat is the timestamp format of the Bitly v4 api
+const bitlyTimeFormat = "2006-01-02T15:04:05-0700"
+
+// ErrInvalidUnits is returned for click queries this shim cannot answer
+var ErrInvalidUnits = codedError("invalid_units", "units", "unit must be day and units a positive number of days or -1")
+
+// BitlyShortenRequest is the body of a Bitly v4 shorten request. The domain is used when it is one
+// the shortener serves, the group is accepted and ignored.
+type BitlyShortenRequest struct {
+	LongURL   string `json:"long_url"`
+	Domain    string `json:"domain"`
+	GroupGUID string `json:"group_guid"`
+}
+
+// Bitlink is a short url in the shape of the Bitly v4 api
+type Bitlink struct {
+	ID             string   `json:"id"`
+	Link           string   `json:"link"`
+	LongURL        string   `json:"long_url"`
+	CreatedAt      string   `json:"created_at"`
+	Archived       bool     `json:"archived"`
+	CustomBitlinks []string `json:"custom_bitlinks"`
+	Tags           []string `json:"tags"`
+}
+
+// BitlyLinkClicks is a Bitly v4 click summary, link_clicks is newest first
+type BitlyLinkClicks struct {
+	LinkClicks    []BitlyUnitClicks `json:"link_clicks"`
+	Units         int               `json:"units"`
+	Unit          string            `json:"unit"`
+	UnitReference string            `json:"unit_reference"`
+}
+
+// BitlyUnitClicks is the number of clicks in one unit of a BitlyLinkClicks
+type BitlyUnitClicks struct {
+	Clicks int    `json:"clicks"`
+	Date   string `json:"date"`
+}
+
+// BitlyError is an error in the shape of the Bitly v4 api
+type BitlyError struct {
+	Message     string `json:"message"`
+	Description string `json:"description"`
+	Resource    string `json:"resource"`
+}
+
+// BitlyShorten shortens a url for tooling written against the Bitly v4 api, it responds 201 for a
+// new url and 200 when the caller had already shortened it
+func (h *Handlers) BitlyShorten(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	req := BitlyShortenRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); bodyTooLarge(err) {
+		respondBitlyError(w, ErrBodyTooLarge, http.StatusRequestEntityTooLarge, "PAYLOAD_TOO_LARGE")
+		return
+	} else if err != nil {
+		respondBitlyError(w, ErrInvalidRequest, http.StatusBadRequest, "INVALID_BODY")
+		return
+	}
+
+	domain := ""
+	if h.shortDomains.Lookup(req.Domain) != nil {
+		domain = req.Domain
+	}
+
+	u, existing, err := h.createURL(r.Context(), w.Header(), requestOwner(r), ShortenRequest{URL: req.LongURL, Domain: h.requestDomain(r, domain)})
+	if err != nil {
+		message := ""
+		if err == ErrInvalidURL || err == ErrPrivateURL {
+			message = "INVALID_ARG_LONG_URL"
+		}
+
+		respondBitlyError(w, err, shortenStatus(err), message)
+		return
+	}
+
+	logSlug(r, u.Slug)
+
+	status := http.StatusCreated
+	if existing {
+		status = http.StatusOK
+	}
+
+	h.writeJSON(w, h.bitlink(u), status)
+}
+
+// BitlyClicks responds with the clicks per day of a url for tooling written against the Bitly v4
+// api. units limits the response to that many days back from today, -1 (the default) covers every
+// day since the first click.
+func (h *Handlers) BitlyClicks(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	slug := h.canonicalSlug(params["slug"])
+	logSlug(r, slug)
+
+	query := r.URL.Query()
+	if unit := query.Get("unit"); unit != "" && unit != "day" {
+		respondBitlyError(w, ErrInvalidUnits, http.StatusBadRequest, "INVALID_ARG_UNIT")
+		return
+	}
+
+	units, err := queryInt(query.Get("units"), -1)
+	if err != nil || units == 0 || units < -1 {
+		respondBitlyError(w, ErrInvalidUnits, http.StatusBadRequest, "INVALID_ARG_UNITS")
+		return
+	}
+
+	if _, err := h.store.FindBySlug(r.Context(), slug); err != nil {
+		respondBitlyError(w, ErrNotFound, http.StatusNotFound, "")
+		return
+	}
+
+	stats, err := h.clicks.Stats(slug)
+	if err != nil {
+		respondBitlyError(w, ErrUnableToLoadStats, http.StatusInternalServerError, "")
+		return
+	}
+
+	h.writeJSON(w, bitlyClicks(stats, units, time.Now().UTC()), http.StatusOK)
+}
+
+// bitlink converts a url to its Bitly v4 representation, its id is the short url without a scheme
+func (h *Handlers) bitlink(u *URL) Bitlink {
+	id := u.ShortURL
+	if short, err := url.Parse(u.ShortURL); err == nil {
+		id = short.Host + short.Path
+	}
+
+	return Bitlink{
+		ID:             id,
+		Link:           u.ShortURL,
+		LongURL:        u.OriginalURL,
+		CreatedAt:      u.CreatedAt.Format(bitlyTimeFormat),
+		CustomBitlinks: []string{},
+		Tags:           []string{},
+	}
+}
+
+// bitlyClicks counts the clicks in stats for each of the last units days up to now, newest first
+func bitlyClicks(stats *Stats, units int, now time.Time) BitlyLinkClicks {
+	counts := map[string]int{}
+	for _, d := range stats.ClicksPerDay {
+		counts[d.Day] = d.Clicks
+	}
+
+	today := now.Truncate(24 * time.Hour)
+	days := units
+	if days == -1 {
+		days = 1
+		if len(stats.ClicksPerDay) > 0 {
+			if first, err := time.Parse("2006-01-02", stats.ClicksPerDay[0].Day); err == nil && first.Before(today) {
+				days = int(today.Sub(first)/(24*time.Hour)) + 1
+			}
+		}
+	}
+
+	clicks := BitlyLinkClicks{Units: units, Unit: "day", UnitReference: now.Format(bitlyTimeFormat), LinkClicks: []BitlyUnitClicks{}}
+	for i := 0; i < days; i++ {
+		day := today.AddDate(0, 0, -i)
+		clicks.LinkClicks = append(clicks.LinkClicks, BitlyUnitClicks{Clicks: counts[day.Format("2006-01-02")], Date: day.Format(bitlyTimeFormat)})
+	}
+
+	return clicks
+}
+
+// respondBitlyError writes err in the shape of a Bitly v4 error, message defaults to the upper cased
+// status text
+func respondBitlyError(w http.ResponseWriter, err error, status int, message string) {
+	if message == "" {
+		message = strings.ToUpper(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+	}
+
+	js, _ := json.Marshal(BitlyError{Message: message, Description: err.Error(), Resource: "bitlinks"})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// bitlyUnits is documented for the clicks endpoint
+var bitlyUnits = []QueryParam{
+	{Name: "unit", Type: "string", Description: "Only day is supported"},
+	{Name: "units", Type: "integer", Description: "Number of days back from today, -1 for every day since the first click"},
+}
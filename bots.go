@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// botAgent names the bot whose user agents contain match
+type botAgent struct {
+	match string
+	name  string
+}
+
+// botAgents are matched against lower cased user agents in order, the link preview fetchers of chat
+// apps and social networks come before the generic words their user agents also contain
+var botAgents = []botAgent{
+	{"slackbot", "slack"},
+	{"slack-imgproxy", "slack"},
+	{"twitterbot", "twitter"},
+	{"facebookexternalhit", "facebook"},
+	{"facebookcatalog", "facebook"},
+	{"linkedinbot", "linkedin"},
+	{"discordbot", "discord"},
+	{"telegrambot", "telegram"},
+	{"whatsapp", "whatsapp"},
+	{"skypeuripreview", "skype"},
+	{"microsoftpreview", "teams"},
+	{"pinterestbot", "pinterest"},
+	{"redditbot", "reddit"},
+	{"applebot", "apple"},
+	{"googlebot", "google"},
+	{"google-inspectiontool", "google"},
+	{"adsbot-google", "google"},
+	{"bingbot", "bing"},
+	{"bingpreview", "bing"},
+	{"yandex", "yandex"},
+	{"baiduspider", "baidu"},
+	{"duckduckbot", "duckduckgo"},
+	{"embedly", "embedly"},
+	{"iframely", "iframely"},
+	{"headlesschrome", "headless"},
+	{"python-requests", "script"},
+	{"go-http-client", "script"},
+	{"okhttp", "script"},
+	{"wget", "script"},
+	{"bot", "other"},
+	{"crawler", "other"},
+	{"spider", "other"},
+	{"preview", "other"},
+	{"fetcher", "other"},
+}
+
+// detectBot returns the name of the bot that sent r, or the empty string for what looks like a person.
+// HEAD requests only probe the redirect and requests without a user agent come from scripts.
+func detectBot(r *http.Request) string {
+	if r.Method == http.MethodHead {
+		return "head"
+	}
+
+	agent := strings.ToLower(r.UserAgent())
+	if agent == "" {
+		return "no_user_agent"
+	}
+
+	for _, b := range botAgents {
+		if strings.Contains(agent, b.match) {
+			return b.name
+		}
+	}
+
+	return ""
+}
+
+// recordBotClick counts a redirect through slug served to bot apart from the clicks of people, off the
+// request path
+func (h *Handlers) recordBotClick(slug, bot string) {
+	if !h.features.Enabled(featureAnalytics) {
+		return
+	}
+
+	go func() {
+		if err := h.clicks.RecordBotClick(slug, bot); err != nil {
+			log.Printf("Unable to record bot click for %s: %v", slug, err)
+		}
+	}()
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultBreakerFailures is the number of consecutive store failures that open the circuit unless
+// URL_BREAKER_FAILURES is set
+const defaultBreakerFailures = 5
+
+// defaultBreakerCooldown is how long an open circuit rejects store operations unless
+// URL_BREAKER_COOLDOWN_SECONDS is set
+const defaultBreakerCooldown = 10 * time.Second
+
+// CircuitBreaker stops calling the store once it has failed failures times in a row, so requests fail
+// at once while it is down instead of each waiting out the store's timeout. After cooldown a single
+// operation is let through to probe the store, its success closes the circuit again.
+type CircuitBreaker struct {
+	failures int
+	cooldown time.Duration
+
+	mu sync.Mutex
+	// failed counts the consecutive failures while the circuit is closed
+	failed int
+	// openUntil is when an open circuit lets the next probe through, zero while closed
+	openUntil time.Time
+	probing   bool
+}
+
+// NewCircuitBreaker returns a closed circuit breaker
+func NewCircuitBreaker(failures int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{failures: failures, cooldown: cooldown}
+}
+
+// allow reports whether a store operation may run, an open circuit lets a single probe through once
+// its cooldown has passed
+func (b *CircuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return true
+	}
+
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+
+	b.probing = true
+
+	return true
+}
+
+// record counts the outcome of an operation allow let through
+func (b *CircuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !storeFailure(err) {
+		b.failed, b.openUntil, b.probing = 0, time.Time{}, false
+		return
+	}
+
+	b.failed++
+	if b.probing || b.failed >= b.failures {
+		b.openUntil, b.probing = time.Now().Add(b.cooldown), false
+	}
+}
+
+// Open reports whether store operations are being rejected
+func (b *CircuitBreaker) Open() bool {
+	return b.RetryAfter() > 0
+}
+
+// RetryAfter returns how long an open circuit keeps rejecting operations, 0 when it is closed
+func (b *CircuitBreaker) RetryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return 0
+	}
+
+	// a probe may be running or about to, clients are asked to wait at least a second
+	return max(time.Until(b.openUntil), time.Second)
+}
+
+// storeFailure reports whether err means the store could not be reached, the coded errors such as
+// ErrNotFound are answers from a healthy store
+func storeFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	_, coded := err.(*CodedError)
+
+	return !coded || err == ErrStoreUnavailable
+}
+
+// setRetryAfter tells clients of a 503 Service Unavailable response when the circuit will let store
+// operations through again
+func (h *Handlers) setRetryAfter(w http.ResponseWriter, status int) {
+	if status != http.StatusServiceUnavailable || h.breaker == nil {
+		return
+	}
+
+	if wait := h.breaker.RetryAfter(); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+}
+
+// breakerStore fails store operations with ErrStoreUnavailable while the circuit is open
+type breakerStore struct {
+	Store
+	breaker *CircuitBreaker
+}
+
+// Save inserts a new url document
+func (s *breakerStore) Save(ctx context.Context, u *URL) error {
+	if !s.breaker.allow() {
+		return ErrStoreUnavailable
+	}
+
+	err := s.Store.Save(ctx, u)
+	s.breaker.record(err)
+
+	return err
+}
+
+// SaveMany inserts urls in a single round trip, the batch counts as one operation and fails as a
+// whole when every url failed for a reason other than a coded error
+func (s *breakerStore) SaveMany(ctx context.Context, urls []*URL) []error {
+	if !s.breaker.allow() {
+		return batchErrors(len(urls), ErrStoreUnavailable)
+	}
+
+	errs := s.Store.SaveMany(ctx, urls)
+
+	var err error
+	for _, e := range errs {
+		if !storeFailure(e) {
+			err = nil
+			break
+		}
+
+		err = e
+	}
+	s.breaker.record(err)
+
+	return errs
+}
+
+// Update replaces the url stored under u.Slug or returns ErrNotFound
+func (s *breakerStore) Update(ctx context.Context, u *URL) error {
+	if !s.breaker.allow() {
+		return ErrStoreUnavailable
+	}
+
+	err := s.Store.Update(ctx, u)
+	s.breaker.record(err)
+
+	return err
+}
+
+// FindBySlug returns the url stored under slug or ErrNotFound
+func (s *breakerStore) FindBySlug(ctx context.Context, slug string) (*URL, error) {
+	if !s.breaker.allow() {
+		return nil, ErrStoreUnavailable
+	}
+
+	u, err := s.Store.FindBySlug(ctx, slug)
+	s.breaker.record(err)
+
+	return u, err
+}
+
+// ResolveSlug returns the url stored under slug for a redirect or ErrNotFound
+func (s *breakerStore) ResolveSlug(ctx context.Context, slug string) (*URL, error) {
+	if !s.breaker.allow() {
+		return nil, ErrStoreUnavailable
+	}
+
+	u, err := s.Store.ResolveSlug(ctx, slug)
+	s.breaker.record(err)
+
+	return u, err
+}
+
+// FindByOriginalURL returns a url owned by owner without an expiry pointing at original or
+// ErrNotFound
+func (s *breakerStore) FindByOriginalURL(ctx context.Context, owner, original string) (*URL, error) {
+	if !s.breaker.allow() {
+		return nil, ErrStoreUnavailable
+	}
+
+	u, err := s.Store.FindByOriginalURL(ctx, owner, original)
+	s.breaker.record(err)
+
+	return u, err
+}
+
+// Exists reports whether a url has already been stored under slug
+func (s *breakerStore) Exists(ctx context.Context, slug string) (bool, error) {
+	if !s.breaker.allow() {
+		return false, ErrStoreUnavailable
+	}
+
+	exists, err := s.Store.Exists(ctx, slug)
+	s.breaker.record(err)
+
+	return exists, err
+}
+
+// Delete removes the url stored under slug or returns ErrNotFound
+func (s *breakerStore) Delete(ctx context.Context, slug string, tombstone bool) error {
+	if !s.breaker.allow() {
+		return ErrStoreUnavailable
+	}
+
+	err := s.Store.Delete(ctx, slug, tombstone)
+	s.breaker.record(err)
+
+	return err
+}
+
+// IncrementUses atomically counts a visit to the url stored under slug
+func (s *breakerStore) IncrementUses(ctx context.Context, slug string) (int, error) {
+	if !s.breaker.allow() {
+		return 0, ErrStoreUnavailable
+	}
+
+	uses, err := s.Store.IncrementUses(ctx, slug)
+	s.breaker.record(err)
+
+	return uses, err
+}
+
+// IncrementClicks atomically counts a redirect through the url stored under slug
+func (s *breakerStore) IncrementClicks(ctx context.Context, slug string) (int, error) {
+	if !s.breaker.allow() {
+		return 0, ErrStoreUnavailable
+	}
+
+	clicks, err := s.Store.IncrementClicks(ctx, slug)
+	s.breaker.record(err)
+
+	return clicks, err
+}
+
+// List returns a page of urls matching q and the total number of matches
+func (s *breakerStore) List(ctx context.Context, q ListQuery) ([]URL, int, error) {
+	if !s.breaker.allow() {
+		return nil, 0, ErrStoreUnavailable
+	}
+
+	urls, total, err := s.Store.List(ctx, q)
+	s.breaker.record(err)
+
+	return urls, total, err
+}
+
+// Ping checks that the store is reachable, it always reaches the store so readiness probes see it
+// recover, and a successful ping closes the circuit
+func (s *breakerStore) Ping(ctx context.Context) error {
+	err := s.Store.Ping(ctx)
+	if err == nil {
+		s.breaker.record(nil)
+	}
+
+	return err
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultCacheTTL is how long a url is served from the cache before it is read from the store again
+const defaultCacheTTL = 30 * time.Second
+
+// LRUCache is a fixed size, thread-safe least recently used cache of urls by slug. Urls expire after
+// ttl, so changes made through other instances, which cannot invalidate this cache, are picked up.
+type LRUCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	slug    string
+	url     URL
+	expires time.Time
+}
+
+// NewLRUCache creates a cache holding at most size urls for ttl each, 0 keeping them until they are
+// evicted or invalidated
+func NewLRUCache(size int, ttl time.Duration) *LRUCache {
+	return &LRUCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// Get returns a copy of the url cached under slug
+func (c *LRUCache) Get(slug string) (*URL, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[slug]
+	if !ok {
+		return nil, false
+	}
+
+	entry := e.Value.(*cacheEntry)
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.order.Remove(e)
+		delete(c.entries, slug)
+		return nil, false
+	}
+
+	c.order.MoveToFront(e)
+	u := entry.url
+
+	return &u, true
+}
+
+// Add caches a copy of u, evicting the least recently used url when full
+func (c *LRUCache) Add(u *URL) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(c.ttl)
+	if e, ok := c.entries[u.Slug]; ok {
+		entry := e.Value.(*cacheEntry)
+		entry.url, entry.expires = *u, expires
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[u.Slug] = c.order.PushFront(&cacheEntry{slug: u.Slug, url: *u, expires: expires})
+
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).slug)
+	}
+}
+
+// IncrementClicks counts a click on the copy of the url cached under slug, if there is one
+func (c *LRUCache) IncrementClicks(slug string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[slug]; ok {
+		e.Value.(*cacheEntry).url.Clicks++
+	}
+}
+
+// Remove drops slug from the cache
+func (c *LRUCache) Remove(slug string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[slug]; ok {
+		c.order.Remove(e)
+		delete(c.entries, slug)
+	}
+}
+
+// Len returns the number of cached urls
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+// warmCache loads the n most clicked urls into cache so a fresh instance does not send its first
+// burst of redirects to the store. It returns the number of urls loaded.
+func warmCache(store Store, cache *LRUCache, n int) (int, error) {
+	urls := []URL{}
+	for len(urls) < n {
+		limit := n - len(urls)
+		if limit > maxPerPage {
+			limit = maxPerPage
+		}
+
+		page, _, err := store.List(context.Background(), ListQuery{AllOwners: true, Sort: "-clicks", Skip: len(urls), Limit: limit})
+		if err != nil {
+			return 0, err
+		}
+
+		urls = append(urls, page...)
+		if len(page) < limit {
+			break
+		}
+	}
+
+	// the least recently added urls are evicted first, so the most clicked go in last
+	for i := len(urls) - 1; i >= 0; i-- {
+		cache.Add(&urls[i])
+	}
+
+	return len(urls), nil
+}
+
+// cachedStore serves FindBySlug from an LRU cache, invalidating entries when urls change here. Urls
+// changed through other instances, such as deleted, disabled or retargeted urls, are served from the
+// cache until their entries expire.
+type cachedStore struct {
+	Store
+	cache  *LRUCache
+	hits   *Counter
+	misses *Counter
+}
+
+// FindBySlug returns the url stored under slug or ErrNotFound
+func (s *cachedStore) FindBySlug(ctx context.Context, slug string) (*URL, error) {
+	if u, ok := s.cache.Get(slug); ok {
+		s.hits.Inc()
+		return u, nil
+	}
+
+	s.misses.Inc()
+
+	u, err := s.Store.FindBySlug(ctx, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cache.Add(u)
+
+	return u, nil
+}
+
+// ResolveSlug returns the url stored under slug for a redirect or ErrNotFound, misses are read with
+// the wrapped store's ResolveSlug and cached
+func (s *cachedStore) ResolveSlug(ctx context.Context, slug string) (*URL, error) {
+	if u, ok := s.cache.Get(slug); ok {
+		s.hits.Inc()
+		return u, nil
+	}
+
+	s.misses.Inc()
+
+	u, err := s.Store.ResolveSlug(ctx, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cache.Add(u)
+
+	return u, nil
+}
+
+// Update replaces the url stored under u.Slug or returns ErrNotFound
+func (s *cachedStore) Update(ctx context.Context, u *URL) error {
+	defer s.cache.Remove(u.Slug)
+
+	return s.Store.Update(ctx, u)
+}
+
+// IncrementClicks atomically counts a redirect through the url stored under slug and keeps the
+// cached copy's count in step
+func (s *cachedStore) IncrementClicks(ctx context.Context, slug string) (int, error) {
+	clicks, err := s.Store.IncrementClicks(ctx, slug)
+	if err != nil {
+		return 0, err
+	}
+
+	s.cache.IncrementClicks(slug)
+
+	return clicks, nil
+}
+
+// Delete removes the url stored under slug or returns ErrNotFound. When tombstone is set the slug is
+// recorded so it is never reused.
+func (s *cachedStore) Delete(ctx context.Context, slug string, tombstone bool) error {
+	defer s.cache.Remove(slug)
+
+	return s.Store.Delete(ctx, slug, tombstone)
+}
+
+// negativeCacheSize bounds the number of unknown slugs remembered, the oldest are forgotten first
+const negativeCacheSize = 10000
+
+// defaultNegativeCacheTTL is how long an unknown slug is remembered
+const defaultNegativeCacheTTL = 10 * time.Second
+
+// NegativeCache is a fixed size, thread-safe set of slugs that were recently looked up and not found
+type NegativeCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type negativeEntry struct {
+	slug    string
+	expires time.Time
+}
+
+// NewNegativeCache creates a cache remembering at most size unknown slugs for ttl each
+func NewNegativeCache(size int, ttl time.Duration) *NegativeCache {
+	return &NegativeCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// Missing reports whether slug was not found less than the cache's ttl ago
+func (c *NegativeCache) Missing(slug string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[slug]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(e.Value.(*negativeEntry).expires) {
+		c.order.Remove(e)
+		delete(c.entries, slug)
+		return false
+	}
+
+	return true
+}
+
+// Add remembers that slug was not found, forgetting the oldest slug when full
+func (c *NegativeCache) Add(slug string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(c.ttl)
+	if e, ok := c.entries[slug]; ok {
+		e.Value.(*negativeEntry).expires = expires
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[slug] = c.order.PushFront(&negativeEntry{slug: slug, expires: expires})
+
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*negativeEntry).slug)
+	}
+}
+
+// Remove forgets slug, it is called once a url is stored under it
+func (c *NegativeCache) Remove(slug string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[slug]; ok {
+		c.order.Remove(e)
+		delete(c.entries, slug)
+	}
+}
+
+// negativeCachedStore answers lookups of recently unknown slugs without querying the store, so
+// scanners probing random slugs cost one query per slug and ttl. Slugs are forgotten as soon as a url
+// is saved under them here, urls created by other instances are found once the ttl has passed.
+type negativeCachedStore struct {
+	Store
+	missing *NegativeCache
+	hits    *Counter
+}
+
+// FindBySlug returns the url stored under slug or ErrNotFound
+func (s *negativeCachedStore) FindBySlug(ctx context.Context, slug string) (*URL, error) {
+	return s.lookup(ctx, slug, s.Store.FindBySlug)
+}
+
+// ResolveSlug returns the url stored under slug for a redirect or ErrNotFound
+func (s *negativeCachedStore) ResolveSlug(ctx context.Context, slug string) (*URL, error) {
+	return s.lookup(ctx, slug, s.Store.ResolveSlug)
+}
+
+// lookup answers ErrNotFound for slugs in the negative cache and adds the slugs find cannot find
+func (s *negativeCachedStore) lookup(ctx context.Context, slug string, find func(context.Context, string) (*URL, error)) (*URL, error) {
+	if s.missing.Missing(slug) {
+		s.hits.Inc()
+		return nil, ErrNotFound
+	}
+
+	u, err := find(ctx, slug)
+	if err == ErrNotFound {
+		s.missing.Add(slug)
+	}
+
+	return u, err
+}
+
+// Save inserts a new url document and forgets that its slug was unknown
+func (s *negativeCachedStore) Save(ctx context.Context, u *URL) error {
+	defer s.missing.Remove(u.Slug)
+
+	return s.Store.Save(ctx, u)
+}
+
+// SaveMany inserts urls in a single round trip and forgets that their slugs were unknown
+func (s *negativeCachedStore) SaveMany(ctx context.Context, urls []*URL) []error {
+	defer func() {
+		for _, u := range urls {
+			s.missing.Remove(u.Slug)
+		}
+	}()
+
+	return s.Store.SaveMany(ctx, urls)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLRUCacheExpiry(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		want bool
+	}{
+		{"fresh", time.Minute, true},
+		{"expired", time.Millisecond, false},
+		{"no ttl", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewLRUCache(10, tt.ttl)
+			c.Add(&URL{Slug: "abc", OriginalURL: "https://example.com/"})
+			time.Sleep(5 * time.Millisecond)
+
+			if _, ok := c.Get("abc"); ok != tt.want {
+				t.Errorf("Get found %v, want %v", ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestCachedStoreSeesOtherInstancesAfterTTL(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	if err := store.Save(ctx, &URL{Slug: "abc", OriginalURL: "https://example.com/old"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cached := &cachedStore{Store: store, cache: NewLRUCache(10, 20*time.Millisecond), hits: &Counter{}, misses: &Counter{}}
+	if _, err := cached.ResolveSlug(ctx, "abc"); err != nil {
+		t.Fatal(err)
+	}
+
+	// another instance deletes the url, bypassing this instance's cache
+	if err := store.Delete(ctx, "abc", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cached.ResolveSlug(ctx, "abc"); err != nil {
+		t.Fatalf("cached url not served before the ttl: %v", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if _, err := cached.ResolveSlug(ctx, "abc"); err != ErrNotFound {
+		t.Errorf("ResolveSlug error %v after the ttl, want %v", err, ErrNotFound)
+	}
+}
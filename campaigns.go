@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const maxCampaignsPerOwner = 100
+const maxCampaignNameLength = 100
+
+// campaignTopLinks is the number of most clicked links reported in a campaign's stats
+const campaignTopLinks = 10
+
+var (
+	ErrInvalidCampaign      = codedError("invalid_campaign", "name", "A campaign needs a name of at most 100 characters")
+	ErrTooManyCampaigns     = codedError("too_many_campaigns", "", "At most 100 campaigns may be created")
+	ErrCampaignNotFound     = codedError("campaign_not_found", "", "Unable to locate a campaign with that id")
+	ErrUnableToSaveCampaign = codedError("campaign_save_failed", "", "Unable to save campaign")
+)
+
+// Campaign groups related urls of an owner so their clicks can be followed together
+type Campaign struct {
+	ID          string    `json:"id" bson:"campaign_id"`
+	Owner       string    `json:"-" bson:"owner"`
+	Name        string    `json:"name" bson:"name"`
+	Description string    `json:"description,omitempty" bson:"description,omitempty"`
+	CreatedAt   time.Time `json:"created_at" bson:"created_at"`
+}
+
+// CampaignRequest is the json body accepted when creating a campaign
+type CampaignRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// CampaignStats sums the clicks of every url in a campaign
+type CampaignStats struct {
+	Campaign
+	Links        int           `json:"links"`
+	TotalClicks  int           `json:"total_clicks"`
+	ClicksPerDay []DailyClicks `json:"clicks_per_day"`
+	TopLinks     []URL         `json:"top_links"`
+}
+
+// CampaignStore defines the persistence operations for campaigns
+type CampaignStore interface {
+	// SaveCampaign inserts a new campaign
+	SaveCampaign(c *Campaign) error
+	// ListCampaigns returns the campaigns of owner, oldest first
+	ListCampaigns(owner string) ([]Campaign, error)
+	// FindCampaign returns the campaign of owner with id or ErrNotFound
+	FindCampaign(owner, id string) (*Campaign, error)
+	// DeleteCampaign removes the campaign of owner with id or returns ErrNotFound
+	DeleteCampaign(owner, id string) error
+}
+
+// campaignDocument is the json encoding used by stores that keep campaigns as json documents, it
+// includes the owner that is hidden from api responses
+type campaignDocument struct {
+	*Campaign
+	Owner string `json:"owner"`
+}
+
+// marshalCampaign encodes c as a stored json document
+func marshalCampaign(c *Campaign) ([]byte, error) {
+	return json.Marshal(campaignDocument{Campaign: c, Owner: c.Owner})
+}
+
+// unmarshalCampaign decodes a stored json document into c
+func unmarshalCampaign(js []byte, c *Campaign) error {
+	doc := campaignDocument{Campaign: c}
+	if err := json.Unmarshal(js, &doc); err != nil {
+		return err
+	}
+
+	c.Owner = doc.Owner
+
+	return nil
+}
+
+// campaignID generates a random campaign id
+func campaignID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// validCampaign returns the campaign of owner with id for a url to join, the empty id leaves the url
+// outside of any campaign
+func (h *Handlers) validCampaign(owner, id string) (string, error) {
+	if id == "" {
+		return "", nil
+	}
+
+	if _, err := h.campaigns.FindCampaign(owner, id); err != nil {
+		if err == ErrNotFound {
+			return "", ErrCampaignNotFound
+		}
+
+		return "", ErrStoreUnavailable
+	}
+
+	return id, nil
+}
+
+// CreateCampaign creates a campaign for the caller's urls
+func (h *Handlers) CreateCampaign(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	req := CampaignRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondBodyError(w, err, ErrInvalidCampaign)
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > maxCampaignNameLength {
+		h.RespondError(w, ErrInvalidCampaign, http.StatusBadRequest)
+		return
+	}
+
+	owner := requestOwner(r)
+	campaigns, err := h.campaigns.ListCampaigns(owner)
+	if err != nil {
+		h.RespondError(w, ErrUnableToSaveCampaign, http.StatusInternalServerError)
+		return
+	}
+
+	if len(campaigns) >= maxCampaignsPerOwner {
+		h.RespondError(w, ErrTooManyCampaigns, http.StatusConflict)
+		return
+	}
+
+	id, err := campaignID()
+	if err != nil {
+		h.RespondError(w, ErrUnableToSaveCampaign, http.StatusInternalServerError)
+		return
+	}
+
+	c := Campaign{
+		ID:          id,
+		Owner:       owner,
+		Name:        name,
+		Description: strings.TrimSpace(req.Description),
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	if err := h.campaigns.SaveCampaign(&c); err != nil {
+		h.RespondError(w, ErrUnableToSaveCampaign, http.StatusInternalServerError)
+		return
+	}
+
+	h.RespondJSON(w, c, http.StatusCreated)
+}
+
+// ListCampaigns responds with the caller's campaigns
+func (h *Handlers) ListCampaigns(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	campaigns, err := h.campaigns.ListCampaigns(requestOwner(r))
+	if err != nil {
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	h.RespondJSON(w, campaigns, http.StatusOK)
+}
+
+// DeleteCampaign removes one of the caller's campaigns, its urls are kept and leave the campaign
+func (h *Handlers) DeleteCampaign(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	owner := requestOwner(r)
+	if err := h.campaigns.DeleteCampaign(owner, params["id"]); err != nil {
+		if err == ErrNotFound {
+			h.RespondError(w, ErrCampaignNotFound, http.StatusNotFound)
+			return
+		}
+
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	// each pass lists the urls still in the campaign, updated urls drop out of the next one
+	for {
+		urls, _, err := h.store.List(r.Context(), ListQuery{Owner: owner, Campaign: params["id"], Limit: maxPerPage})
+		if err != nil || len(urls) == 0 {
+			break
+		}
+
+		for i := range urls {
+			urls[i].Campaign = ""
+			if err := h.store.Update(r.Context(), &urls[i]); err != nil && err != ErrNotFound {
+				h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+				return
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CampaignStats responds with the clicks of every url in one of the caller's campaigns, in total and
+// per day, along with its most clicked urls
+func (h *Handlers) CampaignStats(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	owner := requestOwner(r)
+	c, err := h.campaigns.FindCampaign(owner, params["id"])
+	if err != nil {
+		if err == ErrNotFound {
+			h.RespondError(w, ErrCampaignNotFound, http.StatusNotFound)
+			return
+		}
+
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	stats := CampaignStats{Campaign: *c, TopLinks: []URL{}, ClicksPerDay: []DailyClicks{}}
+	days := map[string]int{}
+	for skip := 0; ; skip += maxPerPage {
+		urls, total, err := h.store.List(r.Context(), ListQuery{Owner: owner, Campaign: c.ID, Sort: "-clicks", Skip: skip, Limit: maxPerPage})
+		if err != nil {
+			h.RespondError(w, ErrUnableToLoadStats, http.StatusInternalServerError)
+			return
+		}
+
+		stats.Links = total
+		for i := range urls {
+			if len(stats.TopLinks) < campaignTopLinks {
+				stats.TopLinks = append(stats.TopLinks, urls[i])
+			}
+
+			stats.TotalClicks += urls[i].Clicks
+
+			s, err := h.clicks.Stats(urls[i].Slug)
+			if err != nil {
+				h.RespondError(w, ErrUnableToLoadStats, http.StatusInternalServerError)
+				return
+			}
+
+			for _, d := range s.ClicksPerDay {
+				days[d.Day] += d.Clicks
+			}
+		}
+
+		if len(urls) < maxPerPage {
+			break
+		}
+	}
+
+	for day, clicks := range days {
+		stats.ClicksPerDay = append(stats.ClicksPerDay, DailyClicks{Day: day, Clicks: clicks})
+	}
+	sort.Slice(stats.ClicksPerDay, func(i, j int) bool { return stats.ClicksPerDay[i].Day < stats.ClicksPerDay[j].Day })
+
+	h.RespondJSON(w, stats, http.StatusOK)
+}
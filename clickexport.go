@@ -0,0 +1,244 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// clickExportColumns are the columns of a csv click export, in order
+var clickExportColumns = []string{"timestamp", "referrer", "user_agent", "country", "variant", "referrer_domain", "utm_source", "utm_medium", "utm_campaign"}
+
+// maxSeriesPoints bounds the number of buckets in a click series
+const maxSeriesPoints = 1000
+
+// defaultSeriesPoints is the number of buckets a click series covers when it is not given a start
+const defaultSeriesPoints = 30
+
+// seriesIntervals are the bucket sizes of a click series
+var seriesIntervals = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+}
+
+var (
+	ErrInvalidStatsRange = codedError("invalid_range", "", "from and to must be RFC 3339 times or dates, with from before to")
+	ErrInvalidInterval   = codedError("invalid_interval", "interval", "interval must be hour or day and cover at most 1000 of them")
+)
+
+// SeriesPoint is the number of clicks in the bucket starting at Time
+type SeriesPoint struct {
+	Time   time.Time `json:"time"`
+	Clicks int       `json:"clicks"`
+}
+
+// ClickSeries is the clicks of a url counted per hour or day, every bucket from From up to before To
+// is listed so the points can be charted as they are
+type ClickSeries struct {
+	Slug     string        `json:"slug"`
+	Interval string        `json:"interval"`
+	From     time.Time     `json:"from"`
+	To       time.Time     `json:"to"`
+	Total    int           `json:"total"`
+	Points   []SeriesPoint `json:"points"`
+}
+
+// parseStatsTime reads an RFC 3339 time or a date, returning def when value is empty
+func parseStatsTime(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+
+	return time.Parse(statsDayFormat, value)
+}
+
+// statsRange reads the from and to query parameters, to defaults to now and from to span before it or,
+// when span is 0, to the first click
+func statsRange(query url.Values, span time.Duration) (time.Time, time.Time, error) {
+	to, err := parseStatsTime(query.Get("to"), time.Now().UTC())
+	if err != nil {
+		return time.Time{}, time.Time{}, ErrInvalidStatsRange
+	}
+
+	defaultFrom := time.Time{}
+	if span > 0 {
+		defaultFrom = to.Add(-span)
+	}
+
+	from, err := parseStatsTime(query.Get("from"), defaultFrom)
+	if err != nil || !from.Before(to) {
+		return time.Time{}, time.Time{}, ErrInvalidStatsRange
+	}
+
+	return from, to, nil
+}
+
+// ExportClicks streams the clicks recorded for one of the caller's urls as csv, or as a json array
+// with format=json, optionally limited to those from from up to before to
+func (h *Handlers) ExportClicks(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	slug := h.canonicalSlug(params["slug"])
+	logSlug(r, slug)
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "csv" && format != "json" {
+		h.RespondError(w, ErrInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := statsRange(r.URL.Query(), 0)
+	if err != nil {
+		h.RespondError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	u, err := h.store.FindBySlug(r.Context(), slug)
+	if err != nil || u.Owner != requestOwner(r) {
+		h.RespondError(w, ErrNotFound, http.StatusNotFound)
+		return
+	}
+
+	clicks, err := h.clicks.Clicks(slug, from, to, 0, maxPerPage)
+	if err != nil {
+		h.RespondError(w, ErrUnableToLoadStats, http.StatusInternalServerError)
+		return
+	}
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+slug+`-clicks.json"`)
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+slug+`-clicks.csv"`)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	out := newExportWriter(w, format, clickExportColumns)
+	for skip := 0; ; skip += maxPerPage {
+		for _, c := range clicks {
+			record := []string{
+				c.Timestamp.UTC().Format(time.RFC3339Nano), c.Referrer, c.UserAgent, c.Country, c.Variant,
+				c.ReferrerDomain, c.UTMSource, c.UTMMedium, c.UTMCampaign,
+			}
+			if err := out.write(record, c); err != nil {
+				return
+			}
+		}
+
+		if len(clicks) < maxPerPage {
+			break
+		}
+
+		clicks, err = h.clicks.Clicks(slug, from, to, skip+maxPerPage, maxPerPage)
+		if err != nil {
+			// the status has been sent, the export is left truncated
+			log.Printf("Unable to export clicks for %s: %v", slug, err)
+			return
+		}
+	}
+
+	out.close()
+}
+
+// ClickSeries responds with the clicks of a url counted per hour or day, for charting
+func (h *Handlers) ClickSeries(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	slug := h.canonicalSlug(params["slug"])
+	logSlug(r, slug)
+
+	interval := r.URL.Query().Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+
+	bucket, ok := seriesIntervals[interval]
+	if !ok {
+		h.RespondError(w, ErrInvalidInterval, http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := statsRange(r.URL.Query(), defaultSeriesPoints*bucket)
+	if err != nil {
+		h.RespondError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// buckets start on the hour or at midnight utc, a partial last bucket is included
+	from = from.Truncate(bucket)
+	if end := to.Truncate(bucket); end.Before(to) {
+		to = end.Add(bucket)
+	}
+
+	if to.Sub(from)/bucket > maxSeriesPoints {
+		h.RespondError(w, ErrInvalidInterval, http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.store.FindBySlug(r.Context(), slug); err != nil {
+		h.RespondError(w, ErrNotFound, http.StatusNotFound)
+		return
+	}
+
+	hours, err := h.clicks.HourlyClicks(slug, from, to)
+	if err != nil {
+		h.RespondError(w, ErrUnableToLoadStats, http.StatusInternalServerError)
+		return
+	}
+
+	series := ClickSeries{Slug: slug, Interval: interval, From: from, To: to, Points: []SeriesPoint{}}
+	index := map[int64]int{}
+	for t := from; t.Before(to); t = t.Add(bucket) {
+		index[t.Unix()] = len(series.Points)
+		series.Points = append(series.Points, SeriesPoint{Time: t})
+	}
+
+	for hour, clicks := range hours {
+		start := time.Unix(hour, 0).UTC().Truncate(bucket)
+		if i, ok := index[start.Unix()]; ok {
+			series.Points[i].Clicks += clicks
+			series.Total += clicks
+		}
+	}
+
+	h.RespondJSON(w, series, http.StatusOK)
+}
+
+// clicksBetween returns the page of clicks from from up to before to, for stores that keep clicks in
+// the order they were recorded
+func clicksBetween(clicks []Click, from, to time.Time, skip, limit int) []Click {
+	page := []Click{}
+	for _, c := range clicks {
+		if c.Timestamp.Before(from) || !c.Timestamp.Before(to) {
+			continue
+		}
+
+		if skip > 0 {
+			skip--
+			continue
+		}
+
+		if len(page) == limit {
+			break
+		}
+
+		page = append(page, c)
+	}
+
+	return page
+}
+
+// countHourly counts the clicks from from up to before to in every hour, for stores that cannot
+// aggregate themselves
+func countHourly(clicks []Click, from, to time.Time) map[int64]int {
+	hours := map[int64]int{}
+	for _, c := range clicks {
+		if !c.Timestamp.Before(from) && c.Timestamp.Before(to) {
+			hours[c.Timestamp.UTC().Truncate(time.Hour).Unix()]++
+		}
+	}
+
+	return hours
+}
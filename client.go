@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const clientUsage = `usage: urlshort [-host url] [-token token] [-json] <command>
+  shorten <url> [slug]  shorten a url, optionally with a custom slug
+  stats <slug>          click statistics of a url
+  list [page]           urls created with the token
+  delete <slug>         delete a url
+
+The host and token default to $URLSHORT_HOST and $URLSHORT_TOKEN.`
+
+const defaultClientHost = "http://localhost:8080"
+
+const clientTimeout = 30 * time.Second
+
+// apiClient calls the versioned json api of a running shortener
+type apiClient struct {
+	host   string
+	token  string
+	client *http.Client
+}
+
+// clientResponse is the envelope of a versioned api response with its data left undecoded
+type clientResponse struct {
+	Data  json.RawMessage `json:"data"`
+	Error *APIError       `json:"error"`
+	Meta  *PageMeta       `json:"meta"`
+}
+
+// runClient executes a urlshort command against the api of a running shortener
+func runClient(args []string) error {
+	flags := flag.NewFlagSet("urlshort", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(flags.Output(), clientUsage) }
+
+	host := os.Getenv("URLSHORT_HOST")
+	if host == "" {
+		host = defaultClientHost
+	}
+
+	flags.StringVar(&host, "host", host, "url of the shortener")
+	token := flags.String("token", os.Getenv("URLSHORT_TOKEN"), "api key or session token")
+	raw := flags.Bool("json", false, "print the response data as json")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+
+		return err
+	}
+
+	args = flags.Args()
+	if len(args) == 0 {
+		return errors.New(clientUsage)
+	}
+
+	c := &apiClient{host: strings.TrimRight(host, "/"), token: *token, client: &http.Client{Timeout: clientTimeout}}
+
+	var data interface{}
+	var err error
+	switch {
+	case args[0] == "shorten" && (len(args) == 2 || len(args) == 3):
+		req := ShortenRequest{URL: args[1]}
+		if len(args) == 3 {
+			req.Slug = args[2]
+		}
+
+		u := &URL{}
+		_, err = c.call(http.MethodPost, "/shorten", req, u)
+		data = u
+		if err == nil && !*raw {
+			fmt.Println(u.ShortURL)
+		}
+	case args[0] == "stats" && len(args) == 2:
+		stats := &Stats{}
+		_, err = c.call(http.MethodGet, "/urls/"+url.PathEscape(args[1])+"/stats", nil, stats)
+		data = stats
+		if err == nil && !*raw {
+			printStats(stats)
+		}
+	case args[0] == "list" && len(args) <= 2:
+		page := 1
+		if len(args) == 2 {
+			if page, err = strconv.Atoi(args[1]); err != nil || page < 1 {
+				return fmt.Errorf("Page must be a positive number, got %q", args[1])
+			}
+		}
+
+		urls := []URL{}
+		var meta *PageMeta
+		meta, err = c.call(http.MethodGet, "/urls?page="+strconv.Itoa(page), nil, &urls)
+		data = urls
+		if err == nil && !*raw {
+			printURLs(urls, meta)
+		}
+	case args[0] == "delete" && len(args) == 2:
+		_, err = c.call(http.MethodDelete, "/urls/"+url.PathEscape(args[1]), nil, nil)
+		if err == nil && !*raw {
+			fmt.Printf("deleted %s\n", args[1])
+		}
+	default:
+		return errors.New(clientUsage)
+	}
+
+	if err != nil || !*raw || data == nil {
+		return err
+	}
+
+	js, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(js))
+	return nil
+}
+
+// call sends body as json to the versioned api route path and decodes the response data into out.
+// It returns the pagination of list responses.
+func (c *apiClient) call(method, path string, body, out interface{}) (*PageMeta, error) {
+	var reader io.Reader
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+
+		reader = bytes.NewReader(js)
+	}
+
+	req, err := http.NewRequest(method, c.host+"/api/"+apiVersion+path, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+
+	envelope := clientResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return nil, fmt.Errorf("Unexpected %s response from %s", resp.Status, c.host)
+	}
+
+	if envelope.Error != nil {
+		return nil, errors.New(envelope.Error.Message)
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(envelope.Data, out); err != nil {
+			return nil, err
+		}
+	}
+
+	return envelope.Meta, nil
+}
+
+// printStats writes a summary of stats to stdout
+func printStats(stats *Stats) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "clicks\t%d\n", stats.TotalClicks)
+	fmt.Fprintf(w, "link status\t%s\n", stats.LinkStatus)
+	for _, d := range stats.ClicksPerDay {
+		fmt.Fprintf(w, "%s\t%d\n", d.Day, d.Clicks)
+	}
+
+	for _, r := range stats.TopReferrers {
+		fmt.Fprintf(w, "referrer %s\t%d\n", r.Referrer, r.Clicks)
+	}
+
+	for _, v := range stats.Variants {
+		fmt.Fprintf(w, "variant %s\t%d\n", v.Variant, v.Clicks)
+	}
+}
+
+// printURLs writes a page of urls to stdout
+func printURLs(urls []URL, meta *PageMeta) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	for _, u := range urls {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", u.ShortURL, u.OriginalURL, u.Clicks)
+	}
+
+	if meta != nil {
+		fmt.Fprintf(w, "page %d, %d urls\n", meta.Page, meta.Total)
+	}
+}
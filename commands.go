@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const usage = `usage:
+  fcc-url-shortener                    start the http server
+  fcc-url-shortener keys create <name> mint a new api key
+  fcc-url-shortener keys revoke <id>   revoke an api key
+  fcc-url-shortener backup             back up every url to URL_BACKUP_LOCATION now
+  fcc-url-shortener urlshort <command> call the api of a running shortener, see urlshort -h`
+
+// runCommand executes a command line subcommand against the configured store
+func runCommand(args []string) error {
+	switch args[0] {
+	case "keys":
+		return runKeysCommand(args[1:])
+	case "urlshort":
+		return runClient(args[1:])
+	case "backup":
+		return runBackupCommand(args[1:])
+	}
+
+	return fmt.Errorf("Unknown command %q\n%s", args[0], usage)
+}
+
+// runKeysCommand mints and revokes api keys
+func runKeysCommand(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("%s", usage)
+	}
+
+	config, err := LoadConfig(false)
+	if err != nil {
+		return err
+	}
+
+	store, err := newStore(config)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	keys, ok := store.(KeyStore)
+	if !ok {
+		return fmt.Errorf("Store does not support api keys")
+	}
+
+	switch args[0] {
+	case "create":
+		k, secret, err := GenerateAPIKey(args[1])
+		if err != nil {
+			return err
+		}
+		k.MonthlyQuota = config.KeyMonthlyQuota
+
+		if err := keys.SaveKey(k); err != nil {
+			return err
+		}
+
+		fmt.Printf("id:  %s\nkey: %s\n", k.ID, secret)
+		return nil
+	case "revoke":
+		if err := keys.RevokeKey(args[1], time.Now().UTC()); err != nil {
+			return err
+		}
+
+		fmt.Printf("revoked %s\n", args[1])
+		return nil
+	}
+
+	return fmt.Errorf("Unknown keys command %q\n%s", args[0], usage)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressibleTypes are the content types worth compressing, images and archives are compressed
+// already
+var compressibleTypes = []string{
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+	"text/",
+}
+
+// encoder is implemented by the gzip and zlib writers
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// encoders reuses the writers of each content encoding, they hold large buffers
+var encoders = map[string]*sync.Pool{
+	"gzip": {New: func() interface{} { return gzip.NewWriter(nil) }},
+	// deflate names the zlib format over http, not a raw deflate stream
+	"deflate": {New: func() interface{} { return zlib.NewWriter(nil) }},
+}
+
+// acceptedEncoding returns the content encoding a client accepts, gzip when it accepts both and the
+// empty string when it accepts neither
+func acceptedEncoding(header string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			if value := strings.TrimSpace(param); strings.HasPrefix(value, "q=") {
+				q, _ = strconv.ParseFloat(value[2:], 64)
+			}
+		}
+
+		accepted[coding] = q > 0
+	}
+
+	for _, coding := range []string{"gzip", "deflate"} {
+		if accepted[coding] {
+			return coding
+		}
+	}
+
+	return ""
+}
+
+// compressWriter encodes the body of a response once its headers show it is worth compressing
+type compressWriter struct {
+	http.ResponseWriter
+	head     bool
+	encoding string
+	started  bool
+	enc      encoder
+}
+
+// WriteHeader decides whether the body is compressed and sends the headers
+func (w *compressWriter) WriteHeader(status int) {
+	if w.started {
+		return
+	}
+	w.started = true
+
+	header := w.Header()
+	if !w.head && status >= http.StatusOK && status < http.StatusMultipleChoices && status != http.StatusNoContent &&
+		header.Get("Content-Encoding") == "" && compressible(header.Get("Content-Type")) {
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+
+		// the body is no longer the bytes a strong tag promises
+		if tag := header.Get("ETag"); tag != "" && !strings.HasPrefix(tag, "W/") {
+			header.Set("ETag", "W/"+tag)
+		}
+
+		w.enc = encoders[w.encoding].Get().(encoder)
+		w.enc.Reset(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write compresses b when the response is compressed
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.started {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends what has been compressed so far, for responses that are streamed
+func (w *compressWriter) Flush() {
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close finishes the compressed body and returns its encoder for reuse
+func (w *compressWriter) close() {
+	if w.enc == nil {
+		return
+	}
+
+	w.enc.Close()
+	encoders[w.encoding].Put(w.enc)
+	w.enc = nil
+}
+
+// compressible reports whether responses of contentType are worth compressing
+func compressible(contentType string) bool {
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Compress gzips, or deflates, json, html and other text responses for clients that accept it.
+// Redirects and empty responses are sent as they are.
+func (h *Handlers) Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, head: r.Method == http.MethodHead, encoding: encoding}
+		defer cw.close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// Config holds every setting the service reads at startup
+type Config struct {
+	Port                 string
+	BindAddress          string
+	Host                 string
+	Store                string
+	MongoDSN             string
+	MongoTimeout         time.Duration
+	MongoPoolSize        int
+	StoreTimeout         time.Duration
+	MongoReadDSN         string
+	MongoReadPreference  string
+	RedisDSN             string
+	RedisPoolSize        int
+	PostgresDSN          string
+	PostgresPoolSize     int
+	RequireAPIKey        bool
+	AdminToken           string
+	RateLimitRPS         float64
+	RateLimitBurst       int
+	TrustProxy           bool
+	TrustedProxyHops     int
+	SlugStrategy         string
+	SlugLength           int
+	SlugShard            string
+	SlugBlockSize        int
+	SlugPoolSize         int
+	BreakerFailures      int
+	BreakerCooldown      time.Duration
+	FallbackSnapshot     string
+	SnapshotInterval     time.Duration
+	BackupLocation       string
+	BackupFormat         string
+	BackupInterval       time.Duration
+	BackupKeep           int
+	S3Endpoint           string
+	S3Region             string
+	S3AccessKey          string
+	S3SecretKey          string
+	CacheSize            int
+	CacheWarm            int
+	CacheTTL             time.Duration
+	NegativeCacheTTL     time.Duration
+	SafeBrowsingKey      string
+	SafeBrowsingURL      string
+	SafeBrowsingRescan   time.Duration
+	RedirectCode         int
+	RedirectMaxAge       int
+	BlockedDomains       []string
+	AllowedDomains       []string
+	JWTSecret            string
+	JWTTTL               time.Duration
+	ReportThreshold      int
+	TLSCert              string
+	TLSKey               string
+	AutocertDomains      []string
+	AutocertCache        string
+	AutocertEmail        string
+	AutocertHTTPPort     string
+	ReadTimeout          time.Duration
+	ReadHeaderTimeout    time.Duration
+	WriteTimeout         time.Duration
+	IdleTimeout          time.Duration
+	MaxHeaderBytes       int
+	HTTP2                bool
+	RedirectCheckHops    int
+	ValidateReachability string
+	DeadLinkInterval     time.Duration
+	DeleteRetention      time.Duration
+	DeadLinkFailures     int
+	GeoIPDB              string
+	NotLiveResponse      string
+	FetchMetadata        bool
+	GRPCPort             string
+	BitlyCompat          bool
+	Webhooks             bool
+	WebhookMilestones    []int
+	EventsURL            string
+	EventsSubject        string
+	OTLPEndpoint         string
+	EgressAllow          []netip.Prefix
+	ReservedSlugs        []string
+	CaselessSlugs        bool
+	ShortDomains         []ShortDomain
+	CustomDomains        bool
+	CountBots            bool
+	AnonymizeIPs         bool
+	ClickRetention       time.Duration
+	ClickArchiveAge      time.Duration
+	ClickArchiveLocation string
+	RobotsTxt            string
+	Compression          bool
+	MaxURLLength         int
+	MaxBodyBytes         int
+	TraceSampleRatio     float64
+	DisabledFeatures     []string
+	FeatureFlags         string
+	KeyMonthlyQuota      int
+	GoogleClientID       string
+	GoogleClientSecret   string
+	GitHubClientID       string
+	GitHubClientSecret   string
+	OIDCIssuer           string
+	OIDCClientID         string
+	OIDCClientSecret     string
+	OIDCName             string
+	PasswordLogin        bool
+}
+
+// LoadConfig reads the configuration from the environment and validates it. Variables that are not
+// set in the environment are read from the NAME=value lines of the file named by URL_CONFIG_FILE when
+// there is one. The server needs a port and public host that commands can do without, so those are
+// only required when server is set. Every invalid value is reported in the returned error, not just
+// the first.
+func LoadConfig(server bool) (*Config, error) {
+	l := &configLoader{}
+	if file := os.Getenv("URL_CONFIG_FILE"); file != "" {
+		values, err := readConfigFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		l.file = values
+	}
+
+	c := &Config{
+		Port:                 l.str("PORT", ""),
+		BindAddress:          l.str("URL_BIND_ADDRESS", ""),
+		Host:                 strings.TrimSuffix(l.str("URL_HOST", ""), "/"),
+		Store:                l.str("URL_STORE", "mongo"),
+		MongoDSN:             l.str("URL_MGO_DSN", ""),
+		MongoTimeout:         time.Duration(l.integer("URL_MGO_TIMEOUT_MS", int(defaultMongoTimeout/time.Millisecond), 1)) * time.Millisecond,
+		MongoPoolSize:        l.integer("URL_MGO_POOL_SIZE", 0, 0),
+		StoreTimeout:         time.Duration(l.integer("URL_STORE_TIMEOUT_MS", int(defaultStoreTimeout/time.Millisecond), 1)) * time.Millisecond,
+		MongoReadDSN:         l.str("URL_MGO_READ_DSN", ""),
+		MongoReadPreference:  l.str("URL_MGO_READ_PREFERENCE", ""),
+		RedisDSN:             l.str("URL_REDIS_DSN", ""),
+		RedisPoolSize:        l.integer("URL_REDIS_POOL_SIZE", 0, 0),
+		PostgresDSN:          l.str("URL_PG_DSN", ""),
+		PostgresPoolSize:     l.integer("URL_PG_POOL_SIZE", 0, 0),
+		RequireAPIKey:        l.boolean("URL_REQUIRE_API_KEY", false),
+		AdminToken:           l.str("URL_ADMIN_TOKEN", ""),
+		RateLimitRPS:         l.float("URL_RATE_LIMIT_RPS", 1),
+		RateLimitBurst:       l.integer("URL_RATE_LIMIT_BURST", 10, 1),
+		TrustProxy:           l.boolean("URL_TRUST_PROXY", false),
+		TrustedProxyHops:     l.integer("URL_TRUSTED_PROXY_HOPS", 1, 1),
+		SlugStrategy:         l.str("URL_SLUG_STRATEGY", "counter"),
+		SlugLength:           l.integer("URL_SLUG_LENGTH", defaultRandomSlugLength, customSlugMinLength),
+		SlugShard:            l.str("URL_SLUG_SHARD", ""),
+		SlugBlockSize:        l.integer("URL_SLUG_BLOCK_SIZE", defaultSlugBlockSize, 1),
+		SlugPoolSize:         l.integer("URL_SLUG_POOL_SIZE", 0, 0),
+		BreakerFailures:      l.integer("URL_BREAKER_FAILURES", defaultBreakerFailures, 0),
+		BreakerCooldown:      l.seconds("URL_BREAKER_COOLDOWN_SECONDS", defaultBreakerCooldown),
+		FallbackSnapshot:     l.str("URL_FALLBACK_SNAPSHOT", ""),
+		SnapshotInterval:     time.Duration(l.integer("URL_FALLBACK_SNAPSHOT_MINUTES", int(defaultSnapshotInterval/time.Minute), 1)) * time.Minute,
+		BackupLocation:       l.str("URL_BACKUP_LOCATION", ""),
+		BackupFormat:         l.str("URL_BACKUP_FORMAT", "json"),
+		BackupInterval:       time.Duration(l.integer("URL_BACKUP_INTERVAL_HOURS", 24, 1)) * time.Hour,
+		BackupKeep:           l.integer("URL_BACKUP_KEEP", defaultBackupKeep, 0),
+		S3Endpoint:           l.str("URL_S3_ENDPOINT", ""),
+		S3Region:             l.str("URL_S3_REGION", defaultS3Region),
+		S3AccessKey:          l.str("URL_S3_ACCESS_KEY", ""),
+		S3SecretKey:          l.str("URL_S3_SECRET_KEY", ""),
+		CacheSize:            l.integer("URL_CACHE_SIZE", 10000, 0),
+		CacheWarm:            l.integer("URL_CACHE_WARM", 0, 0),
+		CacheTTL:             l.seconds("URL_CACHE_SECONDS", defaultCacheTTL),
+		NegativeCacheTTL:     l.seconds("URL_NEGATIVE_CACHE_SECONDS", defaultNegativeCacheTTL),
+		SafeBrowsingKey:      l.str("URL_SAFE_BROWSING_KEY", ""),
+		SafeBrowsingURL:      l.str("URL_SAFE_BROWSING_URL", ""),
+		SafeBrowsingRescan:   time.Duration(l.integer("URL_SAFE_BROWSING_RESCAN_MINUTES", 24*60, 0)) * time.Minute,
+		RedirectCode:         l.integer("URL_REDIRECT_CODE", defaultRedirectCode, 0),
+		RedirectMaxAge:       l.integer("URL_REDIRECT_MAX_AGE", defaultRedirectMaxAge, 0),
+		BlockedDomains:       l.domains("URL_BLOCKED_DOMAINS"),
+		AllowedDomains:       l.domains("URL_ALLOWED_DOMAINS"),
+		JWTSecret:            l.str("URL_JWT_SECRET", ""),
+		JWTTTL:               time.Duration(l.integer("URL_JWT_TTL_MINUTES", int(defaultTokenTTL/time.Minute), 1)) * time.Minute,
+		ReportThreshold:      l.integer("URL_REPORT_THRESHOLD", defaultReportThreshold, 0),
+		TLSCert:              l.str("URL_TLS_CERT", ""),
+		TLSKey:               l.str("URL_TLS_KEY", ""),
+		AutocertDomains:      l.list("URL_AUTOCERT_DOMAINS"),
+		AutocertCache:        l.str("URL_AUTOCERT_CACHE", defaultAutocertCache),
+		AutocertEmail:        l.str("URL_AUTOCERT_EMAIL", ""),
+		AutocertHTTPPort:     l.str("URL_AUTOCERT_HTTP_PORT", defaultAutocertHTTPPort),
+		ReadTimeout:          l.seconds("URL_READ_TIMEOUT_SECONDS", defaultReadTimeout),
+		ReadHeaderTimeout:    l.seconds("URL_READ_HEADER_TIMEOUT_SECONDS", defaultReadHeaderTimeout),
+		WriteTimeout:         l.seconds("URL_WRITE_TIMEOUT_SECONDS", defaultWriteTimeout),
+		IdleTimeout:          l.seconds("URL_IDLE_TIMEOUT_SECONDS", defaultIdleTimeout),
+		MaxHeaderBytes:       l.integer("URL_MAX_HEADER_BYTES", defaultMaxHeaderBytes, 1024),
+		HTTP2:                l.boolean("URL_HTTP2", true),
+		RedirectCheckHops:    l.integer("URL_REDIRECT_CHECK_HOPS", 0, 0),
+		ValidateReachability: l.str("URL_VALIDATE_REACHABILITY", ""),
+		DeadLinkInterval:     time.Duration(l.integer("URL_DEAD_LINK_CHECK_MINUTES", 0, 0)) * time.Minute,
+		DeadLinkFailures:     l.integer("URL_DEAD_LINK_FAILURES", defaultDeadLinkFailures, 1),
+		DeleteRetention:      time.Duration(l.integer("URL_DELETE_RETENTION_DAYS", defaultDeleteRetentionDays, 0)) * 24 * time.Hour,
+		GeoIPDB:              l.str("URL_GEOIP_DB", ""),
+		NotLiveResponse:      l.str("URL_NOT_LIVE_RESPONSE", "page"),
+		FetchMetadata:        l.boolean("URL_FETCH_METADATA", false),
+		GRPCPort:             l.str("URL_GRPC_PORT", ""),
+		BitlyCompat:          l.boolean("URL_BITLY_COMPAT", false),
+		Webhooks:             l.boolean("URL_WEBHOOKS", false),
+		WebhookMilestones:    l.integers("URL_WEBHOOK_MILESTONES", defaultWebhookMilestones, 1),
+		EventsURL:            l.str("URL_EVENTS_URL", ""),
+		EventsSubject:        l.str("URL_EVENTS_SUBJECT", defaultEventsSubject),
+		OTLPEndpoint:         l.str("URL_OTLP_ENDPOINT", ""),
+		TraceSampleRatio:     l.float("URL_TRACE_SAMPLE_RATIO", 1),
+		EgressAllow:          l.prefixes("URL_EGRESS_ALLOW"),
+		ReservedSlugs:        l.list("URL_RESERVED_SLUGS"),
+		CaselessSlugs:        l.boolean("URL_CASE_INSENSITIVE_SLUGS", false),
+		ShortDomains:         l.shortDomains("URL_DOMAINS"),
+		CustomDomains:        l.boolean("URL_CUSTOM_DOMAINS", false),
+		CountBots:            l.boolean("URL_COUNT_BOTS", false),
+		AnonymizeIPs:         l.boolean("URL_ANONYMIZE_IPS", false),
+		ClickRetention:       time.Duration(l.integer("URL_CLICK_RETENTION_DAYS", 0, 0)) * 24 * time.Hour,
+		ClickArchiveAge:      time.Duration(l.integer("URL_CLICK_ARCHIVE_DAYS", 0, 0)) * 24 * time.Hour,
+		ClickArchiveLocation: l.str("URL_CLICK_ARCHIVE_LOCATION", ""),
+		RobotsTxt:            l.str("URL_ROBOTS_TXT", ""),
+		Compression:          l.boolean("URL_COMPRESSION", true),
+		MaxURLLength:         l.integer("URL_MAX_URL_LENGTH", defaultMaxURLLength, 0),
+		MaxBodyBytes:         l.integer("URL_MAX_BODY_BYTES", defaultMaxBodyBytes, 1024),
+		DisabledFeatures:     l.list("URL_DISABLED_FEATURES"),
+		FeatureFlags:         l.str("URL_FEATURE_FLAGS", ""),
+		KeyMonthlyQuota:      l.integer("URL_KEY_MONTHLY_QUOTA", 0, 0),
+		GoogleClientID:       l.str("URL_GOOGLE_CLIENT_ID", ""),
+		GoogleClientSecret:   l.str("URL_GOOGLE_CLIENT_SECRET", ""),
+		GitHubClientID:       l.str("URL_GITHUB_CLIENT_ID", ""),
+		GitHubClientSecret:   l.str("URL_GITHUB_CLIENT_SECRET", ""),
+		OIDCIssuer:           l.str("URL_OIDC_ISSUER", ""),
+		OIDCClientID:         l.str("URL_OIDC_CLIENT_ID", ""),
+		OIDCClientSecret:     l.str("URL_OIDC_CLIENT_SECRET", ""),
+		OIDCName:             l.str("URL_OIDC_NAME", "single sign-on"),
+		PasswordLogin:        l.boolean("URL_PASSWORD_LOGIN", true),
+	}
+
+	if server {
+		if c.Port == "" {
+			l.fail("PORT must be set")
+		} else if p, err := strconv.Atoi(c.Port); err != nil || p < 1 || p > 65535 {
+			l.fail(fmt.Sprintf("PORT must be a port number, got %q", c.Port))
+		}
+
+		if _, err := netip.ParseAddr(c.BindAddress); c.BindAddress != "" && err != nil {
+			l.fail(fmt.Sprintf("URL_BIND_ADDRESS must be an ip address, got %q", c.BindAddress))
+		}
+
+		if c.GRPCPort != "" {
+			if p, err := strconv.Atoi(c.GRPCPort); err != nil || p < 1 || p > 65535 || c.GRPCPort == c.Port {
+				l.fail(fmt.Sprintf("URL_GRPC_PORT must be a port number other than PORT, got %q", c.GRPCPort))
+			}
+		}
+
+		if (c.TLSCert == "") != (c.TLSKey == "") {
+			l.fail("URL_TLS_CERT and URL_TLS_KEY must be set together")
+		}
+
+		if c.TLSCert != "" && len(c.AutocertDomains) > 0 {
+			l.fail("URL_AUTOCERT_DOMAINS cannot be used with URL_TLS_CERT")
+		}
+
+		if u, err := url.Parse(c.Host); c.Host == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			l.fail(fmt.Sprintf("URL_HOST must be the absolute http or https url short urls are served from, got %q", c.Host))
+		}
+
+		if u, err := url.Parse(c.EventsURL); c.EventsURL != "" && (err != nil || (u.Scheme != "nats" && u.Scheme != "tls")) {
+			l.fail(fmt.Sprintf("URL_EVENTS_URL must be a nats:// or tls:// url, got %q", c.EventsURL))
+		}
+
+		if u, err := url.Parse(c.OTLPEndpoint); c.OTLPEndpoint != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			l.fail(fmt.Sprintf("URL_OTLP_ENDPOINT must be the http or https url of an otlp collector, got %q", c.OTLPEndpoint))
+		}
+
+		if c.TraceSampleRatio > 1 {
+			l.fail(fmt.Sprintf("URL_TRACE_SAMPLE_RATIO must be between 0 and 1, got %v", c.TraceSampleRatio))
+		}
+
+		for _, client := range [][3]string{
+			{"URL_GOOGLE", c.GoogleClientID, c.GoogleClientSecret},
+			{"URL_GITHUB", c.GitHubClientID, c.GitHubClientSecret},
+			{"URL_OIDC", c.OIDCClientID, c.OIDCClientSecret},
+		} {
+			if (client[1] == "") != (client[2] == "") {
+				l.fail(client[0] + "_CLIENT_ID and " + client[0] + "_CLIENT_SECRET must be set together")
+			}
+		}
+
+		if (c.OIDCIssuer == "") != (c.OIDCClientID == "") {
+			l.fail("URL_OIDC_ISSUER and URL_OIDC_CLIENT_ID must be set together")
+		}
+
+		if u, err := url.Parse(c.OIDCIssuer); c.OIDCIssuer != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			l.fail(fmt.Sprintf("URL_OIDC_ISSUER must be the http or https url of an openid connect provider, got %q", c.OIDCIssuer))
+		}
+
+		if !c.PasswordLogin && c.GoogleClientID == "" && c.GitHubClientID == "" && c.OIDCIssuer == "" {
+			l.fail("URL_PASSWORD_LOGIN=false requires a login provider, set URL_GOOGLE_CLIENT_ID, URL_GITHUB_CLIENT_ID or URL_OIDC_ISSUER")
+		}
+	}
+
+	switch c.Store {
+	case "mongo":
+		l.require("URL_MGO_DSN", c.MongoDSN, "mongo")
+		if _, err := readpref.ModeFromString(c.MongoReadPreference); c.MongoReadPreference != "" && err != nil {
+			l.fail(fmt.Sprintf("URL_MGO_READ_PREFERENCE must be primary, primaryPreferred, secondary, secondaryPreferred or nearest, got %q", c.MongoReadPreference))
+		}
+	case "redis":
+		l.require("URL_REDIS_DSN", c.RedisDSN, "redis")
+	case "postgres":
+		l.require("URL_PG_DSN", c.PostgresDSN, "postgres")
+	case "memory":
+	default:
+		l.fail(fmt.Sprintf("URL_STORE must be mongo, redis, postgres or memory, got %q", c.Store))
+	}
+
+	if c.SlugStrategy != "counter" && c.SlugStrategy != "random" && c.SlugStrategy != "secure" && c.SlugStrategy != "sharded" {
+		l.fail(fmt.Sprintf("URL_SLUG_STRATEGY must be counter, random, secure or sharded, got %q", c.SlugStrategy))
+	}
+
+	if c.SlugShard != "" && c.SlugStrategy != "sharded" {
+		l.fail("URL_SLUG_SHARD requires URL_SLUG_STRATEGY=sharded")
+	}
+
+	if c.SlugLength > customSlugMaxLength {
+		l.fail(fmt.Sprintf("URL_SLUG_LENGTH must be at most %d, got %d", customSlugMaxLength, c.SlugLength))
+	}
+
+	switch c.ValidateReachability {
+	case "", "false":
+		c.ValidateReachability = ""
+	case "true", "reject":
+		c.ValidateReachability = "reject"
+	case "warn":
+	default:
+		l.fail(fmt.Sprintf("URL_VALIDATE_REACHABILITY must be true, reject, warn or false, got %q", c.ValidateReachability))
+	}
+
+	if c.BackupFormat != "json" && c.BackupFormat != "csv" {
+		l.fail(fmt.Sprintf("URL_BACKUP_FORMAT must be json or csv, got %q", c.BackupFormat))
+	}
+
+	if c.ClickArchiveAge > 0 && c.ClickArchiveLocation == "" {
+		l.fail("URL_CLICK_ARCHIVE_DAYS requires URL_CLICK_ARCHIVE_LOCATION")
+	}
+
+	if c.ClickArchiveAge > 0 && c.ClickRetention > 0 {
+		l.fail("URL_CLICK_ARCHIVE_DAYS and URL_CLICK_RETENTION_DAYS cannot both be set, archived clicks are removed from the store")
+	}
+
+	for _, location := range [][2]string{{"URL_BACKUP_LOCATION", c.BackupLocation}, {"URL_CLICK_ARCHIVE_LOCATION", c.ClickArchiveLocation}} {
+		if strings.HasPrefix(location[1], "s3://") && (c.S3AccessKey == "" || c.S3SecretKey == "") {
+			l.fail(location[0] + " in s3 requires URL_S3_ACCESS_KEY and URL_S3_SECRET_KEY")
+		}
+	}
+
+	if c.NotLiveResponse != "page" && c.NotLiveResponse != "404" {
+		l.fail(fmt.Sprintf("URL_NOT_LIVE_RESPONSE must be page or 404, got %q", c.NotLiveResponse))
+	}
+
+	for _, name := range c.DisabledFeatures {
+		if !slices.Contains(features, name) {
+			l.fail(fmt.Sprintf("URL_DISABLED_FEATURES must list features among %s, got %q", strings.Join(features, ", "), name))
+		}
+	}
+
+	if !redirectCodes[c.RedirectCode] {
+		l.fail(fmt.Sprintf("URL_REDIRECT_CODE must be 301, 302, 307 or 308, got %d", c.RedirectCode))
+	}
+
+	if len(l.errs) > 0 {
+		return nil, errors.New("Invalid configuration:\n  " + strings.Join(l.errs, "\n  "))
+	}
+
+	return c, nil
+}
+
+// configLoader looks up configuration values, collecting a message for each one that is malformed
+type configLoader struct {
+	file map[string]string
+	errs []string
+}
+
+// fail records a validation error
+func (l *configLoader) fail(msg string) {
+	l.errs = append(l.errs, msg)
+}
+
+// require records an error when value, needed by store, is empty
+func (l *configLoader) require(name, value, store string) {
+	if value == "" {
+		l.fail(fmt.Sprintf("%s must be set when URL_STORE is %s", name, store))
+	}
+}
+
+// str returns the value of name from the file named by name_FILE, the environment, then the config
+// file, falling back to def
+func (l *configLoader) str(name, def string) string {
+	if value, ok := l.secretFile(name); ok {
+		return value
+	}
+
+	return l.plain(name, def)
+}
+
+// plain returns the value of name from the environment, then the config file, falling back to def.
+// Unlike str it does not read name_FILE, for the variables whose _FILE variant means something else.
+func (l *configLoader) plain(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	if value := l.file[name]; value != "" {
+		return value
+	}
+
+	return def
+}
+
+// secretFile returns the contents of the file named by name with a _FILE suffix, such as a docker or
+// kubernetes secret, without the trailing newline
+func (l *configLoader) secretFile(name string) (string, bool) {
+	file := os.Getenv(name + "_FILE")
+	if file == "" {
+		file = l.file[name+"_FILE"]
+	}
+
+	if file == "" {
+		return "", false
+	}
+
+	if os.Getenv(name) != "" {
+		l.fail(fmt.Sprintf("%s and %s_FILE cannot both be set", name, name))
+		return "", false
+	}
+
+	value, err := os.ReadFile(file)
+	if err != nil {
+		l.fail(fmt.Sprintf("%s_FILE could not be read: %v", name, err))
+		return "", false
+	}
+
+	return strings.TrimRight(string(value), "\r\n"), true
+}
+
+// integer returns name parsed as an integer of at least min
+func (l *configLoader) integer(name string, def, min int) int {
+	value := l.str(name, "")
+	if value == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min {
+		l.fail(fmt.Sprintf("%s must be a whole number of at least %d, got %q", name, min, value))
+		return def
+	}
+
+	return n
+}
+
+// seconds returns name parsed as a whole number of seconds, 0 meaning no limit
+func (l *configLoader) seconds(name string, def time.Duration) time.Duration {
+	return time.Duration(l.integer(name, int(def/time.Second), 0)) * time.Second
+}
+
+// float returns name parsed as a non negative number
+func (l *configLoader) float(name string, def float64) float64 {
+	value := l.str(name, "")
+	if value == "" {
+		return def
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		l.fail(fmt.Sprintf("%s must be a number of at least 0, got %q", name, value))
+		return def
+	}
+
+	return f
+}
+
+// boolean returns name parsed as a boolean
+func (l *configLoader) boolean(name string, def bool) bool {
+	value := l.str(name, "")
+	if value == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		l.fail(fmt.Sprintf("%s must be true or false, got %q", name, value))
+		return def
+	}
+
+	return b
+}
+
+// list returns the comma separated values held in name
+func (l *configLoader) list(name string) []string {
+	values := []string{}
+	for _, v := range strings.Split(l.str(name, ""), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
+
+// integers returns the comma separated whole numbers of at least min held in name, or in def when
+// name is unset
+func (l *configLoader) integers(name, def string, min int) []int {
+	value := l.str(name, def)
+
+	values := []int{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil || n < min {
+			l.fail(fmt.Sprintf("%s must be a list of whole numbers of at least %d, got %q", name, min, value))
+			return nil
+		}
+
+		values = append(values, n)
+	}
+
+	return values
+}
+
+// prefixes returns the comma separated ip ranges held in name, single addresses are read as ranges
+// holding only that address
+func (l *configLoader) prefixes(name string) []netip.Prefix {
+	prefixes := []netip.Prefix{}
+	for _, v := range l.list(name) {
+		if ip, err := netip.ParseAddr(v); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			l.fail(fmt.Sprintf("%s must be a list of ip addresses or cidr ranges, got %q", name, v))
+			return nil
+		}
+
+		prefixes = append(prefixes, p.Masked())
+	}
+
+	return prefixes
+}
+
+// shortDomains returns the comma separated short domains held in name
+func (l *configLoader) shortDomains(name string) []ShortDomain {
+	domains := []ShortDomain{}
+	for _, v := range l.list(name) {
+		d, err := parseShortDomain(v)
+		if err != nil {
+			l.fail(fmt.Sprintf("%s must be a list of base urls followed by their settings: %v", name, err))
+			return nil
+		}
+
+		domains = append(domains, d)
+	}
+
+	return domains
+}
+
+// domains returns the domain list held in name combined with the list file named by name_FILE, which
+// is read line by line rather than as a secret
+func (l *configLoader) domains(name string) []string {
+	domains, err := loadDomains(l.plain(name, ""), l.plain(name+"_FILE", ""))
+	if err != nil {
+		l.fail(fmt.Sprintf("%s_FILE could not be read: %v", name, err))
+	}
+
+	return domains
+}
+
+// readConfigFile parses a file of NAME=value lines, blank lines and lines starting with # are
+// skipped and values may be wrapped in double quotes
+func readConfigFile(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected NAME=value, got %q", file, n, line)
+		}
+
+		value := strings.TrimSpace(line[i+1:])
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+
+		values[strings.TrimSpace(line[:i])] = value
+	}
+
+	return values, scanner.Err()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigDomainFiles(t *testing.T) {
+	dir := t.TempDir()
+	blocked := filepath.Join(dir, "blocked.txt")
+	if err := os.WriteFile(blocked, []byte("# phishing\nevil.example\n\nbad.example # reported\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		blocked []string
+		allowed []string
+	}{
+		{"file", map[string]string{"URL_BLOCKED_DOMAINS_FILE": blocked}, []string{"evil.example", "bad.example"}, nil},
+		{"inline and file", map[string]string{"URL_BLOCKED_DOMAINS": "spam.example, junk.example", "URL_BLOCKED_DOMAINS_FILE": blocked}, []string{"spam.example", "junk.example", "evil.example", "bad.example"}, nil},
+		{"allowed file", map[string]string{"URL_ALLOWED_DOMAINS": "example.com", "URL_ALLOWED_DOMAINS_FILE": blocked}, nil, []string{"example.com", "evil.example", "bad.example"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("URL_STORE", "memory")
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			c, err := LoadConfig(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := strings.Join(c.BlockedDomains, ","), strings.Join(tt.blocked, ","); got != want {
+				t.Errorf("BlockedDomains = %s, want %s", got, want)
+			}
+			if got, want := strings.Join(c.AllowedDomains, ","), strings.Join(tt.allowed, ","); got != want {
+				t.Errorf("AllowedDomains = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigSecretFile(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "admin_token")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("URL_STORE", "memory")
+	t.Setenv("URL_ADMIN_TOKEN_FILE", secret)
+
+	c, err := LoadConfig(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AdminToken != "s3cret" {
+		t.Errorf("AdminToken = %q, want s3cret", c.AdminToken)
+	}
+
+	t.Setenv("URL_ADMIN_TOKEN", "inline")
+	if _, err := LoadConfig(false); err == nil || !strings.Contains(err.Error(), "cannot both be set") {
+		t.Errorf("LoadConfig error %v, want URL_ADMIN_TOKEN and URL_ADMIN_TOKEN_FILE cannot both be set", err)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+const maxCustomDomainsPerOwner = 5
+
+// customDomainInterval is how often pending domains are checked for their TXT record and verified
+// domains are reloaded so domains verified through other instances are served
+const customDomainInterval = time.Minute
+
+// customDomainClaimTTL is how long a domain may stay unverified before its claim is dropped, so
+// nobody can hold on to a domain they do not control
+const customDomainClaimTTL = 7 * 24 * time.Hour
+
+// customDomainLookupTimeout bounds a single TXT lookup
+const customDomainLookupTimeout = 5 * time.Second
+
+// customDomainChallenge prefixes the name of the TXT record that proves ownership of a domain
+const customDomainChallenge = "_urlshortener-challenge."
+
+// customDomainTXTPrefix prefixes the value of the TXT record, followed by the domain's token
+const customDomainTXTPrefix = "urlshortener-verification="
+
+var (
+	ErrInvalidCustomDomain      = codedError("invalid_domain", "domain", "A custom domain must be a host name such as links.example.com")
+	ErrCustomDomainTaken        = codedError("domain_taken", "domain", "That domain has already been registered")
+	ErrTooManyCustomDomains     = codedError("too_many_domains", "", "At most 5 custom domains may be registered")
+	ErrCustomDomainNotFound     = codedError("domain_not_found", "", "Unable to locate a custom domain with that name")
+	ErrCustomDomainNotVerified  = codedError("domain_not_verified", "", "The TXT record was not found, dns changes can take a while to be visible")
+	ErrUnableToSaveCustomDomain = codedError("domain_save_failed", "", "Unable to save custom domain")
+)
+
+// CustomDomain is a domain a user serves their short urls from once they have proven they control
+// it by publishing its token in a TXT record
+type CustomDomain struct {
+	Domain     string     `json:"domain" bson:"domain"`
+	Owner      string     `json:"-" bson:"owner"`
+	Token      string     `json:"-" bson:"token"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty" bson:"verified_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at" bson:"created_at"`
+}
+
+// CustomDomainRequest is the json body accepted when registering a custom domain
+type CustomDomainRequest struct {
+	Domain string `json:"domain"`
+}
+
+// CustomDomainStatus is a custom domain along with the TXT record that verifies it
+type CustomDomainStatus struct {
+	CustomDomain
+	Verified bool   `json:"verified"`
+	TXTName  string `json:"txt_name"`
+	TXTValue string `json:"txt_value"`
+}
+
+// CustomDomainStore defines the persistence operations for custom domains
+type CustomDomainStore interface {
+	// SaveCustomDomain inserts a new custom domain, returning ErrCustomDomainTaken when it has already
+	// been registered
+	SaveCustomDomain(d *CustomDomain) error
+	// FindCustomDomain returns the custom domain named domain or ErrNotFound
+	FindCustomDomain(domain string) (*CustomDomain, error)
+	// ListCustomDomains returns the custom domains of owner, or of every owner when owner is empty,
+	// oldest first
+	ListCustomDomains(owner string) ([]CustomDomain, error)
+	// VerifyCustomDomain records that domain was verified at at or returns ErrNotFound
+	VerifyCustomDomain(domain string, at time.Time) error
+	// DeleteCustomDomain removes the custom domain of owner named domain or returns ErrNotFound
+	DeleteCustomDomain(owner, domain string) error
+}
+
+// customDomainDocument is the json encoding used by stores that keep custom domains as json
+// documents, it includes the owner and token that are hidden from api responses
+type customDomainDocument struct {
+	*CustomDomain
+	Owner string `json:"owner"`
+	Token string `json:"token"`
+}
+
+// marshalCustomDomain encodes d as a stored json document
+func marshalCustomDomain(d *CustomDomain) ([]byte, error) {
+	return json.Marshal(customDomainDocument{CustomDomain: d, Owner: d.Owner, Token: d.Token})
+}
+
+// unmarshalCustomDomain decodes a stored json document into d
+func unmarshalCustomDomain(js []byte, d *CustomDomain) error {
+	doc := customDomainDocument{CustomDomain: d}
+	if err := json.Unmarshal(js, &doc); err != nil {
+		return err
+	}
+
+	d.Owner = doc.Owner
+	d.Token = doc.Token
+
+	return nil
+}
+
+// status adds the TXT record that verifies d
+func (d *CustomDomain) status() CustomDomainStatus {
+	return CustomDomainStatus{
+		CustomDomain: *d,
+		Verified:     d.VerifiedAt != nil,
+		TXTName:      customDomainChallenge + d.Domain,
+		TXTValue:     customDomainTXTPrefix + d.Token,
+	}
+}
+
+// customDomainName returns the form a custom domain is stored in, lower case ascii without a trailing
+// dot, or false when name is not a public host name
+func customDomainName(name string) (string, bool) {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	if name == "" || len(name) > 253 || net.ParseIP(name) != nil {
+		return "", false
+	}
+
+	ascii, err := idna.Lookup.ToASCII(name)
+	if err != nil || !strings.Contains(ascii, ".") || ascii == "localhost" || strings.HasSuffix(ascii, ".localhost") {
+		return "", false
+	}
+
+	return ascii, true
+}
+
+// publishedToken reports whether the TXT record of d holds its token
+func publishedToken(d *CustomDomain) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), customDomainLookupTimeout)
+	defer cancel()
+
+	records, err := net.DefaultResolver.LookupTXT(ctx, customDomainChallenge+d.Domain)
+	if err != nil {
+		return false
+	}
+
+	for _, record := range records {
+		if strings.TrimSpace(record) == customDomainTXTPrefix+d.Token {
+			return true
+		}
+	}
+
+	return false
+}
+
+// verifyCustomDomains checks the TXT records of pending domains every interval, drops claims that
+// were never verified and hands the verified domains to domains, it never returns
+func verifyCustomDomains(store CustomDomainStore, domains *ShortDomains, interval time.Duration) {
+	for ; ; time.Sleep(interval) {
+		all, err := store.ListCustomDomains("")
+		if err != nil {
+			log.Printf("Unable to load custom domains: %v", err)
+			continue
+		}
+
+		verified := []CustomDomain{}
+		for _, d := range all {
+			if d.VerifiedAt == nil {
+				if time.Since(d.CreatedAt) > customDomainClaimTTL {
+					if err := store.DeleteCustomDomain(d.Owner, d.Domain); err != nil && err != ErrNotFound {
+						log.Printf("Unable to drop unverified domain %s: %v", d.Domain, err)
+					}
+					continue
+				}
+
+				if !publishedToken(&d) {
+					continue
+				}
+
+				now := time.Now().UTC()
+				if err := store.VerifyCustomDomain(d.Domain, now); err != nil {
+					log.Printf("Unable to verify domain %s: %v", d.Domain, err)
+					continue
+				}
+				d.VerifiedAt = &now
+			}
+
+			verified = append(verified, d)
+		}
+
+		domains.SetCustom(verified)
+	}
+}
+
+// RegisterCustomDomain claims a domain for the caller's short urls, it is served once the TXT record
+// in the response has been published and the domain verified
+func (h *Handlers) RegisterCustomDomain(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	req := CustomDomainRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondBodyError(w, err, ErrInvalidCustomDomain)
+		return
+	}
+
+	name, ok := customDomainName(req.Domain)
+	if !ok {
+		h.RespondError(w, ErrInvalidCustomDomain, http.StatusBadRequest)
+		return
+	}
+
+	// the shortener's own domains cannot be claimed
+	if d := h.shortDomains.Lookup(name); d != nil && d.Owner == "" {
+		h.RespondError(w, ErrCustomDomainTaken, http.StatusConflict)
+		return
+	}
+
+	owner := requestOwner(r)
+	domains, err := h.customDomains.ListCustomDomains(owner)
+	if err != nil {
+		h.RespondError(w, ErrUnableToSaveCustomDomain, http.StatusInternalServerError)
+		return
+	}
+
+	if len(domains) >= maxCustomDomainsPerOwner {
+		h.RespondError(w, ErrTooManyCustomDomains, http.StatusConflict)
+		return
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		h.RespondError(w, ErrUnableToSaveCustomDomain, http.StatusInternalServerError)
+		return
+	}
+
+	d := CustomDomain{Domain: name, Owner: owner, Token: hex.EncodeToString(token), CreatedAt: time.Now().UTC()}
+	if err := h.customDomains.SaveCustomDomain(&d); err != nil {
+		if err == ErrCustomDomainTaken {
+			h.RespondError(w, ErrCustomDomainTaken, http.StatusConflict)
+			return
+		}
+
+		h.RespondError(w, ErrUnableToSaveCustomDomain, http.StatusInternalServerError)
+		return
+	}
+
+	h.RespondJSON(w, d.status(), http.StatusCreated)
+}
+
+// ListCustomDomains responds with the caller's custom domains
+func (h *Handlers) ListCustomDomains(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	domains, err := h.customDomains.ListCustomDomains(requestOwner(r))
+	if err != nil {
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	statuses := []CustomDomainStatus{}
+	for i := range domains {
+		statuses = append(statuses, domains[i].status())
+	}
+
+	h.RespondJSON(w, statuses, http.StatusOK)
+}
+
+// VerifyCustomDomain checks the TXT record of one of the caller's domains right away instead of
+// waiting for the next background check
+func (h *Handlers) VerifyCustomDomain(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	d, err := h.customDomains.FindCustomDomain(strings.ToLower(params["domain"]))
+	if err != nil || d.Owner != requestOwner(r) {
+		if err == nil || err == ErrNotFound {
+			h.RespondError(w, ErrCustomDomainNotFound, http.StatusNotFound)
+			return
+		}
+
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	if d.VerifiedAt == nil {
+		if !publishedToken(d) {
+			h.RespondError(w, ErrCustomDomainNotVerified, http.StatusUnprocessableEntity)
+			return
+		}
+
+		now := time.Now().UTC()
+		if err := h.customDomains.VerifyCustomDomain(d.Domain, now); err != nil {
+			h.RespondError(w, ErrUnableToSaveCustomDomain, http.StatusInternalServerError)
+			return
+		}
+		d.VerifiedAt = &now
+	}
+
+	h.shortDomains.AddCustom(*d)
+
+	h.RespondJSON(w, d.status(), http.StatusOK)
+}
+
+// DeleteCustomDomain removes one of the caller's custom domains. Its urls are kept and served on the
+// primary domain.
+func (h *Handlers) DeleteCustomDomain(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	domain := strings.ToLower(params["domain"])
+	if err := h.customDomains.DeleteCustomDomain(requestOwner(r), domain); err != nil {
+		if err == ErrNotFound {
+			h.RespondError(w, ErrCustomDomainNotFound, http.StatusNotFound)
+			return
+		}
+
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	h.shortDomains.RemoveCustom(domain)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dimfeld/httptreemux"
+)
+
+// sessionCookie holds the session token of a user logged in to the dashboard
+const sessionCookie = "session"
+
+const dashboardPerPage = 20
+
+// IndexPage is the data rendered by index.html
+type IndexPage struct {
+	Host          string
+	LoginFailed   bool
+	PasswordLogin bool
+	Providers     []*LoginProvider
+}
+
+// Dashboard is the data rendered by dashboard.html
+type Dashboard struct {
+	Host  string
+	CSRF  string
+	URLs  []URL
+	Page  int
+	Pages int
+	Error string
+}
+
+// PrevPage is the page before the current one, 0 on the first page
+func (d *Dashboard) PrevPage() int {
+	return d.Page - 1
+}
+
+// NextPage is the page after the current one, 0 on the last page
+func (d *Dashboard) NextPage() int {
+	if d.Page >= d.Pages {
+		return 0
+	}
+
+	return d.Page + 1
+}
+
+// Index displays the dashboard to users logged in with a session cookie and the application
+// instructions with a login form to everyone else. Visitors to a domain with a home are sent there.
+func (h *Handlers) Index(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	if d := h.shortDomains.ForRequest(r); d != nil && d.Home != "" {
+		http.Redirect(w, r, d.Home, http.StatusFound)
+		return
+	}
+
+	if id, session := h.sessionUser(r); id != "" {
+		h.renderDashboard(w, r, id, session, "", http.StatusOK)
+		return
+	}
+
+	h.renderIndex(w, false, http.StatusOK)
+}
+
+// renderIndex writes the instructions page, with a notice when a dashboard login failed
+func (h *Handlers) renderIndex(w http.ResponseWriter, loginFailed bool, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	templates.ExecuteTemplate(w, "index.html", &IndexPage{
+		Host:          h.Host,
+		LoginFailed:   loginFailed,
+		PasswordLogin: h.passwordLogin,
+		Providers:     h.providers,
+	})
+}
+
+// renderDashboard writes the page of owner's urls selected by the page query parameter, message is
+// shown above the list when an action failed
+func (h *Handlers) renderDashboard(w http.ResponseWriter, r *http.Request, owner, session, message string, status int) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	urls, total, err := h.store.List(r.Context(), ListQuery{
+		Owner: owner,
+		Sort:  "-created_at",
+		Skip:  (page - 1) * dashboardPerPage,
+		Limit: dashboardPerPage,
+	})
+	if err != nil {
+		h.RespondErrorPage(w, r, ErrUnableToListURLs, http.StatusInternalServerError)
+		return
+	}
+
+	pages := (total + dashboardPerPage - 1) / dashboardPerPage
+	if pages == 0 {
+		pages = 1
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	templates.ExecuteTemplate(w, "dashboard.html", &Dashboard{
+		Host:  h.Host,
+		CSRF:  csrfToken(session),
+		URLs:  urls,
+		Page:  page,
+		Pages: pages,
+		Error: message,
+	})
+}
+
+// sessionUser returns the user logged in with the session cookie and the session token, both are
+// empty when there is no valid session
+func (h *Handlers) sessionUser(r *http.Request) (string, string) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", ""
+	}
+
+	claims, err := h.tokens.Verify(c.Value, time.Now())
+	if err != nil {
+		return "", ""
+	}
+
+	return claims.Subject, c.Value
+}
+
+// csrfToken derives the token dashboard forms have to echo back from the session token. Pages on
+// other sites cannot read the cookie, so they cannot forge a form that acts on the user's behalf.
+func csrfToken(session string) string {
+	sum := sha256.Sum256([]byte("csrf:" + session))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// RequireSession sends dashboard form posts without a valid session cookie and csrf token back to
+// the index, authenticated requests act as the logged in user
+func (h *Handlers) RequireSession(next httptreemux.HandlerFunc) httptreemux.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		id, session := h.sessionUser(r)
+		if id == "" || subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf")), []byte(csrfToken(session))) != 1 {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), userContextKey, id)), params)
+	}
+}
+
+// DashboardLogin checks the login form and starts a session
+func (h *Handlers) DashboardLogin(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	u, err := h.authenticate(Credentials{Email: r.PostFormValue("email"), Password: r.PostFormValue("password")})
+	if err != nil {
+		if err == ErrLoginFailed {
+			h.renderIndex(w, true, http.StatusUnauthorized)
+			return
+		}
+
+		h.RespondErrorPage(w, r, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	token, expires, err := h.tokens.Issue(u.ID, time.Now())
+	if err != nil {
+		h.RespondErrorPage(w, r, ErrUnableToCreateToken, http.StatusInternalServerError)
+		return
+	}
+
+	h.setSession(w, token, expires)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// DashboardLogout ends the session
+func (h *Handlers) DashboardLogout(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	h.setSession(w, "", time.Unix(0, 0))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// setSession stores token in the session cookie until expires, an expiry in the past removes it
+func (h *Handlers) setSession(w http.ResponseWriter, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(h.Host, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// DashboardCreateURL shortens the url submitted with the dashboard's form
+func (h *Handlers) DashboardCreateURL(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	req := ShortenRequest{
+		URL:  strings.TrimSpace(r.PostFormValue("url")),
+		Slug: strings.TrimSpace(r.PostFormValue("slug")),
+	}
+
+	if _, _, err := h.createURL(r.Context(), w.Header(), requestOwner(r), req); err != nil {
+		h.respondDashboardError(w, r, err, shortenStatus(err))
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// DashboardUpdateURL changes the destination of one of the user's urls from the dashboard
+func (h *Handlers) DashboardUpdateURL(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	slug := h.canonicalSlug(params["slug"])
+	logSlug(r, slug)
+
+	if _, err := h.updateURL(w, r, slug, UpdateRequest{URL: strings.TrimSpace(r.PostFormValue("url"))}); err != nil {
+		h.respondDashboardError(w, r, err, updateStatus(err))
+		return
+	}
+
+	http.Redirect(w, r, dashboardReturn(r), http.StatusSeeOther)
+}
+
+// DashboardDeleteURL deletes one of the user's urls from the dashboard, it can be restored through the
+// api until it is purged
+func (h *Handlers) DashboardDeleteURL(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	slug := h.canonicalSlug(params["slug"])
+	logSlug(r, slug)
+
+	if err := h.deleteURL(r.Context(), requestOwner(r), slug, true); err != nil {
+		if err == ErrNotFound {
+			h.respondDashboardError(w, r, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		h.respondDashboardError(w, r, ErrUnableToDeleteURL, http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, dashboardReturn(r), http.StatusSeeOther)
+}
+
+// respondDashboardError renders the dashboard again with err shown above the list
+func (h *Handlers) respondDashboardError(w http.ResponseWriter, r *http.Request, err error, status int) {
+	id, session := h.sessionUser(r)
+
+	h.renderDashboard(w, r, id, session, err.Error(), status)
+}
+
+// dashboardReturn is the dashboard page a form was submitted from
+func dashboardReturn(r *http.Request) string {
+	if page, err := strconv.Atoi(r.PostFormValue("page")); err == nil && page > 1 {
+		return "/?page=" + strconv.Itoa(page)
+	}
+
+	return "/"
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const deadLinkBatchSize = 100
+
+// defaultDeadLinkFailures is how many checks in a row a destination has to be missing on before the
+// url is marked dead
+const defaultDeadLinkFailures = 3
+
+// deadLinkWorkers is how many destinations are probed at the same time
+const deadLinkWorkers = 8
+
+// Link statuses reported by the stats endpoint
+const (
+	linkStatusUnknown = "unknown"
+	linkStatusAlive   = "alive"
+	linkStatusFailing = "failing"
+	linkStatusDead    = "dead"
+)
+
+// linkCheck is the outcome of probing a destination
+type linkCheck int
+
+const (
+	// linkInconclusive covers timeouts and server errors, which say nothing about whether the page
+	// still exists
+	linkInconclusive linkCheck = iota
+	linkAlive
+	linkMissing
+)
+
+// checkLink probes target, only a 404, a 410 or a domain that no longer resolves count as missing
+func checkLink(client *http.Client, target string) linkCheck {
+	status, err := probe(client, target)
+
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return linkMissing
+	case err != nil:
+		return linkInconclusive
+	case status == http.StatusNotFound || status == http.StatusGone:
+		return linkMissing
+	case status < 400:
+		return linkAlive
+	}
+
+	return linkInconclusive
+}
+
+// checkDeadLinks probes every stored destination every interval, it never returns
+func checkDeadLinks(store Store, failures int, interval time.Duration) {
+	client := egress.Client(reachabilityTimeout)
+
+	for range time.Tick(interval) {
+		n, err := recheckLinks(store, client, failures)
+		if err != nil {
+			log.Printf("Unable to check for dead links: %v", err)
+		}
+
+		if n > 0 {
+			log.Printf("Marked %d urls as dead", n)
+		}
+	}
+}
+
+// recheckLinks probes the destination of every enabled url. A url is marked dead once its destination
+// has been missing on failures checks in a row and is revived as soon as it responds again. It returns
+// the number of urls newly marked dead.
+func recheckLinks(store Store, client *http.Client, failures int) (int, error) {
+	dead := 0
+
+	for skip := 0; ; skip += deadLinkBatchSize {
+		urls, _, err := store.List(context.Background(), ListQuery{
+			AllOwners: true,
+			Sort:      "created_at",
+			Skip:      skip,
+			Limit:     deadLinkBatchSize,
+		})
+		if err != nil {
+			return dead, err
+		}
+
+		checks := make([]linkCheck, len(urls))
+		workers := make(chan struct{}, deadLinkWorkers)
+		wg := sync.WaitGroup{}
+		for i := range urls {
+			if urls[i].Disabled {
+				continue
+			}
+
+			wg.Add(1)
+			workers <- struct{}{}
+			go func(i int) {
+				defer wg.Done()
+				checks[i] = checkLink(client, urls[i].OriginalURL)
+				<-workers
+			}(i)
+		}
+		wg.Wait()
+
+		now := time.Now().UTC()
+		for i := range urls {
+			u := &urls[i]
+			if u.Disabled || checks[i] == linkInconclusive {
+				continue
+			}
+
+			wasDead := u.DeadAt != nil
+			u.LinkCheckedAt = &now
+			if checks[i] == linkAlive {
+				u.LinkFailures = 0
+				u.DeadAt = nil
+			} else {
+				u.LinkFailures++
+				if u.LinkFailures >= failures && !wasDead {
+					u.DeadAt = &now
+					dead++
+				}
+			}
+
+			if err := store.Update(context.Background(), u); err != nil && err != ErrNotFound {
+				return dead, err
+			}
+		}
+
+		if len(urls) < deadLinkBatchSize {
+			return dead, nil
+		}
+	}
+}
+
+// linkStatus summarises the result of the dead link checks for u
+func linkStatus(u *URL) string {
+	switch {
+	case u.DeadAt != nil:
+		return linkStatusDead
+	case u.LinkFailures > 0:
+		return linkStatusFailing
+	case u.LinkCheckedAt != nil:
+		return linkStatusAlive
+	}
+
+	return linkStatusUnknown
+}
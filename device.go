@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Devices a url can send to their own destination
+const (
+	deviceIOS     = "ios"
+	deviceAndroid = "android"
+	deviceDesktop = "desktop"
+)
+
+// requestDevice classifies the client from its User-Agent. iPads running iPadOS 13 or later announce
+// themselves as macs and are treated as desktops, as are clients that match neither mobile platform.
+func requestDevice(r *http.Request) string {
+	ua := r.UserAgent()
+
+	switch {
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"), strings.Contains(ua, "iPod"):
+		return deviceIOS
+	case strings.Contains(ua, "Android"):
+		return deviceAndroid
+	}
+
+	return deviceDesktop
+}
+
+// validDeviceTargets checks that targets maps known devices to urls that may be shortened and
+// returns it with the devices lower cased
+func (h *Handlers) validDeviceTargets(targets map[string]string) (map[string]string, error) {
+	if len(targets) == 0 {
+		return nil, nil
+	}
+
+	valid := make(map[string]string, len(targets))
+	for device, target := range targets {
+		device = strings.ToLower(device)
+		if device != deviceIOS && device != deviceAndroid && device != deviceDesktop {
+			return nil, ErrInvalidDeviceTargets
+		}
+
+		target, err := h.NormalizeURL(target)
+		if err != nil {
+			return nil, err
+		}
+
+		valid[device] = target
+	}
+
+	return valid, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const bannedDomainsInterval = time.Minute
+
+// DomainBanStore persists the destination domains banned by moderators
+type DomainBanStore interface {
+	// BanDomain records domain as banned
+	BanDomain(domain string, at time.Time) error
+	// UnbanDomain lifts the ban on domain or returns ErrNotFound
+	UnbanDomain(domain string) error
+	// BannedDomains returns every banned domain
+	BannedDomains() ([]string, error)
+}
+
+// DomainPolicy decides which destination domains may be shortened. A domain also matches all of its
+// subdomains.
+type DomainPolicy struct {
+	// self are the hosts the shortener serves short urls from
+	self    []string
+	blocked []string
+	// allowed restricts destinations to these domains when it is not empty
+	allowed []string
+
+	mu sync.RWMutex
+	// banned are the domains banned at runtime by moderators
+	banned []string
+}
+
+// NewDomainPolicy builds a policy from domain lists, self are the shortener's own hosts and are
+// always blocked so short urls cannot point back at the shortener and loop
+func NewDomainPolicy(self, blocked, allowed []string) *DomainPolicy {
+	p := &DomainPolicy{}
+
+	for _, host := range self {
+		if host != "" {
+			p.self = append(p.self, canonicalHost(host))
+			p.blocked = append(p.blocked, canonicalHost(host))
+		}
+	}
+
+	for _, d := range blocked {
+		p.blocked = append(p.blocked, normalizeDomain(d))
+	}
+
+	for _, d := range allowed {
+		p.allowed = append(p.allowed, normalizeDomain(d))
+	}
+
+	return p
+}
+
+// Allowed reports whether urls pointing at host may be shortened
+func (p *DomainPolicy) Allowed(host string) bool {
+	host = normalizeDomain(host)
+
+	for _, d := range p.blocked {
+		if matchesDomain(host, d) {
+			return false
+		}
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, d := range p.banned {
+		if matchesDomain(host, d) {
+			return false
+		}
+	}
+
+	if len(p.allowed) == 0 {
+		return true
+	}
+
+	for _, d := range p.allowed {
+		if matchesDomain(host, d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsSelf reports whether host is one of the shortener's own hosts or one of their subdomains
+func (p *DomainPolicy) IsSelf(host string) bool {
+	host = normalizeDomain(host)
+	for _, self := range p.self {
+		if matchesDomain(host, self) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetBanned replaces the domains banned by moderators
+func (p *DomainPolicy) SetBanned(domains []string) {
+	banned := make([]string, len(domains))
+	for i, d := range domains {
+		banned[i] = normalizeDomain(d)
+	}
+
+	p.mu.Lock()
+	p.banned = banned
+	p.mu.Unlock()
+}
+
+// refreshBannedDomains reloads the banned domains from store every interval so bans made through
+// other instances take effect, it never returns
+func refreshBannedDomains(store DomainBanStore, p *DomainPolicy, interval time.Duration) {
+	for range time.Tick(interval) {
+		domains, err := store.BannedDomains()
+		if err != nil {
+			log.Printf("Unable to load banned domains: %v", err)
+			continue
+		}
+
+		p.SetBanned(domains)
+	}
+}
+
+// matchesDomain reports whether host is domain or one of its subdomains
+func matchesDomain(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// normalizeDomain returns the form domains are compared and stored in
+func normalizeDomain(domain string) string {
+	return canonicalHost(strings.TrimSpace(domain))
+}
+
+// loadDomains reads a domain list from the comma separated list and the optional file, which holds
+// one domain per line with # comments
+func loadDomains(list, file string) ([]string, error) {
+	domains := []string{}
+
+	for _, d := range strings.Split(list, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+
+	if file == "" {
+		return domains, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		if line = strings.TrimSpace(line); line != "" {
+			domains = append(domains, line)
+		}
+	}
+
+	return domains, scanner.Err()
+}
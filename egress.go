@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// maxEgressRedirects bounds the redirects followed by requests to user supplied urls
+const maxEgressRedirects = 5
+
+// maxEgressBodyBytes bounds how much of a response to a user supplied url is ever read
+const maxEgressBodyBytes = 1 << 20
+
+// ErrEgressBlocked is returned when a request to a user supplied url would connect to an internal
+// address
+var ErrEgressBlocked = codedError("egress_blocked", "url", "Requests to private, loopback, link-local or metadata service addresses are not allowed")
+
+// ErrTooManyRedirects is returned when a user supplied url redirects more than maxEgressRedirects times
+var ErrTooManyRedirects = fmt.Errorf("Stopped after %d redirects", maxEgressRedirects)
+
+// blockedPrefixes are the address ranges requests to user supplied urls may not connect to: this
+// network, private networks, carrier grade nat (which holds some cloud metadata services), loopback,
+// link-local (which holds the usual metadata service at 169.254.169.254), benchmarking, multicast,
+// reserved and their ipv6 equivalents including nat64
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// egress guards every request made to a url supplied by a user
+var egress = &EgressGuard{}
+
+// EgressGuard keeps requests to user supplied urls (destination probes, previews, webhooks) from
+// reaching internal services. Addresses are checked when connecting, after dns resolution, so names
+// resolving or rebinding to internal addresses are caught as well.
+type EgressGuard struct {
+	// allowed ranges are reachable even though they are blocked, for example webhook receivers on a
+	// private network
+	allowed []netip.Prefix
+}
+
+// Blocked reports whether connections to ip are refused
+func (g *EgressGuard) Blocked(ip netip.Addr) bool {
+	ip = ip.Unmap()
+
+	for _, p := range g.allowed {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+
+	for _, p := range blockedPrefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// control refuses connections to blocked addresses, it is called by the dialer for every address a
+// name resolves to
+func (g *EgressGuard) control(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip, err := netip.ParseAddr(host)
+	if err != nil || g.Blocked(ip) {
+		return ErrEgressBlocked
+	}
+
+	return nil
+}
+
+// Client returns a client for user supplied urls. It connects directly, ignoring proxy settings,
+// follows at most maxEgressRedirects redirects and reads at most maxEgressBodyBytes of a response.
+func (g *EgressGuard) Client(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: g.control}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &limitedTransport{RoundTripper: transport, limit: maxEgressBodyBytes},
+		CheckRedirect: func(_ *http.Request, via []*http.Request) error {
+			if len(via) > maxEgressRedirects {
+				return ErrTooManyRedirects
+			}
+
+			return nil
+		},
+	}
+}
+
+// limitedTransport truncates response bodies after limit bytes
+type limitedTransport struct {
+	http.RoundTripper
+	limit int64
+}
+
+// RoundTrip sends req and limits the body of its response
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = &limitedBody{Reader: io.LimitReader(resp.Body, t.limit), Closer: resp.Body}
+
+	return resp, nil
+}
+
+// limitedBody reads a response body up to a limit and closes the whole body
+type limitedBody struct {
+	io.Reader
+	io.Closer
+}
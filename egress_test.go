@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestEgressGuardBlocked(t *testing.T) {
+	tests := []struct {
+		ip      string
+		allowed []string
+		want    bool
+	}{
+		{"8.8.8.8", nil, false},
+		{"2606:4700:4700::1111", nil, false},
+		{"0.0.0.0", nil, true},
+		{"10.1.2.3", nil, true},
+		{"100.100.100.200", nil, true},
+		{"127.0.0.1", nil, true},
+		{"169.254.169.254", nil, true},
+		{"172.16.0.1", nil, true},
+		{"172.32.0.1", nil, false},
+		{"192.168.1.1", nil, true},
+		{"224.0.0.1", nil, true},
+		{"255.255.255.255", nil, true},
+		{"::", nil, true},
+		{"::1", nil, true},
+		{"::ffff:127.0.0.1", nil, true},
+		{"::ffff:169.254.169.254", nil, true},
+		{"64:ff9b::a9fe:a9fe", nil, true},
+		{"fd00::1", nil, true},
+		{"fe80::1", nil, true},
+		{"ff02::1", nil, true},
+		{"10.1.2.3", []string{"10.1.0.0/16"}, false},
+		{"10.2.0.1", []string{"10.1.0.0/16"}, true},
+		{"::ffff:10.1.2.3", []string{"10.1.0.0/16"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			g := &EgressGuard{}
+			for _, prefix := range tt.allowed {
+				g.allowed = append(g.allowed, netip.MustParsePrefix(prefix))
+			}
+
+			if got := g.Blocked(netip.MustParseAddr(tt.ip)); got != tt.want {
+				t.Errorf("Blocked(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEgressGuardClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/loop" {
+			http.Redirect(w, r, "/loop", http.StatusFound)
+			return
+		}
+
+		w.Write(make([]byte, maxEgressBodyBytes+1))
+	}))
+	defer server.Close()
+
+	loopback := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+
+	tests := []struct {
+		name    string
+		allowed []netip.Prefix
+		path    string
+		want    error
+	}{
+		{"loopback server", nil, "/", ErrEgressBlocked},
+		{"allowed range", loopback, "/", nil},
+		{"redirect loop", loopback, "/loop", ErrTooManyRedirects},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := (&EgressGuard{allowed: tt.allowed}).Client(time.Second)
+
+			resp, err := client.Get(server.URL + tt.path)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Get error %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(body) != maxEgressBodyBytes {
+				t.Errorf("read %d bytes, want %d", len(body), maxEgressBodyBytes)
+			}
+		})
+	}
+}
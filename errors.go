@@ -0,0 +1,54 @@
+package main
+
+import "net/http"
+
+// CodedError is an error the api reports with a machine readable code, and the request field it
+// concerns when it is about a single one, so clients need not match on messages
+type CodedError struct {
+	Code    string
+	Field   string
+	Message string
+}
+
+// Error returns the message of the error
+func (e *CodedError) Error() string {
+	return e.Message
+}
+
+// codedError returns an error reported with code, field is empty unless the error concerns a single
+// request field
+func codedError(code, field, message string) error {
+	return &CodedError{Code: code, Field: field, Message: message}
+}
+
+// statusCodes are the codes reported for errors that carry none, by the status they are sent with
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusGone:                  "gone",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUnprocessableEntity:   "unprocessable",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// errorCode returns the code and field reported for err sent with status
+func errorCode(err error, status int) (string, string) {
+	if e, ok := err.(*CodedError); ok {
+		return e.Code, e.Field
+	}
+
+	if code, ok := statusCodes[status]; ok {
+		return code, ""
+	}
+
+	if status >= http.StatusInternalServerError {
+		return "internal_error", ""
+	}
+
+	return "invalid_request", ""
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/dimfeld/httptreemux"
+)
+
+// etagWriter holds back a response so it can be tagged, or replaced by 304 Not Modified, once it is
+// complete
+type etagWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader records the status, it is sent once the body is known
+func (w *etagWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// Write buffers the body
+func (w *etagWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.body.Write(b)
+}
+
+// etagMatches reports whether an If-None-Match header lists tag, compared weakly as RFC 9110 asks
+func etagMatches(header, tag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ETag tags successful responses of next with a hash of their body and answers requests whose
+// If-None-Match lists it with 304 Not Modified, so clients polling a resource only download it when
+// it changes. Responses must be small enough to hold in memory.
+func (h *Handlers) ETag(next httptreemux.HandlerFunc) httptreemux.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		ew := &etagWriter{ResponseWriter: w}
+		next(ew, r, params)
+
+		if ew.status == 0 {
+			return
+		}
+
+		if ew.status == http.StatusOK {
+			sum := sha256.Sum256(ew.body.Bytes())
+			tag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+			w.Header().Set("ETag", tag)
+			if w.Header().Get("Cache-Control") == "" {
+				// responses depend on the caller, they may be kept but must be revalidated
+				w.Header().Set("Cache-Control", "private, no-cache")
+			}
+
+			if etagMatches(r.Header.Get("If-None-Match"), tag) {
+				w.Header().Del("Content-Type")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		w.WriteHeader(ew.status)
+		w.Write(ew.body.Bytes())
+	}
+}
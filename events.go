@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// defaultEventsSubject prefixes the subject click events are published on, each click is published
+// on <subject>.<slug>
+const defaultEventsSubject = "urlshortener.clicks"
+
+// natsFlushTimeout bounds how long buffered events are given to reach the server on shutdown
+const natsFlushTimeout = 5 * time.Second
+
+// ClickEvent is published for every redirect so analytics pipelines can follow clicks as they happen
+type ClickEvent struct {
+	Slug        string    `json:"slug"`
+	Owner       string    `json:"owner,omitempty"`
+	Destination string    `json:"destination"`
+	Variant     string    `json:"variant,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+	Referrer    string    `json:"referrer,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	Country     string    `json:"country,omitempty"`
+	UTMSource   string    `json:"utm_source,omitempty"`
+	UTMMedium   string    `json:"utm_medium,omitempty"`
+	UTMCampaign string    `json:"utm_campaign,omitempty"`
+}
+
+// EventPublisher delivers click events to a message bus. Implementations must be safe for
+// concurrent use, Publish is called off the request path.
+type EventPublisher interface {
+	// Publish sends e, it may buffer it and return before it is delivered
+	Publish(e *ClickEvent) error
+	// Close delivers buffered events and disconnects
+	Close()
+}
+
+// newEventPublisher connects to the message bus named by the scheme of dsn
+func newEventPublisher(dsn, subject string) (EventPublisher, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "nats", "tls":
+		return NewNATSPublisher(dsn, subject)
+	}
+
+	return nil, fmt.Errorf("Unsupported event bus %q", u.Scheme)
+}
+
+// NATSPublisher publishes click events to a nats server. The client buffers events and reconnects on
+// its own while the server is unreachable.
+type NATSPublisher struct {
+	conn    *nats.Conn
+	subject string
+}
+
+// NewNATSPublisher connects to the nats servers in dsn, a comma separated list of nats:// or tls://
+// urls
+func NewNATSPublisher(dsn, subject string) (*NATSPublisher, error) {
+	conn, err := nats.Connect(dsn,
+		nats.Name("fcc-url-shortener"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				log.Printf("Disconnected from nats: %v", err)
+			}
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			log.Printf("Reconnected to nats at %s", c.ConnectedUrlRedacted())
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NATSPublisher{conn: conn, subject: subject}, nil
+}
+
+// Publish sends e on the subject of its slug
+func (p *NATSPublisher) Publish(e *ClickEvent) error {
+	js, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return p.conn.Publish(p.subject+"."+e.Slug, js)
+}
+
+// Close flushes buffered events and disconnects
+func (p *NATSPublisher) Close() {
+	if err := p.conn.FlushTimeout(natsFlushTimeout); err != nil {
+		log.Printf("Unable to flush click events: %v", err)
+	}
+
+	p.conn.Close()
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const purgeInterval = time.Minute
+
+// Purger is implemented by stores that cannot expire urls on their own and need expired urls
+// removed periodically
+type Purger interface {
+	// PurgeExpired removes every url that expired at or before now, returning the number removed
+	PurgeExpired(now time.Time) (int, error)
+}
+
+// purgeExpired removes expired urls from p every interval, it never returns
+func purgeExpired(p Purger, interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := p.PurgeExpired(time.Now())
+		if err != nil {
+			log.Printf("Unable to purge expired urls: %v", err)
+			continue
+		}
+
+		if n > 0 {
+			log.Printf("Purged %d expired urls", n)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxImportRows bounds the number of links a single import may contain
+const maxImportRows = 10000
+
+// maxImportBytes bounds the size of an import body
+const maxImportBytes = 10 << 20
+
+// ErrInvalidImport is returned for import bodies that cannot be read as a list of links
+var ErrInvalidImport = codedError("invalid_import", "", "An import must be a csv file with a url column or a json array of at most 10000 links")
+
+// exportColumns are the columns of a csv export, in order
+var exportColumns = []string{"slug", "original_url", "short_url", "title", "clicks", "created_at", "expires_at"}
+
+// ExportedURL is a url as it is written by an export
+type ExportedURL struct {
+	Slug        string     `json:"slug"`
+	OriginalURL string     `json:"original_url"`
+	ShortURL    string     `json:"short_url"`
+	Title       string     `json:"title,omitempty"`
+	Clicks      int        `json:"clicks"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+// ImportResult is the outcome of importing the link on row Row, counting from 1 and not counting
+// the csv header
+type ImportResult struct {
+	Row int `json:"row"`
+	BatchResult
+}
+
+// ExportURLs streams every url created by the caller as csv, or as a json array with format=json
+func (h *Handlers) ExportURLs(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "csv" && format != "json" {
+		h.RespondError(w, ErrInvalidRequest, http.StatusBadRequest)
+		return
+	}
+
+	owner := requestOwner(r)
+	urls, _, err := h.store.List(r.Context(), ListQuery{Owner: owner, Sort: "created_at", Limit: maxPerPage})
+	if err != nil {
+		h.RespondError(w, ErrUnableToListURLs, http.StatusInternalServerError)
+		return
+	}
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="urls.json"`)
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="urls.csv"`)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	out := newExportWriter(w, format, exportColumns)
+	for skip := 0; ; skip += maxPerPage {
+		for i := range urls {
+			u := exportedURL(&urls[i])
+			if err := out.write(u.record(), u); err != nil {
+				return
+			}
+		}
+
+		if len(urls) < maxPerPage {
+			break
+		}
+
+		urls, _, err = h.store.List(r.Context(), ListQuery{Owner: owner, Sort: "created_at", Skip: skip + maxPerPage, Limit: maxPerPage})
+		if err != nil {
+			// the status has been sent, the export is left truncated
+			log.Printf("Unable to export urls for %s: %v", owner, err)
+			return
+		}
+	}
+
+	out.close()
+}
+
+// ImportURLs shortens the links in a csv file or json array, responding with a result for every
+// row. Links exported from this or another shortener keep their slugs where the file has them.
+func (h *Handlers) ImportURLs(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	var records []map[string]string
+	var err error
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "text/csv" {
+		records, err = readCSVRecords(r.Body)
+	} else {
+		records, err = readJSONRecords(r.Body)
+	}
+
+	if err != nil || len(records) == 0 || len(records) > maxImportRows {
+		h.respondBodyError(w, err, ErrInvalidImport)
+		return
+	}
+
+	owner := requestOwner(r)
+	results := make([]ImportResult, len(records))
+	reqs := []ShortenRequest{}
+	rows := []int{}
+	for i, record := range records {
+		results[i].Row = i + 1
+
+		req, err := importRequest(record)
+		if err != nil {
+			results[i].BatchResult = failedResult(err, http.StatusBadRequest)
+			continue
+		}
+		req.Domain = h.requestDomain(r, "")
+
+		reqs = append(reqs, req)
+		rows = append(rows, i)
+	}
+
+	q, ok := h.reserveEntries(w, r, len(reqs))
+	if !ok {
+		return
+	}
+
+	created := 0
+	for start := 0; start < len(reqs); start += maxBatchSize {
+		end := start + maxBatchSize
+		if end > len(reqs) {
+			end = len(reqs)
+		}
+
+		batch := h.shortenMany(r.Context(), owner, reqs[start:end])
+		for j, result := range batch {
+			results[rows[start+j]].BatchResult = result
+		}
+		created += shortened(batch)
+	}
+	h.useEntries(w, q, created)
+
+	h.RespondJSON(w, results, http.StatusOK)
+}
+
+// exportedURL converts a stored url for an export
+func exportedURL(u *URL) ExportedURL {
+	return ExportedURL{
+		Slug:        u.Slug,
+		OriginalURL: u.OriginalURL,
+		ShortURL:    u.ShortURL,
+		Title:       u.Title,
+		Clicks:      u.Clicks,
+		CreatedAt:   u.CreatedAt,
+		ExpiresAt:   u.ExpiresAt,
+	}
+}
+
+// record returns u as a csv row in the order of exportColumns
+func (u ExportedURL) record() []string {
+	expiresAt := ""
+	if u.ExpiresAt != nil {
+		expiresAt = u.ExpiresAt.Format(time.RFC3339)
+	}
+
+	return []string{u.Slug, u.OriginalURL, u.ShortURL, u.Title, strconv.Itoa(u.Clicks), u.CreatedAt.Format(time.RFC3339), expiresAt}
+}
+
+// exportWriter writes exported rows as csv rows or json array elements
+type exportWriter struct {
+	w       io.Writer
+	csv     *csv.Writer
+	written int
+}
+
+// newExportWriter starts an export in format, csv with a header of columns unless it is json
+func newExportWriter(w io.Writer, format string, columns []string) *exportWriter {
+	if format == "json" {
+		return &exportWriter{w: w}
+	}
+
+	out := &exportWriter{w: w, csv: csv.NewWriter(w)}
+	out.csv.Write(columns)
+
+	return out
+}
+
+// write appends a row to the export, as record in a csv export and as v encoded in a json one
+func (e *exportWriter) write(record []string, v interface{}) error {
+	defer func() { e.written++ }()
+
+	if e.csv != nil {
+		e.csv.Write(record)
+		e.csv.Flush()
+
+		return e.csv.Error()
+	}
+
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	separator := ",\n"
+	if e.written == 0 {
+		separator = "[\n"
+	}
+
+	_, err = io.WriteString(e.w, separator+string(js))
+	return err
+}
+
+// close finishes the export
+func (e *exportWriter) close() {
+	if e.csv != nil {
+		e.csv.Flush()
+		return
+	}
+
+	if e.written == 0 {
+		io.WriteString(e.w, "[")
+	}
+	io.WriteString(e.w, "\n]\n")
+}
+
+// readCSVRecords reads a csv file with a header row into records keyed by the lower cased column names
+func readCSVRecords(r io.Reader) ([]map[string]string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+	}
+
+	records := []map[string]string{}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(records) == maxImportRows {
+			return nil, ErrInvalidImport
+		}
+
+		record := map[string]string{}
+		for i, value := range row {
+			if i < len(header) {
+				record[header[i]] = strings.TrimSpace(value)
+			}
+		}
+		records = append(records, record)
+	}
+}
+
+// readJSONRecords reads a json array of objects into records of their string fields
+func readJSONRecords(r io.Reader) ([]map[string]string, error) {
+	objects := []map[string]interface{}{}
+	if err := json.NewDecoder(r).Decode(&objects); err != nil {
+		return nil, err
+	}
+
+	records := make([]map[string]string, len(objects))
+	for i, object := range objects {
+		records[i] = map[string]string{}
+		for k, v := range object {
+			if s, ok := v.(string); ok {
+				records[i][strings.ToLower(k)] = strings.TrimSpace(s)
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// importRequest builds the shorten request for an imported link. It understands the columns of this
+// shortener's exports as well as Bitly's (long_url, link) and YOURLS's (url, keyword); without a
+// slug column the slug is taken from the link's short url.
+func importRequest(record map[string]string) (ShortenRequest, error) {
+	req := ShortenRequest{
+		URL:  firstValue(record, "original_url", "url", "long_url"),
+		Slug: firstValue(record, "slug", "keyword"),
+	}
+
+	if req.Slug == "" {
+		if short := firstValue(record, "short_url", "link", "bitlink"); short != "" {
+			if !strings.Contains(short, "://") {
+				short = "https://" + short
+			}
+
+			if u, err := url.Parse(short); err == nil && strings.Trim(u.Path, "/") != "" {
+				req.Slug = path.Base(u.Path)
+			}
+		}
+	}
+
+	if expiresAt := record["expires_at"]; expiresAt != "" {
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return req, ErrInvalidExpiry
+		}
+
+		req.ExpiresAt = &t
+	}
+
+	return req, nil
+}
+
+// firstValue returns the first of keys that has a value in record
+func firstValue(record map[string]string, keys ...string) string {
+	for _, k := range keys {
+		if v := record[k]; v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dimfeld/httptreemux"
+)
+
+// The optional subsystems that can be switched on and off without a redeploy
+const (
+	featureAnalytics    = "analytics"
+	featureSafeBrowsing = "safe_browsing"
+	featurePreviews     = "previews"
+	featureQRCodes      = "qr_codes"
+)
+
+// features lists every feature flag, all of them are enabled unless configured otherwise
+var features = []string{featureAnalytics, featureSafeBrowsing, featurePreviews, featureQRCodes}
+
+// featureReloadInterval is how often the feature flags file is checked for changes
+const featureReloadInterval = 30 * time.Second
+
+// ErrFeatureDisabled is returned for requests to a subsystem whose feature flag is off
+var ErrFeatureDisabled = codedError("feature_disabled", "", "This feature is not enabled on this server")
+
+// FeatureFlags reports which optional subsystems are enabled. Flags default to on, URL_DISABLED_FEATURES
+// turns some off at startup and the name=on|off lines of the URL_FEATURE_FLAGS file override both. The
+// file is reloaded when it changes or on SIGHUP, so a flag can be flipped on a running server.
+type FeatureFlags struct {
+	path     string
+	defaults map[string]bool
+
+	mu       sync.RWMutex
+	enabled  map[string]bool
+	modified time.Time
+}
+
+// NewFeatureFlags returns the flags with every feature in disabled turned off, overridden by the flags
+// file at path when there is one
+func NewFeatureFlags(disabled []string, path string) (*FeatureFlags, error) {
+	f := &FeatureFlags{path: path, defaults: map[string]bool{}}
+	for _, name := range features {
+		f.defaults[name] = true
+	}
+	for _, name := range disabled {
+		f.defaults[name] = false
+	}
+
+	f.enabled = f.defaults
+	if path == "" {
+		return f, nil
+	}
+
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Enabled reports whether the feature name is on, every feature is on when there are no flags
+func (f *FeatureFlags) Enabled(name string) bool {
+	if f == nil {
+		return true
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.enabled[name]
+}
+
+// All returns the state of every feature flag
+func (f *FeatureFlags) All() map[string]bool {
+	all := map[string]bool{}
+	for _, name := range features {
+		all[name] = f.Enabled(name)
+	}
+
+	return all
+}
+
+// Reload reads the flags file again. A file that cannot be read or holds an unknown flag or value
+// leaves the current flags in place.
+func (f *FeatureFlags) Reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	values, err := readConfigFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	enabled := map[string]bool{}
+	for name, on := range f.defaults {
+		enabled[name] = on
+	}
+
+	for name, value := range values {
+		if _, ok := f.defaults[name]; !ok {
+			return fmt.Errorf("%s: unknown feature %q, expected one of %s", f.path, name, strings.Join(features, ", "))
+		}
+
+		on, err := parseFlag(value)
+		if err != nil {
+			return fmt.Errorf("%s: %s must be on or off, got %q", f.path, name, value)
+		}
+		enabled[name] = on
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	changed := []string{}
+	for name, on := range enabled {
+		if on != f.enabled[name] {
+			changed = append(changed, fmt.Sprintf("%s=%s", name, flagState(on)))
+		}
+	}
+	sort.Strings(changed)
+
+	if len(changed) > 0 && !f.modified.IsZero() {
+		log.Printf("Feature flags changed: %s", strings.Join(changed, ", "))
+	}
+
+	f.enabled, f.modified = enabled, info.ModTime()
+
+	return nil
+}
+
+// changed reports whether the flags file was modified since it was last read
+func (f *FeatureFlags) changed() bool {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return !info.ModTime().Equal(f.modified)
+}
+
+// watchFeatureFlags reloads the flags file on SIGHUP and whenever it changes, checking every interval
+func watchFeatureFlags(f *FeatureFlags, interval time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	tick := time.Tick(interval)
+	for {
+		select {
+		case <-hangup:
+		case <-tick:
+			if !f.changed() {
+				continue
+			}
+		}
+
+		if err := f.Reload(); err != nil {
+			log.Printf("Unable to reload feature flags: %v", err)
+		}
+	}
+}
+
+// parseFlag parses the value of a feature flag, on and off or anything strconv.ParseBool accepts
+func parseFlag(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "on", "yes":
+		return true, nil
+	case "off", "no":
+		return false, nil
+	}
+
+	return strconv.ParseBool(value)
+}
+
+// flagState names the state of a flag as it is written in the flags file
+func flagState(on bool) string {
+	if on {
+		return "on"
+	}
+
+	return "off"
+}
+
+// Feature responds 404 Not Found with ErrFeatureDisabled instead of calling next while the feature
+// name is off
+func (h *Handlers) Feature(name string, next httptreemux.HandlerFunc) httptreemux.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if !h.features.Enabled(name) {
+			h.RespondError(w, ErrFeatureDisabled, http.StatusNotFound)
+			return
+		}
+
+		next(w, r, params)
+	}
+}
+
+// FeatureFlags lists whether each optional subsystem is enabled
+func (h *Handlers) FeatureFlags(w http.ResponseWriter, _ *http.Request, _ map[string]string) {
+	h.RespondJSON(w, h.features.All(), http.StatusOK)
+}
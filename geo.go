@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// maxGeoTargets bounds how many countries a url may send to their own destination
+const maxGeoTargets = 50
+
+// GeoIP resolves client addresses to countries with a MaxMind GeoIP2 or GeoLite2 country or city
+// database
+type GeoIP struct {
+	db *maxminddb.Reader
+}
+
+// geoRecord is the part of a country or city database record the shortener reads
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// OpenGeoIP opens the mmdb database at path
+func OpenGeoIP(path string) (*GeoIP, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GeoIP{db: db}, nil
+}
+
+// Country returns the ISO 3166 code of the country ip is located in, or an empty string when it is
+// unknown
+func (g *GeoIP) Country(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+
+	record := geoRecord{}
+	if err := g.db.Lookup(addr, &record); err != nil {
+		return ""
+	}
+
+	return record.Country.ISOCode
+}
+
+// country returns the client's country, preferring one supplied by a fronting proxy or cdn over a
+// lookup of the client address
+func (h *Handlers) country(r *http.Request) string {
+	if country := requestCountry(r); country != "" {
+		return strings.ToUpper(country)
+	}
+
+	if h.geoip == nil {
+		return ""
+	}
+
+	return h.geoip.Country(h.clientIP(r))
+}
+
+// validGeoTargets checks that targets maps two letter country codes to urls that may be shortened
+// and returns it with the codes upper cased
+func (h *Handlers) validGeoTargets(targets map[string]string) (map[string]string, error) {
+	if len(targets) == 0 {
+		return nil, nil
+	}
+
+	if len(targets) > maxGeoTargets {
+		return nil, ErrInvalidGeoTargets
+	}
+
+	valid := make(map[string]string, len(targets))
+	for country, target := range targets {
+		if !validCountryCode(country) {
+			return nil, ErrInvalidGeoTargets
+		}
+
+		target, err := h.NormalizeURL(target)
+		if err != nil {
+			return nil, err
+		}
+
+		valid[strings.ToUpper(country)] = target
+	}
+
+	return valid, nil
+}
+
+// validCountryCode reports whether code looks like an ISO 3166 alpha-2 country code
+func validCountryCode(code string) bool {
+	if len(code) != 2 {
+		return false
+	}
+
+	for _, c := range strings.ToUpper(code) {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+
+	return true
+}
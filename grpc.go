@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jcloutz/fcc-url-shortener/shortenerpb"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcService implements the Shortener rpcs on top of the same store and validation as the http
+// handlers
+type grpcService struct {
+	shortenerpb.UnimplementedShortenerServer
+	h *Handlers
+}
+
+// newGRPCServer creates the grpc server, it speaks tls when a certificate is configured
+func newGRPCServer(c *Config, h *Handlers) (*grpc.Server, error) {
+	opts := []grpc.ServerOption{}
+	if c.TLSCert != "" {
+		creds, err := credentials.NewServerTLSFromFile(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, grpc.Creds(creds))
+	}
+
+	server := grpc.NewServer(opts...)
+	shortenerpb.RegisterShortenerServer(server, &grpcService{h: h})
+
+	return server, nil
+}
+
+// serveGRPC accepts grpc connections on the configured port until the server is stopped
+func serveGRPC(server *grpc.Server, c *Config, errs chan<- error) {
+	lis, err := net.Listen("tcp", listenAddr(c, c.GRPCPort))
+	if err != nil {
+		errs <- err
+		return
+	}
+
+	errs <- server.Serve(lis)
+}
+
+// stopGRPC waits up to timeout for in-flight rpcs before closing the remaining connections
+func stopGRPC(server *grpc.Server, timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		server.Stop()
+	}
+}
+
+// Shorten stores a new url for the caller
+func (s *grpcService) Shorten(ctx context.Context, req *shortenerpb.ShortenRequest) (*shortenerpb.URL, error) {
+	ctx, owner, err := s.owner(ctx, s.h.requireAPIKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var q *quotaReservation
+	if k := contextAPIKey(ctx); k != nil {
+		if q, err = s.h.reserveQuota(k, time.Now(), 1); err == ErrQuotaExceeded {
+			return nil, grpcError(err, http.StatusTooManyRequests)
+		} else if err != nil {
+			return nil, grpcError(err, http.StatusServiceUnavailable)
+		}
+	}
+
+	header := http.Header{}
+	u, _, err := s.h.createURL(ctx, header, owner, ShortenRequest{
+		URL:        req.GetUrl(),
+		Slug:       s.h.canonicalSlug(req.GetSlug()),
+		TTLSeconds: int(req.GetTtlSeconds()),
+		ForceNew:   req.GetForceNew(),
+	})
+	if q != nil {
+		s.h.settleQuota(q, err == nil)
+	}
+
+	if err != nil {
+		return nil, grpcError(err, shortenStatus(err))
+	}
+
+	if warning := header.Get("Warning"); warning != "" {
+		grpc.SetHeader(ctx, metadata.Pairs("warning", warning))
+	}
+
+	return protoURL(u), nil
+}
+
+// Resolve returns the destination a visitor with the requested device and country would be sent to
+func (s *grpcService) Resolve(ctx context.Context, req *shortenerpb.ResolveRequest) (*shortenerpb.ResolveResponse, error) {
+	u, err := s.h.store.ResolveSlug(ctx, s.h.canonicalSlug(req.GetSlug()))
+	if storeFailure(err) {
+		return nil, grpcError(ErrStoreUnavailable, http.StatusServiceUnavailable)
+	}
+
+	if err != nil || u.Deleted() {
+		return nil, grpcError(ErrNotFound, http.StatusNotFound)
+	}
+
+	now := time.Now()
+	switch {
+	case u.Expired(now):
+		return nil, grpcError(ErrExpired, http.StatusGone)
+	case u.Disabled:
+		return nil, grpcError(ErrDisabled, http.StatusForbidden)
+	case !u.Started(now) && s.h.hideNotLive:
+		return nil, grpcError(ErrNotFound, http.StatusNotFound)
+	case !u.Started(now):
+		return nil, grpcError(fmt.Errorf("This url goes live at %s", u.StartsAt.Format(time.RFC1123)), http.StatusForbidden)
+	case u.PasswordHash != "" && bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(req.GetPassword())) != nil:
+		return nil, grpcError(ErrPasswordRequired, http.StatusUnauthorized)
+	}
+
+	destination, variant := u.Destination(strings.ToLower(req.GetDevice()), strings.ToUpper(req.GetCountry()))
+
+	return &shortenerpb.ResolveResponse{Destination: destination, Variant: variant, Url: protoURL(u)}, nil
+}
+
+// Delete removes one of the caller's urls
+func (s *grpcService) Delete(ctx context.Context, req *shortenerpb.DeleteRequest) (*shortenerpb.DeleteResponse, error) {
+	_, owner, err := s.owner(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.h.deleteURL(ctx, owner, s.h.canonicalSlug(req.GetSlug()), !req.GetReuseSlug()); err != nil {
+		if err == ErrNotFound {
+			return nil, grpcError(ErrNotFound, http.StatusNotFound)
+		}
+
+		return nil, grpcError(ErrUnableToDeleteURL, http.StatusInternalServerError)
+	}
+
+	return &shortenerpb.DeleteResponse{}, nil
+}
+
+// Stats summarises the clicks recorded for a url
+func (s *grpcService) Stats(ctx context.Context, req *shortenerpb.StatsRequest) (*shortenerpb.StatsResponse, error) {
+	if !s.h.features.Enabled(featureAnalytics) {
+		return nil, grpcError(ErrFeatureDisabled, http.StatusNotFound)
+	}
+
+	u, err := s.h.store.FindBySlug(ctx, s.h.canonicalSlug(req.GetSlug()))
+	if err != nil {
+		return nil, grpcError(ErrNotFound, http.StatusNotFound)
+	}
+
+	stats, err := s.h.clicks.Stats(u.Slug)
+	if err != nil {
+		return nil, grpcError(ErrUnableToLoadStats, http.StatusInternalServerError)
+	}
+
+	resp := &shortenerpb.StatsResponse{
+		Slug:        u.Slug,
+		TotalClicks: int64(stats.TotalClicks),
+		LinkStatus:  linkStatus(u),
+	}
+	for _, d := range stats.ClicksPerDay {
+		resp.ClicksPerDay = append(resp.ClicksPerDay, &shortenerpb.StatsResponse_Count{Key: d.Day, Clicks: int64(d.Clicks)})
+	}
+	for _, r := range stats.TopReferrers {
+		resp.TopReferrers = append(resp.TopReferrers, &shortenerpb.StatsResponse_Count{Key: r.Referrer, Clicks: int64(r.Clicks)})
+	}
+	for _, v := range stats.Variants {
+		resp.Variants = append(resp.Variants, &shortenerpb.StatsResponse_Count{Key: v.Variant, Clicks: int64(v.Clicks)})
+	}
+
+	return resp, nil
+}
+
+// owner authenticates the bearer token in the call's authorization metadata and returns the owner
+// recorded on urls it creates, along with ctx carrying the api key when the call used one. Calls
+// without a token are anonymous unless required is set.
+func (s *grpcService) owner(ctx context.Context, required bool) (context.Context, string, error) {
+	token := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+		token = parseBearer(md.Get("authorization")[0])
+	}
+
+	if token == "" && !required {
+		return ctx, "", nil
+	}
+
+	id, k, err := s.h.authenticateToken(token)
+	if err != nil {
+		return ctx, "", grpcError(ErrUnauthorized, http.StatusUnauthorized)
+	}
+
+	if k == nil {
+		return ctx, id, nil
+	}
+
+	ctx = context.WithValue(ctx, apiKeyContextKey, k)
+	if k.UserID != "" {
+		return ctx, k.UserID, nil
+	}
+
+	return ctx, k.ID, nil
+}
+
+// grpcCodes translates the statuses the http handlers respond with
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusConflict:            codes.AlreadyExists,
+	http.StatusGone:                codes.FailedPrecondition,
+	http.StatusUnprocessableEntity: codes.FailedPrecondition,
+	http.StatusTooManyRequests:     codes.ResourceExhausted,
+	http.StatusServiceUnavailable:  codes.Unavailable,
+}
+
+// grpcError converts err and the http status it would be served with to a grpc status
+func grpcError(err error, httpStatus int) error {
+	code, ok := grpcCodes[httpStatus]
+	if !ok {
+		code = codes.Internal
+	}
+
+	return status.Error(code, err.Error())
+}
+
+// protoURL converts a stored url to its protobuf message
+func protoURL(u *URL) *shortenerpb.URL {
+	p := &shortenerpb.URL{
+		Slug:        u.Slug,
+		OriginalUrl: u.OriginalURL,
+		ShortUrl:    u.ShortURL,
+		Owner:       u.Owner,
+		Clicks:      int64(u.Clicks),
+		Disabled:    u.Disabled,
+		Protected:   u.Protected,
+		CreatedAt:   timestamppb.New(u.CreatedAt),
+	}
+
+	if u.ExpiresAt != nil {
+		p.ExpiresAt = timestamppb.New(*u.ExpiresAt)
+	}
+
+	if u.StartsAt != nil {
+		p.StartsAt = timestamppb.New(*u.StartsAt)
+	}
+
+	return p
+}
@@ -0,0 +1,30 @@
+package main
+
+import "net/http"
+
+// HealthStatus is the body returned by the health endpoints
+type HealthStatus struct {
+	Status string `json:"status"`
+}
+
+// Healthz reports that the process is alive
+func (h *Handlers) Healthz(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	h.RespondJSON(w, HealthStatus{Status: "ok"}, http.StatusOK)
+}
+
+// Readyz reports whether the service can reach its store and is ready for traffic. With a fallback
+// snapshot it stays ready while the store is unavailable, reporting degraded, as it still serves
+// redirects.
+func (h *Handlers) Readyz(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	if err := h.store.Ping(r.Context()); err != nil {
+		if h.snapshot != nil {
+			h.RespondJSON(w, HealthStatus{Status: "degraded"}, http.StatusOK)
+			return
+		}
+
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	h.RespondJSON(w, HealthStatus{Status: "ok"}, http.StatusOK)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// idempotencyKeyHeader names the header clients send to make retrying a shorten request safe
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyKeyTTL is how long a retry with the same idempotency key returns the url it created
+const idempotencyKeyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLength bounds the length of idempotency keys
+const maxIdempotencyKeyLength = 255
+
+var (
+	ErrInvalidIdempotencyKey = codedError("invalid_idempotency_key", "", "Idempotency keys must be at most 255 characters")
+	ErrIdempotencyKeyReused  = codedError("idempotency_key_reused", "", "The idempotency key was already used with a different request")
+	ErrIdempotencyKeyInUse   = codedError("idempotency_key_in_use", "", "A request with this idempotency key is still being processed")
+)
+
+// IdempotencyKey records the url a shorten request sent with an Idempotency-Key header created, so a
+// retry of the request responds with it instead of creating another
+type IdempotencyKey struct {
+	Owner string `json:"owner" bson:"owner"`
+	Key   string `json:"key" bson:"key"`
+	// Fingerprint is a hash of the request, a retry must send the same one
+	Fingerprint string `json:"fingerprint" bson:"fingerprint"`
+	// Slug and Status are empty until the request has been processed
+	Slug      string    `json:"slug" bson:"slug"`
+	Status    int       `json:"status" bson:"status"`
+	ExpiresAt time.Time `json:"expires_at" bson:"expires_at"`
+}
+
+// IdempotencyStore defines the persistence operations for idempotency keys
+type IdempotencyStore interface {
+	// ClaimIdempotencyKey stores k unless its owner already has an unexpired record under its key, which
+	// is returned instead
+	ClaimIdempotencyKey(k *IdempotencyKey) (*IdempotencyKey, error)
+	// CompleteIdempotencyKey records the url the request under key of owner created and the status it
+	// was responded to with
+	CompleteIdempotencyKey(owner, key, slug string, status int) error
+	// ReleaseIdempotencyKey removes the record under key of owner, so a request that failed can be
+	// retried
+	ReleaseIdempotencyKey(owner, key string) error
+}
+
+// requestFingerprint returns a hash of req, requests with the same fields share it however their
+// bodies are formatted
+func requestFingerprint(req ShortenRequest) string {
+	js, _ := json.Marshal(req)
+	sum := sha256.Sum256(js)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// claimIdempotencyKey claims key for the shorten request req of owner. When the key was used before it
+// responds with the url the first request created, or with an error when the request differs or is
+// still being processed, and returns false.
+func (h *Handlers) claimIdempotencyKey(w http.ResponseWriter, r *http.Request, owner, key string, req ShortenRequest) bool {
+	if len(key) > maxIdempotencyKeyLength {
+		h.RespondError(w, ErrInvalidIdempotencyKey, http.StatusBadRequest)
+		return false
+	}
+
+	claim := &IdempotencyKey{
+		Owner:       owner,
+		Key:         key,
+		Fingerprint: requestFingerprint(req),
+		ExpiresAt:   time.Now().Add(idempotencyKeyTTL),
+	}
+
+	previous, err := h.idempotency.ClaimIdempotencyKey(claim)
+	if err != nil {
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return false
+	}
+
+	if previous == nil {
+		return true
+	}
+
+	if previous.Fingerprint != claim.Fingerprint {
+		h.RespondError(w, ErrIdempotencyKeyReused, http.StatusUnprocessableEntity)
+		return false
+	}
+
+	if previous.Slug == "" {
+		h.RespondError(w, ErrIdempotencyKeyInUse, http.StatusConflict)
+		return false
+	}
+
+	u, err := h.store.FindBySlug(r.Context(), previous.Slug)
+	if err != nil {
+		h.RespondError(w, ErrNotFound, http.StatusNotFound)
+		return false
+	}
+
+	logSlug(r, u.Slug)
+	w.Header().Set("Idempotent-Replayed", "true")
+	h.respondShortened(w, u, previous.Status)
+
+	return false
+}
+
+// completeIdempotencyKey records the outcome of the request that claimed key, a failed request
+// releases the key so it can be retried
+func (h *Handlers) completeIdempotencyKey(owner, key string, u *URL, status int) {
+	var err error
+	if u == nil {
+		err = h.idempotency.ReleaseIdempotencyKey(owner, key)
+	} else {
+		err = h.idempotency.CompleteIdempotencyKey(owner, key, u.Slug, status)
+	}
+
+	if err != nil {
+		log.Printf("Unable to update idempotency key for %s: %v", owner, err)
+	}
+}
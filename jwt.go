@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+const defaultTokenTTL = time.Hour
+
+// jwtHeader is the only header issued and accepted, tokens signed with any other algorithm are rejected
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+var errInvalidToken = errors.New("invalid token")
+
+// Claims are the registered jwt claims carried by session tokens
+type Claims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// TokenResponse is returned when a user logs in
+type TokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// TokenSigner issues and verifies HS256 session tokens
+type TokenSigner struct {
+	key []byte
+	ttl time.Duration
+}
+
+// NewTokenSigner creates a signer using key that issues tokens valid for ttl
+func NewTokenSigner(key []byte, ttl time.Duration) *TokenSigner {
+	return &TokenSigner{key: key, ttl: ttl}
+}
+
+// Issue returns a token for subject that expires after the signer's ttl
+func (s *TokenSigner) Issue(subject string, now time.Time) (string, time.Time, error) {
+	expires := now.Add(s.ttl)
+
+	claims, err := json.Marshal(Claims{Subject: subject, IssuedAt: now.Unix(), ExpiresAt: expires.Unix()})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	return unsigned + "." + s.sign(unsigned), expires, nil
+}
+
+// Verify checks the signature and expiry of token and returns its claims
+func (s *TokenSigner) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, errInvalidToken
+	}
+
+	if !hmac.Equal([]byte(parts[2]), []byte(s.sign(parts[0]+"."+parts[1]))) {
+		return nil, errInvalidToken
+	}
+
+	js, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	claims := Claims{}
+	if err := json.Unmarshal(js, &claims); err != nil || claims.Subject == "" {
+		return nil, errInvalidToken
+	}
+
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, errInvalidToken
+	}
+
+	return &claims, nil
+}
+
+// sign returns the encoded HS256 signature of the unsigned token
+func (s *TokenSigner) sign(unsigned string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(unsigned))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newTokenSigner creates the session token signer issuing tokens valid for ttl. Without a secret a
+// random one is generated, so tokens stop working when the process restarts.
+func newTokenSigner(secret string, ttl time.Duration) (*TokenSigner, error) {
+	key := []byte(secret)
+	if secret == "" {
+		log.Printf("URL_JWT_SECRET is not set, session tokens will be invalidated on restart")
+
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewTokenSigner(key, ttl), nil
+}
+
+// isJWT reports whether a bearer token looks like a jwt rather than an api key
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
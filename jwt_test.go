@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenSignerVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	signer := NewTokenSigner([]byte("secret"), time.Hour)
+
+	token, expires, err := signer.Issue("user", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expires.Equal(now.Add(time.Hour)) {
+		t.Errorf("expires %v, want %v", expires, now.Add(time.Hour))
+	}
+
+	other, _, err := NewTokenSigner([]byte("other"), time.Hour).Issue("user", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(token, ".")
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	// resign signs claims with the signer's key, as only a holder of the key could
+	resign := func(header, claims string) string {
+		unsigned := header + "." + encode(claims)
+		return unsigned + "." + signer.sign(unsigned)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		now   time.Time
+		valid bool
+	}{
+		{"valid", token, now, true},
+		{"just before expiry", token, now.Add(time.Hour - time.Second), true},
+		{"at expiry", token, now.Add(time.Hour), false},
+		{"expired", token, now.Add(2 * time.Hour), false},
+		{"other key", other, now, false},
+		{"tampered claims", parts[0] + "." + encode(`{"sub":"admin","iat":1700000000,"exp":1700003600}`) + "." + parts[2], now, false},
+		{"tampered signature", parts[0] + "." + parts[1] + "." + encode("signature"), now, false},
+		{"unsigned", parts[0] + "." + parts[1] + ".", now, false},
+		{"alg none", encode(`{"alg":"none","typ":"JWT"}`) + "." + parts[1] + ".", now, false},
+		{"other alg", resign(encode(`{"alg":"HS512","typ":"JWT"}`), `{"sub":"user","exp":1700003600}`), now, false},
+		{"no subject", resign(jwtHeader, `{"exp":1700003600}`), now, false},
+		{"no expiry", resign(jwtHeader, `{"sub":"user"}`), now, false},
+		{"claims not json", resign(jwtHeader, `user`), now, false},
+		{"two parts", parts[0] + "." + parts[1], now, false},
+		{"four parts", token + "." + parts[2], now, false},
+		{"empty", "", now, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := signer.Verify(tt.token, tt.now)
+			if !tt.valid {
+				if err != errInvalidToken {
+					t.Errorf("Verify error %v, want %v", err, errInvalidToken)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Verify error %v", err)
+			}
+			if claims.Subject != "user" || claims.IssuedAt != now.Unix() || claims.ExpiresAt != now.Add(time.Hour).Unix() {
+				t.Errorf("claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestIsJWT(t *testing.T) {
+	tests := []struct {
+		token string
+		want  bool
+	}{
+		{"header.claims.signature", true},
+		{"sk_0123456789abcdef", false},
+		{"a.b", false},
+		{"a.b.c.d", false},
+	}
+
+	for _, tt := range tests {
+		if got := isJWT(tt.token); got != tt.want {
+			t.Errorf("isJWT(%q) = %v, want %v", tt.token, got, tt.want)
+		}
+	}
+}
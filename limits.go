@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/dimfeld/httptreemux"
+)
+
+// defaultMaxURLLength bounds the length of destinations unless URL_MAX_URL_LENGTH is set
+const defaultMaxURLLength = 8192
+
+// defaultMaxBodyBytes bounds the size of api request bodies unless URL_MAX_BODY_BYTES is set
+const defaultMaxBodyBytes = 1 << 20
+
+var (
+	ErrURLTooLong   = codedError("url_too_long", "url", "The url is longer than allowed")
+	ErrBodyTooLarge = codedError("body_too_large", "", "The request body is larger than allowed")
+)
+
+// bodyTooLarge reports whether err was returned reading a request body past its limit
+func bodyTooLarge(err error) bool {
+	var maxBytes *http.MaxBytesError
+
+	return errors.As(err, &maxBytes)
+}
+
+// respondBodyError responds to a request whose body was rejected with 413 Request Entity Too Large
+// when it was cut off at its limit, and with invalid otherwise
+func (h *Handlers) respondBodyError(w http.ResponseWriter, err, invalid error) {
+	if bodyTooLarge(err) {
+		h.RespondError(w, ErrBodyTooLarge, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	h.RespondError(w, invalid, http.StatusBadRequest)
+}
+
+// LimitBody stops next from reading more than limit bytes of the request body, or URL_MAX_BODY_BYTES
+// when limit is 0, so clients cannot hold memory with huge payloads
+func (h *Handlers) LimitBody(limit int64, next httptreemux.HandlerFunc) httptreemux.HandlerFunc {
+	if limit == 0 {
+		limit = h.maxBodyBytes
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next(w, r, params)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestLogContextKey contextKey = "request_log"
+
+var requestLogger = log.New(os.Stdout, "", 0)
+
+// RequestLog is the structured log line written for every request
+type RequestLog struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	LatencyMS float64   `json:"latency_ms"`
+	ClientIP  string    `json:"client_ip"`
+	Slug      string    `json:"slug,omitempty"`
+	RequestID string    `json:"request_id"`
+	TraceID   string    `json:"trace_id,omitempty"`
+}
+
+// statusWriter records the status code written by a handler
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status before passing it on
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap returns the writer w wraps
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// LogRequests writes one json log line per request handled by next. Every request is given an id,
+// the one in its X-Request-ID header when it has a usable one, which is echoed in the response.
+func (h *Handlers) LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		entry := &RequestLog{
+			Time:      start.UTC(),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			ClientIP:  h.recordedIP(r),
+			RequestID: requestID(r),
+		}
+		w.Header().Set(requestIDHeader, entry.RequestID)
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), requestLogContextKey, entry)))
+
+		entry.Status = sw.status
+		entry.LatencyMS = float64(time.Since(start)) / float64(time.Millisecond)
+
+		js, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+
+		requestLogger.Println(string(js))
+	})
+}
+
+// logSlug attaches the slug a request operated on to its log line
+func logSlug(r *http.Request, slug string) {
+	if entry, ok := r.Context().Value(requestLogContextKey).(*RequestLog); ok {
+		entry.Slug = slug
+	}
+}
+
+// logTrace attaches the trace a request is recorded in to its log line
+func logTrace(r *http.Request, sc trace.SpanContext) {
+	if entry, ok := r.Context().Value(requestLogContextKey).(*RequestLog); ok && sc.IsValid() {
+		entry.TraceID = sc.TraceID().String()
+	}
+}
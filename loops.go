@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+const redirectCheckTimeout = 3 * time.Second
+
+// RedirectChecker follows the redirects of a destination, such as another shortener's link, to make
+// sure the chain does not lead back to this shortener or loop
+type RedirectChecker struct {
+	domains *DomainPolicy
+	hops    int
+	client  *http.Client
+}
+
+// NewRedirectChecker creates a checker that follows at most hops redirects, rejecting chains that
+// reach a host domains considers to be the shortener itself
+func NewRedirectChecker(domains *DomainPolicy, hops int) *RedirectChecker {
+	client := egress.Client(redirectCheckTimeout)
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	return &RedirectChecker{
+		domains: domains,
+		hops:    hops,
+		client:  client,
+	}
+}
+
+// Check returns ErrRedirectLoop when following target's redirects reaches the shortener or a url
+// already seen in the chain. Destinations that cannot be reached are not rejected, chains longer
+// than the hop limit are only followed as far as the limit.
+func (c *RedirectChecker) Check(target string) error {
+	seen := map[string]bool{target: true}
+
+	for i := 0; i < c.hops; i++ {
+		resp, err := c.client.Head(target)
+		if err != nil {
+			return nil
+		}
+		resp.Body.Close()
+
+		location := resp.Header.Get("Location")
+		if resp.StatusCode < 300 || resp.StatusCode > 399 || location == "" {
+			return nil
+		}
+
+		base, err := url.Parse(target)
+		if err != nil {
+			return nil
+		}
+
+		next, err := base.Parse(location)
+		if err != nil {
+			return nil
+		}
+
+		if c.domains.IsSelf(next.Hostname()) || seen[next.String()] {
+			return ErrRedirectLoop
+		}
+
+		target = next.String()
+		seen[target] = true
+	}
+
+	return nil
+}
+
+// canonicalHost returns host in the form hosts are compared in: lower case ascii (punycode for
+// internationalised names) without a port, brackets or trailing dot
+func canonicalHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		host = ascii
+	}
+
+	return strings.ToLower(host)
+}
@@ -1,173 +1,1359 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"io"
 	"log"
 	"math/rand"
 	"net/url"
-	"path"
 	"strings"
 	"time"
 
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
 	"net/http"
 
 	"encoding/json"
 
-	"html/template"
-
 	"github.com/dimfeld/httptreemux"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
 )
 
 const chars = "ABCDEFGHIJKLMNOPQRXWYZabcdefghijklmnopqrstuvwxyz1234567890"
-const urlCollection = "urls"
+const customSlugChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+const customSlugMinLength = 3
+const customSlugMaxLength = 64
+const shutdownTimeout = 15 * time.Second
 
 // Define the errors for the service
 var (
-	ErrInvalidURL         = errors.New("Invalid URL Format")
-	ErrNotFound           = errors.New("Unable to locate a url with that slug")
-	ErrUnableToShortenUrl = errors.New("Unable to create shortened url")
+	ErrInvalidURL           = codedError("invalid_url", "url", "Invalid URL Format")
+	ErrNotFound             = codedError("not_found", "", "Unable to locate a url with that slug")
+	ErrUnableToShortenUrl   = codedError("shorten_failed", "", "Unable to create shortened url")
+	ErrInvalidRequest       = codedError("invalid_request", "", "Invalid request body")
+	ErrInvalidSlug          = codedError("invalid_slug", "slug", "Invalid slug format")
+	ErrSlugTaken            = codedError("slug_taken", "slug", "A url with that slug already exists")
+	ErrReservedSlug         = codedError("slug_reserved", "slug", "That slug is reserved")
+	ErrUnableToLoadStats    = codedError("stats_failed", "", "Unable to load url statistics")
+	ErrInvalidExpiry        = codedError("invalid_expiry", "expires_at", "Expiry must be in the future and only one of expires_at or ttl_seconds may be set")
+	ErrExpired              = codedError("expired", "", "This url has expired")
+	ErrUnauthorized         = codedError("unauthorized", "", "A valid api key or session token is required")
+	ErrKeyNotFound          = codedError("key_not_found", "", "Unable to locate an api key with that id")
+	ErrUnableToCreateKey    = codedError("key_create_failed", "", "Unable to create api key")
+	ErrUnableToRevokeKey    = codedError("key_revoke_failed", "", "Unable to revoke api key")
+	ErrRateLimited          = codedError("rate_limited", "", "Too many requests, try again later")
+	ErrStoreUnavailable     = codedError("store_unavailable", "", "The store is unavailable")
+	ErrUnableToDeleteURL    = codedError("delete_failed", "", "Unable to delete url")
+	ErrUnableToUpdateURL    = codedError("update_failed", "", "Unable to update url")
+	ErrInvalidListQuery     = codedError("invalid_list_query", "", "Invalid page, per_page or sort")
+	ErrUnableToListURLs     = codedError("list_failed", "", "Unable to list urls")
+	ErrUnableToCreateSlug   = codedError("slug_generation_failed", "", "Unable to generate a slug")
+	ErrInvalidQRSize        = codedError("invalid_qr_size", "size", "QR code size must be between 64 and 1024 pixels")
+	ErrUnableToCreateQR     = codedError("qr_failed", "", "Unable to generate qr code")
+	ErrInvalidBatchSize     = codedError("invalid_batch_size", "", "A batch must contain between 1 and 100 urls")
+	ErrUnsafeURL            = codedError("unsafe_url", "url", "This url has been flagged as phishing or malware")
+	ErrDisabled             = codedError("disabled", "", "This url has been disabled")
+	ErrBlockedDomain        = codedError("blocked_domain", "url", "Urls pointing at that domain cannot be shortened")
+	ErrInvalidRedirectCode  = codedError("invalid_redirect_code", "redirect_code", "Redirect code must be one of 301, 302, 307 or 308")
+	ErrPasswordRequired     = codedError("password_required", "password", "This url is password protected")
+	ErrInvalidMaxClicks     = codedError("invalid_max_clicks", "max_clicks", "Max clicks must be positive and self_destruct requires max_clicks")
+	ErrUnreachableURL       = codedError("unreachable_url", "url", "The url could not be reached or responded with an error")
+	ErrRedirectLoop         = codedError("redirect_loop", "url", "The url redirects back to this shortener or in a loop")
+	ErrClickLimitReached    = codedError("click_limit_reached", "", "This url has reached its click limit")
+	ErrInvalidCredentials   = codedError("invalid_credentials", "", "A valid email and a password of at least 8 characters are required")
+	ErrEmailTaken           = codedError("email_taken", "email", "An account with that email already exists")
+	ErrUnableToCreateUser   = codedError("user_create_failed", "", "Unable to create account")
+	ErrLoginFailed          = codedError("login_failed", "", "Incorrect email or password")
+	ErrUserNotFound         = codedError("user_not_found", "", "The credentials do not belong to a user")
+	ErrUnableToCreateToken  = codedError("token_create_failed", "", "Unable to create session token")
+	ErrUnableToBanDomain    = codedError("ban_failed", "", "Unable to update banned domains")
+	ErrDomainNotBanned      = codedError("domain_not_banned", "domain", "That domain is not banned")
+	ErrUnableToSaveReport   = codedError("report_failed", "", "Unable to save report")
+	ErrInvalidGeoTargets    = codedError("invalid_geo_targets", "geo_targets", "Geo targets must map at most 50 two letter country codes to urls")
+	ErrInvalidDeviceTargets = codedError("invalid_device_targets", "device_targets", "Device targets must map ios, android or desktop to urls")
+	ErrInvalidStart         = codedError("invalid_start", "starts_at", "starts_at must come before the url expires")
+	ErrInvalidVariants      = codedError("invalid_variants", "variants", "Variants must list between 2 and 10 urls with unique names and positive weights")
 )
 
 // URL is the representation of a url in mongo
 type URL struct {
-	Slug        string `json:"-" bson:"slug"`
-	OriginalURL string `json:"original_url" bson:"original_url"`
-	ShortURL    string `json:"short_url" bson:"short_url"`
+	Slug          string            `json:"-" bson:"slug"`
+	OriginalURL   string            `json:"original_url" bson:"original_url"`
+	ShortURL      string            `json:"short_url" bson:"short_url"`
+	ExpiresAt     *time.Time        `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	StartsAt      *time.Time        `json:"starts_at,omitempty" bson:"starts_at,omitempty"`
+	History       []Retarget        `json:"history,omitempty" bson:"history,omitempty"`
+	Owner         string            `json:"owner,omitempty" bson:"owner"`
+	KeyID         string            `json:"key_id,omitempty" bson:"key_id,omitempty"`
+	Disabled      bool              `json:"disabled,omitempty" bson:"disabled,omitempty"`
+	RedirectCode  int               `json:"redirect_code,omitempty" bson:"redirect_code,omitempty"`
+	Protected     bool              `json:"protected,omitempty" bson:"protected,omitempty"`
+	MaxClicks     int               `json:"max_clicks,omitempty" bson:"max_clicks,omitempty"`
+	SelfDestruct  bool              `json:"self_destruct,omitempty" bson:"self_destruct,omitempty"`
+	GeoTargets    map[string]string `json:"geo_targets,omitempty" bson:"geo_targets,omitempty"`
+	DeviceTargets map[string]string `json:"device_targets,omitempty" bson:"device_targets,omitempty"`
+	Variants      []Variant         `json:"variants,omitempty" bson:"variants,omitempty"`
+	Tags          []string          `json:"tags,omitempty" bson:"tags,omitempty"`
+	Campaign      string            `json:"campaign,omitempty" bson:"campaign,omitempty"`
+	Domain        string            `json:"domain,omitempty" bson:"domain,omitempty"`
+	PageMetadata  `bson:",inline"`
+	PasswordHash  string     `json:"-" bson:"password_hash,omitempty"`
+	LinkFailures  int        `json:"link_failures,omitempty" bson:"link_failures,omitempty"`
+	LinkCheckedAt *time.Time `json:"link_checked_at,omitempty" bson:"link_checked_at,omitempty"`
+	DeadAt        *time.Time `json:"dead_at,omitempty" bson:"dead_at,omitempty"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`
+	Clicks        int        `json:"clicks" bson:"clicks"`
+	CreatedAt     time.Time  `json:"created_at" bson:"created_at"`
+}
+
+// Retarget is an audit record of a url's destination being changed
+type Retarget struct {
+	PreviousURL string    `json:"previous_url" bson:"previous_url"`
+	ChangedAt   time.Time `json:"changed_at" bson:"changed_at"`
+	ChangedBy   string    `json:"changed_by,omitempty" bson:"changed_by,omitempty"`
+}
+
+// Expired reports whether the url has passed its expiry time
+func (u *URL) Expired(now time.Time) bool {
+	return u.ExpiresAt != nil && !now.Before(*u.ExpiresAt)
+}
+
+// Started reports whether the url has gone live, urls without a start time are always live
+func (u *URL) Started(now time.Time) bool {
+	return u.StartsAt == nil || !now.Before(*u.StartsAt)
+}
+
+// Destination returns the url a visitor on device from country is sent to. A device target wins over
+// a geo target, visitors matching neither are split between the url's variants and the original url
+// is used when none have been set. The name of the variant picked is returned alongside it.
+func (u *URL) Destination(device, country string) (string, string) {
+	if target, ok := u.DeviceTargets[device]; ok {
+		return target, ""
+	}
+
+	if target, ok := u.GeoTargets[country]; ok {
+		return target, ""
+	}
+
+	if len(u.Variants) > 0 {
+		v := pickVariant(u.Variants)
+		return v.URL, v.Name
+	}
+
+	return u.OriginalURL, ""
+}
+
+// Destinations returns the original url followed by every device target, geo target and variant
+func (u *URL) Destinations() []string {
+	urls := []string{u.OriginalURL}
+	for _, target := range u.DeviceTargets {
+		urls = append(urls, target)
+	}
+
+	for _, target := range u.GeoTargets {
+		urls = append(urls, target)
+	}
+
+	for _, v := range u.Variants {
+		urls = append(urls, v.URL)
+	}
+
+	return urls
+}
+
+// targeted reports whether u sends some visitors somewhere other than its original url
+func (u *URL) targeted() bool {
+	return u.GeoTargets != nil || u.DeviceTargets != nil || u.Variants != nil
 }
 
 // SlugGenerator generates rand slugs of indeterminate sizes
 type SlugGenerator struct {
-	random *rand.Rand
+	random interface {
+		Intn(n int) int
+	}
+	// alphabet holds the characters of generated slugs, chars when empty
+	alphabet string
+}
+
+// ShortenRequest is the json body accepted by the shorten endpoint
+type ShortenRequest struct {
+	URL           string            `json:"url"`
+	Slug          string            `json:"slug"`
+	ExpiresAt     *time.Time        `json:"expires_at"`
+	StartsAt      *time.Time        `json:"starts_at"`
+	TTLSeconds    int               `json:"ttl_seconds"`
+	ForceNew      bool              `json:"force_new"`
+	RedirectCode  int               `json:"redirect_code"`
+	Password      string            `json:"password"`
+	MaxClicks     int               `json:"max_clicks"`
+	SelfDestruct  bool              `json:"self_destruct"`
+	GeoTargets    map[string]string `json:"geo_targets"`
+	DeviceTargets map[string]string `json:"device_targets"`
+	Variants      []Variant         `json:"variants"`
+	Tags          []string          `json:"tags"`
+	Campaign      string            `json:"campaign"`
+	Domain        string            `json:"domain"`
+}
+
+// expiry resolves the requested expiry time, returning nil when the url should never expire
+func (req *ShortenRequest) expiry(now time.Time) (*time.Time, error) {
+	if req.ExpiresAt != nil && req.TTLSeconds != 0 {
+		return nil, ErrInvalidExpiry
+	}
+
+	if req.TTLSeconds < 0 {
+		return nil, ErrInvalidExpiry
+	}
+
+	if req.TTLSeconds > 0 {
+		expiresAt := now.Add(time.Duration(req.TTLSeconds) * time.Second).UTC()
+		return &expiresAt, nil
+	}
+
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(now) {
+			return nil, ErrInvalidExpiry
+		}
+
+		expiresAt := req.ExpiresAt.UTC()
+		return &expiresAt, nil
+	}
+
+	return nil, nil
+}
+
+// start resolves the requested start time, which has to come before expiresAt when the url expires
+func (req *ShortenRequest) start(expiresAt *time.Time) (*time.Time, error) {
+	if req.StartsAt == nil {
+		return nil, nil
+	}
+
+	if expiresAt != nil && !req.StartsAt.Before(*expiresAt) {
+		return nil, ErrInvalidStart
+	}
+
+	startsAt := req.StartsAt.UTC()
+	return &startsAt, nil
 }
 
-// JsonError defines the json error response for the service
+// JsonError defines the json error response for the service, Error is the message of the error and
+// Code identifies it
 type JsonError struct {
-	Error string `json:"error"`
+	Error     string `json:"error"`
+	Code      string `json:"code"`
+	Field     string `json:"field,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
 }
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("Port must be set")
+	// installed or linked as urlshort the binary is only the api client
+	if filepath.Base(os.Args[0]) == "urlshort" {
+		if err := runClient(os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+
+		return
 	}
 
-	host := os.Getenv("URL_HOST")
-	mgoDialString := os.Getenv("URL_MGO_DSN")
+	config, err := LoadConfig(true)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	egress.allowed = config.EgressAllow
+	reserveSlugs(config.ReservedSlugs)
 
 	random := rand.New(rand.NewSource(time.Now().Unix()))
 	slug := SlugGenerator{random: random}
-	sess, err := mgo.Dial(mgoDialString)
+	if config.CaselessSlugs {
+		slug.alphabet = caselessChars
+	}
+	store, err := newStore(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	clicks, ok := store.(ClickStore)
+	if !ok {
+		log.Fatal("Store does not support click analytics")
+	}
+
+	keys, ok := store.(KeyStore)
+	if !ok {
+		log.Fatal("Store does not support api keys")
+	}
+
+	users, ok := store.(UserStore)
+	if !ok {
+		log.Fatal("Store does not support user accounts")
+	}
+
+	bans, ok := store.(DomainBanStore)
+	if !ok {
+		log.Fatal("Store does not support banning domains")
+	}
+
+	reports, ok := store.(ReportStore)
+	if !ok {
+		log.Fatal("Store does not support abuse reports")
+	}
+
+	hooks, ok := store.(WebhookStore)
+	if !ok {
+		log.Fatal("Store does not support webhooks")
+	}
+
+	campaigns, ok := store.(CampaignStore)
+	if !ok {
+		log.Fatal("Store does not support campaigns")
+	}
+
+	orgs, ok := store.(OrgStore)
+	if !ok {
+		log.Fatal("Store does not support organizations")
+	}
+
+	usage, ok := store.(UsageStore)
+	if !ok {
+		log.Fatal("Store does not support api key usage")
+	}
+
+	idempotency, ok := store.(IdempotencyStore)
+	if !ok {
+		log.Fatal("Store does not support idempotency keys")
+	}
+
+	var customDomains CustomDomainStore
+	if config.CustomDomains {
+		if customDomains, ok = store.(CustomDomainStore); !ok {
+			log.Fatal("Store does not support custom domains")
+		}
+	}
+
+	if purger, ok := store.(Purger); ok {
+		go purgeExpired(purger, purgeInterval)
+	}
+
+	if rollup, ok := store.(ClickRollup); ok {
+		go rollupClicks(rollup, clickRollupInterval)
+	}
+
+	if config.ClickRetention > 0 {
+		go purgeOldClicks(clicks, config.ClickRetention, clickPurgeInterval)
+	}
+
+	if config.ClickArchiveAge > 0 {
+		events, ok := store.(ClickArchiveStore)
+		if !ok {
+			log.Fatal("Store does not support archiving clicks")
+		}
+
+		objects, err := newObjectStore(config.ClickArchiveLocation, s3Config(config))
+		if err != nil {
+			log.Fatalf("Unable to open the click archive location: %v", err)
+		}
+
+		go archiveClicks(NewClickArchive(clicks, events, objects, config.ClickArchiveAge), clickArchiveInterval)
+	}
+
+	var limiter *RateLimiter
+	if config.RateLimitRPS > 0 {
+		limiter = NewRateLimiter(config.RateLimitRPS, config.RateLimitBurst)
+	}
+
+	var proxyHops int
+	if config.TrustProxy {
+		proxyHops = config.TrustedProxyHops
+	}
+
+	metrics := NewMetrics()
+	if pooled, ok := store.(PooledStore); ok {
+		metrics.observePool(pooled)
+	}
+
+	slugs, err := newSlugSource(config.SlugStrategy, config.SlugLength, slug.alphabet, config.SlugShard, config.SlugBlockSize, store, &slug)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if config.SlugPoolSize > 0 {
+		slugs = NewSlugPool(slugs, config.SlugPoolSize)
+	}
+
+	var handlerStore Store = &instrumentedStore{Store: store, duration: metrics.StoreDuration}
+
+	// the breaker sits in front of the caches, so cached urls are still served while the store is down
+	var breaker *CircuitBreaker
+	if config.BreakerFailures > 0 {
+		breaker = NewCircuitBreaker(config.BreakerFailures, config.BreakerCooldown)
+		handlerStore = &breakerStore{Store: handlerStore, breaker: breaker}
+		metrics.observeBreaker(breaker)
+	}
+
+	if config.CacheSize > 0 {
+		cache := NewLRUCache(config.CacheSize, config.CacheTTL)
+
+		if config.CacheWarm > 0 {
+			start := time.Now()
+			n, err := warmCache(handlerStore, cache, min(config.CacheWarm, config.CacheSize))
+			if err != nil {
+				log.Printf("Unable to warm the url cache: %v", err)
+			} else {
+				log.Printf("Warmed the url cache with %d urls in %s", n, time.Since(start))
+			}
+		}
+
+		handlerStore = &cachedStore{
+			Store:  handlerStore,
+			cache:  cache,
+			hits:   metrics.CacheHits,
+			misses: metrics.CacheMisses,
+		}
+	}
+
+	if config.NegativeCacheTTL > 0 {
+		handlerStore = &negativeCachedStore{
+			Store:   handlerStore,
+			missing: NewNegativeCache(negativeCacheSize, config.NegativeCacheTTL),
+			hits:    metrics.NegativeHits,
+		}
+	}
+
+	// the snapshot is only read once the caches missed and is never cached itself, so urls from it
+	// are not served after the store is back
+	var snapshot *Snapshot
+	if config.FallbackSnapshot != "" {
+		if snapshot, err = LoadSnapshot(config.FallbackSnapshot); err != nil {
+			log.Fatalf("Unable to read the url snapshot: %v", err)
+		}
+
+		go writeSnapshots(handlerStore, snapshot, config.SnapshotInterval)
+		handlerStore = &snapshotStore{Store: handlerStore, snapshot: snapshot, hits: metrics.SnapshotHits}
+	}
+
+	if config.BackupLocation != "" {
+		backup, err := newBackup(config)
+		if err != nil {
+			log.Fatalf("Unable to open the backup location: %v", err)
+		}
+
+		go runBackups(handlerStore, backup, config.BackupInterval)
+	}
+
+	features, err := NewFeatureFlags(config.DisabledFeatures, config.FeatureFlags)
+	if err != nil {
+		log.Fatalf("Unable to load feature flags: %v", err)
+	}
+
+	if config.FeatureFlags != "" {
+		go watchFeatureFlags(features, featureReloadInterval)
+	}
+
+	var screener URLScreener
+	if config.SafeBrowsingKey != "" {
+		screener = NewSafeBrowsing(config.SafeBrowsingURL, config.SafeBrowsingKey)
+
+		if config.SafeBrowsingRescan > 0 {
+			go rescanURLs(handlerStore, screener, features, config.SafeBrowsingRescan)
+		}
+	}
+
+	if config.DeadLinkInterval > 0 {
+		go checkDeadLinks(handlerStore, config.DeadLinkFailures, config.DeadLinkInterval)
+	}
+
+	tokens, err := newTokenSigner(config.JWTSecret, config.JWTTTL)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	providers, err := newLoginProviders(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	shortDomains := NewShortDomains(config.Host, config.ShortDomains)
+	if customDomains != nil {
+		go verifyCustomDomains(customDomains, shortDomains, customDomainInterval)
+	}
+	domains := NewDomainPolicy(shortDomains.Hosts(), config.BlockedDomains, config.AllowedDomains)
+
+	banned, err := bans.BannedDomains()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var redirects *RedirectChecker
+	if config.RedirectCheckHops > 0 {
+		redirects = NewRedirectChecker(domains, config.RedirectCheckHops)
+	}
+
+	var reachability *ReachabilityChecker
+	if config.ValidateReachability != "" {
+		reachability = NewReachabilityChecker(config.ValidateReachability)
+	}
+
+	robotsTxt, err := loadRobotsTxt(config.RobotsTxt)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var geoip *GeoIP
+	if config.GeoIPDB != "" {
+		if geoip, err = OpenGeoIP(config.GeoIPDB); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	domains.SetBanned(banned)
+	go refreshBannedDomains(bans, domains, bannedDomainsInterval)
+
+	var events EventPublisher
+	if config.EventsURL != "" {
+		if events, err = newEventPublisher(config.EventsURL, config.EventsSubject); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var tracing *sdktrace.TracerProvider
+	var tracer trace.Tracer
+	if config.OTLPEndpoint != "" {
+		if tracing, err = newTracerProvider(config.OTLPEndpoint, config.TraceSampleRatio); err != nil {
+			log.Fatal(err)
+		}
+
+		tracer = tracing.Tracer(tracerName)
+	}
+
+	// queries made by handlers are recorded as spans of the request or rpc they serve
+	requestStore := handlerStore
+	if tracer != nil {
+		requestStore = &tracedStore{Store: handlerStore, tracer: tracer}
+	}
+
+	var webhooks *WebhookNotifier
+	if config.Webhooks {
+		webhooks = NewWebhookNotifier(hooks, config.WebhookMilestones)
+		go watchExpiries(handlerStore, webhooks, webhookExpiryInterval)
+	}
+
+	if config.DeleteRetention > 0 {
+		go purgeDeleted(handlerStore, config.DeleteRetention, trashPurgeInterval)
+	}
+
 	handlers := Handlers{
-		Host:      host,
-		masterDB:  sess,
-		slugifier: &slug,
+		Host:            config.Host,
+		store:           requestStore,
+		clicks:          clicks,
+		keys:            keys,
+		users:           users,
+		bans:            bans,
+		reports:         reports,
+		webhooks:        webhooks,
+		campaigns:       campaigns,
+		orgs:            orgs,
+		usage:           usage,
+		keyQuota:        config.KeyMonthlyQuota,
+		idempotency:     idempotency,
+		events:          events,
+		tracer:          tracer,
+		tokens:          tokens,
+		providers:       providers,
+		passwordLogin:   config.PasswordLogin,
+		slugifier:       slugs,
+		caselessSlugs:   config.CaselessSlugs,
+		requireAPIKey:   config.RequireAPIKey,
+		adminToken:      config.AdminToken,
+		limiter:         limiter,
+		breaker:         breaker,
+		snapshot:        snapshot,
+		proxyHops:       proxyHops,
+		metrics:         metrics,
+		screener:        screener,
+		features:        features,
+		domains:         domains,
+		shortDomains:    shortDomains,
+		customDomains:   customDomains,
+		redirects:       redirects,
+		reachability:    reachability,
+		geoip:           geoip,
+		hideNotLive:     config.NotLiveResponse == "404",
+		fetchMetadata:   config.FetchMetadata,
+		countBots:       config.CountBots,
+		anonymizeIPs:    config.AnonymizeIPs,
+		robotsTxt:       robotsTxt,
+		maxURLLength:    config.MaxURLLength,
+		maxBodyBytes:    int64(config.MaxBodyBytes),
+		redirectCode:    config.RedirectCode,
+		redirectMaxAge:  config.RedirectMaxAge,
+		reportThreshold: config.ReportThreshold,
+		deleteRetention: config.DeleteRetention,
 	}
 
-	r := httptreemux.New()
+	r := handlers.router(config)
+
+	var handler http.Handler = r
+	if tracer != nil {
+		handler = handlers.Trace(r)
+	}
+
+	if config.Compression {
+		handler = handlers.Compress(handler)
+	}
+
+	server := newServer(config, handlers.LogRequests(handler))
+
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
+
+	serverErrors := make(chan error, 3)
+	go func() {
+		fmt.Printf("Listening on %s\n", config.Host)
+		listenAndServe(server, config, shortDomains, serverErrors)
+	}()
+
+	var grpcServer *grpc.Server
+	if config.GRPCPort != "" {
+		grpcServer, err = newGRPCServer(config, &handlers)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go func() {
+			fmt.Printf("Serving grpc on :%s\n", config.GRPCPort)
+			serveGRPC(grpcServer, config, serverErrors)
+		}()
+	}
+
+	select {
+	case err := <-serverErrors:
+		store.Close()
+		log.Fatal(err)
+	case sig := <-shutdown:
+		log.Printf("Received %s, draining in-flight requests", sig)
 
-	r.GET("/", handlers.Index)
-	r.GET("/new/*", handlers.NewURL)
-	r.GET("/:slug", handlers.RedirectURL)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
 
-	fmt.Printf("Listening on %s\n", host)
-	http.ListenAndServe(":"+port, r)
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Unable to drain requests within %s: %v", shutdownTimeout, err)
+			server.Close()
+		}
+
+		if grpcServer != nil {
+			stopGRPC(grpcServer, shutdownTimeout)
+		}
+
+		if events != nil {
+			events.Close()
+		}
+
+		if tracing != nil {
+			if err := tracing.Shutdown(ctx); err != nil {
+				log.Printf("Unable to export the remaining spans: %v", err)
+			}
+		}
+
+		store.Close()
+	}
 }
 
-// Handlers contains all route handling logic for the service
-type Handlers struct {
-	Host      string
-	masterDB  *mgo.Session
-	slugifier *SlugGenerator
+// router registers every route of the service. Routes that change anything are wrapped in ReadOnly,
+// so they are refused while the store is unreachable rather than failing one by one.
+func (h *Handlers) router(config *Config) *httptreemux.TreeMux {
+	r := httptreemux.New()
+
+	r.GET("/", h.Index)
+	r.GET("/new/*", h.TextOnRequest(h.Instrument("new_url", h.RateLimit(h.ReadOnly(h.RequireAPIKey(h.NewURL))))))
+	h.apiRoute(r, Operation{Method: "POST", Path: "/shorten", Summary: "Shorten a url", Auth: true, Query: textParams, Request: ShortenRequest{}, Status: http.StatusCreated, Response: URL{}, Text: true},
+		h.Instrument("shorten", h.RateLimit(h.RequireAPIKey(h.Quota(h.Shorten)))))
+	h.apiRoute(r, Operation{Method: "POST", Path: "/shorten/batch", Summary: "Shorten up to 100 urls", Auth: true, Query: textParams, Request: []ShortenRequest{}, Response: []BatchResult{}, Text: true},
+		h.Instrument("shorten_batch", h.RateLimit(h.RequireAPIKey(h.Quota(h.ShortenBatch)))))
+	h.apiRoute(r, Operation{Method: "POST", Path: "/report/:slug", Summary: "Report a url as abusive", Request: ReportRequest{}, Status: http.StatusAccepted},
+		h.Instrument("report_url", h.RateLimit(h.ReportURL)))
+	h.apiRoute(r, Operation{Method: "GET", Path: "/urls/:slug/stats", Summary: "Click statistics of a url", Response: Stats{}},
+		h.Instrument("url_stats", h.Feature(featureAnalytics, h.URLStats)))
+	h.apiRoute(r, Operation{Method: "GET", Path: "/urls/:slug/stats/export", Summary: "Download the clicks of a url as csv, or json with format=json", Auth: true, Query: []QueryParam{{Name: "format", Type: "string", Description: "csv or json"}, {Name: "from", Type: "string", Description: "Only the clicks from this RFC 3339 time or date"}, {Name: "to", Type: "string", Description: "Only the clicks before this RFC 3339 time or date"}}, Produces: "text/csv"},
+		h.Instrument("export_clicks", h.Feature(featureAnalytics, h.RequireAuth(h.ExportClicks))))
+	h.apiRoute(r, Operation{Method: "GET", Path: "/urls/:slug/stats/series", Summary: "Clicks of a url per hour or day", Query: []QueryParam{{Name: "interval", Type: "string", Description: "hour or day (default)"}, {Name: "from", Type: "string", Description: "Start of the series as an RFC 3339 time or date, defaults to 30 intervals before to"}, {Name: "to", Type: "string", Description: "End of the series as an RFC 3339 time or date, defaults to now"}}, Response: ClickSeries{}},
+		h.Instrument("click_series", h.Feature(featureAnalytics, h.ClickSeries)))
+	h.apiRoute(r, Operation{Method: "GET", Path: "/urls/:slug/stats/breakdown", Summary: "Top values of a click field, such as the referrer domain or utm campaign", Query: []QueryParam{{Name: "by", Type: "string", Description: "referrer, referrer_domain, utm_source, utm_medium or utm_campaign"}, {Name: "limit", Type: "integer", Description: "Number of values, 1 to 100, defaults to 10"}}, Response: Breakdown{}},
+		h.Instrument("click_breakdown", h.Feature(featureAnalytics, h.StatsBreakdown)))
+	h.apiRoute(r, Operation{Method: "GET", Path: "/urls/:slug/qr", Summary: "QR code of a short url", Query: []QueryParam{{Name: "size", Type: "integer", Description: "Width in pixels, 64 to 1024"}}, Produces: "image/png"},
+		h.Instrument("url_qr", h.Feature(featureQRCodes, h.QRCode)))
+	h.apiRoute(r, Operation{Method: "GET", Path: "/urls", Summary: "Urls created by the caller", Auth: true, Query: append([]QueryParam{{Name: "tag", Type: "string", Description: "Only the urls carrying this tag"}, {Name: "q", Type: "string", Description: "Only the urls whose destination or title contains every word"}, {Name: "campaign", Type: "string", Description: "Only the urls in this campaign"}, {Name: "deleted", Type: "boolean", Description: "true lists the deleted urls that can still be restored"}}, listParams...), Response: URLList{}},
+		h.Instrument("list_urls", h.RequireAuth(h.ListURLs)))
+	h.apiRoute(r, Operation{Method: "PUT", Path: "/urls/:slug", Summary: "Change a url", Auth: true, Request: UpdateRequest{}, Response: URL{}},
+		h.Instrument("update_url", h.RequireAuth(h.UpdateURL)))
+	h.apiRoute(r, Operation{Method: "DELETE", Path: "/urls/:slug", Summary: "Delete a url", Auth: true, Query: []QueryParam{{Name: "tombstone", Type: "boolean", Description: "false deletes the url permanently and allows the slug to be reused"}}, Status: http.StatusNoContent},
+		h.Instrument("delete_url", h.RequireAuth(h.DeleteURL)))
+	h.apiRoute(r, Operation{Method: "POST", Path: "/urls/:slug/restore", Summary: "Restore a deleted url", Auth: true, Response: URL{}},
+		h.Instrument("restore_url", h.RequireAuth(h.RestoreURL)))
+	h.apiRoute(r, Operation{Method: "GET", Path: "/export", Summary: "Download the caller's urls as csv, or json with format=json", Auth: true, Query: []QueryParam{{Name: "format", Type: "string", Description: "csv or json"}}, Produces: "text/csv"},
+		h.Instrument("export_urls", h.RequireAuth(h.ExportURLs)))
+	h.apiRoute(r, Operation{Method: "POST", Path: "/import", Summary: "Shorten the links in a csv file (text/csv) or json array", Auth: true, Request: []map[string]string{}, Response: []ImportResult{}, MaxBody: maxImportBytes},
+		h.Instrument("import_urls", h.RateLimit(h.RequireAuth(h.Quota(h.ImportURLs)))))
+	if config.Webhooks {
+		h.apiRoute(r, Operation{Method: "POST", Path: "/webhooks", Summary: "Register a webhook for the caller's urls", Auth: true, Request: WebhookRequest{}, Status: http.StatusCreated, Response: NewWebhookResponse{}},
+			h.RequireAuth(h.CreateWebhook))
+		h.apiRoute(r, Operation{Method: "GET", Path: "/webhooks", Summary: "The caller's webhooks", Auth: true, Response: []Webhook{}},
+			h.RequireAuth(h.ListWebhooks))
+		h.apiRoute(r, Operation{Method: "DELETE", Path: "/webhooks/:id", Summary: "Remove a webhook", Auth: true, Status: http.StatusNoContent},
+			h.RequireAuth(h.DeleteWebhook))
+	}
+	h.apiRoute(r, Operation{Method: "POST", Path: "/campaigns", Summary: "Create a campaign grouping the caller's urls", Auth: true, Request: CampaignRequest{}, Status: http.StatusCreated, Response: Campaign{}},
+		h.RequireAuth(h.CreateCampaign))
+	h.apiRoute(r, Operation{Method: "GET", Path: "/campaigns", Summary: "The caller's campaigns", Auth: true, Response: []Campaign{}},
+		h.RequireAuth(h.ListCampaigns))
+	h.apiRoute(r, Operation{Method: "GET", Path: "/campaigns/:id/stats", Summary: "Clicks of the urls in a campaign", Auth: true, Response: CampaignStats{}},
+		h.Instrument("campaign_stats", h.Feature(featureAnalytics, h.RequireAuth(h.CampaignStats))))
+	h.apiRoute(r, Operation{Method: "DELETE", Path: "/campaigns/:id", Summary: "Remove a campaign, its urls are kept", Auth: true, Status: http.StatusNoContent},
+		h.RequireAuth(h.DeleteCampaign))
+	if config.CustomDomains {
+		h.apiRoute(r, Operation{Method: "POST", Path: "/domains", Summary: "Register a custom domain for the caller's urls", Auth: true, Request: CustomDomainRequest{}, Status: http.StatusCreated, Response: CustomDomainStatus{}},
+			h.RequireAuth(h.RegisterCustomDomain))
+		h.apiRoute(r, Operation{Method: "GET", Path: "/domains", Summary: "The caller's custom domains", Auth: true, Response: []CustomDomainStatus{}},
+			h.RequireAuth(h.ListCustomDomains))
+		h.apiRoute(r, Operation{Method: "POST", Path: "/domains/:domain/verify", Summary: "Check the TXT record of a custom domain now", Auth: true, Response: CustomDomainStatus{}},
+			h.RateLimit(h.RequireAuth(h.VerifyCustomDomain)))
+		h.apiRoute(r, Operation{Method: "DELETE", Path: "/domains/:domain", Summary: "Remove a custom domain, its urls move to the primary domain", Auth: true, Status: http.StatusNoContent},
+			h.RequireAuth(h.DeleteCustomDomain))
+	}
+	h.apiRoute(r, Operation{Method: "POST", Path: "/users", Summary: "Register an account", Request: Credentials{}, Status: http.StatusCreated, Response: User{}},
+		h.Instrument("register", h.RateLimit(h.PasswordLogin(h.Register))))
+	h.apiRoute(r, Operation{Method: "POST", Path: "/login", Summary: "Log in for a session token", Request: Credentials{}, Response: TokenResponse{}},
+		h.Instrument("login", h.RateLimit(h.PasswordLogin(h.Login))))
+	h.apiRoute(r, Operation{Method: "GET", Path: "/users/me", Summary: "The caller's account", Auth: true, Response: User{}},
+		h.RequireAuth(h.CurrentUser))
+	h.apiRoute(r, Operation{Method: "POST", Path: "/users/me/keys", Summary: "Mint an api key for the caller's account", Auth: true, Request: NewAPIKeyRequest{}, Status: http.StatusCreated, Response: NewAPIKeyResponse{}},
+		h.RequireAuth(h.CreateUserAPIKey))
+	h.apiRoute(r, Operation{Method: "GET", Path: "/usage", Summary: "Shorten calls and redirects of the caller's api key in a month", Auth: true, Query: usageParams, Response: KeyUsage{}},
+		h.RequireAuth(h.Usage))
+	h.apiRoute(r, Operation{Method: "POST", Path: "/orgs", Summary: "Create an organization owned by the caller", Auth: true, Request: OrgRequest{}, Status: http.StatusCreated, Response: OrgMembership{}},
+		h.RequireAuth(h.CreateOrg))
+	h.apiRoute(r, Operation{Method: "GET", Path: "/orgs", Summary: "The organizations the caller is a member of", Auth: true, Response: []OrgMembership{}},
+		h.RequireAuth(h.ListOrgs))
+	h.apiRoute(r, Operation{Method: "DELETE", Path: "/orgs/:id", Summary: "Delete an organization without urls (owner)", Auth: true, Status: http.StatusNoContent},
+		h.RequireAuth(h.DeleteOrg))
+	h.apiRoute(r, Operation{Method: "GET", Path: "/orgs/:id/members", Summary: "Members of an organization", Auth: true, Response: []Member{}},
+		h.RequireAuth(h.ListMembers))
+	h.apiRoute(r, Operation{Method: "POST", Path: "/orgs/:id/members", Summary: "Add a registered user to an organization (owner)", Auth: true, Request: MemberRequest{}, Status: http.StatusCreated, Response: Member{}},
+		h.RequireAuth(h.AddMember))
+	h.apiRoute(r, Operation{Method: "PUT", Path: "/orgs/:id/members/:user_id", Summary: "Change the role of a member (owner)", Auth: true, Request: MemberRequest{}, Response: Member{}},
+		h.RequireAuth(h.UpdateMember))
+	h.apiRoute(r, Operation{Method: "DELETE", Path: "/orgs/:id/members/:user_id", Summary: "Remove a member, or leave an organization", Auth: true, Status: http.StatusNoContent},
+		h.RequireAuth(h.RemoveMember))
+	h.apiRoute(r, Operation{Method: "POST", Path: "/admin/keys", Summary: "Mint an api key (admin)", Auth: true, Request: NewAPIKeyRequest{}, Status: http.StatusCreated, Response: NewAPIKeyResponse{}},
+		h.RequireAdmin(h.CreateAPIKey))
+	h.apiRoute(r, Operation{Method: "DELETE", Path: "/admin/keys/:id", Summary: "Revoke an api key (admin)", Auth: true, Status: http.StatusNoContent},
+		h.RequireAdmin(h.RevokeAPIKey))
+	h.apiRoute(r, Operation{Method: "PUT", Path: "/admin/keys/:id", Summary: "Change the monthly quota of an api key (admin)", Auth: true, Request: KeyQuotaRequest{}, Response: APIKey{}},
+		h.RequireAdmin(h.SetKeyQuota))
+	h.apiRoute(r, Operation{Method: "GET", Path: "/admin/keys/:id/usage", Summary: "Shorten calls and redirects of an api key in a month (admin)", Auth: true, Query: usageParams, Response: KeyUsage{}},
+		h.RequireAdmin(h.KeyUsage))
+	h.apiRoute(r, Operation{Method: "GET", Path: "/admin/urls", Summary: "Search every owner's urls (admin)", Auth: true, Query: append([]QueryParam{{Name: "q", Type: "string", Description: "Matches slugs and destinations"}}, listParams...), Response: URLList{}},
+		h.RequireAdmin(h.SearchURLs))
+	h.apiRoute(r, Operation{Method: "POST", Path: "/admin/urls/:slug/disable", Summary: "Stop a url from redirecting (admin)", Auth: true, Response: URL{}},
+		h.RequireAdmin(h.DisableURL))
+	h.apiRoute(r, Operation{Method: "POST", Path: "/admin/urls/:slug/enable", Summary: "Re-enable a disabled url (admin)", Auth: true, Response: URL{}},
+		h.RequireAdmin(h.EnableURL))
+	h.apiRoute(r, Operation{Method: "DELETE", Path: "/admin/urls/:slug", Summary: "Ban a slug (admin)", Auth: true, Status: http.StatusNoContent},
+		h.RequireAdmin(h.BanURL))
+	h.apiRoute(r, Operation{Method: "GET", Path: "/admin/domains", Summary: "Banned destination domains (admin)", Auth: true, Response: BannedDomainList{}},
+		h.RequireAdmin(h.BannedDomains))
+	h.apiRoute(r, Operation{Method: "POST", Path: "/admin/domains", Summary: "Ban a destination domain (admin)", Auth: true, Request: BanDomainRequest{}, Status: http.StatusCreated, Response: BanDomainResponse{}},
+		h.RequireAdmin(h.BanDomain))
+	h.apiRoute(r, Operation{Method: "DELETE", Path: "/admin/domains/:domain", Summary: "Lift a domain ban (admin)", Auth: true, Status: http.StatusNoContent},
+		h.RequireAdmin(h.UnbanDomain))
+	h.apiRoute(r, Operation{Method: "GET", Path: "/admin/reports", Summary: "Abuse reports (admin)", Auth: true, Query: []QueryParam{{Name: "slug", Type: "string", Description: "Only the reports for this url"}, listParams[0], listParams[1]}, Response: ReportList{}},
+		h.RequireAdmin(h.ListReports))
+	h.apiRoute(r, Operation{Method: "DELETE", Path: "/admin/reports/:slug", Summary: "Dismiss the reports for a url (admin)", Auth: true, Status: http.StatusNoContent},
+		h.RequireAdmin(h.DismissReports))
+	h.apiRoute(r, Operation{Method: "DELETE", Path: "/admin/clicks", Summary: "Purge the click events recorded before a time (admin)", Auth: true, Query: []QueryParam{{Name: "before", Type: "string", Description: "RFC 3339 time or date the click events recorded before are purged"}}, Response: PurgeClicksResponse{}},
+		h.RequireAdmin(h.PurgeClicks))
+	h.apiRoute(r, Operation{Method: "GET", Path: "/admin/features", Summary: "Whether each optional feature is enabled (admin)", Auth: true, Response: map[string]bool{}},
+		h.RequireAdmin(h.FeatureFlags))
+	if config.BitlyCompat {
+		h.route(r, Operation{Method: "POST", Path: "/v4/shorten", Summary: "Shorten a url (Bitly v4 compatible)", Auth: true, Request: BitlyShortenRequest{}, Status: http.StatusCreated, Response: Bitlink{}},
+			h.Instrument("bitly_shorten", h.RateLimit(h.ReadOnly(h.RequireAPIKey(h.Quota(h.LimitBody(0, h.BitlyShorten)))))))
+		h.route(r, Operation{Method: "GET", Path: "/v4/bitlinks/:domain/:slug/clicks", Summary: "Clicks per day of a url (Bitly v4 compatible)", Query: bitlyUnits, Response: BitlyLinkClicks{}},
+			h.Instrument("bitly_clicks", h.Feature(featureAnalytics, h.BitlyClicks)))
+	}
+	h.route(r, Operation{Method: "GET", Path: "/api/quick", Summary: "Shorten a url and respond with only the short url as plain text", Auth: true, Query: quickParams, Status: http.StatusCreated, Produces: "text/plain"},
+		h.Instrument("quick", h.PlainText(h.RateLimit(h.ReadOnly(h.QueryKey(h.RequireAPIKey(h.Quota(h.Quick))))))))
+	r.GET("/api/openapi.json", h.OpenAPI)
+	r.GET("/api/docs", h.APIDocs)
+	r.POST("/dashboard/login", h.Instrument("dashboard_login", h.RateLimit(h.PasswordLogin(h.DashboardLogin))))
+	r.GET("/auth/:provider", h.Instrument("provider_login", h.RateLimit(h.ProviderLogin)))
+	r.GET("/auth/:provider/callback", h.Instrument("provider_callback", h.RateLimit(h.ReadOnlyPage(h.ProviderCallback))))
+	r.POST("/dashboard/logout", h.RequireSession(h.DashboardLogout))
+	r.POST("/dashboard/urls", h.Instrument("dashboard_create_url", h.RateLimit(h.ReadOnlyPage(h.RequireSession(h.DashboardCreateURL)))))
+	r.POST("/dashboard/urls/:slug", h.Instrument("dashboard_update_url", h.ReadOnlyPage(h.RequireSession(h.DashboardUpdateURL))))
+	r.POST("/dashboard/urls/:slug/delete", h.Instrument("dashboard_delete_url", h.ReadOnlyPage(h.RequireSession(h.DashboardDeleteURL))))
+	r.GET("/robots.txt", h.RobotsTxt)
+	r.GET("/healthz", h.Healthz)
+	r.GET("/readyz", h.Readyz)
+	r.GET("/metrics", func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		h.metrics.Registry.ServeHTTP(w, r)
+	})
+	h.route(r, Operation{Method: "GET", Path: "/:slug", Summary: "Redirect to the destination of a short url", Status: http.StatusFound},
+		h.Instrument("redirect_url", h.RedirectURL))
+	h.route(r, Operation{Method: "HEAD", Path: "/:slug", Summary: "Redirect headers of a short url, without a body and without counting a click", Status: http.StatusFound},
+		h.Instrument("redirect_head", h.RedirectURL))
+	h.route(r, Operation{Method: "OPTIONS", Path: "/:slug", Summary: "Methods a short url answers", Status: http.StatusNoContent},
+		h.RedirectOptions)
+	r.POST("/:slug", h.Instrument("unlock_url", h.RateLimit(h.ReadOnlyPage(h.RedirectURL))))
+
+	return r
 }
 
-// Index displays the application instructions
-func (h *Handlers) Index(w http.ResponseWriter, r *http.Request, _ map[string]string) {
-	file := path.Join("index.html")
+// newStore creates the storage backend selected by the configuration
+func newStore(c *Config) (Store, error) {
+	switch c.Store {
+	case "mongo":
+		s, err := NewMongoStore(c.MongoDSN, c.MongoTimeout, c.MongoPoolSize)
+		if err != nil || (c.MongoReadDSN == "" && c.MongoReadPreference == "") {
+			return s, err
+		}
+
+		if err := s.ReadFrom(c.MongoReadDSN, c.MongoReadPreference, c.MongoPoolSize); err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		return s, nil
+	case "redis":
+		return NewRedisStore(c.RedisDSN, c.StoreTimeout, c.RedisPoolSize)
+	case "postgres":
+		return NewPostgresStore(c.PostgresDSN, c.StoreTimeout, c.PostgresPoolSize)
+	case "memory":
+		return NewMemoryStore(), nil
+	}
 
-	data := struct{ Host string }{Host: h.Host}
+	return nil, fmt.Errorf("Unknown store %q", c.Store)
+}
 
-	temp, _ := template.ParseFiles(file)
-	temp.Execute(w, &data)
+// Handlers contains all route handling logic for the service
+type Handlers struct {
+	Host          string
+	store         Store
+	clicks        ClickStore
+	keys          KeyStore
+	tokens        *TokenSigner
+	providers     []*LoginProvider
+	passwordLogin bool
+	users         UserStore
+	bans          DomainBanStore
+	reports       ReportStore
+	webhooks      *WebhookNotifier
+	campaigns     CampaignStore
+	orgs          OrgStore
+	usage         UsageStore
+	keyQuota      int
+	idempotency   IdempotencyStore
+	events        EventPublisher
+	tracer        trace.Tracer
+	slugifier     SlugSource
+	caselessSlugs bool
+	requireAPIKey bool
+	adminToken    string
+	limiter       *RateLimiter
+	breaker       *CircuitBreaker
+	snapshot      *Snapshot
+	proxyHops     int
+	metrics       *Metrics
+	screener      URLScreener
+	features      *FeatureFlags
+	domains       *DomainPolicy
+	shortDomains  *ShortDomains
+	customDomains CustomDomainStore
+	redirects     *RedirectChecker
+	reachability  *ReachabilityChecker
+	geoip         *GeoIP
+	hideNotLive   bool
+	fetchMetadata bool
+	// countBots counts redirects served to bots as clicks
+	countBots bool
+	// anonymizeIPs truncates client addresses before they are logged or stored
+	anonymizeIPs bool
+	// robotsTxt is served as /robots.txt
+	robotsTxt []byte
+	// maxURLLength bounds the length of destinations, 0 does not bound it
+	maxURLLength int
+	// maxBodyBytes bounds the size of api request bodies
+	maxBodyBytes   int64
+	redirectCode   int
+	redirectMaxAge int
+	// deleteRetention is how long deleted urls can be restored, 0 deletes them right away
+	deleteRetention time.Duration
+	// reportThreshold is the number of distinct reporters that disables a url, 0 never disables
+	reportThreshold int
+	operations      []Operation
 }
 
 // NewURL creates a new url in the database
 func (h *Handlers) NewURL(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	u := params[""]
 
-	if !h.ValidateURL(u) {
-		h.RespondError(w, ErrInvalidURL, http.StatusBadRequest)
+	h.shorten(w, r, ShortenRequest{URL: u, ForceNew: r.URL.Query().Get("force_new") == "true"})
+}
+
+// Shorten creates a new url in the database from a json request body
+func (h *Handlers) Shorten(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	req := ShortenRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondBodyError(w, err, ErrInvalidRequest)
 		return
 	}
 
-	reqDB := h.masterDB.Copy()
-	defer reqDB.Close()
+	if r.URL.Query().Get("force_new") == "true" {
+		req.ForceNew = true
+	}
 
-	collection := reqDB.DB("").C(urlCollection)
+	h.shorten(w, r, req)
+}
 
-	slug := h.slugifier.GenerateUniqueSlug(8, collection, "slug")
+// shorten validates the request, stores the url under the requested slug (or a newly generated one
+// when empty) and writes the created document. Retries of a request sent with an Idempotency-Key
+// header respond with the url the first one created.
+func (h *Handlers) shorten(w http.ResponseWriter, r *http.Request, req ShortenRequest) {
+	req.Domain = h.requestDomain(r, req.Domain)
+	owner := requestOwner(r)
 
-	newUrl := URL{
-		Slug:        slug,
-		OriginalURL: u,
-		ShortURL:    h.Host + "/" + slug,
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key != "" && !h.claimIdempotencyKey(w, r, owner, key, req) {
+		return
 	}
 
-	if err := collection.Insert(&newUrl); err != nil {
-		h.RespondError(w, ErrUnableToShortenUrl, http.StatusBadRequest)
+	newUrl, existing, err := h.createURL(r.Context(), w.Header(), owner, req)
+	if err != nil {
+		if key != "" {
+			h.completeIdempotencyKey(owner, key, nil, 0)
+		}
+
+		h.RespondError(w, err, shortenStatus(err))
 		return
 	}
 
-	h.RespondJSON(w, newUrl, 201)
+	logSlug(r, newUrl.Slug)
+
+	status := http.StatusCreated
+	if existing {
+		status = http.StatusOK
+	}
+
+	if key != "" {
+		h.completeIdempotencyKey(owner, key, newUrl, status)
+	}
+
+	h.respondShortened(w, newUrl, status)
+}
+
+// createURL validates req, screens and probes its destinations and stores the url for owner. When
+// owner has already shortened the same url the stored document is returned with existing set instead.
+func (h *Handlers) createURL(ctx context.Context, header http.Header, owner string, req ShortenRequest) (u *URL, existing bool, err error) {
+	u, existing, err = h.newURL(ctx, owner, req)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if flaggedURL(h.unsafeURLs(u.Destinations()...), u) {
+		return nil, false, ErrUnsafeURL
+	}
+
+	if existing {
+		return u, true, nil
+	}
+
+	for _, destination := range u.Destinations() {
+		if err := h.reachable(header, destination); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if h.fetchMetadata {
+		u.PageMetadata = fetchMetadata(u.OriginalURL)
+	}
+
+	err = h.store.Save(ctx, u)
+	if err == ErrSlugTaken && req.Slug == "" {
+		err = h.saveUnderNewSlug(ctx, u)
+	}
+
+	if err != nil {
+		if err == ErrSlugTaken || err == ErrUnableToCreateSlug {
+			return nil, false, err
+		}
+
+		return nil, false, ErrUnableToShortenUrl
+	}
+
+	h.metrics.ShortensCreated.Inc()
+	h.notify(EventLinkCreated, u)
+
+	return u, false, nil
+}
+
+// saveUnderNewSlug stores u under a freshly drawn slug after its generated slug turned out to be
+// taken, which happens when the slug is claimed as a custom slug while it waits in a SlugPool. The
+// caller did not choose the slug, so it is only told about a conflict with ErrUnableToCreateSlug once
+// maxSlugRetries fresh slugs have been taken as well.
+func (h *Handlers) saveUnderNewSlug(ctx context.Context, u *URL) error {
+	for i := 0; i < maxSlugRetries; i++ {
+		slug, err := h.slugifier.NextSlug()
+		if err != nil {
+			return ErrUnableToCreateSlug
+		}
+
+		u.Slug, u.ShortURL = slug, h.shortDomains.Of(u).ShortURL(slug)
+		if err := h.store.Save(ctx, u); err != ErrSlugTaken {
+			return err
+		}
+	}
+
+	return ErrUnableToCreateSlug
+}
+
+// newURL validates req and builds the url to store for owner. When owner has already shortened the
+// same url the stored document is returned with existing set instead.
+func (h *Handlers) newURL(ctx context.Context, owner string, req ShortenRequest) (u *URL, existing bool, err error) {
+	slug := h.canonicalSlug(req.Slug)
+
+	if req.URL, err = h.NormalizeURL(req.URL); err != nil {
+		return nil, false, err
+	}
+
+	geoTargets, err := h.validGeoTargets(req.GeoTargets)
+	if err != nil {
+		return nil, false, err
+	}
+
+	deviceTargets, err := h.validDeviceTargets(req.DeviceTargets)
+	if err != nil {
+		return nil, false, err
+	}
+
+	variants, err := h.validVariants(req.Variants)
+	if err != nil {
+		return nil, false, err
+	}
+
+	tags, err := validTags(req.Tags)
+	if err != nil {
+		return nil, false, err
+	}
+
+	campaign, err := h.validCampaign(owner, req.Campaign)
+	if err != nil {
+		return nil, false, err
+	}
+
+	domain := h.shortDomains.Lookup(req.Domain)
+	if domain == nil || (domain.Owner != "" && domain.Owner != owner) {
+		return nil, false, ErrUnknownDomain
+	}
+
+	if slug != "" && !h.ValidateSlug(slug) {
+		return nil, false, ErrInvalidSlug
+	}
+
+	if slug != "" && reservedSlug(slug) {
+		return nil, false, ErrReservedSlug
+	}
+
+	expiresAt, err := req.expiry(time.Now())
+	if err != nil {
+		return nil, false, err
+	}
+
+	startsAt, err := req.start(expiresAt)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if req.RedirectCode != 0 && !redirectCodes[req.RedirectCode] {
+		return nil, false, ErrInvalidRedirectCode
+	}
+
+	if req.MaxClicks < 0 || (req.SelfDestruct && req.MaxClicks == 0) {
+		return nil, false, ErrInvalidMaxClicks
+	}
+
+	// identical long urls share a slug unless the caller asked for a specific slug, expiry, start, redirect
+	// code, password, click limit, geo or device targets, variants, tags, campaign or a new one.
+	// Protected, limited and targeted urls are never handed to callers that did not ask for them.
+	if slug == "" && expiresAt == nil && startsAt == nil && req.RedirectCode == 0 && req.Password == "" && req.MaxClicks == 0 && geoTargets == nil && deviceTargets == nil && variants == nil && tags == nil && campaign == "" && !req.ForceNew {
+		if existing, err := h.store.FindByOriginalURL(ctx, owner, req.URL); err == nil && existing.PasswordHash == "" && existing.MaxClicks == 0 && !existing.targeted() && h.shortDomains.Of(existing) == domain {
+			return existing, true, nil
+		} else if err != nil && err != ErrNotFound {
+			return nil, false, ErrUnableToShortenUrl
+		}
+	}
+
+	passwordHash := ""
+	if req.Password != "" {
+		if passwordHash, err = hashPassword(req.Password); err != nil {
+			return nil, false, ErrUnableToShortenUrl
+		}
+	}
+
+	// redirects through the url count towards the usage of the api key that created it
+	keyID := ""
+	if k := contextAPIKey(ctx); k != nil {
+		keyID = k.ID
+	}
+
+	if slug == "" {
+		next, err := h.slugifier.NextSlug()
+		if err != nil {
+			return nil, false, ErrUnableToCreateSlug
+		}
+
+		slug = next
+	} else if exists, err := h.store.Exists(ctx, slug); err != nil {
+		return nil, false, ErrUnableToShortenUrl
+	} else if exists {
+		return nil, false, ErrSlugTaken
+	}
+
+	return &URL{
+		Slug:          slug,
+		OriginalURL:   req.URL,
+		ShortURL:      domain.ShortURL(slug),
+		Domain:        domain.Host,
+		ExpiresAt:     expiresAt,
+		StartsAt:      startsAt,
+		Owner:         owner,
+		KeyID:         keyID,
+		RedirectCode:  req.RedirectCode,
+		Protected:     passwordHash != "",
+		PasswordHash:  passwordHash,
+		MaxClicks:     req.MaxClicks,
+		SelfDestruct:  req.SelfDestruct,
+		GeoTargets:    geoTargets,
+		DeviceTargets: deviceTargets,
+		Variants:      variants,
+		Tags:          tags,
+		Campaign:      campaign,
+		CreatedAt:     time.Now().UTC(),
+	}, false, nil
+}
+
+// shortenStatus returns the http status reported for an error returned by newURL or createURL
+func shortenStatus(err error) int {
+	switch err {
+	case ErrSlugTaken, ErrReservedSlug:
+		return http.StatusConflict
+	case ErrUnsafeURL, ErrUnreachableURL, ErrURLTooLong:
+		return http.StatusUnprocessableEntity
+	case ErrUnableToShortenUrl, ErrUnableToCreateSlug:
+		return http.StatusInternalServerError
+	case ErrStoreUnavailable:
+		return http.StatusServiceUnavailable
+	}
+
+	// the remaining coded errors are validation failures, anything else is unexpected
+	if _, ok := err.(*CodedError); ok {
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
 }
 
 // RedirectURL parses the url slug and redirects the user to the desired location
 func (h *Handlers) RedirectURL(w http.ResponseWriter, r *http.Request, params map[string]string) {
-	slug := params["slug"]
+	slug, preview := isPreview(r, h.canonicalSlug(params["slug"]))
+	logSlug(r, slug)
+
+	// slugs are unique across domains, a url is only served on the domain it was created on
+	newUrl, err := h.store.ResolveSlug(r.Context(), slug)
+	if storeFailure(err) {
+		h.RespondErrorPage(w, r, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	if d := h.shortDomains.ForRequest(r); err != nil || newUrl.Deleted() || (d != nil && d != h.shortDomains.Of(newUrl)) {
+		h.metrics.NotFound.Inc()
+		h.RespondErrorPage(w, r, ErrNotFound, http.StatusNotFound)
 
-	reqDB := h.masterDB.Copy()
-	defer reqDB.Close()
+		return
+	}
 
-	newUrl := URL{}
-	if err := reqDB.DB("").C(urlCollection).Find(bson.M{"slug": slug}).One(&newUrl); err != nil {
-		h.RespondError(w, ErrNotFound, http.StatusNotFound)
+	if newUrl.Expired(time.Now()) {
+		h.RespondErrorPage(w, r, ErrExpired, http.StatusGone)
+		return
+	}
 
+	if newUrl.Disabled {
+		h.RespondErrorPage(w, r, ErrDisabled, http.StatusForbidden)
 		return
 	}
 
-	http.Redirect(w, r, newUrl.OriginalURL, 302)
+	if !newUrl.Started(time.Now()) {
+		h.respondNotLive(w, r, newUrl)
+		return
+	}
+
+	if !h.unlocked(w, r, newUrl) {
+		return
+	}
+
+	// the interstitial links back to the short url, the click is recorded once the visitor continues
+	if preview {
+		if !h.features.Enabled(featurePreviews) {
+			h.RespondErrorPage(w, r, ErrFeatureDisabled, http.StatusNotFound)
+			return
+		}
+
+		h.RespondPreview(w, newUrl)
+		return
+	}
+
+	if newUrl.MaxClicks > 0 {
+		// probes learn the url is live without using up one of its clicks or seeing where it leads
+		if r.Method == http.MethodHead {
+			w.Header().Set("Cache-Control", "private, no-cache, no-store, must-revalidate")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if !h.consumeClick(w, r, newUrl) {
+			return
+		}
+	}
+
+	destination, variant := newUrl.Destination(requestDevice(r), h.country(r))
+
+	h.recordClick(newUrl, destination, variant, r)
+	h.metrics.RedirectsServed.Inc()
+
+	h.redirect(w, r, newUrl, destination)
 
 	return
 }
 
-// ValidateURL will check a url to ensure that it is valid
-func (h *Handlers) ValidateURL(input string) bool {
-	u, err := url.Parse(input)
+// NormalizeURL checks that a url is a valid http or https url pointing at a public domain that may be
+// shortened and does not redirect back to the shortener, returning the canonical form it is stored in
+func (h *Handlers) NormalizeURL(input string) (string, error) {
+	if h.maxURLLength > 0 && len(input) > h.maxURLLength {
+		return "", ErrURLTooLong
+	}
+
+	normalized, err := normalizeURL(input)
+	if err != nil {
+		return "", err
+	}
+
+	// normalizing may escape or punycode a url into a longer one
+	if h.maxURLLength > 0 && len(normalized) > h.maxURLLength {
+		return "", ErrURLTooLong
+	}
+
+	u, _ := url.Parse(normalized)
+	if h.domains != nil && !h.domains.Allowed(u.Hostname()) {
+		return "", ErrBlockedDomain
+	}
+
+	if h.redirects != nil {
+		if err := h.redirects.Check(normalized); err != nil {
+			return "", err
+		}
+	}
+
+	return normalized, nil
+}
+
+// canonicalSlug returns the form slug is stored and looked up in, lower case when slugs are
+// case-insensitive
+func (h *Handlers) canonicalSlug(slug string) string {
+	if h.caselessSlugs {
+		return strings.ToLower(slug)
+	}
+
+	return slug
+}
 
-	fmt.Println(err, u.Scheme, u.Host)
-	if err != nil || u.Scheme == "" || !strings.Contains(u.Host, ".") {
+// ValidateSlug will check a custom slug to ensure it only uses the allowed characters
+func (h *Handlers) ValidateSlug(slug string) bool {
+	if len(slug) < customSlugMinLength || len(slug) > customSlugMaxLength {
 		return false
 	}
 
+	for _, c := range slug {
+		if !strings.ContainsRune(customSlugChars, c) {
+			return false
+		}
+	}
+
 	return true
 }
 
 // RespondError creates a valid error response
 func (h *Handlers) RespondError(w http.ResponseWriter, err error, status int) {
-	h.RespondJSON(w, JsonError{Error: err.Error()}, status)
+	h.setRetryAfter(w, status)
+
+	if plainText(w) {
+		h.writeText(w, err.Error(), status)
+		return
+	}
+
+	id := w.Header().Get(requestIDHeader)
+	code, field := errorCode(err, status)
+	if enveloped(w) {
+		h.writeJSON(w, Envelope{Error: &APIError{Status: status, Code: code, Field: field, Message: err.Error(), RequestID: id}}, status)
+		return
+	}
+
+	h.writeJSON(w, JsonError{Error: err.Error(), Code: code, Field: field, RequestID: id}, status)
 }
 
-// ResponseJSON handles all json responses from the service
+// RespondErrorPage writes err as an html page to browsers and as json to api clients, it is used on
+// the routes visitors reach by clicking short urls
+func (h *Handlers) RespondErrorPage(w http.ResponseWriter, r *http.Request, err error, status int) {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		h.RespondError(w, err, status)
+		return
+	}
+
+	h.setRetryAfter(w, status)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	templates.ExecuteTemplate(w, "error.html", &ErrorPage{
+		Host:       h.Host,
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    err.Error(),
+		RequestID:  w.Header().Get(requestIDHeader),
+	})
+}
+
+// ResponseJSON handles all json responses from the service, wrapping them in an Envelope on the
+// versioned api
 func (h *Handlers) RespondJSON(w http.ResponseWriter, data interface{}, status int) {
+	if enveloped(w) {
+		data = envelope(data)
+	}
+
+	h.writeJSON(w, data, status)
+}
+
+// writeJSON writes data as the response body
+func (h *Handlers) writeJSON(w http.ResponseWriter, data interface{}, status int) {
 	w.Header().Set("Content-Type", "application/json")
 
 	js, err := json.Marshal(data)
@@ -185,10 +1371,14 @@ func (h *Handlers) RespondJSON(w http.ResponseWriter, data interface{}, status i
 func (s *SlugGenerator) GenerateSlug(length int) string {
 	slugBytes := make([]byte, length)
 
-	charCount := len(chars) - 1
+	alphabet := s.alphabet
+	if alphabet == "" {
+		alphabet = chars
+	}
+
 	for i := 0; i < length; i++ {
-		num := s.random.Intn(charCount)
-		slugBytes[i] = chars[num]
+		num := s.random.Intn(len(alphabet))
+		slugBytes[i] = alphabet[num]
 	}
 
 	slug := string(slugBytes)
@@ -197,13 +1387,17 @@ func (s *SlugGenerator) GenerateSlug(length int) string {
 }
 
 // GenerateUniqueSlug will generate a slug of the specified length and verify that it does not exist
-// in the database
-func (s *SlugGenerator) GenerateUniqueSlug(length int, c *mgo.Collection, key string) string {
+// in the store
+func (s *SlugGenerator) GenerateUniqueSlug(length int, store Store) string {
 	valid := false
 	slug := ""
 	for valid == false {
 		slug = s.GenerateSlug(length)
-		if c, err := c.Find(bson.M{"slug": slug}).Count(); err == nil && c == 0 {
+		if reservedSlug(slug) {
+			continue
+		}
+
+		if exists, err := store.Exists(context.Background(), slug); err == nil && !exists {
 			valid = true
 			break
 		}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// testHost is the host the handlers under test shorten urls on
+const testHost = "https://sho.rt"
+
+// newTestHandlers returns handlers backed by a fresh memory store with every feature enabled and no
+// rate limits, api keys or quotas required
+func newTestHandlers(tb testing.TB) (*Handlers, *MemoryStore) {
+	tb.Helper()
+
+	store := NewMemoryStore()
+	features, err := NewFeatureFlags(nil, "")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	generator := &SlugGenerator{random: rand.New(rand.NewSource(1))}
+	slugs, err := newSlugSource("counter", defaultRandomSlugLength, "", "", defaultSlugBlockSize, store, generator)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	shortDomains := NewShortDomains(testHost, nil)
+
+	return &Handlers{
+		Host:         testHost,
+		store:        store,
+		clicks:       store,
+		keys:         store,
+		users:        store,
+		bans:         store,
+		reports:      store,
+		campaigns:    store,
+		orgs:         store,
+		usage:        store,
+		idempotency:  store,
+		slugifier:    slugs,
+		metrics:      NewMetrics(),
+		features:     features,
+		shortDomains: shortDomains,
+		domains:      NewDomainPolicy(shortDomains.Hosts(), nil, nil),
+		redirectCode: 302,
+	}, store
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultPerPage = 20
+const maxPerPage = 100
+
+// URLList is a page of urls
+type URLList struct {
+	URLs    []URL `json:"urls"`
+	Page    int   `json:"page"`
+	PerPage int   `json:"per_page"`
+	Total   int   `json:"total"`
+}
+
+// ListURLs responds with a page of the urls created with the caller's api key. The page, per_page
+// and sort (created_at, slug, original_url or clicks, prefixed with - for descending) query parameters
+// select the page, tag restricts it to urls carrying that tag, campaign to the urls in that campaign
+// and q to urls whose destination or title contains every word of it.
+func (h *Handlers) ListURLs(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	q, err := listQuery(r)
+	if err != nil {
+		h.RespondError(w, ErrInvalidListQuery, http.StatusBadRequest)
+		return
+	}
+
+	q.Owner = requestOwner(r)
+	q.Tag = normalizeTag(r.URL.Query().Get("tag"))
+	q.Text = strings.Join(searchWords(r.URL.Query().Get("q")), " ")
+	q.Campaign = r.URL.Query().Get("campaign")
+	q.Deleted = r.URL.Query().Get("deleted") == "true"
+
+	h.respondURLList(w, r, q)
+}
+
+// listQuery parses the page, per_page and sort query parameters into the query for a page of urls
+func listQuery(r *http.Request) (ListQuery, error) {
+	query := r.URL.Query()
+
+	page, err := queryInt(query.Get("page"), 1)
+	if err != nil || page < 1 {
+		return ListQuery{}, ErrInvalidListQuery
+	}
+
+	perPage, err := queryInt(query.Get("per_page"), defaultPerPage)
+	if err != nil || perPage < 1 || perPage > maxPerPage {
+		return ListQuery{}, ErrInvalidListQuery
+	}
+
+	sort := query.Get("sort")
+	if sort == "" {
+		sort = defaultListSort
+	}
+
+	if !validSort(sort) {
+		return ListQuery{}, ErrInvalidListQuery
+	}
+
+	return ListQuery{Sort: sort, Skip: (page - 1) * perPage, Limit: perPage}, nil
+}
+
+// respondURLList responds with the page of urls selected by q
+func (h *Handlers) respondURLList(w http.ResponseWriter, r *http.Request, q ListQuery) {
+	urls, total, err := h.store.List(r.Context(), q)
+	if err != nil {
+		h.RespondError(w, ErrUnableToListURLs, http.StatusInternalServerError)
+		return
+	}
+
+	h.RespondJSON(w, URLList{URLs: urls, Page: q.Skip/q.Limit + 1, PerPage: q.Limit, Total: total}, http.StatusOK)
+}
+
+// queryInt parses an integer query parameter, returning def when it is empty
+func queryInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	return strconv.Atoi(value)
+}
+
+// UpdateRequest is the json body accepted when re-pointing a url. An empty url keeps the current
+// destination. Geo targets, device targets, variants and tags are replaced when set, an empty object
+// or list removes them. The url moves to campaign when it is set, an empty string takes it out of its
+// campaign.
+type UpdateRequest struct {
+	URL           string            `json:"url"`
+	RedirectCode  int               `json:"redirect_code"`
+	GeoTargets    map[string]string `json:"geo_targets"`
+	DeviceTargets map[string]string `json:"device_targets"`
+	Variants      []Variant         `json:"variants"`
+	Tags          []string          `json:"tags"`
+	Campaign      *string           `json:"campaign"`
+}
+
+// UpdateURL changes the destination of one of the caller's urls, keeping the previous destination
+// in the url's history
+func (h *Handlers) UpdateURL(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	slug := h.canonicalSlug(params["slug"])
+	logSlug(r, slug)
+
+	req := UpdateRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondBodyError(w, err, ErrInvalidRequest)
+		return
+	}
+
+	u, err := h.updateURL(w, r, slug, req)
+	if err != nil {
+		h.RespondError(w, err, updateStatus(err))
+		return
+	}
+
+	h.RespondJSON(w, u, http.StatusOK)
+}
+
+// updateURL applies req to the url stored under slug when it belongs to the caller, returning the
+// updated url. An empty url keeps the current destination, only the destinations req changes are
+// screened and probed.
+func (h *Handlers) updateURL(w http.ResponseWriter, r *http.Request, slug string, req UpdateRequest) (*URL, error) {
+	u, err := h.store.FindBySlug(r.Context(), slug)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrNotFound
+		}
+
+		return nil, ErrUnableToUpdateURL
+	}
+
+	// other owners' urls are reported as missing so their slugs are not revealed, deleted urls have to
+	// be restored first. Ownership is checked before anything else so callers cannot have urls screened
+	// or probed through slugs that are not theirs.
+	if u.Owner != requestOwner(r) || u.Deleted() {
+		return nil, ErrNotFound
+	}
+
+	if req.URL == "" {
+		req.URL = u.OriginalURL
+	} else if req.URL, err = h.NormalizeURL(req.URL); err != nil {
+		return nil, err
+	}
+
+	geoTargets, err := h.validGeoTargets(req.GeoTargets)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceTargets, err := h.validDeviceTargets(req.DeviceTargets)
+	if err != nil {
+		return nil, err
+	}
+
+	variants, err := h.validVariants(req.Variants)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := validTags(req.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	campaign := ""
+	if req.Campaign != nil {
+		if campaign, err = h.validCampaign(requestOwner(r), *req.Campaign); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.RedirectCode != 0 && !redirectCodes[req.RedirectCode] {
+		return nil, ErrInvalidRedirectCode
+	}
+
+	target := &URL{OriginalURL: req.URL, GeoTargets: u.GeoTargets, DeviceTargets: u.DeviceTargets, Variants: u.Variants}
+	if req.GeoTargets != nil {
+		target.GeoTargets = geoTargets
+	}
+
+	if req.DeviceTargets != nil {
+		target.DeviceTargets = deviceTargets
+	}
+
+	if req.Variants != nil {
+		target.Variants = variants
+	}
+
+	if added := addedDestinations(u, target); len(added) > 0 {
+		if flaggedURL(h.unsafeURLs(added...), target) {
+			return nil, ErrUnsafeURL
+		}
+
+		for _, destination := range added {
+			if err := h.reachable(w.Header(), destination); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	changed := false
+
+	if u.OriginalURL != req.URL {
+		change := Retarget{PreviousURL: u.OriginalURL, ChangedAt: time.Now().UTC()}
+		if k := requestAPIKey(r); k != nil {
+			change.ChangedBy = k.ID
+		} else {
+			change.ChangedBy = requestUserID(r)
+		}
+
+		u.History = append(u.History, change)
+		u.OriginalURL = req.URL
+
+		// the new destination has not been checked yet
+		u.LinkFailures, u.LinkCheckedAt, u.DeadAt = 0, nil, nil
+
+		u.PageMetadata = PageMetadata{}
+		if h.fetchMetadata {
+			u.PageMetadata = fetchMetadata(u.OriginalURL)
+		}
+		changed = true
+	}
+
+	if req.RedirectCode != 0 && req.RedirectCode != u.RedirectCode {
+		u.RedirectCode = req.RedirectCode
+		changed = true
+	}
+
+	if req.GeoTargets != nil {
+		u.GeoTargets = geoTargets
+		changed = true
+	}
+
+	if req.DeviceTargets != nil {
+		u.DeviceTargets = deviceTargets
+		changed = true
+	}
+
+	if req.Variants != nil {
+		u.Variants = variants
+		changed = true
+	}
+
+	if req.Tags != nil {
+		u.Tags = tags
+		changed = true
+	}
+
+	if req.Campaign != nil && campaign != u.Campaign {
+		u.Campaign = campaign
+		changed = true
+	}
+
+	if changed {
+		if err := h.store.Update(r.Context(), u); err != nil {
+			if err == ErrNotFound {
+				return nil, ErrNotFound
+			}
+
+			return nil, ErrUnableToUpdateURL
+		}
+	}
+
+	return u, nil
+}
+
+// addedDestinations returns the destinations of updated that u does not already redirect to
+func addedDestinations(u, updated *URL) []string {
+	current := map[string]bool{}
+	for _, destination := range u.Destinations() {
+		current[destination] = true
+	}
+
+	added := []string{}
+	for _, destination := range updated.Destinations() {
+		if !current[destination] {
+			added = append(added, destination)
+			current[destination] = true
+		}
+	}
+
+	return added
+}
+
+// updateStatus returns the http status reported for an error returned by updateURL
+func updateStatus(err error) int {
+	switch err {
+	case ErrNotFound:
+		return http.StatusNotFound
+	case ErrUnsafeURL, ErrUnreachableURL, ErrURLTooLong:
+		return http.StatusUnprocessableEntity
+	case ErrUnableToUpdateURL:
+		return http.StatusInternalServerError
+	case ErrStoreUnavailable:
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusBadRequest
+}
+
+// DeleteURL removes one of the caller's urls. By default it can be restored until URL_DELETE_RETENTION_DAYS
+// have passed, after which its slug is tombstoned so it is never handed out again. Pass ?tombstone=false
+// to delete it permanently right away and allow the slug to be reused.
+func (h *Handlers) DeleteURL(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	slug := h.canonicalSlug(params["slug"])
+	logSlug(r, slug)
+
+	tombstone := r.URL.Query().Get("tombstone") != "false"
+
+	if err := h.deleteURL(r.Context(), requestOwner(r), slug, tombstone); err != nil {
+		if err == ErrNotFound {
+			h.RespondError(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		h.RespondError(w, ErrUnableToDeleteURL, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteURL moves the url stored under slug to the trash when it belongs to owner, urls belonging to
+// anyone else are reported as ErrNotFound. Urls are removed permanently when there is no retention
+// window, when the slug may be reused or when they are deleted again from the trash.
+func (h *Handlers) deleteURL(ctx context.Context, owner, slug string, tombstone bool) error {
+	u, err := h.store.FindBySlug(ctx, slug)
+	if err != nil {
+		return err
+	}
+
+	if u.Owner != owner {
+		return ErrNotFound
+	}
+
+	if h.deleteRetention == 0 || !tombstone || u.Deleted() {
+		return h.store.Delete(ctx, slug, tombstone)
+	}
+
+	now := time.Now().UTC()
+	u.DeletedAt = &now
+
+	return h.store.Update(ctx, u)
+}
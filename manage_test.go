@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ownedRequest returns a request made by the user owner, anonymous when owner is empty
+func ownedRequest(method, target, body, owner string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if owner == "" {
+		return r
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), userContextKey, owner))
+}
+
+// seedOwnedURLs stores a url of alice's, one of bob's and one alice has deleted
+func seedOwnedURLs(t *testing.T, store *MemoryStore) {
+	t.Helper()
+
+	deleted := time.Now().UTC()
+	for _, u := range []*URL{
+		{Slug: "alice", Owner: "alice", OriginalURL: "https://example.com/alice"},
+		{Slug: "bob", Owner: "bob", OriginalURL: "https://example.com/bob"},
+		{Slug: "trashed", Owner: "alice", OriginalURL: "https://example.com/trashed", DeletedAt: &deleted},
+	} {
+		if err := store.Save(context.Background(), u); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUpdateURLOwner(t *testing.T) {
+	tests := []struct {
+		name   string
+		owner  string
+		slug   string
+		status int
+	}{
+		{"own url", "alice", "alice", http.StatusOK},
+		{"other owner's url", "alice", "bob", http.StatusNotFound},
+		{"anonymous", "", "bob", http.StatusNotFound},
+		{"deleted url", "alice", "trashed", http.StatusNotFound},
+		{"missing url", "alice", "missing", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, store := newTestHandlers(t)
+			seedOwnedURLs(t, store)
+			before, _ := store.FindBySlug(context.Background(), tt.slug)
+
+			w := httptest.NewRecorder()
+			r := ownedRequest(http.MethodPut, "/api/v1/urls/"+tt.slug, `{"url": "https://example.org/new"}`, tt.owner)
+			h.UpdateURL(w, r, map[string]string{"slug": tt.slug})
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			after, _ := store.FindBySlug(context.Background(), tt.slug)
+			if tt.status != http.StatusOK && before != nil && after.OriginalURL != before.OriginalURL {
+				t.Errorf("destination changed to %s by a refused update", after.OriginalURL)
+			}
+			if tt.status == http.StatusOK && after.OriginalURL != "https://example.org/new" {
+				t.Errorf("destination %s, want https://example.org/new", after.OriginalURL)
+			}
+		})
+	}
+}
+
+func TestDeleteURLOwner(t *testing.T) {
+	tests := []struct {
+		name   string
+		owner  string
+		slug   string
+		status int
+	}{
+		{"own url", "alice", "alice", http.StatusNoContent},
+		{"own deleted url", "alice", "trashed", http.StatusNoContent},
+		{"other owner's url", "alice", "bob", http.StatusNotFound},
+		{"other owner's deleted url", "bob", "trashed", http.StatusNotFound},
+		{"anonymous", "", "bob", http.StatusNotFound},
+		{"missing url", "alice", "missing", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, store := newTestHandlers(t)
+			seedOwnedURLs(t, store)
+
+			w := httptest.NewRecorder()
+			r := ownedRequest(http.MethodDelete, "/api/v1/urls/"+tt.slug, "", tt.owner)
+			h.DeleteURL(w, r, map[string]string{"slug": tt.slug})
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			_, err := store.FindBySlug(context.Background(), tt.slug)
+			if tt.status == http.StatusNoContent && err != ErrNotFound {
+				t.Errorf("url still stored after delete: %v", err)
+			}
+			if tt.status == http.StatusNotFound && tt.slug != "missing" && err != nil {
+				t.Errorf("url removed by a refused delete: %v", err)
+			}
+		})
+	}
+}
+
+func TestListURLsOwner(t *testing.T) {
+	tests := []struct {
+		owner string
+		query string
+		want  []string
+	}{
+		{"alice", "", []string{"https://example.com/alice"}},
+		{"alice", "?deleted=true", []string{"https://example.com/trashed"}},
+		{"bob", "", []string{"https://example.com/bob"}},
+		{"carol", "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.owner+tt.query, func(t *testing.T) {
+			h, store := newTestHandlers(t)
+			seedOwnedURLs(t, store)
+
+			w := httptest.NewRecorder()
+			h.ListURLs(w, ownedRequest(http.MethodGet, "/api/urls"+tt.query, "", tt.owner), nil)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+
+			list := URLList{}
+			if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+				t.Fatal(err)
+			}
+
+			var listed []string
+			for _, u := range list.URLs {
+				listed = append(listed, u.OriginalURL)
+			}
+			if strings.Join(listed, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("listed %v, want %v", listed, tt.want)
+			}
+		})
+	}
+}
+
+// roundTripperFunc answers requests with a function
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+// RoundTrip calls f
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestUpdateURLProbes(t *testing.T) {
+	tests := []struct {
+		name   string
+		owner  string
+		slug   string
+		body   string
+		status int
+		probed []string
+	}{
+		{"other owner's url", "alice", "bob", `{"url": "https://internal.example/"}`, http.StatusNotFound, nil},
+		{"deleted url", "alice", "trashed", `{"url": "https://internal.example/"}`, http.StatusNotFound, nil},
+		{"tags only", "alice", "alice", `{"tags": ["docs"]}`, http.StatusOK, nil},
+		{"same destination", "alice", "alice", `{"url": "https://example.com/alice", "redirect_code": 301}`, http.StatusOK, nil},
+		{"new destination", "alice", "alice", `{"url": "https://example.org/new"}`, http.StatusOK, []string{"https://example.org/new"}},
+		{"new device target", "alice", "alice", `{"device_targets": {"ios": "https://example.org/ios"}}`, http.StatusOK, []string{"https://example.org/ios"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, store := newTestHandlers(t)
+			seedOwnedURLs(t, store)
+
+			var probed []string
+			h.reachability = &ReachabilityChecker{reject: true, client: &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				probed = append(probed, r.URL.String())
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+			})}}
+
+			w := httptest.NewRecorder()
+			r := ownedRequest(http.MethodPut, "/api/v1/urls/"+tt.slug, tt.body, tt.owner)
+			h.UpdateURL(w, r, map[string]string{"slug": tt.slug})
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if strings.Join(probed, ",") != strings.Join(tt.probed, ",") {
+				t.Errorf("probed %v, want %v", probed, tt.probed)
+			}
+
+			u, _ := store.FindBySlug(context.Background(), tt.slug)
+			if tt.status == http.StatusOK && tt.probed == nil && u.OriginalURL != "https://example.com/alice" {
+				t.Errorf("destination changed to %s", u.OriginalURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dimfeld/httptreemux"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultBuckets are the histogram upper bounds in seconds, matching the prometheus client defaults
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector is a metric that can write itself in the prometheus text exposition format
+type collector interface {
+	writeTo(w io.Writer)
+}
+
+// Registry holds the metrics exposed on /metrics
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// ServeHTTP writes every registered metric in the prometheus text exposition format
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	collectors := append([]collector(nil), reg.collectors...)
+	reg.mu.Unlock()
+
+	buf := &bytes.Buffer{}
+	for _, c := range collectors {
+		c.writeTo(buf)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+func (reg *Registry) register(c collector) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.collectors = append(reg.collectors, c)
+}
+
+// Counter is a monotonically increasing metric
+type Counter struct {
+	name  string
+	help  string
+	value uint64
+}
+
+// NewCounter creates and registers a counter
+func (reg *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	reg.register(c)
+
+	return c
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, atomic.LoadUint64(&c.value))
+}
+
+// funcMetric is a gauge or counter whose value is read when the metrics are written, for values
+// another package keeps track of
+type funcMetric struct {
+	name  string
+	help  string
+	kind  string
+	value func() float64
+}
+
+// NewGaugeFunc creates and registers a gauge reporting value
+func (reg *Registry) NewGaugeFunc(name, help string, value func() float64) {
+	reg.register(&funcMetric{name: name, help: help, kind: "gauge", value: value})
+}
+
+// NewCounterFunc creates and registers a counter reporting value, which must never decrease
+func (reg *Registry) NewCounterFunc(name, help string, value func() float64) {
+	reg.register(&funcMetric{name: name, help: help, kind: "counter", value: value})
+}
+
+func (m *funcMetric) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", m.name, m.help, m.name, m.kind, m.name, m.value())
+}
+
+// HistogramVec is a set of histograms partitioned by a single label
+type HistogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec creates and registers a histogram partitioned by label
+func (reg *Registry) NewHistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		label:   label,
+		buckets: buckets,
+		series:  map[string]*histogram{},
+	}
+	reg.register(h)
+
+	return h
+}
+
+// Observe records value for the series identified by labelValue
+func (h *HistogramVec) Observe(labelValue string, value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[labelValue]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[labelValue] = s
+	}
+
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// ObserveSince records the seconds elapsed since start
+func (h *HistogramVec) ObserveSince(labelValue string, start time.Time) {
+	h.Observe(labelValue, time.Since(start).Seconds())
+}
+
+func (h *HistogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	labels := make([]string, 0, len(h.series))
+	for l := range h.series {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+
+	for _, l := range labels {
+		s := h.series[l]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=%q} %d\n", h.name, h.label, l, strconv.FormatFloat(upper, 'g', -1, 64), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", h.name, h.label, l, s.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %g\n", h.name, h.label, l, s.sum)
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", h.name, h.label, l, s.count)
+	}
+}
+
+// Metrics are the service level metrics
+type Metrics struct {
+	Registry        *Registry
+	ShortensCreated *Counter
+	RedirectsServed *Counter
+	NotFound        *Counter
+	CacheHits       *Counter
+	CacheMisses     *Counter
+	NegativeHits    *Counter
+	SnapshotHits    *Counter
+	HandlerDuration *HistogramVec
+	StoreDuration   *HistogramVec
+}
+
+// NewMetrics creates and registers the service metrics
+func NewMetrics() *Metrics {
+	reg := &Registry{}
+
+	return &Metrics{
+		Registry:        reg,
+		ShortensCreated: reg.NewCounter("urlshortener_shortens_created_total", "Number of short urls created."),
+		RedirectsServed: reg.NewCounter("urlshortener_redirects_served_total", "Number of redirects served."),
+		NotFound:        reg.NewCounter("urlshortener_not_found_total", "Number of redirects for unknown slugs."),
+		CacheHits:       reg.NewCounter("urlshortener_cache_hits_total", "Number of slug lookups served from the cache."),
+		CacheMisses:     reg.NewCounter("urlshortener_cache_misses_total", "Number of slug lookups that missed the cache."),
+		NegativeHits:    reg.NewCounter("urlshortener_negative_cache_hits_total", "Number of lookups of recently unknown slugs answered without the store."),
+		SnapshotHits:    reg.NewCounter("urlshortener_snapshot_hits_total", "Number of redirects served from the fallback snapshot while the store was unavailable."),
+		HandlerDuration: reg.NewHistogramVec(
+			"urlshortener_handler_duration_seconds", "Time spent handling requests.", "handler", defaultBuckets,
+		),
+		StoreDuration: reg.NewHistogramVec(
+			"urlshortener_store_duration_seconds", "Time spent in store operations.", "operation", defaultBuckets,
+		),
+	}
+}
+
+// PoolStats describes the connections a store holds to its database
+type PoolStats struct {
+	// Open is the number of connections, in use or idle
+	Open int
+	// InUse is the number of connections serving an operation
+	InUse int
+	// Waits is the number of operations that had to wait for a connection and WaitTime the total time
+	// they waited
+	Waits    int64
+	WaitTime time.Duration
+}
+
+// PooledStore is implemented by stores that keep a pool of connections
+type PooledStore interface {
+	// PoolStats returns the current state of the connection pool
+	PoolStats() PoolStats
+}
+
+// observePool registers the connection pool of store as metrics
+func (m *Metrics) observePool(store PooledStore) {
+	m.Registry.NewGaugeFunc("urlshortener_store_connections_open", "Number of open store connections.", func() float64 {
+		return float64(store.PoolStats().Open)
+	})
+	m.Registry.NewGaugeFunc("urlshortener_store_connections_in_use", "Number of store connections serving an operation.", func() float64 {
+		return float64(store.PoolStats().InUse)
+	})
+	m.Registry.NewGaugeFunc("urlshortener_store_connections_idle", "Number of idle store connections.", func() float64 {
+		stats := store.PoolStats()
+		return float64(stats.Open - stats.InUse)
+	})
+	m.Registry.NewCounterFunc("urlshortener_store_connection_waits_total", "Number of store operations that waited for a connection.", func() float64 {
+		return float64(store.PoolStats().Waits)
+	})
+	m.Registry.NewCounterFunc("urlshortener_store_connection_wait_seconds_total", "Time store operations spent waiting for a connection.", func() float64 {
+		return store.PoolStats().WaitTime.Seconds()
+	})
+}
+
+// observeBreaker reports whether breaker is rejecting store operations
+func (m *Metrics) observeBreaker(breaker *CircuitBreaker) {
+	m.Registry.NewGaugeFunc("urlshortener_store_circuit_open", "Whether store operations are failing fast, 1 while the circuit is open.", func() float64 {
+		if breaker.Open() {
+			return 1
+		}
+
+		return 0
+	})
+}
+
+// Instrument records the time spent in next under the handler label name and names the request's
+// span after it
+func (h *Handlers) Instrument(name string, next httptreemux.HandlerFunc) httptreemux.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		defer h.metrics.HandlerDuration.ObserveSince(name, time.Now())
+		trace.SpanFromContext(r.Context()).SetName(name)
+
+		next(w, r, params)
+	}
+}
+
+// instrumentedStore records the time spent in each store operation
+type instrumentedStore struct {
+	Store
+	duration *HistogramVec
+}
+
+// Save inserts a new url document
+func (s *instrumentedStore) Save(ctx context.Context, u *URL) error {
+	defer s.duration.ObserveSince("save", time.Now())
+
+	return s.Store.Save(ctx, u)
+}
+
+// SaveMany inserts urls in a single round trip
+func (s *instrumentedStore) SaveMany(ctx context.Context, urls []*URL) []error {
+	defer s.duration.ObserveSince("save_many", time.Now())
+
+	return s.Store.SaveMany(ctx, urls)
+}
+
+// Update replaces the url stored under u.Slug or returns ErrNotFound
+func (s *instrumentedStore) Update(ctx context.Context, u *URL) error {
+	defer s.duration.ObserveSince("update", time.Now())
+
+	return s.Store.Update(ctx, u)
+}
+
+// IncrementUses atomically counts a visit to the url stored under slug
+func (s *instrumentedStore) IncrementUses(ctx context.Context, slug string) (int, error) {
+	defer s.duration.ObserveSince("increment_uses", time.Now())
+
+	return s.Store.IncrementUses(ctx, slug)
+}
+
+// IncrementClicks atomically counts a redirect through the url stored under slug
+func (s *instrumentedStore) IncrementClicks(ctx context.Context, slug string) (int, error) {
+	defer s.duration.ObserveSince("increment_clicks", time.Now())
+
+	return s.Store.IncrementClicks(ctx, slug)
+}
+
+// ResolveSlug returns the url stored under slug for a redirect or ErrNotFound
+func (s *instrumentedStore) ResolveSlug(ctx context.Context, slug string) (*URL, error) {
+	defer s.duration.ObserveSince("resolve_slug", time.Now())
+
+	return s.Store.ResolveSlug(ctx, slug)
+}
+
+// FindBySlug returns the url stored under slug or ErrNotFound
+func (s *instrumentedStore) FindBySlug(ctx context.Context, slug string) (*URL, error) {
+	defer s.duration.ObserveSince("find_by_slug", time.Now())
+
+	return s.Store.FindBySlug(ctx, slug)
+}
+
+// FindByOriginalURL returns a url owned by owner without an expiry pointing at original or
+// ErrNotFound
+func (s *instrumentedStore) FindByOriginalURL(ctx context.Context, owner, original string) (*URL, error) {
+	defer s.duration.ObserveSince("find_by_original_url", time.Now())
+
+	return s.Store.FindByOriginalURL(ctx, owner, original)
+}
+
+// Exists reports whether a url has already been stored under slug, including deleted urls that left
+// a tombstone
+func (s *instrumentedStore) Exists(ctx context.Context, slug string) (bool, error) {
+	defer s.duration.ObserveSince("exists", time.Now())
+
+	return s.Store.Exists(ctx, slug)
+}
+
+// Delete removes the url stored under slug or returns ErrNotFound
+func (s *instrumentedStore) Delete(ctx context.Context, slug string, tombstone bool) error {
+	defer s.duration.ObserveSince("delete", time.Now())
+
+	return s.Store.Delete(ctx, slug, tombstone)
+}
+
+// List returns the page of urls selected by q and the total number of urls the owner has
+func (s *instrumentedStore) List(ctx context.Context, q ListQuery) ([]URL, int, error) {
+	defer s.duration.ObserveSince("list", time.Now())
+
+	return s.Store.List(ctx, q)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// ErrPrivateURL is returned for urls pointing at loopback, private or link-local addresses
+var ErrPrivateURL = codedError("private_url", "url", "Urls pointing at private, loopback or link-local addresses cannot be shortened")
+
+// defaultPorts are the ports dropped from normalized urls
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// normalizeURL returns the canonical form of an absolute http or https url: a lower case scheme and
+// host, the host in its punycode form without a trailing dot, no default port and / for an empty
+// path. Urls with credentials, without a host with a dot or pointing at a private address by ip or
+// as localhost are rejected.
+func normalizeURL(input string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(input))
+	if err != nil || u.Opaque != "" || u.User != nil {
+		return "", ErrInvalidURL
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if _, ok := defaultPorts[scheme]; !ok {
+		return "", ErrInvalidURL
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return "", ErrInvalidURL
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if privateIP(ip) {
+			return "", ErrPrivateURL
+		}
+	} else {
+		if host, err = idna.Lookup.ToASCII(host); err != nil {
+			return "", ErrInvalidURL
+		}
+
+		if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+			return "", ErrPrivateURL
+		}
+
+		if !strings.Contains(host, ".") {
+			return "", ErrInvalidURL
+		}
+	}
+
+	port := u.Port()
+	if port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return "", ErrInvalidURL
+		}
+	}
+
+	if port == defaultPorts[scheme] {
+		port = ""
+	}
+
+	u.Scheme = scheme
+	u.Host = host
+	if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	}
+
+	if port != "" {
+		u.Host += ":" + port
+	}
+
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	return u.String(), nil
+}
+
+// canonicalURL returns the normalized form of destination, or destination itself when it cannot be
+// normalized
+func canonicalURL(destination string) string {
+	if normalized, err := normalizeURL(destination); err == nil {
+		return normalized
+	}
+
+	return destination
+}
+
+// privateIP reports whether ip is a loopback, private, link-local, multicast or unspecified address
+func privateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified()
+}
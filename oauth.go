@@ -0,0 +1,422 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dimfeld/httptreemux"
+)
+
+// oauthTimeout bounds each request to a login provider
+const oauthTimeout = 10 * time.Second
+
+// oauthStateCookie holds the state of a login with a provider from the redirect to the provider until
+// the user is sent back
+const oauthStateCookie = "oauth_state"
+
+// oauthStateTTL is how long a user has to log in with a provider
+const oauthStateTTL = 10 * time.Minute
+
+// maxProviderResponse bounds the size of the json read from a login provider
+const maxProviderResponse = 1 << 20
+
+var (
+	ErrUnknownProvider       = codedError("unknown_provider", "", "No login provider with that name is configured")
+	ErrInvalidLoginState     = codedError("invalid_login_state", "", "The login expired or was started in another browser, try again")
+	ErrProviderDenied        = codedError("provider_login_denied", "", "The login was cancelled or refused by the provider")
+	ErrProviderFailed        = codedError("provider_login_failed", "", "Unable to log in with the provider")
+	ErrEmailNotVerified      = codedError("email_not_verified", "", "The provider did not return a verified email address")
+	ErrPasswordLoginDisabled = codedError("password_login_disabled", "", "Passwords are disabled, log in with one of the configured providers")
+)
+
+// LoginProvider is an oauth2 provider users log in with instead of a password. Users are matched to
+// their account by the verified email the provider returns and an account without a password is
+// created on their first login.
+type LoginProvider struct {
+	// Name is the provider's part of the login and callback urls
+	Name string
+	// Title is shown on the dashboard's login button
+	Title        string
+	AuthURL      string
+	TokenURL     string
+	UserInfoURL  string
+	Scopes       []string
+	ClientID     string
+	ClientSecret string
+	// github providers list the user's emails from the github api instead of an openid connect
+	// userinfo endpoint
+	github bool
+	client *http.Client
+}
+
+// oidcConfiguration is the part of an openid connect discovery document the login needs
+type oidcConfiguration struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// newLoginProviders returns the login providers configured with a client id, the generic openid
+// connect provider's endpoints are discovered from its issuer
+func newLoginProviders(c *Config) ([]*LoginProvider, error) {
+	client := &http.Client{Timeout: oauthTimeout}
+	providers := []*LoginProvider{}
+
+	if c.GoogleClientID != "" {
+		providers = append(providers, &LoginProvider{
+			Name:         "google",
+			Title:        "Google",
+			AuthURL:      "https://accounts.google.com/o/oauth2/v2/auth",
+			TokenURL:     "https://oauth2.googleapis.com/token",
+			UserInfoURL:  "https://openidconnect.googleapis.com/v1/userinfo",
+			Scopes:       []string{"openid", "email"},
+			ClientID:     c.GoogleClientID,
+			ClientSecret: c.GoogleClientSecret,
+			client:       client,
+		})
+	}
+
+	if c.GitHubClientID != "" {
+		providers = append(providers, &LoginProvider{
+			Name:         "github",
+			Title:        "GitHub",
+			AuthURL:      "https://github.com/login/oauth/authorize",
+			TokenURL:     "https://github.com/login/oauth/access_token",
+			UserInfoURL:  "https://api.github.com/user/emails",
+			Scopes:       []string{"user:email"},
+			ClientID:     c.GitHubClientID,
+			ClientSecret: c.GitHubClientSecret,
+			github:       true,
+			client:       client,
+		})
+	}
+
+	if c.OIDCIssuer != "" {
+		conf, err := discoverOIDC(client, c.OIDCIssuer)
+		if err != nil {
+			return nil, err
+		}
+
+		providers = append(providers, &LoginProvider{
+			Name:         "oidc",
+			Title:        c.OIDCName,
+			AuthURL:      conf.AuthorizationEndpoint,
+			TokenURL:     conf.TokenEndpoint,
+			UserInfoURL:  conf.UserinfoEndpoint,
+			Scopes:       []string{"openid", "email"},
+			ClientID:     c.OIDCClientID,
+			ClientSecret: c.OIDCClientSecret,
+			client:       client,
+		})
+	}
+
+	return providers, nil
+}
+
+// discoverOIDC reads the endpoints of the openid connect provider issuer from its discovery document
+func discoverOIDC(client *http.Client, issuer string) (*oidcConfiguration, error) {
+	resp, err := client.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("unable to discover openid connect provider %s: %v", issuer, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to discover openid connect provider %s: %s", issuer, resp.Status)
+	}
+
+	conf := oidcConfiguration{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxProviderResponse)).Decode(&conf); err != nil {
+		return nil, fmt.Errorf("unable to discover openid connect provider %s: %v", issuer, err)
+	}
+
+	if conf.AuthorizationEndpoint == "" || conf.TokenEndpoint == "" || conf.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("openid connect provider %s has no authorization, token or userinfo endpoint", issuer)
+	}
+
+	return &conf, nil
+}
+
+// authCodeURL returns the url of the provider's login page, which sends the user back to redirectURL
+// with an authorization code and state
+func (p *LoginProvider) authCodeURL(redirectURL, state string) string {
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.ClientID},
+		"redirect_uri":  {redirectURL},
+		"scope":         {strings.Join(p.Scopes, " ")},
+		"state":         {state},
+	}
+
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+
+	return p.AuthURL + sep + query.Encode()
+}
+
+// Email exchanges the authorization code for an access token and returns the verified email of the
+// user it was issued to, or ErrEmailNotVerified when the provider has none
+func (p *LoginProvider) Email(code, redirectURL string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	token := struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}{}
+	if err := p.do(req, &token); err != nil {
+		return "", err
+	}
+
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("no access token issued: %s", token.Error)
+	}
+
+	if req, err = http.NewRequest(http.MethodGet, p.UserInfoURL, nil); err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	if p.github {
+		emails := []struct {
+			Email    string `json:"email"`
+			Primary  bool   `json:"primary"`
+			Verified bool   `json:"verified"`
+		}{}
+		if err := p.do(req, &emails); err != nil {
+			return "", err
+		}
+
+		for _, e := range emails {
+			if e.Primary && e.Verified {
+				return e.Email, nil
+			}
+		}
+
+		return "", ErrEmailNotVerified
+	}
+
+	info := struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}{}
+	if err := p.do(req, &info); err != nil {
+		return "", err
+	}
+
+	if info.Email == "" || !info.EmailVerified {
+		return "", ErrEmailNotVerified
+	}
+
+	return info.Email, nil
+}
+
+// do sends req to the provider and decodes its json response into v
+func (p *LoginProvider) do(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s responded %s", req.Method, req.URL.Redacted(), resp.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, maxProviderResponse)).Decode(v)
+}
+
+// provider returns the configured login provider called name, nil when there is none
+func (h *Handlers) provider(name string) *LoginProvider {
+	for _, p := range h.providers {
+		if p.Name == name {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// oauthCallbackURL is where p sends users back to, it has to be registered with the provider
+func (h *Handlers) oauthCallbackURL(p *LoginProvider) string {
+	return h.Host + "/auth/" + p.Name + "/callback"
+}
+
+// setOAuthState stores the state of a login with p in a cookie only sent back to its callback, an
+// empty value removes it
+func (h *Handlers) setOAuthState(w http.ResponseWriter, p *LoginProvider, value string) {
+	maxAge := int(oauthStateTTL / time.Second)
+	if value == "" {
+		maxAge = -1
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    value,
+		Path:     "/auth/" + p.Name + "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(h.Host, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ProviderLogin sends the user to log in with a provider. Once they are back they are logged in to the
+// dashboard, or with ?token=true they are given a session token for the api instead.
+func (h *Handlers) ProviderLogin(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	p := h.provider(params["provider"])
+	if p == nil {
+		h.RespondErrorPage(w, r, ErrUnknownProvider, http.StatusNotFound)
+		return
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		h.RespondErrorPage(w, r, ErrUnableToCreateToken, http.StatusInternalServerError)
+		return
+	}
+	state := base64.RawURLEncoding.EncodeToString(b)
+
+	mode := "session"
+	if r.URL.Query().Get("token") == "true" {
+		mode = "token"
+	}
+
+	h.setOAuthState(w, p, mode+"."+state)
+	http.Redirect(w, r, p.authCodeURL(h.oauthCallbackURL(p), state), http.StatusFound)
+}
+
+// ProviderCallback logs in the user a provider sent back, creating their account on the first login
+func (h *Handlers) ProviderCallback(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	p := h.provider(params["provider"])
+	if p == nil {
+		h.RespondErrorPage(w, r, ErrUnknownProvider, http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	mode, state := "", ""
+	if c, err := r.Cookie(oauthStateCookie); err == nil {
+		mode, state, _ = strings.Cut(c.Value, ".")
+	}
+
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(query.Get("state"))) != 1 {
+		h.RespondErrorPage(w, r, ErrInvalidLoginState, http.StatusBadRequest)
+		return
+	}
+	h.setOAuthState(w, p, "")
+
+	if query.Get("error") != "" || query.Get("code") == "" {
+		h.RespondErrorPage(w, r, ErrProviderDenied, http.StatusUnauthorized)
+		return
+	}
+
+	email, err := p.Email(query.Get("code"), h.oauthCallbackURL(p))
+	if err != nil {
+		if err == ErrEmailNotVerified {
+			h.RespondErrorPage(w, r, ErrEmailNotVerified, http.StatusForbidden)
+			return
+		}
+
+		log.Printf("Unable to log in with %s: %v", p.Name, err)
+		h.RespondErrorPage(w, r, ErrProviderFailed, http.StatusBadGateway)
+		return
+	}
+
+	u, err := h.providerUser(email)
+	if err != nil {
+		if err == ErrStoreUnavailable {
+			h.RespondErrorPage(w, r, err, http.StatusServiceUnavailable)
+			return
+		}
+
+		h.RespondErrorPage(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	token, expires, err := h.tokens.Issue(u.ID, time.Now())
+	if err != nil {
+		h.RespondErrorPage(w, r, ErrUnableToCreateToken, http.StatusInternalServerError)
+		return
+	}
+
+	if mode == "token" {
+		w.Header().Set("Cache-Control", "no-store")
+		h.RespondJSON(w, TokenResponse{Token: token, ExpiresAt: expires.UTC()}, http.StatusOK)
+		return
+	}
+
+	h.setSession(w, token, expires)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// providerUser returns the account registered with email, creating one without a password when there
+// is none
+func (h *Handlers) providerUser(email string) (*User, error) {
+	email = normalizeEmail(email)
+
+	u, err := h.users.FindUserByEmail(email)
+	if err == nil {
+		return u, nil
+	}
+
+	if err != ErrNotFound {
+		return nil, ErrStoreUnavailable
+	}
+
+	id, err := newUserID()
+	if err != nil {
+		return nil, ErrUnableToCreateUser
+	}
+
+	u = &User{ID: id, Email: email, CreatedAt: time.Now().UTC()}
+	if err := h.users.SaveUser(u); err != nil {
+		// the account was created by a concurrent first login
+		if err == ErrEmailTaken {
+			if u, err = h.users.FindUserByEmail(email); err == nil {
+				return u, nil
+			}
+		}
+
+		return nil, ErrUnableToCreateUser
+	}
+
+	return u, nil
+}
+
+// PasswordLogin responds 403 Forbidden with ErrPasswordLoginDisabled instead of calling next when
+// users may only log in with a provider
+func (h *Handlers) PasswordLogin(next httptreemux.HandlerFunc) httptreemux.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if !h.passwordLogin {
+			h.RespondErrorPage(w, r, ErrPasswordLoginDisabled, http.StatusForbidden)
+			return
+		}
+
+		next(w, r, params)
+	}
+}
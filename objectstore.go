@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Timeout bounds each request to s3
+const s3Timeout = 5 * time.Minute
+
+// defaultS3Region is the region requests are signed for unless URL_S3_REGION is set
+const defaultS3Region = "us-east-1"
+
+// ObjectStore keeps the files written by backups and archives, in a local directory or an s3 bucket
+type ObjectStore interface {
+	// Put stores data under name, replacing any object already there
+	Put(name string, data []byte) error
+	// List returns the names of the objects starting with prefix in lexical order
+	List(prefix string) ([]string, error)
+	// Delete removes the object stored under name
+	Delete(name string) error
+}
+
+// S3Config holds the credentials and endpoint used for s3:// locations
+type S3Config struct {
+	// Endpoint is the url of the service, defaulting to aws s3 in Region, e.g. http://minio:9000
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// s3Config returns the s3 settings of c
+func s3Config(c *Config) S3Config {
+	return S3Config{Endpoint: c.S3Endpoint, Region: c.S3Region, AccessKey: c.S3AccessKey, SecretKey: c.S3SecretKey}
+}
+
+// newObjectStore returns the object store for location, an s3://bucket/prefix url or a local
+// directory that is created when missing
+func newObjectStore(location string, s3 S3Config) (ObjectStore, error) {
+	if !strings.HasPrefix(location, "s3://") {
+		if err := os.MkdirAll(location, 0o755); err != nil {
+			return nil, err
+		}
+
+		return DirObjectStore(location), nil
+	}
+
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("Invalid s3 location %q, expected s3://bucket/prefix", location)
+	}
+
+	return NewS3ObjectStore(u.Host, strings.Trim(u.Path, "/"), s3), nil
+}
+
+// DirObjectStore stores objects as files in a local directory, names may contain / to use
+// subdirectories
+type DirObjectStore string
+
+// Put writes data to the file name, through a temporary file so a partial object is never seen
+func (d DirObjectStore) Put(name string, data []byte) error {
+	path := filepath.Join(string(d), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// List returns the files whose name starts with prefix
+func (d DirObjectStore) List(prefix string) ([]string, error) {
+	names := []string{}
+	err := filepath.WalkDir(string(d), func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(string(d), path)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) && !strings.HasSuffix(name, ".tmp") {
+			names = append(names, name)
+		}
+
+		return nil
+	})
+
+	sort.Strings(names)
+
+	return names, err
+}
+
+// Delete removes the file name
+func (d DirObjectStore) Delete(name string) error {
+	return os.Remove(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+// S3ObjectStore stores objects in an s3 bucket, or a bucket of a compatible service such as minio,
+// under a prefix. Requests use path style urls and are signed with aws signature version 4.
+type S3ObjectStore struct {
+	bucket string
+	prefix string
+	config S3Config
+	client *http.Client
+}
+
+// NewS3ObjectStore returns a store for the objects under prefix in bucket
+func NewS3ObjectStore(bucket, prefix string, config S3Config) *S3ObjectStore {
+	if config.Region == "" {
+		config.Region = defaultS3Region
+	}
+
+	if config.Endpoint == "" {
+		config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	config.Endpoint = strings.TrimRight(config.Endpoint, "/")
+
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &S3ObjectStore{bucket: bucket, prefix: prefix, config: config, client: &http.Client{Timeout: s3Timeout}}
+}
+
+// s3ListResult is the part of a ListObjectsV2 response the store reads
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// Put uploads data as the object name
+func (s *S3ObjectStore) Put(name string, data []byte) error {
+	resp, err := s.do(http.MethodPut, s.prefix+name, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// List returns the names of the objects under prefix, following continuation tokens
+func (s *S3ObjectStore) List(prefix string) ([]string, error) {
+	names := []string{}
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			names = append(names, strings.TrimPrefix(object.Key, s.prefix))
+		}
+
+		if !result.IsTruncated {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Delete removes the object name
+func (s *S3ObjectStore) Delete(name string) error {
+	resp, err := s.do(http.MethodDelete, s.prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// do sends a signed request for key in the bucket, returning an error for responses other than 2xx
+func (s *S3ObjectStore) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	path := "/" + s.bucket
+	if key != "" {
+		path += "/" + s3Escape(key, false)
+	}
+
+	target := s.config.Endpoint + path
+	if len(query) > 0 {
+		target += "?" + s3Query(query)
+	}
+
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, path, query, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+
+		return nil, fmt.Errorf("s3 %s %s responded %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	return resp, nil
+}
+
+// sign adds the aws signature version 4 headers for a request sent at now
+func (s *S3ObjectStore) sign(req *http.Request, path string, query url.Values, body []byte, now time.Time) {
+	date := now.Format("20060102")
+	stamp := now.Format("20060102T150405Z")
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		s3Query(query),
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + stamp + "\n",
+		signed,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + s.config.SecretKey)
+	for _, part := range []string{date, s.config.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+// hmacSHA256 returns the hmac of data under key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+// s3Query encodes query sorted by name as signature version 4 expects
+func s3Query(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := []string{}
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent encodes every byte of s but the unreserved characters, and / unless slash is set
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dimfeld/httptreemux"
+)
+
+// Operation documents a route in the OpenAPI specification. Request and Response are zero values of
+// the json bodies the handler reads and writes, a nil Response means the route responds without a
+// body and Produces names the content type of responses that are not json.
+type Operation struct {
+	Method   string
+	Path     string
+	Summary  string
+	Auth     bool
+	Query    []QueryParam
+	Request  interface{}
+	Status   int
+	Response interface{}
+	Produces string
+	// MaxBody bounds the request body, URL_MAX_BODY_BYTES when 0
+	MaxBody int64
+	// Text lets clients ask for a plain text response, see TextOnRequest
+	Text bool
+
+	versioned bool
+}
+
+// QueryParam documents a query string parameter of an Operation
+type QueryParam struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+// listParams are accepted by the paged url listings
+var listParams = []QueryParam{
+	{Name: "page", Type: "integer", Description: "Page to return, starting at 1"},
+	{Name: "per_page", Type: "integer", Description: "Urls per page, at most 100"},
+	{Name: "sort", Type: "string", Description: "created_at, slug, original_url or clicks, prefixed with - for descending"},
+}
+
+// route registers handler for op and records op for the OpenAPI specification
+func (h *Handlers) route(r *httptreemux.TreeMux, op Operation, handler httptreemux.HandlerFunc) {
+	r.Handle(op.Method, op.Path, handler)
+	h.operations = append(h.operations, op)
+}
+
+// OpenAPI responds with an OpenAPI 3 specification of the documented routes
+func (h *Handlers) OpenAPI(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	h.RespondJSON(w, h.openAPISpec(), http.StatusOK)
+}
+
+// APIDocs displays the OpenAPI specification with Swagger UI
+func (h *Handlers) APIDocs(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	templates.ExecuteTemplate(w, "docs.html", &IndexPage{Host: h.Host})
+}
+
+// openAPISpec builds the specification from the operations recorded as routes were registered
+func (h *Handlers) openAPISpec() map[string]interface{} {
+	schemas := map[string]interface{}{}
+	errorSchema := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"error": schemaOf(reflect.TypeOf(APIError{}), schemas),
+		},
+	}
+
+	paths := map[string]interface{}{}
+	for _, op := range h.operations {
+		path, params := openAPIPath(op.Path)
+		for _, q := range op.Query {
+			params = append(params, map[string]interface{}{
+				"name":        q.Name,
+				"in":          "query",
+				"description": q.Description,
+				"schema":      map[string]interface{}{"type": q.Type},
+			})
+		}
+
+		status := op.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		response := map[string]interface{}{"description": http.StatusText(status)}
+		switch {
+		case op.Produces != "":
+			response["content"] = map[string]interface{}{
+				op.Produces: map[string]interface{}{
+					"schema": map[string]interface{}{"type": "string", "format": "binary"},
+				},
+			}
+		case op.Response != nil:
+			response["content"] = jsonContent(responseSchema(op, schemas))
+		}
+
+		responses := map[string]interface{}{strconv.Itoa(status): response}
+		if op.versioned {
+			responses["default"] = map[string]interface{}{
+				"description": "Error",
+				"content":     jsonContent(errorSchema),
+			}
+		}
+
+		operation := map[string]interface{}{
+			"summary":    op.Summary,
+			"parameters": params,
+			"responses":  responses,
+		}
+
+		if op.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  jsonContent(schemaOf(reflect.TypeOf(op.Request), schemas)),
+			}
+		}
+
+		if op.Auth {
+			operation["security"] = []interface{}{map[string]interface{}{"bearer": []string{}}}
+		}
+
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[path] = item
+		}
+		item[strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "FCC URL Shortener",
+			"version": apiVersion,
+		},
+		"servers": []interface{}{map[string]interface{}{"url": h.Host}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "A session token from /api/v1/login, an api key or the admin token",
+				},
+			},
+		},
+	}
+}
+
+// responseSchema describes the body written by op, versioned routes wrap it in an Envelope
+func responseSchema(op Operation, schemas map[string]interface{}) map[string]interface{} {
+	if !op.versioned {
+		return schemaOf(reflect.TypeOf(op.Response), schemas)
+	}
+
+	properties := map[string]interface{}{}
+	if p, ok := op.Response.(paged); ok {
+		data, _ := p.envelope()
+		properties["data"] = schemaOf(reflect.TypeOf(data), schemas)
+		properties["meta"] = schemaOf(reflect.TypeOf(PageMeta{}), schemas)
+	} else {
+		properties["data"] = schemaOf(reflect.TypeOf(op.Response), schemas)
+	}
+
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// openAPIPath converts a router path to an OpenAPI path template and its path parameters
+func openAPIPath(path string) (string, []interface{}) {
+	params := []interface{}{}
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if !strings.HasPrefix(s, ":") {
+			continue
+		}
+
+		name := s[1:]
+		segments[i] = "{" + name + "}"
+		params = append(params, map[string]interface{}{
+			"name":     name,
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]interface{}{"type": "string"},
+		})
+	}
+
+	return strings.Join(segments, "/"), params
+}
+
+// schemaOf describes t as a json schema. Named structs are added to schemas and referenced.
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+
+		if _, ok := schemas[t.Name()]; !ok {
+			// reserve the name first so self referencing types terminate
+			schemas[t.Name()] = nil
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+
+	return map[string]interface{}{}
+}
+
+// structSchema describes the json encoding of a struct, embedded structs without a json name are
+// flattened into it like encoding/json does
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			embedded := structSchema(f.Type, schemas)
+			for k, v := range embedded["properties"].(map[string]interface{}) {
+				properties[k] = v
+			}
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = schemaOf(f.Type, schemas)
+	}
+
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// jsonContent is the content of a json request or response body matching schema
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxOrgsPerUser = 100
+const maxOrgMembers = 100
+const maxOrgNameLength = 100
+
+// orgHeader selects the organization a request acts for, the caller's own urls are used without it
+const orgHeader = "X-Organization"
+
+// The roles a member can have in an organization, each allows what the previous ones do
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleOwner  = "owner"
+)
+
+// roleRanks orders the roles from the least to the most privileged
+var roleRanks = map[string]int{roleViewer: 1, roleEditor: 2, roleOwner: 3}
+
+var (
+	ErrInvalidOrg         = codedError("invalid_org", "name", "An organization needs a name of at most 100 characters")
+	ErrInvalidRole        = codedError("invalid_role", "role", "Role must be owner, editor or viewer")
+	ErrOrgNotFound        = codedError("org_not_found", "", "Unable to locate an organization with that id")
+	ErrMemberNotFound     = codedError("member_not_found", "", "That user is not a member of the organization")
+	ErrInsufficientRole   = codedError("insufficient_role", "", "Your role in the organization does not allow this")
+	ErrAlreadyMember      = codedError("already_member", "email", "That user is already a member of the organization")
+	ErrLastOwner          = codedError("last_owner", "", "An organization must keep at least one owner")
+	ErrOrgNotEmpty        = codedError("org_not_empty", "", "Delete the organization's urls before deleting it")
+	ErrTooManyOrgs        = codedError("too_many_orgs", "", "A user may belong to at most 100 organizations")
+	ErrTooManyMembers     = codedError("too_many_members", "", "An organization may have at most 100 members")
+	ErrUnableToSaveOrg    = codedError("org_save_failed", "", "Unable to save organization")
+	ErrUnableToSaveMember = codedError("member_save_failed", "", "Unable to save member")
+)
+
+// Organization is a team of users sharing a pool of urls, the urls, campaigns, webhooks and custom
+// domains created for it are owned by its id
+type Organization struct {
+	ID        string    `json:"id" bson:"org_id"`
+	Name      string    `json:"name" bson:"name"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+// Member is a user's membership of an organization. Viewers can read the organization's urls,
+// editors can also create, change and delete them, and owners can also manage the members.
+type Member struct {
+	OrgID   string    `json:"org_id" bson:"org_id"`
+	UserID  string    `json:"user_id" bson:"user_id"`
+	Email   string    `json:"email" bson:"email"`
+	Role    string    `json:"role" bson:"role"`
+	AddedAt time.Time `json:"added_at" bson:"added_at"`
+}
+
+// OrgMembership is an organization along with the caller's role in it
+type OrgMembership struct {
+	Organization
+	Role string `json:"role"`
+}
+
+// OrgRequest is the json body accepted when creating an organization
+type OrgRequest struct {
+	Name string `json:"name"`
+}
+
+// MemberRequest is the json body accepted when adding a member or changing their role, the email is
+// only read when adding
+type MemberRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// OrgStore defines the persistence operations for organizations and their members
+type OrgStore interface {
+	// SaveOrg inserts a new organization
+	SaveOrg(o *Organization) error
+	// FindOrg returns the organization with id or ErrNotFound
+	FindOrg(id string) (*Organization, error)
+	// DeleteOrg removes the organization with id and its members or returns ErrNotFound
+	DeleteOrg(id string) error
+	// SaveMember adds a member to an organization or replaces the membership they have
+	SaveMember(m *Member) error
+	// FindMember returns the membership of user in org or ErrNotFound
+	FindMember(orgID, userID string) (*Member, error)
+	// ListMembers returns the members of org, oldest first
+	ListMembers(orgID string) ([]Member, error)
+	// ListMemberships returns the memberships of user, oldest first
+	ListMemberships(userID string) ([]Member, error)
+	// RemoveMember removes user from org or returns ErrNotFound
+	RemoveMember(orgID, userID string) error
+}
+
+// orgID generates a random organization id, the prefix keeps it apart from user and api key ids in
+// the owner of urls
+func orgID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return "org_" + hex.EncodeToString(id), nil
+}
+
+// allows reports whether the member's role permits a request with method, viewers may only read
+func (m *Member) allows(method string) bool {
+	if method == http.MethodGet || method == http.MethodHead {
+		return true
+	}
+
+	return roleRanks[m.Role] >= roleRanks[roleEditor]
+}
+
+// requestOrg returns the membership of the organization the request acts for, if any
+func requestOrg(r *http.Request) *Member {
+	m, _ := r.Context().Value(orgContextKey).(*Member)
+
+	return m
+}
+
+// orgMember returns the membership of the caller in the organization with id when their role is at
+// least role. Organizations the caller is not a member of are reported as missing.
+func (h *Handlers) orgMember(r *http.Request, id, role string) (*Member, error) {
+	userID := requestUserID(r)
+	if userID == "" {
+		return nil, ErrOrgNotFound
+	}
+
+	m, err := h.orgs.FindMember(id, userID)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrOrgNotFound
+		}
+
+		return nil, ErrStoreUnavailable
+	}
+
+	if roleRanks[m.Role] < roleRanks[role] {
+		return nil, ErrInsufficientRole
+	}
+
+	return m, nil
+}
+
+// orgStatus returns the http status reported for an error of the organization handlers
+func orgStatus(err error) int {
+	switch err {
+	case ErrOrgNotFound, ErrMemberNotFound, ErrUserNotFound:
+		return http.StatusNotFound
+	case ErrInsufficientRole:
+		return http.StatusForbidden
+	case ErrAlreadyMember, ErrLastOwner, ErrOrgNotEmpty, ErrTooManyOrgs, ErrTooManyMembers:
+		return http.StatusConflict
+	case ErrInvalidOrg, ErrInvalidRole, ErrInvalidRequest:
+		return http.StatusBadRequest
+	case ErrUnableToSaveOrg, ErrUnableToSaveMember:
+		return http.StatusInternalServerError
+	}
+
+	return http.StatusServiceUnavailable
+}
+
+// CreateOrg creates an organization with the caller as its owner
+func (h *Handlers) CreateOrg(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	req := OrgRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondBodyError(w, err, ErrInvalidOrg)
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > maxOrgNameLength {
+		h.RespondError(w, ErrInvalidOrg, http.StatusBadRequest)
+		return
+	}
+
+	u, err := h.users.FindUserByID(requestUserID(r))
+	if err != nil {
+		if err == ErrNotFound {
+			h.RespondError(w, ErrUserNotFound, http.StatusNotFound)
+			return
+		}
+
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	memberships, err := h.orgs.ListMemberships(u.ID)
+	if err != nil {
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	if len(memberships) >= maxOrgsPerUser {
+		h.RespondError(w, ErrTooManyOrgs, http.StatusConflict)
+		return
+	}
+
+	id, err := orgID()
+	if err != nil {
+		h.RespondError(w, ErrUnableToSaveOrg, http.StatusInternalServerError)
+		return
+	}
+
+	o := Organization{ID: id, Name: name, CreatedAt: time.Now().UTC()}
+	if err := h.orgs.SaveOrg(&o); err != nil {
+		h.RespondError(w, ErrUnableToSaveOrg, http.StatusInternalServerError)
+		return
+	}
+
+	m := Member{OrgID: o.ID, UserID: u.ID, Email: u.Email, Role: roleOwner, AddedAt: o.CreatedAt}
+	if err := h.orgs.SaveMember(&m); err != nil {
+		h.RespondError(w, ErrUnableToSaveOrg, http.StatusInternalServerError)
+		return
+	}
+
+	h.RespondJSON(w, OrgMembership{Organization: o, Role: m.Role}, http.StatusCreated)
+}
+
+// ListOrgs responds with the organizations the caller is a member of and their role in each
+func (h *Handlers) ListOrgs(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	orgs := []OrgMembership{}
+
+	userID := requestUserID(r)
+	if userID == "" {
+		h.RespondJSON(w, orgs, http.StatusOK)
+		return
+	}
+
+	memberships, err := h.orgs.ListMemberships(userID)
+	if err != nil {
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	for _, m := range memberships {
+		o, err := h.orgs.FindOrg(m.OrgID)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+			return
+		}
+
+		orgs = append(orgs, OrgMembership{Organization: *o, Role: m.Role})
+	}
+
+	h.RespondJSON(w, orgs, http.StatusOK)
+}
+
+// DeleteOrg removes an organization the caller owns once it has no urls left
+func (h *Handlers) DeleteOrg(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if _, err := h.orgMember(r, params["id"], roleOwner); err != nil {
+		h.RespondError(w, err, orgStatus(err))
+		return
+	}
+
+	_, total, err := h.store.List(r.Context(), ListQuery{Owner: params["id"], Limit: 1})
+	if err != nil {
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	if total > 0 {
+		h.RespondError(w, ErrOrgNotEmpty, http.StatusConflict)
+		return
+	}
+
+	if err := h.orgs.DeleteOrg(params["id"]); err != nil {
+		if err == ErrNotFound {
+			h.RespondError(w, ErrOrgNotFound, http.StatusNotFound)
+			return
+		}
+
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListMembers responds with the members of an organization the caller belongs to
+func (h *Handlers) ListMembers(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if _, err := h.orgMember(r, params["id"], roleViewer); err != nil {
+		h.RespondError(w, err, orgStatus(err))
+		return
+	}
+
+	members, err := h.orgs.ListMembers(params["id"])
+	if err != nil {
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	h.RespondJSON(w, members, http.StatusOK)
+}
+
+// AddMember adds the user registered with an email to an organization the caller owns
+func (h *Handlers) AddMember(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	req := MemberRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondBodyError(w, err, ErrInvalidRequest)
+		return
+	}
+
+	if roleRanks[req.Role] == 0 {
+		h.RespondError(w, ErrInvalidRole, http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.orgMember(r, params["id"], roleOwner); err != nil {
+		h.RespondError(w, err, orgStatus(err))
+		return
+	}
+
+	u, err := h.users.FindUserByEmail(normalizeEmail(req.Email))
+	if err != nil {
+		if err == ErrNotFound {
+			h.RespondError(w, ErrUserNotFound, http.StatusNotFound)
+			return
+		}
+
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	members, err := h.orgs.ListMembers(params["id"])
+	if err != nil {
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	for _, m := range members {
+		if m.UserID == u.ID {
+			h.RespondError(w, ErrAlreadyMember, http.StatusConflict)
+			return
+		}
+	}
+
+	if len(members) >= maxOrgMembers {
+		h.RespondError(w, ErrTooManyMembers, http.StatusConflict)
+		return
+	}
+
+	m := Member{OrgID: params["id"], UserID: u.ID, Email: u.Email, Role: req.Role, AddedAt: time.Now().UTC()}
+	if err := h.orgs.SaveMember(&m); err != nil {
+		h.RespondError(w, ErrUnableToSaveMember, http.StatusInternalServerError)
+		return
+	}
+
+	h.RespondJSON(w, m, http.StatusCreated)
+}
+
+// UpdateMember changes the role of a member of an organization the caller owns
+func (h *Handlers) UpdateMember(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	req := MemberRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondBodyError(w, err, ErrInvalidRequest)
+		return
+	}
+
+	if roleRanks[req.Role] == 0 {
+		h.RespondError(w, ErrInvalidRole, http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.orgMember(r, params["id"], roleOwner); err != nil {
+		h.RespondError(w, err, orgStatus(err))
+		return
+	}
+
+	m, err := h.changeableMember(params["id"], params["user_id"], req.Role)
+	if err != nil {
+		h.RespondError(w, err, orgStatus(err))
+		return
+	}
+
+	m.Role = req.Role
+	if err := h.orgs.SaveMember(m); err != nil {
+		h.RespondError(w, ErrUnableToSaveMember, http.StatusInternalServerError)
+		return
+	}
+
+	h.RespondJSON(w, m, http.StatusOK)
+}
+
+// RemoveMember removes a member from an organization the caller owns, any member may remove themselves
+// to leave it
+func (h *Handlers) RemoveMember(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	role := roleOwner
+	if params["user_id"] == requestUserID(r) {
+		role = roleViewer
+	}
+
+	if _, err := h.orgMember(r, params["id"], role); err != nil {
+		h.RespondError(w, err, orgStatus(err))
+		return
+	}
+
+	if _, err := h.changeableMember(params["id"], params["user_id"], ""); err != nil {
+		h.RespondError(w, err, orgStatus(err))
+		return
+	}
+
+	if err := h.orgs.RemoveMember(params["id"], params["user_id"]); err != nil {
+		if err == ErrNotFound {
+			h.RespondError(w, ErrMemberNotFound, http.StatusNotFound)
+			return
+		}
+
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// changeableMember returns the member of org with userID when their role may become role, the empty
+// role removing them. The last owner can be neither demoted nor removed.
+func (h *Handlers) changeableMember(orgID, userID, role string) (*Member, error) {
+	members, err := h.orgs.ListMembers(orgID)
+	if err != nil {
+		return nil, ErrStoreUnavailable
+	}
+
+	var member *Member
+	owners := 0
+	for i, m := range members {
+		if m.Role == roleOwner {
+			owners++
+		}
+
+		if m.UserID == userID {
+			member = &members[i]
+		}
+	}
+
+	if member == nil {
+		return nil, ErrMemberNotFound
+	}
+
+	if member.Role == roleOwner && role != roleOwner && owners == 1 {
+		return nil, ErrLastOwner
+	}
+
+	return member, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const passwordHeader = "X-Link-Password"
+
+// PasswordForm is the data rendered by the password prompt
+type PasswordForm struct {
+	Action string
+	Failed bool
+}
+
+// hashPassword returns the bcrypt hash stored for a protected url
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+
+	return string(hash), err
+}
+
+// requestPassword returns the password supplied for a protected url, from the prompt's form, the
+// password query parameter or the X-Link-Password header
+func requestPassword(r *http.Request) string {
+	if r.Method == http.MethodPost {
+		if password := r.PostFormValue("password"); password != "" {
+			return password
+		}
+	}
+
+	if password := r.URL.Query().Get("password"); password != "" {
+		return password
+	}
+
+	return r.Header.Get(passwordHeader)
+}
+
+// unlocked reports whether the request may follow u, writing the password prompt when it may not
+func (h *Handlers) unlocked(w http.ResponseWriter, r *http.Request, u *URL) bool {
+	if u.PasswordHash == "" {
+		return true
+	}
+
+	password := requestPassword(r)
+	if password != "" && bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil {
+		return true
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusUnauthorized)
+	templates.ExecuteTemplate(w, "password.html", &PasswordForm{Action: r.URL.Path, Failed: password != ""})
+
+	return false
+}
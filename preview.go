@@ -0,0 +1,156 @@
+package main
+
+import (
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const previewTimeout = 3 * time.Second
+
+// previewReadLimit caps how much of the destination is read while looking for its title and metadata
+const previewReadLimit = 64 * 1024
+
+// metadataMaxLength caps the length of the title and description stored with a url
+const metadataMaxLength = 300
+
+var titlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+var metaPattern = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+var attributePattern = regexp.MustCompile(`(?is)([a-z:-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+
+var previewClient = egress.Client(previewTimeout)
+
+// Preview is the data rendered by the interstitial page
+type Preview struct {
+	Host        string
+	ShortURL    string
+	OriginalURL string
+	PageMetadata
+}
+
+// PageMetadata describes a destination page, it is read from the page's title, description and Open
+// Graph tags
+type PageMetadata struct {
+	Title       string `json:"title,omitempty" bson:"title,omitempty"`
+	Description string `json:"description,omitempty" bson:"description,omitempty"`
+	ImageURL    string `json:"image_url,omitempty" bson:"image_url,omitempty"`
+}
+
+// isPreview reports whether the request asked for the interstitial instead of a redirect, either with
+// a trailing + on the slug or a preview query parameter. The router unescapes the + in the slug
+// parameter to a space so the suffix is checked on the raw path.
+func isPreview(r *http.Request, slug string) (string, bool) {
+	if strings.HasSuffix(r.URL.Path, "+") && slug != "" {
+		return slug[:len(slug)-1], true
+	}
+
+	switch r.URL.Query().Get("preview") {
+	case "1", "true":
+		return slug, true
+	}
+
+	return slug, false
+}
+
+// RespondPreview renders the interstitial page for u so the visitor can inspect the destination
+// before following it. Metadata stored when the url was created is used when there is some,
+// otherwise the destination is fetched.
+func (h *Handlers) RespondPreview(w http.ResponseWriter, u *URL) {
+	data := Preview{
+		Host:         h.Host,
+		ShortURL:     u.ShortURL,
+		OriginalURL:  u.OriginalURL,
+		PageMetadata: u.PageMetadata,
+	}
+	if data.PageMetadata == (PageMetadata{}) {
+		data.PageMetadata = fetchMetadata(u.OriginalURL)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	templates.ExecuteTemplate(w, "preview.html", &data)
+}
+
+// fetchMetadata returns the title, description and og:image of the page at target. The html title
+// and description meta tag are preferred over their Open Graph equivalents, fields are left empty
+// when the page cannot be loaded in time or does not set them.
+func fetchMetadata(target string) PageMetadata {
+	m := PageMetadata{}
+
+	resp, err := previewClient.Get(target)
+	if err != nil {
+		return m
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return m
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, previewReadLimit))
+	if err != nil {
+		return m
+	}
+
+	if match := titlePattern.FindSubmatch(body); match != nil {
+		m.Title = cleanText(string(match[1]))
+	}
+
+	meta := map[string]string{}
+	for _, tag := range metaPattern.FindAll(body, -1) {
+		attrs := map[string]string{}
+		for _, attr := range attributePattern.FindAllSubmatch(tag, -1) {
+			attrs[strings.ToLower(string(attr[1]))] = string(attr[2]) + string(attr[3]) + string(attr[4])
+		}
+
+		key := attrs["property"]
+		if key == "" {
+			key = attrs["name"]
+		}
+		if key = strings.ToLower(key); key != "" && meta[key] == "" {
+			meta[key] = attrs["content"]
+		}
+	}
+
+	if m.Title == "" {
+		m.Title = cleanText(meta["og:title"])
+	}
+
+	if m.Description = cleanText(meta["description"]); m.Description == "" {
+		m.Description = cleanText(meta["og:description"])
+	}
+
+	m.ImageURL = resolveImage(resp.Request.URL, html.UnescapeString(meta["og:image"]))
+
+	return m
+}
+
+// cleanText unescapes s, collapses its whitespace and truncates it to metadataMaxLength characters
+func cleanText(s string) string {
+	s = strings.Join(strings.Fields(html.UnescapeString(s)), " ")
+
+	if runes := []rune(s); len(runes) > metadataMaxLength {
+		s = string(runes[:metadataMaxLength])
+	}
+
+	return s
+}
+
+// resolveImage resolves an og:image reference against the page it was found on, only http and https
+// images are kept
+func resolveImage(page *url.URL, image string) string {
+	ref, err := url.Parse(strings.TrimSpace(image))
+	if image == "" || err != nil {
+		return ""
+	}
+
+	resolved := page.ResolveReference(ref)
+	if resolved.Scheme != "http" && resolved.Scheme != "https" {
+		return ""
+	}
+
+	return resolved.String()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// clickPurgeInterval is how often click events past the retention window are purged
+const clickPurgeInterval = time.Hour
+
+// ErrInvalidBefore is returned when purging clicks without a valid time to purge them before
+var ErrInvalidBefore = codedError("invalid_before", "before", "before must be an RFC 3339 time or date")
+
+// PurgeClicksResponse is returned after click events have been purged
+type PurgeClicksResponse struct {
+	Before time.Time `json:"before"`
+	Purged int       `json:"purged"`
+}
+
+// anonymizeIP zeroes the host part of ip, keeping the /24 network of ipv4 addresses and the /48 of
+// ipv6 addresses, so it still locates a visitor roughly but no longer identifies them
+func anonymizeIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// recordedIP returns the client address of r as it may be logged or stored, truncated when
+// URL_ANONYMIZE_IPS is set
+func (h *Handlers) recordedIP(r *http.Request) string {
+	if h.anonymizeIPs {
+		return anonymizeIP(h.clientIP(r))
+	}
+
+	return h.clientIP(r)
+}
+
+// purgeOldClicks removes click events recorded more than retention ago every interval, it never
+// returns
+func purgeOldClicks(clicks ClickStore, retention, interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := clicks.PurgeClicks(time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("Unable to purge old clicks: %v", err)
+		}
+
+		if n > 0 {
+			log.Printf("Purged %d old clicks", n)
+		}
+	}
+}
+
+// PurgeClicks removes every click event recorded before the before query parameter, an RFC 3339 time
+// or date, such as when an operator shortens the retention window
+func (h *Handlers) PurgeClicks(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	value := r.URL.Query().Get("before")
+	before, err := parseStatsTime(value, time.Time{})
+	if value == "" || err != nil {
+		h.RespondError(w, ErrInvalidBefore, http.StatusBadRequest)
+		return
+	}
+
+	n, err := h.clicks.PurgeClicks(before)
+	if err != nil {
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	h.RespondJSON(w, PurgeClicksResponse{Before: before, Purged: n}, http.StatusOK)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const defaultQRSize = 256
+const minQRSize = 64
+const maxQRSize = 1024
+
+// QRCode responds with a png qr code that encodes the short url for slug. The optional size query
+// parameter sets the width and height of the image in pixels.
+func (h *Handlers) QRCode(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	slug := h.canonicalSlug(params["slug"])
+	logSlug(r, slug)
+
+	size := defaultQRSize
+	if s := r.URL.Query().Get("size"); s != "" {
+		var err error
+		size, err = strconv.Atoi(s)
+		if err != nil || size < minQRSize || size > maxQRSize {
+			h.RespondError(w, ErrInvalidQRSize, http.StatusBadRequest)
+			return
+		}
+	}
+
+	u, err := h.store.FindBySlug(r.Context(), slug)
+	if err != nil || u.Deleted() {
+		h.RespondError(w, ErrNotFound, http.StatusNotFound)
+		return
+	}
+
+	if u.Expired(time.Now()) {
+		h.RespondError(w, ErrExpired, http.StatusGone)
+		return
+	}
+
+	png, err := qrcode.Encode(u.ShortURL, qrcode.Medium, size)
+	if err != nil {
+		h.RespondError(w, ErrUnableToCreateQR, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(png)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(png)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/dimfeld/httptreemux"
+)
+
+// quickParams are accepted by the quick shorten endpoint
+var quickParams = []QueryParam{
+	{Name: "url", Type: "string", Description: "Url to shorten"},
+	{Name: "key", Type: "string", Description: "Api key or session token, for clients that cannot send an Authorization header"},
+	{Name: "slug", Type: "string", Description: "Custom slug, generated when empty"},
+}
+
+// QueryKey authenticates requests that cannot set an Authorization header, such as bookmarklets, with
+// the api key or session token in the key query parameter
+func (h *Handlers) QueryKey(next httptreemux.HandlerFunc) httptreemux.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if key := r.URL.Query().Get("key"); key != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+
+		next(w, r, params)
+	}
+}
+
+// Quick shortens the url query parameter through the same path as the shorten endpoint, idempotency
+// keys included, and responds with nothing but the short url as plain text when wrapped in PlainText,
+// so bookmarklets, browser extensions and shell scripts can use it without parsing json
+func (h *Handlers) Quick(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	query := r.URL.Query()
+	req := ShortenRequest{
+		URL:      query.Get("url"),
+		Slug:     query.Get("slug"),
+		ForceNew: query.Get("force_new") == "true",
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	h.shorten(w, r, req)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQuick(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		body   string
+	}{
+		{"generated slug", "url=https://example.com/a", http.StatusCreated, testHost + "/"},
+		{"custom slug", "url=https://example.com/b&slug=custom", http.StatusCreated, testHost + "/custom\n"},
+		{"missing url", "", http.StatusBadRequest, ""},
+		{"invalid url", "url=not+a+url", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestHandlers(t)
+
+			w := httptest.NewRecorder()
+			h.PlainText(h.Quick)(w, httptest.NewRequest(http.MethodGet, "/quick?"+tt.query, nil), nil)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+				t.Errorf("Content-Type = %q, want text/plain", got)
+			}
+			if !strings.HasPrefix(w.Body.String(), tt.body) {
+				t.Errorf("body %q, want it to start with %q", w.Body, tt.body)
+			}
+		})
+	}
+}
+
+func TestQuickIdempotencyKey(t *testing.T) {
+	h, _ := newTestHandlers(t)
+	handler := h.PlainText(h.Quick)
+
+	var first string
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/quick?url=https://example.com/a&force_new=true", nil)
+		r.Header.Set(idempotencyKeyHeader, "retry")
+
+		w := httptest.NewRecorder()
+		handler(w, r, nil)
+
+		if w.Code != http.StatusCreated {
+			t.Fatalf("call %d: status %d: %s", i, w.Code, w.Body)
+		}
+		if i == 0 {
+			first = w.Body.String()
+			continue
+		}
+
+		if w.Body.String() != first {
+			t.Errorf("retry shortened to %q, want %q", w.Body, first)
+		}
+		if w.Header().Get("Idempotent-Replayed") != "true" {
+			t.Error("retry was not replayed")
+		}
+	}
+}
+
+func TestQuickQuotaExceeded(t *testing.T) {
+	h, _ := newTestHandlers(t)
+	k := &APIKey{ID: "key", MonthlyQuota: 1}
+	handler := h.PlainText(h.Quota(h.Quick))
+
+	for i, want := range []int{http.StatusCreated, http.StatusTooManyRequests} {
+		r := quotaRequest(k, "")
+		r.URL.RawQuery = "url=https://example.com/a&force_new=true"
+
+		w := httptest.NewRecorder()
+		handler(w, r, nil)
+
+		if w.Code != want {
+			t.Fatalf("call %d: status %d, want %d: %s", i, w.Code, want, w.Body)
+		}
+		if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+			t.Errorf("call %d: Content-Type = %q, want text/plain", i, got)
+		}
+		if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Errorf("call %d: refused with no Retry-After", i)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dimfeld/httptreemux"
+)
+
+// usageMonthFormat names the calendar month, in utc, usage is counted for
+const usageMonthFormat = "2006-01"
+
+// The counters kept for every api key and month
+const (
+	usageShortens  = "shortens"
+	usageRedirects = "redirects"
+)
+
+var (
+	ErrQuotaExceeded    = codedError("quota_exceeded", "", "The api key has used its monthly quota of shorten calls")
+	ErrInvalidQuota     = codedError("invalid_quota", "monthly_quota", "The monthly quota must be 0 for no limit or more")
+	ErrInvalidMonth     = codedError("invalid_month", "month", "Month must be a year and month such as 2024-05")
+	ErrAPIKeyRequired   = codedError("api_key_required", "", "Usage is counted for api keys, authenticate with one")
+	ErrUnableToSetKey   = codedError("key_update_failed", "", "Unable to update api key")
+	ErrUsageUnavailable = codedError("usage_unavailable", "", "Unable to load the usage of the api key")
+)
+
+// UsageStore counts the shorten calls made with each api key and the redirects through the urls they
+// created, per calendar month
+type UsageStore interface {
+	// CountUsage atomically adds n, which may be negative, to the counter kind, shortens or redirects,
+	// of key in month and returns its new value
+	CountUsage(keyID, month, kind string, n int) (int, error)
+	// KeyUsage returns the shorten calls and redirects counted for key in month
+	KeyUsage(keyID, month string) (shortens, redirects int, err error)
+}
+
+// KeyUsage reports the use of an api key during a month against its quota
+type KeyUsage struct {
+	KeyID     string `json:"key_id"`
+	Month     string `json:"month"`
+	Shortens  int    `json:"shortens"`
+	Redirects int    `json:"redirects"`
+	// MonthlyQuota is the number of shorten calls allowed per month, 0 when they are not limited
+	MonthlyQuota int       `json:"monthly_quota"`
+	Remaining    *int      `json:"remaining,omitempty"`
+	ResetsAt     time.Time `json:"resets_at"`
+}
+
+// quotaContextKey holds the quotaReservation of a shorten call in its request context
+const quotaContextKey contextKey = "quota"
+
+// quotaReservation is the part of an api key's monthly quota a shorten call has taken. Calls are
+// counted before the url is created, so concurrent calls cannot go over the quota together, and
+// returned to the quota when the call fails.
+type quotaReservation struct {
+	key      *APIKey
+	month    string
+	reserved int
+	// used is the number of calls the handler reported using, -1 until it does
+	used int
+	// remaining is the number of calls left in the month once the reserved ones are made
+	remaining int
+}
+
+// usageParams are accepted by the usage reports
+var usageParams = []QueryParam{{Name: "month", Type: "string", Description: "Month as 2024-05, defaults to the current month"}}
+
+// KeyQuotaRequest is the json body accepted when changing the quota of an api key
+type KeyQuotaRequest struct {
+	MonthlyQuota *int `json:"monthly_quota"`
+}
+
+// usageMonth returns the month usage at t is counted in
+func usageMonth(t time.Time) string {
+	return t.UTC().Format(usageMonthFormat)
+}
+
+// monthEnd returns when the month starting at month ends and its quota resets
+func monthEnd(month time.Time) time.Time {
+	return month.AddDate(0, 1, 0)
+}
+
+// contextAPIKey returns the api key that authenticated the request ctx belongs to, if any
+func contextAPIKey(ctx context.Context) *APIKey {
+	k, _ := ctx.Value(apiKeyContextKey).(*APIKey)
+
+	return k
+}
+
+// contextQuota returns the quota reservation of the shorten call ctx belongs to, if any
+func contextQuota(ctx context.Context) *quotaReservation {
+	q, _ := ctx.Value(quotaContextKey).(*quotaReservation)
+
+	return q
+}
+
+// reserveQuota counts n shorten calls of k in the month of now and returns the reservation. When they
+// would take k over its quota they are not counted and ErrQuotaExceeded is returned.
+func (h *Handlers) reserveQuota(k *APIKey, now time.Time, n int) (*quotaReservation, error) {
+	q := &quotaReservation{key: k, month: usageMonth(now), used: -1}
+
+	return q, h.extendQuota(q, n)
+}
+
+// extendQuota counts n more shorten calls on q, or none and returns ErrQuotaExceeded when they would
+// take its key over its quota
+func (h *Handlers) extendQuota(q *quotaReservation, n int) error {
+	shortens, err := h.usage.CountUsage(q.key.ID, q.month, usageShortens, n)
+	if err != nil {
+		return ErrStoreUnavailable
+	}
+
+	if q.key.MonthlyQuota > 0 && shortens > q.key.MonthlyQuota {
+		h.refundQuota(q, n)
+		return ErrQuotaExceeded
+	}
+
+	q.reserved += n
+	q.remaining = max(q.key.MonthlyQuota-shortens, 0)
+
+	return nil
+}
+
+// refundQuota returns n of the calls counted for q to its key's quota, failures are only logged
+func (h *Handlers) refundQuota(q *quotaReservation, n int) {
+	if n == 0 {
+		return
+	}
+
+	if _, err := h.usage.CountUsage(q.key.ID, q.month, usageShortens, -n); err != nil {
+		log.Printf("Unable to refund %d shortens of api key %s: %v", n, q.key.ID, err)
+	}
+}
+
+// settleQuota returns the calls reserved on q that were not used to its key's quota. Handlers that
+// did not report what they used used the whole reservation when they succeeded and none otherwise.
+func (h *Handlers) settleQuota(q *quotaReservation, succeeded bool) {
+	used := q.used
+	if used < 0 {
+		used = 0
+		if succeeded {
+			used = q.reserved
+		}
+	}
+
+	h.refundQuota(q, q.reserved-used)
+}
+
+// countUsage adds one to the counter kind of the api key keyID for the current month, failures are
+// only logged
+func (h *Handlers) countUsage(keyID, kind string) {
+	if _, err := h.usage.CountUsage(keyID, usageMonth(time.Now()), kind, 1); err != nil {
+		log.Printf("Unable to count %s of api key %s: %v", kind, keyID, err)
+	}
+}
+
+// respondQuotaError responds to a shorten call that could not reserve its quota, with 429 Too Many
+// Requests and when the quota resets once it is used up
+func (h *Handlers) respondQuotaError(w http.ResponseWriter, err error, now time.Time) {
+	if err != ErrQuotaExceeded {
+		h.RespondError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+
+	month, _ := time.Parse(usageMonthFormat, usageMonth(now))
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(monthEnd(month).Sub(now).Seconds()))))
+	h.RespondError(w, ErrQuotaExceeded, http.StatusTooManyRequests)
+}
+
+// setQuotaHeaders tells the caller its quota in X-Quota-Limit and the calls it has left in
+// X-Quota-Remaining
+func setQuotaHeaders(w http.ResponseWriter, q *quotaReservation) {
+	if q.key.MonthlyQuota > 0 {
+		w.Header().Set("X-Quota-Limit", strconv.Itoa(q.key.MonthlyQuota))
+		w.Header().Set("X-Quota-Remaining", strconv.Itoa(q.remaining))
+	}
+}
+
+// reserveEntries counts every one of the n entries of a batch or import against the quota of the api
+// key the call r is made with, the call itself reserved the first. It responds with the error and
+// returns false when they would go over the quota. The reservation is nil for calls not counted.
+func (h *Handlers) reserveEntries(w http.ResponseWriter, r *http.Request, n int) (*quotaReservation, bool) {
+	q := contextQuota(r.Context())
+	if q == nil || n <= q.reserved {
+		return q, true
+	}
+
+	if err := h.extendQuota(q, n-q.reserved); err != nil {
+		h.respondQuotaError(w, err, time.Now().UTC())
+		return nil, false
+	}
+	setQuotaHeaders(w, q)
+
+	return q, true
+}
+
+// useEntries reports that n of the entries reserved on q were shortened, the others are returned to
+// the quota once the response is written
+func (h *Handlers) useEntries(w http.ResponseWriter, q *quotaReservation, n int) {
+	if q == nil {
+		return
+	}
+
+	q.used = n
+	q.remaining += q.reserved - n
+	setQuotaHeaders(w, q)
+}
+
+// Quota counts the shorten calls of an api key against its monthly quota before they are made and
+// rejects them with 429 Too Many Requests once it is used up. Calls that fail are returned to the
+// quota. Responses carry the quota in X-Quota-Limit and the calls left after this one in
+// X-Quota-Remaining. Calls made with a session token or anonymously are not counted.
+func (h *Handlers) Quota(next httptreemux.HandlerFunc) httptreemux.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		k := requestAPIKey(r)
+		if k == nil {
+			next(w, r, params)
+			return
+		}
+
+		now := time.Now().UTC()
+		q, err := h.reserveQuota(k, now, 1)
+		if err != nil {
+			if k.MonthlyQuota > 0 {
+				w.Header().Set("X-Quota-Limit", strconv.Itoa(k.MonthlyQuota))
+				w.Header().Set("X-Quota-Remaining", "0")
+			}
+
+			h.respondQuotaError(w, err, now)
+			return
+		}
+		setQuotaHeaders(w, q)
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next(sw, r.WithContext(context.WithValue(r.Context(), quotaContextKey, q)), params)
+
+		h.settleQuota(q, sw.status < http.StatusMultipleChoices)
+	}
+}
+
+// keyUsage returns the usage of k in the month named by the month query parameter, the current month
+// when it is empty
+func (h *Handlers) keyUsage(k *APIKey, r *http.Request) (*KeyUsage, error) {
+	name := r.URL.Query().Get("month")
+	if name == "" {
+		name = usageMonth(time.Now())
+	}
+
+	month, err := time.Parse(usageMonthFormat, name)
+	if err != nil {
+		return nil, ErrInvalidMonth
+	}
+
+	shortens, redirects, err := h.usage.KeyUsage(k.ID, name)
+	if err != nil {
+		return nil, ErrUsageUnavailable
+	}
+
+	usage := &KeyUsage{
+		KeyID:        k.ID,
+		Month:        name,
+		Shortens:     shortens,
+		Redirects:    redirects,
+		MonthlyQuota: k.MonthlyQuota,
+		ResetsAt:     monthEnd(month),
+	}
+
+	if k.MonthlyQuota > 0 {
+		remaining := max(k.MonthlyQuota-shortens, 0)
+		usage.Remaining = &remaining
+	}
+
+	return usage, nil
+}
+
+// respondKeyUsage responds with the usage of k for the requested month
+func (h *Handlers) respondKeyUsage(w http.ResponseWriter, r *http.Request, k *APIKey) {
+	usage, err := h.keyUsage(k, r)
+	if err != nil {
+		if err == ErrInvalidMonth {
+			h.RespondError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		h.RespondError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+
+	h.RespondJSON(w, usage, http.StatusOK)
+}
+
+// Usage responds with the shorten calls and redirects counted this month, or the month passed as
+// ?month=2024-05, for the api key the caller authenticated with
+func (h *Handlers) Usage(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	k := requestAPIKey(r)
+	if k == nil {
+		h.RespondError(w, ErrAPIKeyRequired, http.StatusBadRequest)
+		return
+	}
+
+	h.respondKeyUsage(w, r, k)
+}
+
+// KeyUsage responds with the usage of any api key (admin)
+func (h *Handlers) KeyUsage(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	k, err := h.keys.FindKeyByID(params["id"])
+	if err != nil {
+		if err == ErrNotFound {
+			h.RespondError(w, ErrKeyNotFound, http.StatusNotFound)
+			return
+		}
+
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	h.respondKeyUsage(w, r, k)
+}
+
+// SetKeyQuota changes the number of shorten calls an api key may make per month (admin)
+func (h *Handlers) SetKeyQuota(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	req := KeyQuotaRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondBodyError(w, err, ErrInvalidQuota)
+		return
+	}
+
+	if req.MonthlyQuota == nil || *req.MonthlyQuota < 0 {
+		h.RespondError(w, ErrInvalidQuota, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.keys.SetKeyQuota(params["id"], *req.MonthlyQuota); err != nil {
+		if err == ErrNotFound {
+			h.RespondError(w, ErrKeyNotFound, http.StatusNotFound)
+			return
+		}
+
+		h.RespondError(w, ErrUnableToSetKey, http.StatusInternalServerError)
+		return
+	}
+
+	k, err := h.keys.FindKeyByID(params["id"])
+	if err != nil {
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	h.RespondJSON(w, k, http.StatusOK)
+}
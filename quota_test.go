@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// quotaRequest returns a shorten call made with k
+func quotaRequest(k *APIKey, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/shorten", strings.NewReader(body))
+
+	return r.WithContext(context.WithValue(r.Context(), apiKeyContextKey, k))
+}
+
+// shortensOf returns the shorten calls counted for k this month
+func shortensOf(t *testing.T, h *Handlers, k *APIKey) int {
+	t.Helper()
+
+	shortens, _, err := h.usage.KeyUsage(k.ID, usageMonth(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return shortens
+}
+
+func TestQuotaConcurrentCalls(t *testing.T) {
+	h, _ := newTestHandlers(t)
+	k := &APIKey{ID: "key", MonthlyQuota: 5}
+	handler := h.Quota(func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		// hold every call inside the handler so they all check the quota before any finishes
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	var wg sync.WaitGroup
+	statuses := make([]int, 20)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			w := httptest.NewRecorder()
+			handler(w, quotaRequest(k, ""), nil)
+			statuses[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for _, status := range statuses {
+		switch status {
+		case http.StatusCreated:
+			created++
+		case http.StatusTooManyRequests:
+		default:
+			t.Fatalf("unexpected status %d", status)
+		}
+	}
+
+	if created != k.MonthlyQuota {
+		t.Errorf("%d calls succeeded, want %d", created, k.MonthlyQuota)
+	}
+	if n := shortensOf(t, h, k); n != k.MonthlyQuota {
+		t.Errorf("%d shortens counted, want %d", n, k.MonthlyQuota)
+	}
+}
+
+func TestQuotaRefundsFailedCalls(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		want   int
+	}{
+		{"created", http.StatusCreated, 1},
+		{"existing url", http.StatusOK, 1},
+		{"invalid request", http.StatusBadRequest, 0},
+		{"store failure", http.StatusServiceUnavailable, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestHandlers(t)
+			k := &APIKey{ID: "key", MonthlyQuota: 3}
+			handler := h.Quota(func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+				w.WriteHeader(tt.status)
+			})
+
+			w := httptest.NewRecorder()
+			handler(w, quotaRequest(k, ""), nil)
+
+			if n := shortensOf(t, h, k); n != tt.want {
+				t.Errorf("%d shortens counted, want %d", n, tt.want)
+			}
+			if got := w.Header().Get("X-Quota-Remaining"); got != "2" {
+				t.Errorf("X-Quota-Remaining = %q, want 2", got)
+			}
+		})
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	h, _ := newTestHandlers(t)
+	k := &APIKey{ID: "key", MonthlyQuota: 1}
+	called := 0
+	handler := h.Quota(func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		called++
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	for i, want := range []int{http.StatusCreated, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		handler(w, quotaRequest(k, ""), nil)
+
+		if w.Code != want {
+			t.Fatalf("call %d: status %d, want %d", i, w.Code, want)
+		}
+		if i == 1 && w.Header().Get("Retry-After") == "" {
+			t.Error("refused call has no Retry-After")
+		}
+	}
+
+	if called != 1 {
+		t.Errorf("handler called %d times, want 1", called)
+	}
+	if n := shortensOf(t, h, k); n != 1 {
+		t.Errorf("%d shortens counted, want 1", n)
+	}
+}
+
+func TestQuotaBatchCountsEveryURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		quota  int
+		body   string
+		status int
+		want   int
+	}{
+		{"every entry shortened", 10, `[{"url": "https://example.com/a"}, {"url": "https://example.com/b"}, {"url": "https://example.com/c"}]`, http.StatusOK, 3},
+		{"failed entries refunded", 10, `[{"url": "https://example.com/a"}, {"url": "not a url"}]`, http.StatusOK, 1},
+		{"larger than the quota left", 2, `[{"url": "https://example.com/a"}, {"url": "https://example.com/b"}, {"url": "https://example.com/c"}]`, http.StatusTooManyRequests, 0},
+		{"unlimited", 0, `[{"url": "https://example.com/a"}, {"url": "https://example.com/b"}]`, http.StatusOK, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestHandlers(t)
+			k := &APIKey{ID: "key", MonthlyQuota: tt.quota}
+
+			w := httptest.NewRecorder()
+			h.Quota(h.ShortenBatch)(w, quotaRequest(k, tt.body), nil)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if n := shortensOf(t, h, k); n != tt.want {
+				t.Errorf("%d shortens counted, want %d", n, tt.want)
+			}
+		})
+	}
+}
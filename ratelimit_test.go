@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		proxyHops int
+		forwarded []string
+		want      string
+	}{
+		{"no proxy ignores the header", 0, []string{"203.0.113.9"}, "192.0.2.1"},
+		{"no header", 1, nil, "192.0.2.1"},
+		{"single proxy", 1, []string{"203.0.113.9"}, "203.0.113.9"},
+		{"spoofed entry before the proxy's", 1, []string{"10.0.0.1, 203.0.113.9"}, "203.0.113.9"},
+		{"spoofed entries across headers", 1, []string{"10.0.0.1", "10.0.0.2, 203.0.113.9"}, "203.0.113.9"},
+		{"two proxies", 2, []string{"10.0.0.1, 203.0.113.9, 198.51.100.7"}, "203.0.113.9"},
+		{"fewer entries than proxies", 2, []string{"203.0.113.9"}, "192.0.2.1"},
+		{"blank entries are skipped", 1, []string{"203.0.113.9, "}, "203.0.113.9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handlers{proxyHops: tt.proxyHops}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "192.0.2.1:4321"
+			for _, forwarded := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", forwarded)
+			}
+
+			if got := h.clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitIgnoresSpoofedForwardedFor(t *testing.T) {
+	h := &Handlers{limiter: NewRateLimiter(1, 1), proxyHops: 1}
+	handler := h.RateLimit(func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for i, spoofed := range []string{"10.0.0.1", "10.0.0.2"} {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/shorten", nil)
+		r.RemoteAddr = "192.0.2.1:4321"
+		r.Header.Set("X-Forwarded-For", spoofed+", 203.0.113.9")
+		w := httptest.NewRecorder()
+
+		handler(w, r, nil)
+
+		want := http.StatusNoContent
+		if i > 0 {
+			want = http.StatusTooManyRequests
+		}
+		if w.Code != want {
+			t.Fatalf("request %d with spoofed %s: status %d, want %d", i, spoofed, w.Code, want)
+		}
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	l := NewRateLimiter(2, 1)
+	now := time.Now()
+
+	if ok, _ := l.Allow("client", now); !ok {
+		t.Fatal("first request was limited")
+	}
+
+	ok, wait := l.Allow("client", now)
+	if ok {
+		t.Fatal("request beyond the burst was allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("wait = %s, want 500ms", wait)
+	}
+
+	if ok, _ := l.Allow("client", now.Add(wait)); !ok {
+		t.Error("request after the refill was limited")
+	}
+	if ok, _ := l.Allow("other", now); !ok {
+		t.Error("another client was limited")
+	}
+}
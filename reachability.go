@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const reachabilityTimeout = 5 * time.Second
+
+// reachabilityReadLimit caps how much of a destination's body is read when it has to be probed with
+// GET
+const reachabilityReadLimit = 64 << 10
+
+// ReachabilityChecker probes destinations when they are shortened so links to pages that do not
+// exist are caught before they are shared
+type ReachabilityChecker struct {
+	// reject fails the request for unreachable destinations, otherwise they are only flagged with a
+	// Warning header
+	reject bool
+	client *http.Client
+}
+
+// NewReachabilityChecker creates a checker for the URL_VALIDATE_REACHABILITY mode, true or reject
+// rejects unreachable destinations and warn only flags them
+func NewReachabilityChecker(mode string) *ReachabilityChecker {
+	return &ReachabilityChecker{
+		reject: mode != "warn",
+		client: egress.Client(reachabilityTimeout),
+	}
+}
+
+// Probe returns an error describing why target is unreachable when it cannot be resolved or connected
+// to or responds with a 4xx or 5xx status
+func (c *ReachabilityChecker) Probe(target string) error {
+	status, err := probe(c.client, target)
+	if err != nil {
+		return fmt.Errorf("%s could not be reached", target)
+	}
+
+	if status >= 400 {
+		return fmt.Errorf("%s responded %d %s", target, status, http.StatusText(status))
+	}
+
+	return nil
+}
+
+// probe returns the status target responds with, requesting it with HEAD and falling back to GET for
+// servers that do not support it
+func probe(client *http.Client, target string) (int, error) {
+	resp, err := client.Head(target)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp.Body.Close()
+		resp, err = client.Get(target)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, reachabilityReadLimit))
+
+	return resp.StatusCode, nil
+}
+
+// reachable probes target when reachability checks are enabled. Unreachable destinations are either
+// rejected with ErrUnreachableURL or flagged with a Warning header on the response.
+func (h *Handlers) reachable(header http.Header, target string) error {
+	if h.reachability == nil {
+		return nil
+	}
+
+	err := h.reachability.Probe(target)
+	if err == nil {
+		return nil
+	}
+
+	if h.reachability.reject {
+		return ErrUnreachableURL
+	}
+
+	log.Printf("Shortening unreachable url: %v", err)
+	header.Set("Warning", fmt.Sprintf("199 - %q", err.Error()))
+
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dimfeld/httptreemux"
+)
+
+// defaultSnapshotInterval is how often the fallback snapshot is rewritten unless
+// URL_FALLBACK_SNAPSHOT_MINUTES is set
+const defaultSnapshotInterval = time.Hour
+
+// snapshotBatchSize is the number of urls listed at a time while writing a snapshot
+const snapshotBatchSize = 500
+
+// ErrReadOnly is returned for changes requested while the store is unavailable
+var ErrReadOnly = codedError("read_only", "", "The store is unavailable, short urls keep redirecting but nothing can be changed until it is back")
+
+// snapshotRecord is a line of a snapshot file, urls are kept in their stored encoding so protected
+// urls keep their password
+type snapshotRecord struct {
+	Slug string          `json:"slug"`
+	URL  json.RawMessage `json:"url"`
+}
+
+// encodeSnapshotRecord writes u as a line of a snapshot
+func encodeSnapshotRecord(enc *json.Encoder, u *URL) error {
+	js, err := marshalURL(u)
+	if err != nil {
+		return err
+	}
+
+	return enc.Encode(snapshotRecord{Slug: u.Slug, URL: js})
+}
+
+// Snapshot is a copy of every url kept in memory and in a file, it serves redirects while the store is
+// unavailable, including after a restart during an outage
+type Snapshot struct {
+	path string
+
+	mu   sync.RWMutex
+	urls map[string]*URL
+}
+
+// LoadSnapshot reads the snapshot file at path, a missing file gives an empty snapshot that is filled
+// the first time it is written
+func LoadSnapshot(path string) (*Snapshot, error) {
+	s := &Snapshot{path: path, urls: map[string]*URL{}}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxImportBytes)
+	for scanner.Scan() {
+		var record snapshotRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, err
+		}
+
+		u := &URL{}
+		if err := unmarshalURL(record.URL, u); err != nil {
+			return nil, err
+		}
+		u.Slug = record.Slug
+
+		s.urls[u.Slug] = u
+	}
+
+	return s, scanner.Err()
+}
+
+// Get returns the url stored under slug when the snapshot was taken
+func (s *Snapshot) Get(slug string) (*URL, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.urls[slug]
+
+	return u, ok
+}
+
+// Len returns the number of urls in the snapshot
+func (s *Snapshot) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.urls)
+}
+
+// Write copies every live url of store into the snapshot and its file. The file is replaced once the
+// copy is complete, a failure leaves the previous snapshot in place.
+func (s *Snapshot) Write(store Store) error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	out := bufio.NewWriter(f)
+	enc := json.NewEncoder(out)
+	urls := map[string]*URL{}
+
+	err = eachURL(store, func(u *URL) error {
+		urls[u.Slug] = u
+		return encodeSnapshotRecord(enc, u)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := out.Flush(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.urls = urls
+	s.mu.Unlock()
+
+	return nil
+}
+
+// writeSnapshots rewrites snapshot from store right away and then every interval
+func writeSnapshots(store Store, snapshot *Snapshot, interval time.Duration) {
+	for {
+		start := time.Now()
+		if err := snapshot.Write(store); err != nil {
+			log.Printf("Unable to write the url snapshot: %v", err)
+		} else {
+			log.Printf("Wrote %d urls to the snapshot in %s", snapshot.Len(), time.Since(start))
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// snapshotStore serves redirects from a snapshot when the store cannot be reached
+type snapshotStore struct {
+	Store
+	snapshot *Snapshot
+	hits     *Counter
+}
+
+// ResolveSlug returns the url stored under slug for a redirect or ErrNotFound, falling back to the
+// snapshot while the store is unavailable
+func (s *snapshotStore) ResolveSlug(ctx context.Context, slug string) (*URL, error) {
+	u, err := s.Store.ResolveSlug(ctx, slug)
+	if !storeFailure(err) {
+		return u, err
+	}
+
+	if u, ok := s.snapshot.Get(slug); ok {
+		s.hits.Inc()
+		return u, nil
+	}
+
+	return nil, err
+}
+
+// ReadOnly rejects the changes next would make with 503 Service Unavailable while the circuit breaker
+// is open, rather than letting each fail on the store
+func (h *Handlers) ReadOnly(next httptreemux.HandlerFunc) httptreemux.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if h.readOnly() {
+			h.RespondError(w, ErrReadOnly, http.StatusServiceUnavailable)
+			return
+		}
+
+		next(w, r, params)
+	}
+}
+
+// ReadOnlyPage is ReadOnly for the routes browsers reach through links and forms, it shows them an
+// html error page
+func (h *Handlers) ReadOnlyPage(next httptreemux.HandlerFunc) httptreemux.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if h.readOnly() {
+			h.RespondErrorPage(w, r, ErrReadOnly, http.StatusServiceUnavailable)
+			return
+		}
+
+		next(w, r, params)
+	}
+}
+
+// readOnly reports whether changes are refused because the circuit breaker is open
+func (h *Handlers) readOnly() bool {
+	return h.breaker != nil && h.breaker.Open()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadOnlyCoversEveryMutatingRoute(t *testing.T) {
+	h, _ := newTestHandlers(t)
+	h.breaker = NewCircuitBreaker(1, time.Minute)
+	h.breaker.record(errors.New("store down"))
+
+	mux := h.router(&Config{Webhooks: true, CustomDomains: true, BitlyCompat: true})
+
+	// the routes that change something without being documented, or with a method that looks safe
+	routes := [][2]string{
+		{"GET", "/new/https://example.com"},
+		{"GET", "/api/quick?url=https://example.com"},
+		{"GET", "/auth/github/callback"},
+		{"POST", "/dashboard/urls"},
+		{"POST", "/dashboard/urls/abc"},
+		{"POST", "/dashboard/urls/abc/delete"},
+		{"POST", "/abc"},
+	}
+
+	for _, op := range h.operations {
+		switch op.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			continue
+		}
+
+		path := op.Path
+		for _, param := range []string{":slug", ":id", ":domain", ":user_id"} {
+			path = strings.ReplaceAll(path, param, "x")
+		}
+
+		routes = append(routes, [2]string{op.Method, path}, [2]string{op.Method, strings.Replace(path, "/api/"+apiVersion, "/api", 1)})
+	}
+
+	for _, route := range routes {
+		t.Run(route[0]+" "+route[1], func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(route[0], route[1], strings.NewReader("{}")))
+
+			if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), ErrReadOnly.Error()) {
+				t.Errorf("status %d, want %d read only: %s", w.Code, http.StatusServiceUnavailable, w.Body)
+			}
+		})
+	}
+}
+
+func TestReadOnlyServesReads(t *testing.T) {
+	h, _ := newTestHandlers(t)
+	h.breaker = NewCircuitBreaker(1, time.Minute)
+	h.breaker.record(errors.New("store down"))
+
+	w := httptest.NewRecorder()
+	h.router(&Config{}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultRedirectCode = http.StatusFound
+const defaultRedirectMaxAge = 24 * 60 * 60
+
+// redirectCodes are the statuses a url may redirect with
+var redirectCodes = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+// permanentRedirect reports whether browsers and cdns may cache a redirect with code
+func permanentRedirect(code int) bool {
+	return code == http.StatusMovedPermanently || code == http.StatusPermanentRedirect
+}
+
+// consumeClick counts a visit to a url with a click limit, responding 410 Gone and returning false
+// once the limit has been used up. Self destructing urls are deleted on their last click.
+func (h *Handlers) consumeClick(w http.ResponseWriter, r *http.Request, u *URL) bool {
+	uses, err := h.store.IncrementUses(r.Context(), u.Slug)
+	if err != nil {
+		if err == ErrNotFound {
+			h.RespondErrorPage(w, r, ErrNotFound, http.StatusNotFound)
+			return false
+		}
+
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return false
+	}
+
+	if uses > u.MaxClicks {
+		h.RespondErrorPage(w, r, ErrClickLimitReached, http.StatusGone)
+		return false
+	}
+
+	if uses == u.MaxClicks && u.SelfDestruct {
+		if err := h.store.Delete(r.Context(), u.Slug, true); err != nil && err != ErrNotFound {
+			log.Printf("Unable to delete self destructing url %s: %v", u.Slug, err)
+		}
+	}
+
+	return true
+}
+
+// respondNotLive answers visits to u before its start time, either with a page saying when it goes
+// live or, when URL_NOT_LIVE_RESPONSE is 404, as though the url did not exist
+func (h *Handlers) respondNotLive(w http.ResponseWriter, r *http.Request, u *URL) {
+	if h.hideNotLive {
+		h.metrics.NotFound.Inc()
+		h.RespondErrorPage(w, r, ErrNotFound, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, no-cache, no-store, must-revalidate")
+	h.RespondErrorPage(w, r, fmt.Errorf("This url goes live at %s", u.StartsAt.Format(time.RFC1123)), http.StatusForbidden)
+}
+
+// redirect sends the visitor to u's destination with its redirect code, or the default of its domain
+// or the shortener. Permanent redirects are cacheable until the url expires, temporary ones are never cached so every
+// visit reaches the shortener and is counted.
+func (h *Handlers) redirect(w http.ResponseWriter, r *http.Request, u *URL, destination string) {
+	code := u.RedirectCode
+	if code == 0 {
+		code = h.shortDomains.Of(u).RedirectCode
+	}
+	if code == 0 {
+		code = h.redirectCode
+	}
+
+	// protected, limited and targeted urls are never cached, every visit has to reach the shortener
+	if permanentRedirect(code) && u.PasswordHash == "" && u.MaxClicks == 0 && !u.targeted() {
+		maxAge := h.redirectMaxAge
+		if u.ExpiresAt != nil {
+			if remaining := int(time.Until(*u.ExpiresAt) / time.Second); remaining < maxAge {
+				maxAge = remaining
+			}
+		}
+
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(maxAge))
+	} else {
+		w.Header().Set("Cache-Control", "private, no-cache, no-store, must-revalidate")
+	}
+
+	// search engines that follow a short url anyway index the destination rather than the slug
+	w.Header().Set("X-Robots-Tag", "noindex")
+	http.Redirect(w, r, destination, code)
+}
+
+// redirectMethods are the methods a short url answers
+const redirectMethods = "GET, HEAD, POST, OPTIONS"
+
+// RedirectOptions lists the methods a short url answers without looking the url up
+func (h *Handlers) RedirectOptions(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	w.Header().Set("Allow", redirectMethods)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.WriteHeader(http.StatusNoContent)
+}
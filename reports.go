@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+const defaultReportThreshold = 5
+const maxReportReasonLength = 500
+
+// Report is an end user flagging a url as abusive. Reporters are identified by a hash of their ip
+// so repeated reports from one client count once.
+type Report struct {
+	Slug      string    `json:"slug" bson:"slug"`
+	Reason    string    `json:"reason" bson:"reason"`
+	Reporter  string    `json:"reporter" bson:"reporter"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+// ReportRequest is the json body accepted when reporting a url
+type ReportRequest struct {
+	Reason string `json:"reason"`
+}
+
+// ReportList is a page of abuse reports
+type ReportList struct {
+	Reports []Report `json:"reports"`
+	Page    int      `json:"page"`
+	PerPage int      `json:"per_page"`
+	Total   int      `json:"total"`
+}
+
+// ReportStore defines the persistence operations for abuse reports
+type ReportStore interface {
+	// SaveReport inserts a new report
+	SaveReport(r *Report) error
+	// CountReporters returns the number of distinct reporters that have flagged slug
+	CountReporters(slug string) (int, error)
+	// ListReports returns a page of reports, newest first, for slug or every url when slug is empty
+	// and the total number of reports
+	ListReports(slug string, skip, limit int) ([]Report, int, error)
+	// DeleteReports dismisses every report for slug
+	DeleteReports(slug string) error
+}
+
+// reporterHash identifies a reporter without storing their ip
+func reporterHash(ip string) string {
+	sum := sha256.Sum256([]byte(ip))
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// ReportURL records an abuse report for a url. Once enough distinct clients have reported it the url
+// is disabled until an admin reviews it.
+func (h *Handlers) ReportURL(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	slug := h.canonicalSlug(params["slug"])
+	logSlug(r, slug)
+
+	req := ReportRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Reason) > maxReportReasonLength {
+		h.respondBodyError(w, err, ErrInvalidRequest)
+		return
+	}
+
+	u, err := h.store.FindBySlug(r.Context(), slug)
+	if err != nil || u.Deleted() {
+		if err == nil || err == ErrNotFound {
+			h.RespondError(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		h.RespondError(w, ErrUnableToSaveReport, http.StatusInternalServerError)
+		return
+	}
+
+	report := Report{
+		Slug:      slug,
+		Reason:    req.Reason,
+		Reporter:  reporterHash(h.recordedIP(r)),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err := h.reports.SaveReport(&report); err != nil {
+		h.RespondError(w, ErrUnableToSaveReport, http.StatusInternalServerError)
+		return
+	}
+
+	if h.reportThreshold > 0 && !u.Disabled {
+		n, err := h.reports.CountReporters(slug)
+		if err != nil {
+			log.Printf("Unable to count reports for %s: %v", slug, err)
+		} else if n >= h.reportThreshold {
+			u.Disabled = true
+			if err := h.store.Update(r.Context(), u); err != nil {
+				log.Printf("Unable to disable reported url %s: %v", slug, err)
+			}
+		}
+	}
+
+	if h.webhooks != nil {
+		h.webhooks.Notify(u.Owner, WebhookEvent{Event: EventLinkFlagged, URL: u, Report: &report})
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ListReports responds with a page of abuse reports, newest first. The slug query parameter
+// restricts them to a single url.
+func (h *Handlers) ListReports(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	q, err := listQuery(r)
+	if err != nil {
+		h.RespondError(w, ErrInvalidListQuery, http.StatusBadRequest)
+		return
+	}
+
+	reports, total, err := h.reports.ListReports(h.canonicalSlug(r.URL.Query().Get("slug")), q.Skip, q.Limit)
+	if err != nil {
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	h.RespondJSON(w, ReportList{Reports: reports, Page: q.Skip/q.Limit + 1, PerPage: q.Limit, Total: total}, http.StatusOK)
+}
+
+// DismissReports deletes every report for a url once an admin has reviewed it, the url is not
+// re-enabled
+func (h *Handlers) DismissReports(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	slug := h.canonicalSlug(params["slug"])
+	logSlug(r, slug)
+
+	if err := h.reports.DeleteReports(slug); err != nil {
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"os"
+)
+
+// defaultRobotsTxt lets crawlers index the home page but not the slug space, short urls only lead
+// elsewhere and crawling them would fill stats with bots
+const defaultRobotsTxt = `User-agent: *
+Allow: /$
+Disallow: /
+`
+
+// loadRobotsTxt returns the robots.txt served, the contents of the file named by URL_ROBOTS_TXT or the
+// default when it is empty
+func loadRobotsTxt(path string) ([]byte, error) {
+	if path == "" {
+		return []byte(defaultRobotsTxt), nil
+	}
+
+	return os.ReadFile(path)
+}
+
+// RobotsTxt tells crawlers which paths they may fetch
+func (h *Handlers) RobotsTxt(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(h.robotsTxt)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// clickRollupInterval is how often recorded clicks are folded into hourly rollups
+const clickRollupInterval = time.Minute
+
+// clickRollupLag keeps an hour open for a while after it ends, clicks are recorded off the request
+// path and may arrive a little after their timestamp
+const clickRollupLag = 5 * time.Minute
+
+// clickRollupBatch bounds the clicks aggregated in one pass so it stays within the store's query
+// timeout, a store with a long history of clicks that have never been rolled up catches up an hour at
+// a time
+const clickRollupBatch = time.Hour
+
+// ClickRollup is implemented by click stores that keep every raw click and pre-aggregate them into
+// hourly counts per slug, referrer and variant. Stats add up the rollups and only count the clicks
+// recorded since the last rollup one by one.
+type ClickRollup interface {
+	// RolledUpUntil returns the time rollups cover clicks up to, the time of the first click when
+	// nothing has been rolled up yet and the zero time when no clicks have been recorded
+	RolledUpUntil() (time.Time, error)
+	// RollupClicks replaces the rollups of every hour from from up to before to with counts of the
+	// clicks recorded in them and records that rollups cover clicks up to to. Rolling up an hour again
+	// gives the same counts, so instances may roll up concurrently.
+	RollupClicks(from, to time.Time) error
+}
+
+// rollupClicks folds the clicks of every hour that has ended into rollups every interval, it never
+// returns
+func rollupClicks(r ClickRollup, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := rollupPendingClicks(r, time.Now()); err != nil {
+			log.Printf("Unable to roll up clicks: %v", err)
+		}
+	}
+}
+
+// rollupPendingClicks rolls up the clicks of the hours that ended at least clickRollupLag before now
+// and have not been rolled up yet
+func rollupPendingClicks(r ClickRollup, now time.Time) error {
+	end := now.Add(-clickRollupLag).UTC().Truncate(time.Hour)
+
+	for {
+		from, err := r.RolledUpUntil()
+		if err != nil || from.IsZero() {
+			return err
+		}
+
+		from = from.UTC().Truncate(time.Hour)
+		if !from.Before(end) {
+			return nil
+		}
+
+		to := from.Add(clickRollupBatch)
+		if to.After(end) {
+			to = end
+		}
+
+		if err := r.RollupClicks(from, to); err != nil {
+			return err
+		}
+	}
+}
+
+// earliest returns whichever of a and b comes first
+func earliest(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+
+	return a
+}
+
+// latest returns whichever of a and b comes last
+func latest(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+
+	return a
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const defaultSafeBrowsingURL = "https://safebrowsing.googleapis.com/v4/threatMatches:find"
+
+// safeBrowsingBatchSize is the most urls the lookup api accepts in a single request
+const safeBrowsingBatchSize = 500
+
+const safeBrowsingTimeout = 5 * time.Second
+
+// URLScreener checks destinations against a list of known phishing and malware urls
+type URLScreener interface {
+	// Flagged returns the subset of urls that are known to be unsafe
+	Flagged(urls []string) (map[string]bool, error)
+}
+
+// SafeBrowsing is a URLScreener backed by the Google Safe Browsing lookup api, or any blocklist
+// service that implements the same threatMatches:find request
+type SafeBrowsing struct {
+	Endpoint string
+	Key      string
+	client   *http.Client
+}
+
+// NewSafeBrowsing creates a client for the lookup api at endpoint, defaulting to Google's
+func NewSafeBrowsing(endpoint, key string) *SafeBrowsing {
+	if endpoint == "" {
+		endpoint = defaultSafeBrowsingURL
+	}
+
+	return &SafeBrowsing{Endpoint: endpoint, Key: key, client: &http.Client{Timeout: safeBrowsingTimeout}}
+}
+
+type threatEntry struct {
+	URL string `json:"url"`
+}
+
+type threatMatchesRequest struct {
+	Client struct {
+		ClientID      string `json:"clientId"`
+		ClientVersion string `json:"clientVersion"`
+	} `json:"client"`
+	ThreatInfo struct {
+		ThreatTypes      []string      `json:"threatTypes"`
+		PlatformTypes    []string      `json:"platformTypes"`
+		ThreatEntryTypes []string      `json:"threatEntryTypes"`
+		ThreatEntries    []threatEntry `json:"threatEntries"`
+	} `json:"threatInfo"`
+}
+
+type threatMatchesResponse struct {
+	Matches []struct {
+		ThreatType string      `json:"threatType"`
+		Threat     threatEntry `json:"threat"`
+	} `json:"matches"`
+}
+
+// Flagged returns the subset of urls that match a malware, phishing or unwanted software list
+func (s *SafeBrowsing) Flagged(urls []string) (map[string]bool, error) {
+	flagged := map[string]bool{}
+
+	for start := 0; start < len(urls); start += safeBrowsingBatchSize {
+		end := start + safeBrowsingBatchSize
+		if end > len(urls) {
+			end = len(urls)
+		}
+
+		if err := s.lookup(urls[start:end], flagged); err != nil {
+			return nil, err
+		}
+	}
+
+	return flagged, nil
+}
+
+// lookup checks a single batch of urls, adding matches to flagged
+func (s *SafeBrowsing) lookup(urls []string, flagged map[string]bool) error {
+	req := threatMatchesRequest{}
+	req.Client.ClientID = "fcc-url-shortener"
+	req.Client.ClientVersion = "1.0"
+	req.ThreatInfo.ThreatTypes = []string{"MALWARE", "SOCIAL_ENGINEERING", "UNWANTED_SOFTWARE", "POTENTIALLY_HARMFUL_APPLICATION"}
+	req.ThreatInfo.PlatformTypes = []string{"ANY_PLATFORM"}
+	req.ThreatInfo.ThreatEntryTypes = []string{"URL"}
+	for _, u := range urls {
+		req.ThreatInfo.ThreatEntries = append(req.ThreatInfo.ThreatEntries, threatEntry{URL: u})
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.Endpoint+"?key="+s.Key, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("safe browsing lookup failed with status %d", resp.StatusCode)
+	}
+
+	matches := threatMatchesResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&matches); err != nil {
+		return err
+	}
+
+	for _, m := range matches.Matches {
+		flagged[m.Threat.URL] = true
+	}
+
+	return nil
+}
+
+// unsafeURLs returns which of urls the configured screener has flagged, none while the safe_browsing
+// feature is off. Screening fails open, when
+// the lookup service cannot be reached the urls are allowed and the error is logged.
+func (h *Handlers) unsafeURLs(urls ...string) map[string]bool {
+	if h.screener == nil || !h.features.Enabled(featureSafeBrowsing) {
+		return map[string]bool{}
+	}
+
+	flagged, err := h.screener.Flagged(urls)
+	if err != nil {
+		log.Printf("Unable to screen urls: %v", err)
+		return map[string]bool{}
+	}
+
+	return flagged
+}
+
+// flaggedURL reports whether any of u's destinations is in flagged
+func flaggedURL(flagged map[string]bool, u *URL) bool {
+	for _, destination := range u.Destinations() {
+		if flagged[destination] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rescanURLs pages through every stored url every interval and disables the ones the screener has
+// since flagged, skipping the rounds that find safe browsing turned off, it never returns
+func rescanURLs(store Store, screener URLScreener, flags *FeatureFlags, interval time.Duration) {
+	for range time.Tick(interval) {
+		if !flags.Enabled(featureSafeBrowsing) {
+			continue
+		}
+
+		n, err := rescan(store, screener)
+		if err != nil {
+			log.Printf("Unable to rescan urls: %v", err)
+		}
+
+		if n > 0 {
+			log.Printf("Disabled %d unsafe urls", n)
+		}
+	}
+}
+
+// rescan checks every enabled url against screener, returning the number of urls disabled
+func rescan(store Store, screener URLScreener) (int, error) {
+	disabled := 0
+
+	for skip := 0; ; skip += safeBrowsingBatchSize {
+		urls, _, err := store.List(context.Background(), ListQuery{
+			AllOwners: true,
+			Sort:      "created_at",
+			Skip:      skip,
+			Limit:     safeBrowsingBatchSize,
+		})
+		if err != nil {
+			return disabled, err
+		}
+
+		destinations := []string{}
+		for _, u := range urls {
+			if !u.Disabled {
+				destinations = append(destinations, u.Destinations()...)
+			}
+		}
+
+		flagged, err := screener.Flagged(destinations)
+		if err != nil {
+			return disabled, err
+		}
+
+		for i := range urls {
+			u := &urls[i]
+			if u.Disabled || !flaggedURL(flagged, u) {
+				continue
+			}
+
+			u.Disabled = true
+			if err := store.Update(context.Background(), u); err != nil {
+				return disabled, err
+			}
+
+			disabled++
+		}
+
+		if len(urls) < safeBrowsingBatchSize {
+			return disabled, nil
+		}
+	}
+}
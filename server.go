@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// Connection limits, a client has to send its headers and body within the read timeouts so slow
+// clients cannot hold connections open indefinitely
+const (
+	defaultReadTimeout       = 10 * time.Second
+	defaultReadHeaderTimeout = 5 * time.Second
+	defaultWriteTimeout      = 30 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+	defaultMaxHeaderBytes    = 64 << 10
+)
+
+// listenAddr returns the address port is listened on, on every interface unless URL_BIND_ADDRESS is set
+func listenAddr(c *Config, port string) string {
+	return net.JoinHostPort(c.BindAddress, port)
+}
+
+// newServer creates the http server for handler with the configured connection limits. HTTP/2 is
+// spoken over tls and, for clients with prior knowledge such as a fronting proxy, over plain http
+// unless it has been disabled.
+func newServer(c *Config, handler http.Handler) *http.Server {
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(c.HTTP2)
+	protocols.SetUnencryptedHTTP2(c.HTTP2)
+
+	return &http.Server{
+		Addr:              listenAddr(c, c.Port),
+		Handler:           handler,
+		ReadTimeout:       c.ReadTimeout,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		MaxHeaderBytes:    c.MaxHeaderBytes,
+		Protocols:         protocols,
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownDomain is returned when a url is shortened on a domain the shortener does not serve
+var ErrUnknownDomain = codedError("unknown_domain", "domain", "That domain is not served by this shortener")
+
+// ShortDomain is a host name short urls are served from along with the defaults of urls created on it
+type ShortDomain struct {
+	// Host is the lower cased host name, without a port
+	Host string
+	// BaseURL is the scheme, host and port short urls on the domain start with
+	BaseURL string
+	// RedirectCode is the redirect status of urls on the domain that did not set one, 0 keeps
+	// URL_REDIRECT_CODE
+	RedirectCode int
+	// Home is where visitors to the root of the domain are sent, empty shows the instructions page
+	Home string
+	// Owner is the user a custom domain belongs to, only they may create urls on it. It is empty for
+	// the configured domains.
+	Owner string
+}
+
+// ShortURL returns the short url of slug on d
+func (d *ShortDomain) ShortURL(slug string) string {
+	return d.BaseURL + "/" + slug
+}
+
+// ShortDomains are the domains a shortener serves, the configured ones and the verified custom
+// domains of its users. Urls created before domains were recorded, and urls of domains that have since
+// been removed, belong to the primary domain.
+type ShortDomains struct {
+	primary *ShortDomain
+	hosts   map[string]*ShortDomain
+	// scheme is the scheme of custom domain short urls, that of the primary domain
+	scheme string
+
+	mu     sync.RWMutex
+	custom map[string]*ShortDomain
+}
+
+// NewShortDomains serves the primary base url host and the extra domains, listing the primary host
+// among them sets its defaults
+func NewShortDomains(host string, extra []ShortDomain) *ShortDomains {
+	primary := &ShortDomain{BaseURL: host}
+	scheme := "https"
+	if u, err := url.Parse(host); err == nil {
+		primary.Host = domainHost(u.Host)
+		scheme = u.Scheme
+	}
+
+	d := &ShortDomains{primary: primary, hosts: map[string]*ShortDomain{primary.Host: primary}, scheme: scheme, custom: map[string]*ShortDomain{}}
+	for i := range extra {
+		if extra[i].Host == primary.Host {
+			d.primary = &extra[i]
+		}
+
+		d.hosts[extra[i].Host] = &extra[i]
+	}
+
+	return d
+}
+
+// Lookup returns the domain named host, the primary domain when host is empty and nil when it is not
+// served
+func (d *ShortDomains) Lookup(host string) *ShortDomain {
+	if host == "" {
+		return d.primary
+	}
+
+	host = domainHost(host)
+	if domain := d.hosts[host]; domain != nil {
+		return domain
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.custom[host]
+}
+
+// Of returns the domain u was created on
+func (d *ShortDomains) Of(u *URL) *ShortDomain {
+	if domain := d.Lookup(u.Domain); domain != nil {
+		return domain
+	}
+
+	return d.primary
+}
+
+// ForRequest returns the domain r was sent to or nil when its Host header names none of them
+func (d *ShortDomains) ForRequest(r *http.Request) *ShortDomain {
+	if r.Host == "" {
+		return nil
+	}
+
+	return d.Lookup(r.Host)
+}
+
+// SetCustom replaces the custom domains served with the verified domains
+func (d *ShortDomains) SetCustom(domains []CustomDomain) {
+	custom := map[string]*ShortDomain{}
+	for _, c := range domains {
+		if c.VerifiedAt != nil && d.hosts[c.Domain] == nil {
+			custom[c.Domain] = d.customDomain(c)
+		}
+	}
+
+	d.mu.Lock()
+	d.custom = custom
+	d.mu.Unlock()
+}
+
+// AddCustom starts serving a verified custom domain
+func (d *ShortDomains) AddCustom(c CustomDomain) {
+	if c.VerifiedAt == nil || d.hosts[c.Domain] != nil {
+		return
+	}
+
+	d.mu.Lock()
+	d.custom[c.Domain] = d.customDomain(c)
+	d.mu.Unlock()
+}
+
+// RemoveCustom stops serving a custom domain
+func (d *ShortDomains) RemoveCustom(domain string) {
+	d.mu.Lock()
+	delete(d.custom, domain)
+	d.mu.Unlock()
+}
+
+// customDomain returns the short domain of a custom domain
+func (d *ShortDomains) customDomain(c CustomDomain) *ShortDomain {
+	return &ShortDomain{Host: c.Domain, BaseURL: d.scheme + "://" + c.Domain, Owner: c.Owner}
+}
+
+// Hosts returns the host names of the configured domains
+func (d *ShortDomains) Hosts() []string {
+	hosts := []string{}
+	for host := range d.hosts {
+		hosts = append(hosts, host)
+	}
+
+	return hosts
+}
+
+// domainHost lower cases host and strips its port
+func domainHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// requestDomain returns the domain a url shortened through r is created on: the one it asked for, or
+// the domain r was sent to when it did not ask and that domain is served
+func (h *Handlers) requestDomain(r *http.Request, requested string) string {
+	if requested != "" {
+		return requested
+	}
+
+	// custom domains are only used when asked for, anyone else calling the api through one would be
+	// refused
+	if d := h.shortDomains.ForRequest(r); d != nil && d.Owner == "" {
+		return d.Host
+	}
+
+	return ""
+}
+
+// parseShortDomain reads a domain from its base url followed by space separated name=value
+// defaults, e.g. "https://go.example.com redirect_code=301 home=https://example.com"
+func parseShortDomain(value string) (ShortDomain, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return ShortDomain{}, errors.New("missing base url")
+	}
+
+	base := strings.TrimSuffix(fields[0], "/")
+	u, err := url.Parse(base)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.Path != "" {
+		return ShortDomain{}, fmt.Errorf("%q is not an http or https base url", fields[0])
+	}
+
+	d := ShortDomain{Host: domainHost(u.Host), BaseURL: base}
+	for _, option := range fields[1:] {
+		i := strings.Index(option, "=")
+		if i <= 0 {
+			return d, fmt.Errorf("expected name=value, got %q", option)
+		}
+
+		name, value := option[:i], option[i+1:]
+		switch name {
+		case "redirect_code":
+			if d.RedirectCode, err = strconv.Atoi(value); err != nil || !redirectCodes[d.RedirectCode] {
+				return d, fmt.Errorf("redirect_code must be 301, 302, 307 or 308, got %q", value)
+			}
+		case "home":
+			if home, err := url.Parse(value); err != nil || (home.Scheme != "http" && home.Scheme != "https") || home.Host == "" {
+				return d, fmt.Errorf("home must be an http or https url, got %q", value)
+			}
+			d.Home = value
+		default:
+			return d, fmt.Errorf("unknown setting %q", name)
+		}
+	}
+
+	return d, nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+const base62Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// caselessChars are the characters of generated slugs when slugs are case-insensitive, lower case
+// letters and digits without the easily confused 0, o, 1, l and i
+const caselessChars = "23456789abcdefghjkmnpqrstuvwxyz"
+const defaultRandomSlugLength = 8
+
+// slugPoolRetry is how long a slug pool waits after its source failed before drawing from it again
+const slugPoolRetry = time.Second
+
+// maxSlugRetries bounds the fresh slugs drawn for a url whose generated slug turned out to be taken
+const maxSlugRetries = 3
+
+// defaultSlugBlockSize is the number of sequence values a sharded slug source reserves at a time
+const defaultSlugBlockSize = 1000
+
+// reservedSlugs are never handed out, by the slug sources or as custom slugs. They name the routes
+// served next to short urls and ones that may be added later, so links cannot shadow them.
+var reservedSlugs = map[string]bool{
+	"about": true, "account": true, "admin": true, "api": true, "app": true, "assets": true,
+	"auth": true, "callback": true, "dashboard": true, "docs": true, "health": true, "healthz": true,
+	"help": true, "login": true, "logout": true, "metrics": true, "new": true, "oauth": true,
+	"preview": true, "qr": true, "readyz": true, "register": true, "settings": true, "signup": true,
+	"static": true, "stats": true, "status": true, "v1": true, "v2": true, "v3": true, "v4": true,
+	"webhooks": true, "www": true,
+}
+
+// reserveSlugs adds slugs to the reserved slugs
+func reserveSlugs(slugs []string) {
+	for _, s := range slugs {
+		reservedSlugs[strings.ToLower(s)] = true
+	}
+}
+
+// reservedSlug reports whether slug is reserved, regardless of case
+func reservedSlug(slug string) bool {
+	return reservedSlugs[strings.ToLower(slug)]
+}
+
+// SlugSource hands out slugs that are not in use yet
+type SlugSource interface {
+	NextSlug() (string, error)
+}
+
+// SequenceStore is implemented by stores that can hand out a monotonically increasing sequence
+type SequenceStore interface {
+	// NextSequence atomically increments and returns the slug sequence, starting at 1
+	NextSequence() (uint64, error)
+}
+
+// SlugBlockStore is implemented by stores that can hand out many values of the slug sequence and check
+// many slugs at once
+type SlugBlockStore interface {
+	// ReserveSequence reserves the next n values of the slug sequence, they need not be consecutive
+	ReserveSequence(n int) ([]uint64, error)
+	// ExistingSlugs returns which of slugs are in use or tombstoned
+	ExistingSlugs(slugs []string) (map[string]bool, error)
+}
+
+// consecutive returns the n values counting up from first
+func consecutive(first uint64, n int) []uint64 {
+	values := make([]uint64, n)
+	for i := range values {
+		values[i] = first + uint64(i)
+	}
+
+	return values
+}
+
+// CounterSlugSource generates slugs by encoding a sequence kept in the store with the characters of
+// alphabet, so new slugs never need to be checked against the store except when a custom slug
+// already took them
+type CounterSlugSource struct {
+	sequence SequenceStore
+	store    Store
+	alphabet string
+}
+
+// NextSlug returns the next unused slug from the sequence
+func (s *CounterSlugSource) NextSlug() (string, error) {
+	for {
+		n, err := s.sequence.NextSequence()
+		if err != nil {
+			return "", err
+		}
+
+		slug := encodeSlug(n, s.alphabet)
+		if reservedSlug(slug) {
+			continue
+		}
+
+		// generated slugs are shorter than custom slugs may be, so only check those that could clash
+		if len(slug) < customSlugMinLength {
+			return slug, nil
+		}
+
+		exists, err := s.store.Exists(context.Background(), slug)
+		if err != nil {
+			return "", err
+		}
+
+		if !exists {
+			return slug, nil
+		}
+	}
+}
+
+// ShardedSlugSource hands out slugs from blocks of the store sequence, so instances sharing the store
+// coordinate once per block instead of once per slug and never hand out the same value. Each block is
+// checked against custom and tombstoned slugs with a single query. Slugs are prefixed with shard,
+// which gives instances that do not share a store, such as one per region, slugs that never clash.
+type ShardedSlugSource struct {
+	mu        sync.Mutex
+	store     SlugBlockStore
+	alphabet  string
+	shard     string
+	blockSize int
+	// block holds the unused slugs of the reserved block
+	block []string
+}
+
+// NextSlug returns the next unused slug of the reserved block, reserving another when it runs out
+func (s *ShardedSlugSource) NextSlug() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.block) == 0 {
+		if err := s.reserve(); err != nil {
+			return "", err
+		}
+	}
+
+	slug := s.block[0]
+	s.block = s.block[1:]
+
+	return slug, nil
+}
+
+// reserve fills block with the slugs of the next block of the sequence that are neither reserved nor
+// taken, values of a block lost to a restart are never handed out
+func (s *ShardedSlugSource) reserve() error {
+	values, err := s.store.ReserveSequence(s.blockSize)
+	if err != nil {
+		return err
+	}
+
+	slugs := make([]string, 0, len(values))
+	for _, n := range values {
+		if slug := s.shard + encodeSlug(n, s.alphabet); !reservedSlug(slug) {
+			slugs = append(slugs, slug)
+		}
+	}
+
+	existing, err := s.store.ExistingSlugs(slugs)
+	if err != nil {
+		return err
+	}
+
+	for _, slug := range slugs {
+		if !existing[slug] {
+			s.block = append(s.block, slug)
+		}
+	}
+
+	return nil
+}
+
+// RandomSlugSource generates random slugs of length characters, retrying until one is unused
+type RandomSlugSource struct {
+	generator *SlugGenerator
+	store     Store
+	length    int
+}
+
+// NextSlug returns a random unused slug
+func (s *RandomSlugSource) NextSlug() (string, error) {
+	return s.generator.GenerateUniqueSlug(s.length, s.store), nil
+}
+
+// SlugPool keeps a buffer of slugs drawn from another source topped up in the background, so creating
+// a url takes a slug that was generated and checked against the store beforehand instead of waiting
+// for the store. When the buffer has run dry the source is asked directly.
+type SlugPool struct {
+	source SlugSource
+	slugs  chan string
+}
+
+// NewSlugPool starts filling a pool of size slugs from source
+func NewSlugPool(source SlugSource, size int) *SlugPool {
+	p := &SlugPool{source: source, slugs: make(chan string, size)}
+	go p.fill()
+
+	return p
+}
+
+// fill draws slugs from the source whenever the pool has room, it never returns
+func (p *SlugPool) fill() {
+	for {
+		slug, err := p.source.NextSlug()
+		if err != nil {
+			log.Printf("Unable to generate a slug for the pool: %v", err)
+			time.Sleep(slugPoolRetry)
+			continue
+		}
+
+		p.slugs <- slug
+	}
+}
+
+// NextSlug returns a pooled slug, or one from the source when the pool is empty
+func (p *SlugPool) NextSlug() (string, error) {
+	select {
+	case slug := <-p.slugs:
+		return slug, nil
+	default:
+		return p.source.NextSlug()
+	}
+}
+
+// cryptoRand draws numbers from crypto/rand, unlike a seeded math/rand source the slugs it produces
+// cannot be predicted from the time the process started
+type cryptoRand struct{}
+
+// Intn returns a uniformly random number in [0, n), it panics if the system's secure random number
+// generator fails
+func (cryptoRand) Intn(n int) int {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic(fmt.Sprintf("Unable to read secure random number: %v", err))
+	}
+
+	return int(v.Int64())
+}
+
+// newSlugSource creates the slug source selected by strategy, defaulting to the store's sequence.
+// length only applies to random slugs, shard and blockSize to sharded ones. Counter, sharded and
+// secure slugs use the characters of alphabet, or base62 when it is empty.
+func newSlugSource(strategy string, length int, alphabet, shard string, blockSize int, store Store, generator *SlugGenerator) (SlugSource, error) {
+	switch strategy {
+	case "", "counter":
+		sequence, ok := store.(SequenceStore)
+		if !ok {
+			return nil, fmt.Errorf("Store does not support counter slugs")
+		}
+
+		if alphabet == "" {
+			alphabet = base62Chars
+		}
+
+		return &CounterSlugSource{sequence: sequence, store: store, alphabet: alphabet}, nil
+	case "sharded":
+		blocks, ok := store.(SlugBlockStore)
+		if !ok {
+			return nil, fmt.Errorf("Store does not support sharded slugs")
+		}
+
+		if alphabet == "" {
+			alphabet = base62Chars
+		}
+
+		for _, c := range shard {
+			if !strings.ContainsRune(alphabet, c) {
+				return nil, fmt.Errorf("Slug shard %q may only contain the characters %s", shard, alphabet)
+			}
+		}
+
+		return &ShardedSlugSource{store: blocks, alphabet: alphabet, shard: shard, blockSize: blockSize}, nil
+	case "random":
+		return &RandomSlugSource{generator: generator, store: store, length: length}, nil
+	case "secure":
+		return &RandomSlugSource{generator: &SlugGenerator{random: cryptoRand{}, alphabet: alphabet}, store: store, length: length}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown slug strategy %q", strategy)
+}
+
+// encodeSlug encodes n in the base of the length of alphabet using its characters as digits
+func encodeSlug(n uint64, alphabet string) string {
+	if n == 0 {
+		return alphabet[:1]
+	}
+
+	base := uint64(len(alphabet))
+	buf := make([]byte, 0, 16)
+	for n > 0 {
+		buf = append(buf, alphabet[n%base])
+		n /= base
+	}
+
+	for i, j := 0, len(buf)-1; i < j; i, j = i+1, j-1 {
+		buf[i], buf[j] = buf[j], buf[i]
+	}
+
+	return string(buf)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fixedSlugs hands out its slugs in order
+type fixedSlugs struct {
+	slugs []string
+}
+
+// NextSlug returns the next slug
+func (s *fixedSlugs) NextSlug() (string, error) {
+	slug := s.slugs[0]
+	s.slugs = s.slugs[1:]
+
+	return slug, nil
+}
+
+func TestShortenRetriesTakenGeneratedSlug(t *testing.T) {
+	tests := []struct {
+		name   string
+		slugs  []string
+		body   string
+		status int
+		slug   string
+	}{
+		{"generated slug free", []string{"fresh"}, `{"url": "https://example.com/a"}`, http.StatusCreated, "fresh"},
+		{"generated slug claimed", []string{"taken", "fresh"}, `{"url": "https://example.com/a"}`, http.StatusCreated, "fresh"},
+		{"every retry claimed", []string{"taken", "taken", "taken", "taken"}, `{"url": "https://example.com/a"}`, http.StatusInternalServerError, ""},
+		{"custom slug taken", []string{"fresh"}, `{"url": "https://example.com/a", "slug": "taken"}`, http.StatusConflict, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, store := newTestHandlers(t)
+			h.slugifier = &fixedSlugs{slugs: tt.slugs}
+			if err := store.Save(context.Background(), &URL{Slug: "taken", OriginalURL: "https://example.com/custom"}); err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			h.Shorten(w, httptest.NewRequest(http.MethodPost, "/api/v1/shorten", strings.NewReader(tt.body)), nil)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.slug == "" {
+				return
+			}
+
+			u := URL{}
+			if err := json.NewDecoder(w.Body).Decode(&u); err != nil {
+				t.Fatal(err)
+			}
+			if u.ShortURL != testHost+"/"+tt.slug {
+				t.Errorf("short url %s, want %s/%s", u.ShortURL, testHost, tt.slug)
+			}
+		})
+	}
+}
+
+func TestShortenBatchRetriesTakenGeneratedSlug(t *testing.T) {
+	h, store := newTestHandlers(t)
+	h.slugifier = &fixedSlugs{slugs: []string{"taken", "fresh"}}
+	if err := store.Save(context.Background(), &URL{Slug: "taken", OriginalURL: "https://example.com/custom"}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	body := `[{"url": "https://example.com/a"}, {"url": "https://example.com/b", "slug": "taken"}]`
+	h.ShortenBatch(w, httptest.NewRequest(http.MethodPost, "/api/v1/shorten/batch", strings.NewReader(body)), nil)
+
+	results := []BatchResult{}
+	if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("%d results, want 2", len(results))
+	}
+	if results[0].Status != http.StatusCreated || results[0].URL.ShortURL != testHost+"/fresh" {
+		t.Errorf("generated slug result %+v, want created at %s/fresh", results[0], testHost)
+	}
+	if results[1].Status != http.StatusConflict {
+		t.Errorf("custom slug result %+v, want a conflict", results[1])
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultListSort = "-created_at"
+
+// defaultIdleConnections is the number of idle connections the redis and postgres stores keep unless
+// their pool size is set
+const defaultIdleConnections = 10
+
+// defaultStoreTimeout bounds each url operation of the redis and postgres stores when
+// URL_STORE_TIMEOUT_MS is unset
+const defaultStoreTimeout = 5 * time.Second
+
+// storeConnMaxIdle is how long a store connection may sit idle before it is closed
+const storeConnMaxIdle = 4 * time.Minute
+
+// listSortFields are the fields urls may be sorted by when listing
+var listSortFields = []string{"created_at", "slug", "original_url", "clicks"}
+
+// ListQuery selects a page of the urls belonging to an owner
+type ListQuery struct {
+	Owner string
+	// AllOwners lists every url regardless of Owner, for background jobs and moderation
+	AllOwners bool
+	// Search restricts the urls to those whose slug or original url contains it, ignoring case
+	Search string
+	// Tag restricts the urls to those tagged with it
+	Tag string
+	// Text restricts the urls to those whose original url or title contains every word of it
+	Text string
+	// Campaign restricts the urls to those in the campaign with this id
+	Campaign string
+	// Deleted lists the deleted urls waiting to be purged instead of the live ones
+	Deleted bool
+	// Sort is one of listSortFields, prefixed with - for descending order
+	Sort  string
+	Skip  int
+	Limit int
+}
+
+// Store defines the persistence operations the service needs for shortened urls. Operations give up
+// once ctx is done, so a request the client abandoned stops querying, the stores backed by a database
+// bound each one by their own timeout as well.
+type Store interface {
+	// Save inserts a new url document
+	Save(ctx context.Context, u *URL) error
+	// SaveMany inserts urls in a single round trip, the returned slice holds the error for each url in
+	// the same order and ErrSlugTaken for slugs that are already in use
+	SaveMany(ctx context.Context, urls []*URL) []error
+	// Update replaces the url stored under u.Slug or returns ErrNotFound
+	Update(ctx context.Context, u *URL) error
+	// FindBySlug returns the url stored under slug or ErrNotFound
+	FindBySlug(ctx context.Context, slug string) (*URL, error)
+	// ResolveSlug returns the url stored under slug to serve a redirect or ErrNotFound. Stores with
+	// read replicas may answer it from a replica that lags behind writes, so the url must not be
+	// changed and written back.
+	ResolveSlug(ctx context.Context, slug string) (*URL, error)
+	// FindByOriginalURL returns a url owned by owner without an expiry that has not been deleted pointing
+	// at original or ErrNotFound
+	FindByOriginalURL(ctx context.Context, owner, original string) (*URL, error)
+	// Exists reports whether a url has already been stored under slug, including deleted urls that
+	// left a tombstone
+	Exists(ctx context.Context, slug string) (bool, error)
+	// Delete removes the url stored under slug or returns ErrNotFound. When tombstone is set the slug
+	// is recorded so it is never reused.
+	Delete(ctx context.Context, slug string, tombstone bool) error
+	// IncrementUses atomically counts a visit to the url stored under slug and returns the number of
+	// visits counted so far, it is used to enforce max clicks
+	IncrementUses(ctx context.Context, slug string) (int, error)
+	// IncrementClicks atomically counts a redirect through the url stored under slug and returns the
+	// number of redirects counted so far, the count is returned in Clicks and is never overwritten by
+	// Update
+	IncrementClicks(ctx context.Context, slug string) (int, error)
+	// List returns the page of urls selected by q and the total number of urls the owner has, deleted
+	// urls are only listed when q.Deleted is set
+	List(ctx context.Context, q ListQuery) ([]URL, int, error)
+	// Ping checks that the backing database is reachable
+	Ping(ctx context.Context) error
+	// Close releases any connections held by the store
+	Close()
+}
+
+// sortField splits Sort into the field name and whether the order is descending
+func (q ListQuery) sortField() (string, bool) {
+	if strings.HasPrefix(q.Sort, "-") {
+		return q.Sort[1:], true
+	}
+
+	return q.Sort, false
+}
+
+// validSort reports whether sort names a sortable field
+func validSort(sort string) bool {
+	field := strings.TrimPrefix(sort, "-")
+	for _, f := range listSortFields {
+		if f == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sortURLs orders urls in place according to q for stores that cannot sort themselves, urls are
+// expected in creation order
+func sortURLs(urls []URL, q ListQuery) {
+	field, desc := q.sortField()
+
+	less := func(a, b *URL) bool {
+		switch field {
+		case "slug":
+			return a.Slug < b.Slug
+		case "original_url":
+			return a.OriginalURL < b.OriginalURL
+		case "clicks":
+			return a.Clicks < b.Clicks
+		}
+
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+
+	sort.SliceStable(urls, func(i, j int) bool {
+		if desc {
+			return less(&urls[j], &urls[i])
+		}
+
+		return less(&urls[i], &urls[j])
+	})
+}
+
+// urlDocument is the json encoding used by stores that keep urls as json documents, it includes the
+// fields that are hidden from api responses
+type urlDocument struct {
+	*URL
+	PasswordHash string `json:"password_hash,omitempty"`
+}
+
+// marshalURL encodes u as a stored json document
+func marshalURL(u *URL) ([]byte, error) {
+	return json.Marshal(urlDocument{URL: u, PasswordHash: u.PasswordHash})
+}
+
+// unmarshalURL decodes a stored json document into u
+func unmarshalURL(js []byte, u *URL) error {
+	doc := urlDocument{URL: u}
+	if err := json.Unmarshal(js, &doc); err != nil {
+		return err
+	}
+
+	u.PasswordHash = doc.PasswordHash
+
+	return nil
+}
+
+// batchErrors returns a slice reporting err for every one of n urls, for batches that failed as a
+// whole
+func batchErrors(n int, err error) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+
+	return errs
+}
+
+// matchesSearch reports whether u's slug or original url contains search, ignoring case
+func matchesSearch(u *URL, search string) bool {
+	search = strings.ToLower(search)
+
+	return strings.Contains(strings.ToLower(u.Slug), search) || strings.Contains(strings.ToLower(u.OriginalURL), search)
+}
+
+// filtered reports whether q restricts the urls beyond their owner
+func (q ListQuery) filtered() bool {
+	return q.Search != "" || q.Tag != "" || q.Text != "" || q.Campaign != ""
+}
+
+// matchesQuery reports whether u passes the search, tag, text and campaign filters of q and is in the
+// trash only when q asks for deleted urls
+func matchesQuery(u *URL, q ListQuery) bool {
+	return u.Deleted() == q.Deleted && (q.Search == "" || matchesSearch(u, q.Search)) && (q.Tag == "" || u.hasTag(q.Tag)) && (q.Text == "" || matchesText(u, q.Text)) &&
+		(q.Campaign == "" || u.Campaign == q.Campaign)
+}
+
+// searchURLs returns the urls that match the filters of q, for stores that cannot search themselves
+func searchURLs(urls []URL, q ListQuery) []URL {
+	if !q.filtered() {
+		return urls
+	}
+
+	matched := []URL{}
+	for i := range urls {
+		if matchesQuery(&urls[i], q) {
+			matched = append(matched, urls[i])
+		}
+	}
+
+	return matched
+}
+
+// pageURLs returns the page of sorted urls selected by q
+func pageURLs(urls []URL, q ListQuery) []URL {
+	if q.Skip >= len(urls) {
+		return []URL{}
+	}
+
+	end := q.Skip + q.Limit
+	if end > len(urls) {
+		end = len(urls)
+	}
+
+	return urls[q.Skip:end]
+}
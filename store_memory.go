@@ -0,0 +1,996 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a thread-safe Store that keeps urls in process memory. Nothing is persisted, it
+// is intended for local demos and tests.
+type MemoryStore struct {
+	mu         sync.RWMutex
+	urls       map[string]URL
+	slugs      []string
+	clicks     map[string][]Click
+	botClicks  map[string]map[string]int
+	visitors   map[string]visitorSketch
+	keys       map[string]APIKey
+	tombstones map[string]time.Time
+	uses       map[string]int
+	counts     map[string]int
+	usage      map[string]int
+	users      map[string]User
+	emails     map[string]string
+	banned     map[string]time.Time
+	reports    []Report
+	webhooks   []Webhook
+	campaigns  []Campaign
+	orgs       map[string]Organization
+	members    []Member
+	customs    []CustomDomain
+	idempotent map[string]IdempotencyKey
+	sequence   uint64
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		urls:       map[string]URL{},
+		clicks:     map[string][]Click{},
+		botClicks:  map[string]map[string]int{},
+		visitors:   map[string]visitorSketch{},
+		keys:       map[string]APIKey{},
+		tombstones: map[string]time.Time{},
+		uses:       map[string]int{},
+		counts:     map[string]int{},
+		usage:      map[string]int{},
+		users:      map[string]User{},
+		emails:     map[string]string{},
+		orgs:       map[string]Organization{},
+		banned:     map[string]time.Time{},
+		idempotent: map[string]IdempotencyKey{},
+	}
+}
+
+// Close is a no-op, the memory store holds no connections
+func (s *MemoryStore) Close() {}
+
+// Ping always succeeds, the memory store has no database to reach
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Save inserts a new url document, returning ErrSlugTaken when the slug is already in use
+func (s *MemoryStore) Save(ctx context.Context, u *URL) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.urls[u.Slug]; ok {
+		return ErrSlugTaken
+	}
+
+	s.urls[u.Slug] = *u
+	s.slugs = append(s.slugs, u.Slug)
+
+	return nil
+}
+
+// SaveMany inserts each of urls
+func (s *MemoryStore) SaveMany(ctx context.Context, urls []*URL) []error {
+	errs := make([]error, len(urls))
+	for i, u := range urls {
+		errs[i] = s.Save(ctx, u)
+	}
+
+	return errs
+}
+
+// NextSequence atomically increments and returns the slug sequence, starting at 1
+func (s *MemoryStore) NextSequence() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sequence++
+
+	return s.sequence, nil
+}
+
+// ReserveSequence reserves the next n values of the slug sequence
+func (s *MemoryStore) ReserveSequence(n int) ([]uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values := make([]uint64, n)
+	for i := range values {
+		s.sequence++
+		values[i] = s.sequence
+	}
+
+	return values, nil
+}
+
+// ExistingSlugs returns which of slugs are in use or tombstoned
+func (s *MemoryStore) ExistingSlugs(slugs []string) (map[string]bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	existing := map[string]bool{}
+	for _, slug := range slugs {
+		_, ok := s.urls[slug]
+		_, deleted := s.tombstones[slug]
+		if ok || deleted {
+			existing[slug] = true
+		}
+	}
+
+	return existing, nil
+}
+
+// Update replaces the url stored under u.Slug or returns ErrNotFound
+func (s *MemoryStore) Update(ctx context.Context, u *URL) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.urls[u.Slug]; !ok {
+		return ErrNotFound
+	}
+
+	s.urls[u.Slug] = *u
+
+	return nil
+}
+
+// ResolveSlug returns the url stored under slug for a redirect or ErrNotFound
+func (s *MemoryStore) ResolveSlug(ctx context.Context, slug string) (*URL, error) {
+	return s.FindBySlug(ctx, slug)
+}
+
+// FindBySlug returns the url stored under slug or ErrNotFound
+func (s *MemoryStore) FindBySlug(ctx context.Context, slug string) (*URL, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.urls[slug]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	u.Clicks = s.counts[slug]
+
+	return &u, nil
+}
+
+// FindByOriginalURL returns a url owned by owner without an expiry that has not been deleted pointing
+// at original or ErrNotFound
+func (s *MemoryStore) FindByOriginalURL(ctx context.Context, owner, original string) (*URL, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, slug := range s.slugs {
+		if u := s.urls[slug]; u.Owner == owner && u.OriginalURL == original && u.ExpiresAt == nil && !u.Deleted() {
+			u.Clicks = s.counts[slug]
+			return &u, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// Exists reports whether a url has already been stored under slug, including deleted urls that left
+// a tombstone
+func (s *MemoryStore) Exists(ctx context.Context, slug string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.urls[slug]
+	_, deleted := s.tombstones[slug]
+
+	return ok || deleted, nil
+}
+
+// Delete removes the url stored under slug or returns ErrNotFound. When tombstone is set the slug is
+// recorded so it is never reused.
+func (s *MemoryStore) Delete(ctx context.Context, slug string, tombstone bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.urls[slug]; !ok {
+		return ErrNotFound
+	}
+
+	delete(s.urls, slug)
+	delete(s.uses, slug)
+	delete(s.counts, slug)
+	for i, existing := range s.slugs {
+		if existing == slug {
+			s.slugs = append(s.slugs[:i], s.slugs[i+1:]...)
+			break
+		}
+	}
+
+	if tombstone {
+		s.tombstones[slug] = time.Now().UTC()
+	}
+
+	return nil
+}
+
+// IncrementUses counts a visit to slug or returns ErrNotFound
+func (s *MemoryStore) IncrementUses(ctx context.Context, slug string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.urls[slug]; !ok {
+		return 0, ErrNotFound
+	}
+
+	s.uses[slug]++
+
+	return s.uses[slug], nil
+}
+
+// IncrementClicks counts a redirect through slug or returns ErrNotFound
+func (s *MemoryStore) IncrementClicks(ctx context.Context, slug string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.urls[slug]; !ok {
+		return 0, ErrNotFound
+	}
+
+	s.counts[slug]++
+
+	return s.counts[slug], nil
+}
+
+// List returns the page of urls selected by q and the total number of urls the owner has
+func (s *MemoryStore) List(ctx context.Context, q ListQuery) ([]URL, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	urls := []URL{}
+	for _, slug := range s.slugs {
+		if u := s.urls[slug]; (q.AllOwners || u.Owner == q.Owner) && matchesQuery(&u, q) {
+			u.Clicks = s.counts[slug]
+			urls = append(urls, u)
+		}
+	}
+
+	sortURLs(urls, q)
+
+	return pageURLs(urls, q), len(urls), nil
+}
+
+// PurgeExpired removes every url that expired at or before now, returning the number removed
+func (s *MemoryStore) PurgeExpired(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slugs := s.slugs[:0]
+	for _, slug := range s.slugs {
+		u := s.urls[slug]
+		if u.Expired(now) {
+			delete(s.urls, slug)
+			continue
+		}
+
+		slugs = append(slugs, slug)
+	}
+
+	n := len(s.slugs) - len(slugs)
+	s.slugs = slugs
+
+	for id, k := range s.idempotent {
+		if !k.ExpiresAt.After(now) {
+			delete(s.idempotent, id)
+		}
+	}
+
+	return n, nil
+}
+
+// RecordClick stores a single redirect
+func (s *MemoryStore) RecordClick(c *Click) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clicks[c.Slug] = append(s.clicks[c.Slug], *c)
+
+	return nil
+}
+
+// Stats summarises the clicks recorded for slug
+func (s *MemoryStore) Stats(slug string) (*Stats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return summarizeClicks(slug, s.clicks[slug]), nil
+}
+
+// Clicks returns a page of the clicks recorded for slug from from up to before to, oldest first
+func (s *MemoryStore) Clicks(slug string, from, to time.Time, skip, limit int) ([]Click, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return clicksBetween(s.clicks[slug], from, to, skip, limit), nil
+}
+
+// HourlyClicks counts the clicks recorded for slug in every hour from from up to before to
+func (s *MemoryStore) HourlyClicks(slug string, from, to time.Time) (map[int64]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return countHourly(s.clicks[slug], from, to), nil
+}
+
+// RecordBotClick counts a redirect through slug served to bot
+func (s *MemoryStore) RecordBotClick(slug, bot string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.botClicks[slug] == nil {
+		s.botClicks[slug] = map[string]int{}
+	}
+	s.botClicks[slug][bot]++
+
+	return nil
+}
+
+// BotClicks returns the redirects through slug served to bots, per bot
+func (s *MemoryStore) BotClicks(slug string) (map[string]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bots := map[string]int{}
+	for bot, clicks := range s.botClicks[slug] {
+		bots[bot] = clicks
+	}
+
+	return bots, nil
+}
+
+// AddVisitor adds the hash of a visitor to the unique visitor sketch of slug
+func (s *MemoryStore) AddVisitor(slug string, visitor uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.visitors[slug] == nil {
+		s.visitors[slug] = newVisitorSketch()
+	}
+	s.visitors[slug].add(visitor)
+
+	return nil
+}
+
+// UniqueVisitors estimates the number of distinct visitors to slug
+func (s *MemoryStore) UniqueVisitors(slug string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.visitors[slug] == nil {
+		return 0, nil
+	}
+
+	return s.visitors[slug].count(), nil
+}
+
+// PurgeClicks removes the clicks recorded before before, the memory store computes stats from its
+// clicks so they are no longer counted
+func (s *MemoryStore) PurgeClicks(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := 0
+	for slug, clicks := range s.clicks {
+		kept := clicks[:0]
+		for _, c := range clicks {
+			if c.Timestamp.Before(before) {
+				purged++
+				continue
+			}
+
+			kept = append(kept, c)
+		}
+		s.clicks[slug] = kept
+	}
+
+	return purged, nil
+}
+
+// EachClick calls fn with every click recorded from from up to before to, the store is locked while
+// it runs
+func (s *MemoryStore) EachClick(from, to time.Time, fn func(c *Click) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, clicks := range s.clicks {
+		for i := range clicks {
+			if clicks[i].Timestamp.Before(from) || !clicks[i].Timestamp.Before(to) {
+				continue
+			}
+
+			if err := fn(&clicks[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// CountClicksBy counts the clicks recorded for slug per value of field
+func (s *MemoryStore) CountClicksBy(slug, field string) (map[string]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return countClicksBy(s.clicks[slug], field), nil
+}
+
+// SaveKey inserts a new api key
+func (s *MemoryStore) SaveKey(k *APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[k.Hash] = *k
+
+	return nil
+}
+
+// FindKeyByHash returns the key with the given secret hash or ErrNotFound
+func (s *MemoryStore) FindKeyByHash(hash string) (*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	k, ok := s.keys[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &k, nil
+}
+
+// RevokeKey marks the key with id as revoked or returns ErrNotFound
+func (s *MemoryStore) RevokeKey(id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, k := range s.keys {
+		if k.ID == id {
+			k.RevokedAt = &at
+			s.keys[hash] = k
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+// FindKeyByID returns the key with id or ErrNotFound
+func (s *MemoryStore) FindKeyByID(id string) (*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, k := range s.keys {
+		if k.ID == id {
+			return &k, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// SetKeyQuota changes the monthly quota of the key with id or returns ErrNotFound
+func (s *MemoryStore) SetKeyQuota(id string, quota int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, k := range s.keys {
+		if k.ID == id {
+			k.MonthlyQuota = quota
+			s.keys[hash] = k
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+// CountUsage adds n to the counter kind, shortens or redirects, of key in month and returns its new
+// value
+func (s *MemoryStore) CountUsage(keyID, month, kind string, n int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := keyID + "\n" + month + "\n" + kind
+	s.usage[key] += n
+
+	return s.usage[key], nil
+}
+
+// KeyUsage returns the shorten calls and redirects counted for key in month
+func (s *MemoryStore) KeyUsage(keyID, month string) (int, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	prefix := keyID + "\n" + month + "\n"
+
+	return s.usage[prefix+usageShortens], s.usage[prefix+usageRedirects], nil
+}
+
+// SaveUser inserts a new user or returns ErrEmailTaken
+func (s *MemoryStore) SaveUser(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.emails[u.Email]; ok {
+		return ErrEmailTaken
+	}
+
+	s.users[u.ID] = *u
+	s.emails[u.Email] = u.ID
+
+	return nil
+}
+
+// FindUserByEmail returns the user registered with email or ErrNotFound
+func (s *MemoryStore) FindUserByEmail(email string) (*User, error) {
+	s.mu.RLock()
+	id, ok := s.emails[email]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return s.FindUserByID(id)
+}
+
+// FindUserByID returns the user with id or ErrNotFound
+func (s *MemoryStore) FindUserByID(id string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &u, nil
+}
+
+// BanDomain records domain as banned
+func (s *MemoryStore) BanDomain(domain string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.banned[domain] = at
+
+	return nil
+}
+
+// UnbanDomain lifts the ban on domain or returns ErrNotFound
+func (s *MemoryStore) UnbanDomain(domain string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.banned[domain]; !ok {
+		return ErrNotFound
+	}
+
+	delete(s.banned, domain)
+
+	return nil
+}
+
+// BannedDomains returns every banned domain
+func (s *MemoryStore) BannedDomains() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	domains := []string{}
+	for domain := range s.banned {
+		domains = append(domains, domain)
+	}
+
+	sort.Strings(domains)
+
+	return domains, nil
+}
+
+// SaveReport inserts a new report
+func (s *MemoryStore) SaveReport(r *Report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reports = append(s.reports, *r)
+
+	return nil
+}
+
+// CountReporters returns the number of distinct reporters that have flagged slug
+func (s *MemoryStore) CountReporters(slug string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	reporters := map[string]bool{}
+	for _, r := range s.reports {
+		if r.Slug == slug {
+			reporters[r.Reporter] = true
+		}
+	}
+
+	return len(reporters), nil
+}
+
+// ListReports returns a page of reports, newest first, for slug or every url when slug is empty
+func (s *MemoryStore) ListReports(slug string, skip, limit int) ([]Report, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matched := []Report{}
+	for i := len(s.reports) - 1; i >= 0; i-- {
+		if slug == "" || s.reports[i].Slug == slug {
+			matched = append(matched, s.reports[i])
+		}
+	}
+
+	if skip >= len(matched) {
+		return []Report{}, len(matched), nil
+	}
+
+	end := skip + limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+
+	return matched[skip:end], len(matched), nil
+}
+
+// DeleteReports dismisses every report for slug
+func (s *MemoryStore) DeleteReports(slug string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.reports[:0]
+	for _, r := range s.reports {
+		if r.Slug != slug {
+			kept = append(kept, r)
+		}
+	}
+
+	s.reports = kept
+
+	return nil
+}
+
+// SaveWebhook inserts a new webhook
+func (s *MemoryStore) SaveWebhook(wh *Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.webhooks = append(s.webhooks, *wh)
+
+	return nil
+}
+
+// ListWebhooks returns the webhooks of owner, or of every owner when owner is empty, oldest first
+func (s *MemoryStore) ListWebhooks(owner string) ([]Webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hooks := []Webhook{}
+	for _, wh := range s.webhooks {
+		if owner == "" || wh.Owner == owner {
+			hooks = append(hooks, wh)
+		}
+	}
+
+	return hooks, nil
+}
+
+// DeleteWebhook removes the webhook of owner with id or returns ErrNotFound
+func (s *MemoryStore) DeleteWebhook(owner, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, wh := range s.webhooks {
+		if wh.Owner == owner && wh.ID == id {
+			s.webhooks = append(s.webhooks[:i], s.webhooks[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+// SaveCampaign inserts a new campaign
+func (s *MemoryStore) SaveCampaign(c *Campaign) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.campaigns = append(s.campaigns, *c)
+
+	return nil
+}
+
+// ListCampaigns returns the campaigns of owner, oldest first
+func (s *MemoryStore) ListCampaigns(owner string) ([]Campaign, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	campaigns := []Campaign{}
+	for _, c := range s.campaigns {
+		if c.Owner == owner {
+			campaigns = append(campaigns, c)
+		}
+	}
+
+	return campaigns, nil
+}
+
+// FindCampaign returns the campaign of owner with id or ErrNotFound
+func (s *MemoryStore) FindCampaign(owner, id string) (*Campaign, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, c := range s.campaigns {
+		if c.Owner == owner && c.ID == id {
+			return &c, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// DeleteCampaign removes the campaign of owner with id or returns ErrNotFound
+func (s *MemoryStore) DeleteCampaign(owner, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, c := range s.campaigns {
+		if c.Owner == owner && c.ID == id {
+			s.campaigns = append(s.campaigns[:i], s.campaigns[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+// SaveOrg inserts a new organization
+func (s *MemoryStore) SaveOrg(o *Organization) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.orgs[o.ID] = *o
+
+	return nil
+}
+
+// FindOrg returns the organization with id or ErrNotFound
+func (s *MemoryStore) FindOrg(id string) (*Organization, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	o, ok := s.orgs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &o, nil
+}
+
+// DeleteOrg removes the organization with id and its members or returns ErrNotFound
+func (s *MemoryStore) DeleteOrg(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.orgs[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.orgs, id)
+
+	members := []Member{}
+	for _, m := range s.members {
+		if m.OrgID != id {
+			members = append(members, m)
+		}
+	}
+	s.members = members
+
+	return nil
+}
+
+// SaveMember adds a member to an organization or replaces the membership they have
+func (s *MemoryStore) SaveMember(m *Member) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, existing := range s.members {
+		if existing.OrgID == m.OrgID && existing.UserID == m.UserID {
+			s.members[i] = *m
+			return nil
+		}
+	}
+
+	s.members = append(s.members, *m)
+
+	return nil
+}
+
+// FindMember returns the membership of user in org or ErrNotFound
+func (s *MemoryStore) FindMember(orgID, userID string) (*Member, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, m := range s.members {
+		if m.OrgID == orgID && m.UserID == userID {
+			return &m, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// ListMembers returns the members of org, oldest first
+func (s *MemoryStore) ListMembers(orgID string) ([]Member, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	members := []Member{}
+	for _, m := range s.members {
+		if m.OrgID == orgID {
+			members = append(members, m)
+		}
+	}
+
+	return members, nil
+}
+
+// ListMemberships returns the memberships of user, oldest first
+func (s *MemoryStore) ListMemberships(userID string) ([]Member, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	members := []Member{}
+	for _, m := range s.members {
+		if m.UserID == userID {
+			members = append(members, m)
+		}
+	}
+
+	return members, nil
+}
+
+// RemoveMember removes user from org or returns ErrNotFound
+func (s *MemoryStore) RemoveMember(orgID, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, m := range s.members {
+		if m.OrgID == orgID && m.UserID == userID {
+			s.members = append(s.members[:i], s.members[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+// ClaimIdempotencyKey stores k unless its owner already has an unexpired record under its key, which
+// is returned instead
+func (s *MemoryStore) ClaimIdempotencyKey(k *IdempotencyKey) (*IdempotencyKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := k.Owner + "\n" + k.Key
+	if previous, ok := s.idempotent[id]; ok && previous.ExpiresAt.After(time.Now()) {
+		return &previous, nil
+	}
+
+	s.idempotent[id] = *k
+
+	return nil, nil
+}
+
+// CompleteIdempotencyKey records the url the request under key of owner created and the status it
+// was responded to with
+func (s *MemoryStore) CompleteIdempotencyKey(owner, key, slug string, status int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := owner + "\n" + key
+	if k, ok := s.idempotent[id]; ok {
+		k.Slug, k.Status = slug, status
+		s.idempotent[id] = k
+	}
+
+	return nil
+}
+
+// ReleaseIdempotencyKey removes the record under key of owner
+func (s *MemoryStore) ReleaseIdempotencyKey(owner, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.idempotent, owner+"\n"+key)
+
+	return nil
+}
+
+// SaveCustomDomain inserts a new custom domain, returning ErrCustomDomainTaken when it has already
+// been registered
+func (s *MemoryStore) SaveCustomDomain(d *CustomDomain) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.customs {
+		if existing.Domain == d.Domain {
+			return ErrCustomDomainTaken
+		}
+	}
+
+	s.customs = append(s.customs, *d)
+
+	return nil
+}
+
+// FindCustomDomain returns the custom domain named domain or ErrNotFound
+func (s *MemoryStore) FindCustomDomain(domain string) (*CustomDomain, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, d := range s.customs {
+		if d.Domain == domain {
+			return &d, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// ListCustomDomains returns the custom domains of owner, or of every owner when owner is empty, oldest
+// first
+func (s *MemoryStore) ListCustomDomains(owner string) ([]CustomDomain, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	domains := []CustomDomain{}
+	for _, d := range s.customs {
+		if owner == "" || d.Owner == owner {
+			domains = append(domains, d)
+		}
+	}
+
+	return domains, nil
+}
+
+// VerifyCustomDomain records that domain was verified at at or returns ErrNotFound
+func (s *MemoryStore) VerifyCustomDomain(domain string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.customs {
+		if s.customs[i].Domain == domain {
+			s.customs[i].VerifiedAt = &at
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+// DeleteCustomDomain removes the custom domain of owner named domain or returns ErrNotFound
+func (s *MemoryStore) DeleteCustomDomain(owner, domain string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, d := range s.customs {
+		if d.Owner == owner && d.Domain == domain {
+			s.customs = append(s.customs[:i], s.customs[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
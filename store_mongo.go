@@ -0,0 +1,1734 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+)
+
+const urlCollection = "urls"
+const clickCollection = "clicks"
+const clickRollupCollection = "click_rollups"
+const botClickCollection = "bot_clicks"
+const visitorCollection = "visitor_sketches"
+const keyCollection = "api_keys"
+const tombstoneCollection = "tombstones"
+const counterCollection = "counters"
+const userCollection = "users"
+const bannedDomainCollection = "banned_domains"
+const reportCollection = "reports"
+const webhookCollection = "webhooks"
+const campaignCollection = "campaigns"
+const orgCollection = "organizations"
+const memberCollection = "org_members"
+const usageCollection = "key_usage"
+const customDomainCollection = "custom_domains"
+const idempotencyCollection = "idempotency_keys"
+const slugCounter = "slug"
+const usesCounterPrefix = "uses:"
+
+// mongoClickBatch is the number of clicks read at a time while going through every click
+const mongoClickBatch = 1000
+
+// clickRollupProgress is the id of the counters document holding the time click rollups cover
+const clickRollupProgress = "click_rollups"
+
+// defaultMongoTimeout bounds each mongo operation when URL_MGO_TIMEOUT_MS is unset
+const defaultMongoTimeout = 5 * time.Second
+
+// defaultMongoDatabase is used when the dsn does not name a database, matching the mgo driver the
+// store used to be built on
+const defaultMongoDatabase = "test"
+
+// mongoIndexes are created on startup, creating an index that already exists is a no-op. The unique
+// slug index is what stops two concurrent shortens that picked the same slug from both being stored.
+var mongoIndexes = map[string][]mongo.IndexModel{
+	urlCollection: {
+		{Keys: bson.D{{Key: "slug", Value: 1}}, Options: options.Index().SetUnique(true)},
+		// mongo removes documents once expires_at has passed, the smallest delay it supports is a second
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(1)},
+		{Keys: bson.D{{Key: "original_url", Value: 1}}},
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "created_at", Value: 1}}},
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "tags", Value: 1}}},
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "campaign", Value: 1}}},
+		{Keys: bson.D{{Key: "deleted_at", Value: 1}}, Options: options.Index().SetSparse(true)},
+		// text search matches whole words, without stemming since urls are not written in a language
+		{Keys: bson.D{{Key: "original_url", Value: "text"}, {Key: "title", Value: "text"}}, Options: options.Index().SetDefaultLanguage("none")},
+	},
+	keyCollection: {
+		{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	clickCollection: {
+		{Keys: bson.D{{Key: "slug", Value: 1}, {Key: "timestamp", Value: 1}}},
+		{Keys: bson.D{{Key: "timestamp", Value: 1}}},
+	},
+	clickRollupCollection: {
+		{Keys: bson.D{{Key: "slug", Value: 1}, {Key: "hour", Value: 1}, {Key: "referrer", Value: 1}, {Key: "variant", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	botClickCollection: {
+		{Keys: bson.D{{Key: "slug", Value: 1}, {Key: "bot", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	visitorCollection: {
+		{Keys: bson.D{{Key: "slug", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	tombstoneCollection: {
+		{Keys: bson.D{{Key: "slug", Value: 1}}},
+	},
+	userCollection: {
+		{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	reportCollection: {
+		{Keys: bson.D{{Key: "slug", Value: 1}, {Key: "created_at", Value: 1}}},
+	},
+	webhookCollection: {
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "created_at", Value: 1}}},
+	},
+	campaignCollection: {
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "created_at", Value: 1}}},
+	},
+	orgCollection: {
+		{Keys: bson.D{{Key: "org_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	usageCollection: {
+		{Keys: bson.D{{Key: "key_id", Value: 1}, {Key: "month", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	memberCollection: {
+		{Keys: bson.D{{Key: "org_id", Value: 1}, {Key: "user_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "added_at", Value: 1}}},
+	},
+	customDomainCollection: {
+		{Keys: bson.D{{Key: "domain", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "created_at", Value: 1}}},
+	},
+	idempotencyCollection: {
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(1)},
+	},
+}
+
+// MongoStore is a Store backed by a mongo database
+type MongoStore struct {
+	client  *mongo.Client
+	db      *mongo.Database
+	timeout time.Duration
+	// reads serves ResolveSlug, it is db unless ReadFrom pointed redirects at replicas
+	reads *mongo.Database
+	// readClient is the separate connection reads use, if any
+	readClient *mongo.Client
+	// pool follows the connections of client and readClient
+	pool *mongoPoolMonitor
+}
+
+// mongoCheckoutWait is how long checking a connection out of the pool may take before it counts as
+// having waited for one
+const mongoCheckoutWait = time.Millisecond
+
+// mongoPoolMonitor counts the connections the driver opens and checks out, the driver keeps no
+// statistics of its own
+type mongoPoolMonitor struct {
+	open     int64
+	inUse    int64
+	waits    int64
+	waitTime int64
+}
+
+// monitor returns the driver hook reporting pool events to m
+func (m *mongoPoolMonitor) monitor() *event.PoolMonitor {
+	return &event.PoolMonitor{Event: func(e *event.PoolEvent) {
+		switch e.Type {
+		case event.ConnectionCreated:
+			atomic.AddInt64(&m.open, 1)
+		case event.ConnectionClosed:
+			atomic.AddInt64(&m.open, -1)
+		case event.GetSucceeded:
+			atomic.AddInt64(&m.inUse, 1)
+			if e.Duration > mongoCheckoutWait {
+				atomic.AddInt64(&m.waits, 1)
+				atomic.AddInt64(&m.waitTime, int64(e.Duration))
+			}
+		case event.ConnectionReturned:
+			atomic.AddInt64(&m.inUse, -1)
+		}
+	}}
+}
+
+// NewMongoStore connects to the mongo deployment described by dsn and creates the indexes the store
+// relies on. Every operation runs under a deadline of timeout so a slow node fails the request instead
+// of holding its goroutine, and at most poolSize connections are opened to each server, 0 keeps the
+// driver default.
+func NewMongoStore(dsn string, timeout time.Duration, poolSize int) (*MongoStore, error) {
+	cs, err := connstring.ParseAndValidate(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	pool := &mongoPoolMonitor{}
+	client, err := mongo.Connect(ctx, mongoClientOptions(dsn, timeout, poolSize, pool))
+	if err != nil {
+		return nil, err
+	}
+
+	name := cs.Database
+	if name == "" {
+		name = defaultMongoDatabase
+	}
+
+	s := &MongoStore{client: client, db: client.Database(name), timeout: timeout, pool: pool}
+	s.reads = s.db
+
+	for collection, indexes := range mongoIndexes {
+		if _, err := s.db.Collection(collection).Indexes().CreateMany(ctx, indexes); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("Unable to create indexes on %s: %v", collection, err)
+		}
+	}
+
+	return s, nil
+}
+
+// mongoClientOptions configures a client for dsn with the store's timeout and pool size, reporting its
+// connections to pool. Every request shares the client's pool, idle connections are closed after
+// storeConnMaxIdle.
+func mongoClientOptions(dsn string, timeout time.Duration, poolSize int, pool *mongoPoolMonitor) *options.ClientOptions {
+	opts := options.Client().
+		ApplyURI(dsn).
+		SetConnectTimeout(timeout).
+		SetServerSelectionTimeout(timeout).
+		SetMaxConnIdleTime(storeConnMaxIdle).
+		SetPoolMonitor(pool.monitor())
+	if poolSize > 0 {
+		opts.SetMaxPoolSize(uint64(poolSize))
+	}
+
+	return opts
+}
+
+// ReadFrom serves redirect lookups from the deployment described by dsn, or from the store's own
+// deployment when dsn is empty, with the read preference named by preference (primary,
+// primaryPreferred, secondary, secondaryPreferred or nearest). An empty preference keeps the one in
+// the dsn. Every other operation stays on the primary.
+func (s *MongoStore) ReadFrom(dsn, preference string, poolSize int) error {
+	opts := options.Database()
+	if preference != "" {
+		mode, err := readpref.ModeFromString(preference)
+		if err != nil {
+			return err
+		}
+
+		rp, err := readpref.New(mode)
+		if err != nil {
+			return err
+		}
+
+		opts.SetReadPreference(rp)
+	}
+
+	if dsn == "" {
+		s.reads = s.client.Database(s.db.Name(), opts)
+		return nil
+	}
+
+	if _, err := connstring.ParseAndValidate(dsn); err != nil {
+		return err
+	}
+
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, mongoClientOptions(dsn, s.timeout, poolSize, s.pool))
+	if err != nil {
+		return err
+	}
+
+	s.readClient = client
+	s.reads = client.Database(s.db.Name(), opts)
+
+	return nil
+}
+
+// context returns a context carrying the deadline for a single store operation, it is cancelled
+// with parent as well
+func (s *MongoStore) context(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, s.timeout)
+}
+
+// findOne decodes the single document in c matching filter into v or returns ErrNotFound
+func findOne(ctx context.Context, c *mongo.Collection, filter interface{}, v interface{}) error {
+	err := c.FindOne(ctx, filter).Decode(v)
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// Close disconnects the client, waiting for in progress operations up to the store's timeout
+func (s *MongoStore) Close() {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	if s.readClient != nil {
+		s.readClient.Disconnect(ctx)
+	}
+
+	s.client.Disconnect(ctx)
+}
+
+// PoolStats returns the state of the connections to every server, including those of the read client
+func (s *MongoStore) PoolStats() PoolStats {
+	return PoolStats{
+		Open:     int(atomic.LoadInt64(&s.pool.open)),
+		InUse:    int(atomic.LoadInt64(&s.pool.inUse)),
+		Waits:    atomic.LoadInt64(&s.pool.waits),
+		WaitTime: time.Duration(atomic.LoadInt64(&s.pool.waitTime)),
+	}
+}
+
+// Ping checks that the database is reachable
+func (s *MongoStore) Ping(ctx context.Context) error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	return s.client.Ping(ctx, nil)
+}
+
+// Save inserts a new url document, returning ErrSlugTaken when the slug is already in use
+func (s *MongoStore) Save(ctx context.Context, u *URL) error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	_, err := s.db.Collection(urlCollection).InsertOne(ctx, u)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrSlugTaken
+	}
+
+	return err
+}
+
+// SaveMany inserts urls with a single unordered bulk insert
+func (s *MongoStore) SaveMany(ctx context.Context, urls []*URL) []error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	docs := make([]interface{}, len(urls))
+	for i, u := range urls {
+		docs[i] = u
+	}
+
+	errs := make([]error, len(urls))
+
+	_, err := s.db.Collection(urlCollection).InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err == nil {
+		return errs
+	}
+
+	bulkErr, ok := err.(mongo.BulkWriteException)
+	if !ok || bulkErr.WriteConcernError != nil {
+		return batchErrors(len(urls), err)
+	}
+
+	for _, we := range bulkErr.WriteErrors {
+		if we.Index < 0 || we.Index >= len(urls) {
+			return batchErrors(len(urls), err)
+		}
+
+		errs[we.Index] = we
+		if mongo.IsDuplicateKeyError(we) {
+			errs[we.Index] = ErrSlugTaken
+		}
+	}
+
+	return errs
+}
+
+// NextSequence atomically increments and returns the slug sequence, starting at 1
+func (s *MongoStore) NextSequence() (uint64, error) {
+	seq, err := s.increment(context.Background(), slugCounter, 1)
+
+	return uint64(seq), err
+}
+
+// ReserveSequence reserves the next n values of the slug sequence with a single increment
+func (s *MongoStore) ReserveSequence(n int) ([]uint64, error) {
+	last, err := s.increment(context.Background(), slugCounter, int64(n))
+	if err != nil {
+		return nil, err
+	}
+
+	return consecutive(uint64(last)-uint64(n)+1, n), nil
+}
+
+// ExistingSlugs returns which of slugs are in use or tombstoned
+func (s *MongoStore) ExistingSlugs(slugs []string) (map[string]bool, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	existing := map[string]bool{}
+	for _, c := range []string{urlCollection, tombstoneCollection} {
+		cur, err := s.db.Collection(c).Find(ctx, bson.M{"slug": bson.M{"$in": slugs}}, options.Find().SetProjection(bson.M{"slug": 1}))
+		if err != nil {
+			return nil, err
+		}
+
+		docs := []struct {
+			Slug string `bson:"slug"`
+		}{}
+		if err := cur.All(ctx, &docs); err != nil {
+			return nil, err
+		}
+
+		for _, doc := range docs {
+			existing[doc.Slug] = true
+		}
+	}
+
+	return existing, nil
+}
+
+// increment atomically adds by to the counter stored under id and returns its new value
+func (s *MongoStore) increment(ctx context.Context, id string, by int64) (int64, error) {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	counter := struct {
+		Seq int64 `bson:"seq"`
+	}{}
+
+	err := s.db.Collection(counterCollection).FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": id},
+		bson.M{"$inc": bson.M{"seq": by}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+
+	return counter.Seq, err
+}
+
+// Update replaces the url stored under u.Slug or returns ErrNotFound. The replacement is done in an
+// update pipeline that carries over the stored click count, so clicks counted since u was read are
+// not lost.
+func (s *MongoStore) Update(ctx context.Context, u *URL) error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	pipeline := bson.A{bson.M{"$replaceWith": bson.M{"$mergeObjects": bson.A{
+		bson.M{"$literal": u},
+		bson.M{"_id": "$_id", "clicks": "$clicks"},
+	}}}}
+
+	res, err := s.db.Collection(urlCollection).UpdateOne(ctx, bson.M{"slug": u.Slug}, pipeline)
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// FindBySlug returns the url stored under slug or ErrNotFound
+func (s *MongoStore) FindBySlug(ctx context.Context, slug string) (*URL, error) {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	u := URL{}
+	if err := findOne(ctx, s.db.Collection(urlCollection), bson.M{"slug": slug}, &u); err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// ResolveSlug returns the url stored under slug for a redirect or ErrNotFound, it is read with the
+// read preference set by ReadFrom
+func (s *MongoStore) ResolveSlug(ctx context.Context, slug string) (*URL, error) {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	u := URL{}
+	if err := findOne(ctx, s.reads.Collection(urlCollection), bson.M{"slug": slug}, &u); err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// FindByOriginalURL returns a url owned by owner without an expiry that has not been deleted pointing
+// at original or ErrNotFound
+func (s *MongoStore) FindByOriginalURL(ctx context.Context, owner, original string) (*URL, error) {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	u := URL{}
+	query := ownerQuery(owner)
+	query["original_url"] = original
+	query["expires_at"] = bson.M{"$exists": false}
+	query["deleted_at"] = bson.M{"$exists": false}
+	if err := findOne(ctx, s.db.Collection(urlCollection), query, &u); err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// Exists reports whether a url has already been stored under slug, including deleted urls that left
+// a tombstone
+func (s *MongoStore) Exists(ctx context.Context, slug string) (bool, error) {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	for _, c := range []string{urlCollection, tombstoneCollection} {
+		count, err := s.db.Collection(c).CountDocuments(ctx, bson.M{"slug": slug}, options.Count().SetLimit(1))
+		if err != nil {
+			return false, err
+		}
+
+		if count > 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Delete removes the url stored under slug or returns ErrNotFound. When tombstone is set the slug is
+// recorded so it is never reused.
+func (s *MongoStore) Delete(ctx context.Context, slug string, tombstone bool) error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	res, err := s.db.Collection(urlCollection).DeleteOne(ctx, bson.M{"slug": slug})
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+
+	if _, err := s.db.Collection(counterCollection).DeleteOne(ctx, bson.M{"_id": usesCounterPrefix + slug}); err != nil {
+		return err
+	}
+
+	if tombstone {
+		_, err := s.db.Collection(tombstoneCollection).InsertOne(ctx, bson.M{"slug": slug, "deleted_at": time.Now().UTC()})
+		return err
+	}
+
+	return nil
+}
+
+// IncrementUses atomically counts a visit to slug in the counters collection
+func (s *MongoStore) IncrementUses(ctx context.Context, slug string) (int, error) {
+	seq, err := s.increment(ctx, usesCounterPrefix+slug, 1)
+
+	return int(seq), err
+}
+
+// IncrementClicks atomically counts a redirect through slug on its url document
+func (s *MongoStore) IncrementClicks(ctx context.Context, slug string) (int, error) {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	doc := struct {
+		Clicks int `bson:"clicks"`
+	}{}
+	err := s.db.Collection(urlCollection).FindOneAndUpdate(ctx, bson.M{"slug": slug}, bson.M{"$inc": bson.M{"clicks": 1}},
+		options.FindOneAndUpdate().SetProjection(bson.M{"clicks": 1}).SetReturnDocument(options.After)).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, ErrNotFound
+		}
+
+		return 0, err
+	}
+
+	return doc.Clicks, nil
+}
+
+// List returns the page of urls selected by q and the total number of urls the owner has
+func (s *MongoStore) List(ctx context.Context, q ListQuery) ([]URL, int, error) {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	collection := s.db.Collection(urlCollection)
+	query := ownerQuery(q.Owner)
+	if q.AllOwners {
+		query = bson.M{}
+	}
+
+	if q.Search != "" {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(q.Search), Options: "i"}
+		query["$or"] = []bson.M{{"slug": pattern}, {"original_url": pattern}}
+	}
+
+	if q.Tag != "" {
+		query["tags"] = q.Tag
+	}
+
+	if q.Campaign != "" {
+		query["campaign"] = q.Campaign
+	}
+
+	if q.Text != "" {
+		query["$text"] = bson.M{"$search": mongoTextSearch(q.Text)}
+	}
+
+	query["deleted_at"] = bson.M{"$exists": q.Deleted}
+
+	total, err := collection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	field, desc := q.sortField()
+	order := 1
+	if desc {
+		order = -1
+	}
+
+	cur, err := collection.Find(ctx, query, options.Find().
+		SetSort(bson.D{{Key: field, Value: order}, {Key: "_id", Value: 1}}).
+		SetSkip(int64(q.Skip)).
+		SetLimit(int64(q.Limit)))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	urls := []URL{}
+	if err := cur.All(ctx, &urls); err != nil {
+		return nil, 0, err
+	}
+
+	return urls, int(total), nil
+}
+
+// mongoTextSearch quotes each word of text so the text index matches urls containing all of them
+// rather than any
+func mongoTextSearch(text string) string {
+	phrases := []string{}
+	for _, word := range searchWords(text) {
+		phrases = append(phrases, `"`+word+`"`)
+	}
+
+	return strings.Join(phrases, " ")
+}
+
+// ownerQuery matches the urls belonging to owner, anonymous urls created before owners were
+// recorded have no owner field at all
+func ownerQuery(owner string) bson.M {
+	if owner == "" {
+		return bson.M{"owner": bson.M{"$in": []interface{}{"", nil}}}
+	}
+
+	return bson.M{"owner": owner}
+}
+
+// RecordClick stores a single redirect
+func (s *MongoStore) RecordClick(c *Click) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	_, err := s.db.Collection(clickCollection).InsertOne(ctx, c)
+
+	return err
+}
+
+// mongoClickCount is the number of clicks on a slug in one day from one referrer to one variant
+type mongoClickCount struct {
+	ID struct {
+		Day      string `bson:"day"`
+		Referrer string `bson:"referrer"`
+		Variant  string `bson:"variant"`
+	} `bson:"_id"`
+	Clicks int `bson:"clicks"`
+}
+
+// mongoClickRollup is the number of clicks on a slug in one hour from one referrer to one variant
+type mongoClickRollup struct {
+	Slug     string    `bson:"slug"`
+	Hour     time.Time `bson:"hour"`
+	Referrer string    `bson:"referrer"`
+	Variant  string    `bson:"variant"`
+	Clicks   int       `bson:"clicks"`
+}
+
+// Stats summarises the clicks recorded for slug, adding up its hourly rollups and only counting the
+// clicks recorded since the last rollup one by one
+func (s *MongoStore) Stats(slug string) (*Stats, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	until, err := s.clickRollupEnd(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rolledUp := []mongoClickCount{}
+	err = aggregate(ctx, s.db.Collection(clickRollupCollection), &rolledUp, []bson.M{
+		{"$match": bson.M{"slug": slug, "hour": bson.M{"$lt": until}}},
+		{"$group": bson.M{
+			"_id": bson.M{
+				"day":      bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$hour"}},
+				"referrer": "$referrer",
+				"variant":  "$variant",
+			},
+			"clicks": bson.M{"$sum": "$clicks"},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	recent := []mongoClickCount{}
+	err = aggregate(ctx, s.db.Collection(clickCollection), &recent, []bson.M{
+		{"$match": bson.M{"slug": slug, "timestamp": bson.M{"$gte": until}}},
+		{"$group": bson.M{
+			"_id": bson.M{
+				"day":      bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$timestamp"}},
+				"referrer": "$referrer",
+				"variant":  bson.M{"$ifNull": []interface{}{"$variant", ""}},
+			},
+			"clicks": bson.M{"$sum": 1},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	total := 0
+	days, referrers, variants := map[string]int{}, map[string]int{}, map[string]int{}
+	for _, c := range append(rolledUp, recent...) {
+		total += c.Clicks
+		days[c.ID.Day] += c.Clicks
+		if c.ID.Referrer != "" {
+			referrers[c.ID.Referrer] += c.Clicks
+		}
+		if c.ID.Variant != "" {
+			variants[c.ID.Variant] += c.Clicks
+		}
+	}
+
+	return newStats(slug, total, days, referrers, variants), nil
+}
+
+// Clicks returns a page of the clicks recorded for slug from from up to before to, oldest first
+func (s *MongoStore) Clicks(slug string, from, to time.Time, skip, limit int) ([]Click, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	cur, err := s.db.Collection(clickCollection).Find(ctx,
+		bson.M{"slug": slug, "timestamp": bson.M{"$gte": from, "$lt": to}},
+		options.Find().
+			SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}).
+			SetSkip(int64(skip)).
+			SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+
+	clicks := []Click{}
+	if err := cur.All(ctx, &clicks); err != nil {
+		return nil, err
+	}
+
+	return clicks, nil
+}
+
+// HourlyClicks counts the clicks recorded for slug in every hour from from up to before to, from the
+// hourly rollups and counting the clicks recorded since the last rollup one by one
+func (s *MongoStore) HourlyClicks(slug string, from, to time.Time) (map[int64]int, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	until, err := s.clickRollupEnd(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rolledUp := []mongoClickRollup{}
+	err = aggregate(ctx, s.db.Collection(clickRollupCollection), &rolledUp, []bson.M{
+		{"$match": bson.M{"slug": slug, "hour": bson.M{"$gte": from, "$lt": earliest(to, until)}}},
+		{"$group": bson.M{"_id": "$hour", "clicks": bson.M{"$sum": "$clicks"}}},
+		{"$project": bson.M{"_id": 0, "hour": "$_id", "clicks": 1}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	recent := []mongoClickRollup{}
+	err = aggregate(ctx, s.db.Collection(clickCollection), &recent, []bson.M{
+		{"$match": bson.M{"slug": slug, "timestamp": bson.M{"$gte": latest(from, until), "$lt": to}}},
+		{"$group": bson.M{
+			"_id": bson.M{"$dateFromParts": bson.M{
+				"year":  bson.M{"$year": "$timestamp"},
+				"month": bson.M{"$month": "$timestamp"},
+				"day":   bson.M{"$dayOfMonth": "$timestamp"},
+				"hour":  bson.M{"$hour": "$timestamp"},
+			}},
+			"clicks": bson.M{"$sum": 1},
+		}},
+		{"$project": bson.M{"_id": 0, "hour": "$_id", "clicks": 1}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hours := map[int64]int{}
+	for _, r := range append(rolledUp, recent...) {
+		hours[r.Hour.Unix()] += r.Clicks
+	}
+
+	return hours, nil
+}
+
+// RecordBotClick counts a redirect through slug served to bot
+func (s *MongoStore) RecordBotClick(slug, bot string) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	_, err := s.db.Collection(botClickCollection).UpdateOne(ctx, bson.M{"slug": slug, "bot": bot},
+		bson.M{"$inc": bson.M{"clicks": 1}}, options.Update().SetUpsert(true))
+
+	return err
+}
+
+// BotClicks returns the redirects through slug served to bots, per bot
+func (s *MongoStore) BotClicks(slug string) (map[string]int, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	cur, err := s.db.Collection(botClickCollection).Find(ctx, bson.M{"slug": slug})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := []struct {
+		Bot    string `bson:"bot"`
+		Clicks int    `bson:"clicks"`
+	}{}
+	if err := cur.All(ctx, &counts); err != nil {
+		return nil, err
+	}
+
+	bots := map[string]int{}
+	for _, c := range counts {
+		bots[c.Bot] = c.Clicks
+	}
+
+	return bots, nil
+}
+
+// AddVisitor adds the hash of a visitor to the unique visitor sketch of slug. The sketch only holds the
+// registers visitors have raised, keyed by their index, so concurrent clicks raise them in place.
+func (s *MongoStore) AddVisitor(slug string, visitor uint64) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	index, rank := visitorRegister(visitor)
+	_, err := s.db.Collection(visitorCollection).UpdateOne(ctx, bson.M{"slug": slug},
+		bson.M{"$max": bson.M{"registers." + strconv.Itoa(index): int(rank)}}, options.Update().SetUpsert(true))
+
+	return err
+}
+
+// UniqueVisitors estimates the number of distinct visitors to slug
+func (s *MongoStore) UniqueVisitors(slug string) (int, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	doc := struct {
+		Registers map[string]int `bson:"registers"`
+	}{}
+	err := s.db.Collection(visitorCollection).FindOne(ctx, bson.M{"slug": slug}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	sketch := newVisitorSketch()
+	for index, rank := range doc.Registers {
+		if i, err := strconv.Atoi(index); err == nil && i >= 0 && i < len(sketch) {
+			sketch[i] = byte(rank)
+		}
+	}
+
+	return sketch.count(), nil
+}
+
+// PurgeClicks removes the clicks recorded before before that have been rolled up, so stats keep
+// counting them. Clicks recorded since the last rollup are left for the next purge.
+func (s *MongoStore) PurgeClicks(before time.Time) (int, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	until, err := s.clickRollupEnd(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := s.db.Collection(clickCollection).DeleteMany(ctx, bson.M{"timestamp": bson.M{"$lt": earliest(before, until)}})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(res.DeletedCount), nil
+}
+
+// mongoClick is a click document with its id, which pages of clicks are read after
+type mongoClick struct {
+	ID    primitive.ObjectID `bson:"_id"`
+	Click `bson:",inline"`
+}
+
+// EachClick calls fn with every click recorded from from up to before to, read a batch at a time in
+// the order they were inserted
+func (s *MongoStore) EachClick(from, to time.Time, fn func(c *Click) error) error {
+	filter := bson.M{"timestamp": bson.M{"$gte": from, "$lt": to}}
+
+	for {
+		page, err := s.clickPage(filter)
+		if err != nil {
+			return err
+		}
+
+		for i := range page {
+			if err := fn(&page[i].Click); err != nil {
+				return err
+			}
+		}
+
+		if len(page) < mongoClickBatch {
+			return nil
+		}
+		filter["_id"] = bson.M{"$gt": page[len(page)-1].ID}
+	}
+}
+
+// clickPage returns the first batch of clicks matching filter by id
+func (s *MongoStore) clickPage(filter bson.M) ([]mongoClick, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	cur, err := s.db.Collection(clickCollection).Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(mongoClickBatch))
+	if err != nil {
+		return nil, err
+	}
+
+	page := []mongoClick{}
+	if err := cur.All(ctx, &page); err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// mongoFieldCount is the number of clicks on a slug with one value of a field
+type mongoFieldCount struct {
+	Value  string `bson:"_id"`
+	Clicks int    `bson:"clicks"`
+}
+
+// CountClicksBy counts the clicks recorded for slug per value of field. Referrers are counted from the
+// hourly rollups and the clicks recorded since the last rollup, utm parameters are not rolled up and
+// are counted from every click.
+func (s *MongoStore) CountClicksBy(slug, field string) (map[string]int, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	match := bson.M{"slug": slug, field: bson.M{"$nin": []interface{}{"", nil}}}
+	counts := []mongoFieldCount{}
+
+	if field == "referrer" {
+		until, err := s.clickRollupEnd(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		err = aggregate(ctx, s.db.Collection(clickRollupCollection), &counts, []bson.M{
+			{"$match": bson.M{"slug": slug, "referrer": bson.M{"$ne": ""}, "hour": bson.M{"$lt": until}}},
+			{"$group": bson.M{"_id": "$referrer", "clicks": bson.M{"$sum": "$clicks"}}},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		match["timestamp"] = bson.M{"$gte": until}
+	}
+
+	recent := []mongoFieldCount{}
+	err := aggregate(ctx, s.db.Collection(clickCollection), &recent, []bson.M{
+		{"$match": match},
+		{"$group": bson.M{"_id": "$" + field, "clicks": bson.M{"$sum": 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]int{}
+	for _, c := range append(counts, recent...) {
+		values[c.Value] += c.Clicks
+	}
+
+	return values, nil
+}
+
+// clickRollupEnd returns the time click rollups cover clicks up to, the zero time before the first
+// rollup
+func (s *MongoStore) clickRollupEnd(ctx context.Context) (time.Time, error) {
+	progress := struct {
+		Until time.Time `bson:"until"`
+	}{}
+
+	err := s.db.Collection(counterCollection).FindOne(ctx, bson.M{"_id": clickRollupProgress}).Decode(&progress)
+	if err == mongo.ErrNoDocuments {
+		return time.Time{}, nil
+	}
+
+	return progress.Until, err
+}
+
+// RolledUpUntil returns the time rollups cover clicks up to, the time of the first click when nothing
+// has been rolled up yet and the zero time when no clicks have been recorded
+func (s *MongoStore) RolledUpUntil() (time.Time, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	until, err := s.clickRollupEnd(ctx)
+	if err != nil || !until.IsZero() {
+		return until, err
+	}
+
+	first := Click{}
+	err = s.db.Collection(clickCollection).FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: 1}})).Decode(&first)
+	if err == mongo.ErrNoDocuments {
+		return time.Time{}, nil
+	}
+
+	return first.Timestamp, err
+}
+
+// RollupClicks replaces the rollups of every hour from from up to before to with counts of the clicks
+// recorded in them and records that rollups cover clicks up to to
+func (s *MongoStore) RollupClicks(from, to time.Time) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	rollups := []mongoClickRollup{}
+	err := aggregate(ctx, s.db.Collection(clickCollection), &rollups, []bson.M{
+		{"$match": bson.M{"timestamp": bson.M{"$gte": from, "$lt": to}}},
+		{"$group": bson.M{
+			"_id": bson.M{
+				"slug": "$slug",
+				"hour": bson.M{"$dateFromParts": bson.M{
+					"year":  bson.M{"$year": "$timestamp"},
+					"month": bson.M{"$month": "$timestamp"},
+					"day":   bson.M{"$dayOfMonth": "$timestamp"},
+					"hour":  bson.M{"$hour": "$timestamp"},
+				}},
+				"referrer": "$referrer",
+				"variant":  bson.M{"$ifNull": []interface{}{"$variant", ""}},
+			},
+			"clicks": bson.M{"$sum": 1},
+		}},
+		{"$project": bson.M{
+			"_id":      0,
+			"slug":     "$_id.slug",
+			"hour":     "$_id.hour",
+			"referrer": "$_id.referrer",
+			"variant":  "$_id.variant",
+			"clicks":   1,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// the counts are set rather than incremented so an hour rolled up twice is counted once
+	if len(rollups) > 0 {
+		models := make([]mongo.WriteModel, len(rollups))
+		for i, r := range rollups {
+			models[i] = mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"slug": r.Slug, "hour": r.Hour, "referrer": r.Referrer, "variant": r.Variant}).
+				SetUpdate(bson.M{"$set": bson.M{"clicks": r.Clicks}}).
+				SetUpsert(true)
+		}
+
+		if _, err := s.db.Collection(clickRollupCollection).BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+			return err
+		}
+	}
+
+	_, err = s.db.Collection(counterCollection).UpdateOne(ctx, bson.M{"_id": clickRollupProgress},
+		bson.M{"$max": bson.M{"until": to}}, options.Update().SetUpsert(true))
+
+	return err
+}
+
+// aggregate runs pipeline against c and decodes every resulting document into results
+func aggregate(ctx context.Context, c *mongo.Collection, results interface{}, pipeline []bson.M) error {
+	cur, err := c.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+
+	return cur.All(ctx, results)
+}
+
+// SaveKey inserts a new api key
+func (s *MongoStore) SaveKey(k *APIKey) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	_, err := s.db.Collection(keyCollection).InsertOne(ctx, k)
+
+	return err
+}
+
+// FindKeyByHash returns the key with the given secret hash or ErrNotFound
+func (s *MongoStore) FindKeyByHash(hash string) (*APIKey, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	k := APIKey{}
+	if err := findOne(ctx, s.db.Collection(keyCollection), bson.M{"hash": hash}, &k); err != nil {
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+// RevokeKey marks the key with id as revoked or returns ErrNotFound
+func (s *MongoStore) RevokeKey(id string, at time.Time) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	res, err := s.db.Collection(keyCollection).UpdateOne(ctx, bson.M{"key_id": id}, bson.M{"$set": bson.M{"revoked_at": at}})
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// FindKeyByID returns the key with id or ErrNotFound
+func (s *MongoStore) FindKeyByID(id string) (*APIKey, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	k := APIKey{}
+	if err := findOne(ctx, s.db.Collection(keyCollection), bson.M{"key_id": id}, &k); err != nil {
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+// SetKeyQuota changes the monthly quota of the key with id or returns ErrNotFound
+func (s *MongoStore) SetKeyQuota(id string, quota int) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	res, err := s.db.Collection(keyCollection).UpdateOne(ctx, bson.M{"key_id": id}, bson.M{"$set": bson.M{"monthly_quota": quota}})
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// CountUsage adds n to the counter kind, shortens or redirects, of key in month and returns its new
+// value
+func (s *MongoStore) CountUsage(keyID, month, kind string, n int) (int, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	var usage struct {
+		Shortens  int `bson:"shortens"`
+		Redirects int `bson:"redirects"`
+	}
+	err := s.db.Collection(usageCollection).FindOneAndUpdate(ctx, bson.M{"key_id": keyID, "month": month},
+		bson.M{"$inc": bson.M{kind: n}}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&usage)
+	if err != nil {
+		return 0, err
+	}
+
+	if kind == usageRedirects {
+		return usage.Redirects, nil
+	}
+
+	return usage.Shortens, nil
+}
+
+// KeyUsage returns the shorten calls and redirects counted for key in month
+func (s *MongoStore) KeyUsage(keyID, month string) (int, int, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	var usage struct {
+		Shortens  int `bson:"shortens"`
+		Redirects int `bson:"redirects"`
+	}
+	err := s.db.Collection(usageCollection).FindOne(ctx, bson.M{"key_id": keyID, "month": month}).Decode(&usage)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return 0, 0, err
+	}
+
+	return usage.Shortens, usage.Redirects, nil
+}
+
+// SaveUser inserts a new user or returns ErrEmailTaken
+func (s *MongoStore) SaveUser(u *User) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	_, err := s.db.Collection(userCollection).InsertOne(ctx, u)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrEmailTaken
+	}
+
+	return err
+}
+
+// FindUserByEmail returns the user registered with email or ErrNotFound
+func (s *MongoStore) FindUserByEmail(email string) (*User, error) {
+	return s.findUser(bson.M{"email": email})
+}
+
+// FindUserByID returns the user with id or ErrNotFound
+func (s *MongoStore) FindUserByID(id string) (*User, error) {
+	return s.findUser(bson.M{"user_id": id})
+}
+
+// findUser returns the single user matching query or ErrNotFound
+func (s *MongoStore) findUser(query bson.M) (*User, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	u := User{}
+	if err := findOne(ctx, s.db.Collection(userCollection), query, &u); err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// BanDomain records domain as banned
+func (s *MongoStore) BanDomain(domain string, at time.Time) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	_, err := s.db.Collection(bannedDomainCollection).UpdateOne(
+		ctx,
+		bson.M{"_id": domain},
+		bson.M{"$set": bson.M{"banned_at": at}},
+		options.Update().SetUpsert(true),
+	)
+
+	return err
+}
+
+// UnbanDomain lifts the ban on domain or returns ErrNotFound
+func (s *MongoStore) UnbanDomain(domain string) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	res, err := s.db.Collection(bannedDomainCollection).DeleteOne(ctx, bson.M{"_id": domain})
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// BannedDomains returns every banned domain
+func (s *MongoStore) BannedDomains() ([]string, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	cur, err := s.db.Collection(bannedDomainCollection).Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	docs := []struct {
+		Domain string `bson:"_id"`
+	}{}
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+
+	domains := make([]string, len(docs))
+	for i, d := range docs {
+		domains[i] = d.Domain
+	}
+
+	return domains, nil
+}
+
+// SaveReport inserts a new report
+func (s *MongoStore) SaveReport(r *Report) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	_, err := s.db.Collection(reportCollection).InsertOne(ctx, r)
+
+	return err
+}
+
+// CountReporters returns the number of distinct reporters that have flagged slug
+func (s *MongoStore) CountReporters(slug string) (int, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	reporters, err := s.db.Collection(reportCollection).Distinct(ctx, "reporter", bson.M{"slug": slug})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(reporters), nil
+}
+
+// ListReports returns a page of reports, newest first, for slug or every url when slug is empty
+func (s *MongoStore) ListReports(slug string, skip, limit int) ([]Report, int, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	query := bson.M{}
+	if slug != "" {
+		query["slug"] = slug
+	}
+
+	collection := s.db.Collection(reportCollection)
+
+	total, err := collection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cur, err := collection.Find(ctx, query, options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(int64(skip)).
+		SetLimit(int64(limit)))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	reports := []Report{}
+	if err := cur.All(ctx, &reports); err != nil {
+		return nil, 0, err
+	}
+
+	return reports, int(total), nil
+}
+
+// DeleteReports dismisses every report for slug
+func (s *MongoStore) DeleteReports(slug string) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	_, err := s.db.Collection(reportCollection).DeleteMany(ctx, bson.M{"slug": slug})
+
+	return err
+}
+
+// SaveWebhook inserts a new webhook
+func (s *MongoStore) SaveWebhook(wh *Webhook) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	_, err := s.db.Collection(webhookCollection).InsertOne(ctx, wh)
+
+	return err
+}
+
+// ListWebhooks returns the webhooks of owner, or of every owner when owner is empty, oldest first
+func (s *MongoStore) ListWebhooks(owner string) ([]Webhook, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	query := bson.M{}
+	if owner != "" {
+		query["owner"] = owner
+	}
+
+	cur, err := s.db.Collection(webhookCollection).Find(ctx, query, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := []Webhook{}
+	if err := cur.All(ctx, &hooks); err != nil {
+		return nil, err
+	}
+
+	return hooks, nil
+}
+
+// DeleteWebhook removes the webhook of owner with id or returns ErrNotFound
+func (s *MongoStore) DeleteWebhook(owner, id string) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	res, err := s.db.Collection(webhookCollection).DeleteOne(ctx, bson.M{"owner": owner, "webhook_id": id})
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// SaveCampaign inserts a new campaign
+func (s *MongoStore) SaveCampaign(c *Campaign) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	_, err := s.db.Collection(campaignCollection).InsertOne(ctx, c)
+
+	return err
+}
+
+// ListCampaigns returns the campaigns of owner, oldest first
+func (s *MongoStore) ListCampaigns(owner string) ([]Campaign, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	cur, err := s.db.Collection(campaignCollection).Find(ctx, bson.M{"owner": owner}, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	campaigns := []Campaign{}
+	if err := cur.All(ctx, &campaigns); err != nil {
+		return nil, err
+	}
+
+	return campaigns, nil
+}
+
+// FindCampaign returns the campaign of owner with id or ErrNotFound
+func (s *MongoStore) FindCampaign(owner, id string) (*Campaign, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	c := Campaign{}
+	if err := s.db.Collection(campaignCollection).FindOne(ctx, bson.M{"owner": owner, "campaign_id": id}).Decode(&c); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// DeleteCampaign removes the campaign of owner with id or returns ErrNotFound
+func (s *MongoStore) DeleteCampaign(owner, id string) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	res, err := s.db.Collection(campaignCollection).DeleteOne(ctx, bson.M{"owner": owner, "campaign_id": id})
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// SaveOrg inserts a new organization
+func (s *MongoStore) SaveOrg(o *Organization) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	_, err := s.db.Collection(orgCollection).InsertOne(ctx, o)
+
+	return err
+}
+
+// FindOrg returns the organization with id or ErrNotFound
+func (s *MongoStore) FindOrg(id string) (*Organization, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	o := Organization{}
+	if err := s.db.Collection(orgCollection).FindOne(ctx, bson.M{"org_id": id}).Decode(&o); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return &o, nil
+}
+
+// DeleteOrg removes the organization with id and its members or returns ErrNotFound
+func (s *MongoStore) DeleteOrg(id string) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	res, err := s.db.Collection(orgCollection).DeleteOne(ctx, bson.M{"org_id": id})
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+
+	_, err = s.db.Collection(memberCollection).DeleteMany(ctx, bson.M{"org_id": id})
+
+	return err
+}
+
+// SaveMember adds a member to an organization or replaces the membership they have
+func (s *MongoStore) SaveMember(m *Member) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	_, err := s.db.Collection(memberCollection).ReplaceOne(ctx, bson.M{"org_id": m.OrgID, "user_id": m.UserID}, m,
+		options.Replace().SetUpsert(true))
+
+	return err
+}
+
+// FindMember returns the membership of user in org or ErrNotFound
+func (s *MongoStore) FindMember(orgID, userID string) (*Member, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	m := Member{}
+	if err := s.db.Collection(memberCollection).FindOne(ctx, bson.M{"org_id": orgID, "user_id": userID}).Decode(&m); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// ListMembers returns the members of org, oldest first
+func (s *MongoStore) ListMembers(orgID string) ([]Member, error) {
+	return s.findMembers(bson.M{"org_id": orgID})
+}
+
+// ListMemberships returns the memberships of user, oldest first
+func (s *MongoStore) ListMemberships(userID string) ([]Member, error) {
+	return s.findMembers(bson.M{"user_id": userID})
+}
+
+// findMembers returns the memberships matching filter, oldest first
+func (s *MongoStore) findMembers(filter bson.M) ([]Member, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	cur, err := s.db.Collection(memberCollection).Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "added_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	members := []Member{}
+	if err := cur.All(ctx, &members); err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// RemoveMember removes user from org or returns ErrNotFound
+func (s *MongoStore) RemoveMember(orgID, userID string) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	res, err := s.db.Collection(memberCollection).DeleteOne(ctx, bson.M{"org_id": orgID, "user_id": userID})
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// ClaimIdempotencyKey stores k unless its owner already has an unexpired record under its key, which
+// is returned instead
+func (s *MongoStore) ClaimIdempotencyKey(k *IdempotencyKey) (*IdempotencyKey, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	collection := s.db.Collection(idempotencyCollection)
+
+	// mongo only removes expired documents once a minute, an expired key may be claimed again sooner
+	if _, err := collection.DeleteOne(ctx, bson.M{"owner": k.Owner, "key": k.Key, "expires_at": bson.M{"$lte": time.Now()}}); err != nil {
+		return nil, err
+	}
+
+	_, err := collection.InsertOne(ctx, k)
+	if err == nil {
+		return nil, nil
+	} else if !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+
+	previous := IdempotencyKey{}
+	if err := collection.FindOne(ctx, bson.M{"owner": k.Owner, "key": k.Key}).Decode(&previous); err != nil {
+		return nil, err
+	}
+
+	return &previous, nil
+}
+
+// CompleteIdempotencyKey records the url the request under key of owner created and the status it
+// was responded to with
+func (s *MongoStore) CompleteIdempotencyKey(owner, key, slug string, status int) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	_, err := s.db.Collection(idempotencyCollection).UpdateOne(ctx, bson.M{"owner": owner, "key": key}, bson.M{"$set": bson.M{"slug": slug, "status": status}})
+
+	return err
+}
+
+// ReleaseIdempotencyKey removes the record under key of owner
+func (s *MongoStore) ReleaseIdempotencyKey(owner, key string) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	_, err := s.db.Collection(idempotencyCollection).DeleteOne(ctx, bson.M{"owner": owner, "key": key})
+
+	return err
+}
+
+// SaveCustomDomain inserts a new custom domain, returning ErrCustomDomainTaken when it has already
+// been registered
+func (s *MongoStore) SaveCustomDomain(d *CustomDomain) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	_, err := s.db.Collection(customDomainCollection).InsertOne(ctx, d)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrCustomDomainTaken
+	}
+
+	return err
+}
+
+// FindCustomDomain returns the custom domain named domain or ErrNotFound
+func (s *MongoStore) FindCustomDomain(domain string) (*CustomDomain, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	d := CustomDomain{}
+	if err := s.db.Collection(customDomainCollection).FindOne(ctx, bson.M{"domain": domain}).Decode(&d); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// ListCustomDomains returns the custom domains of owner, or of every owner when owner is empty, oldest
+// first
+func (s *MongoStore) ListCustomDomains(owner string) ([]CustomDomain, error) {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	query := bson.M{}
+	if owner != "" {
+		query["owner"] = owner
+	}
+
+	cur, err := s.db.Collection(customDomainCollection).Find(ctx, query, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	domains := []CustomDomain{}
+	if err := cur.All(ctx, &domains); err != nil {
+		return nil, err
+	}
+
+	return domains, nil
+}
+
+// VerifyCustomDomain records that domain was verified at at or returns ErrNotFound
+func (s *MongoStore) VerifyCustomDomain(domain string, at time.Time) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	res, err := s.db.Collection(customDomainCollection).UpdateOne(ctx, bson.M{"domain": domain}, bson.M{"$set": bson.M{"verified_at": at}})
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// DeleteCustomDomain removes the custom domain of owner named domain or returns ErrNotFound
+func (s *MongoStore) DeleteCustomDomain(owner, domain string) error {
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	res, err := s.db.Collection(customDomainCollection).DeleteOne(ctx, bson.M{"owner": owner, "domain": domain})
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,1600 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// postgresMigrations are applied in order at startup, the index of each entry plus one is its
+// schema version. Entries must never be edited once released, add a new one instead.
+var postgresMigrations = []string{
+	`CREATE TABLE urls (
+		id BIGSERIAL PRIMARY KEY,
+		slug TEXT NOT NULL,
+		original_url TEXT NOT NULL,
+		document JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE UNIQUE INDEX urls_slug_idx ON urls (slug)`,
+	`CREATE TABLE clicks (
+		id BIGSERIAL PRIMARY KEY,
+		slug TEXT NOT NULL,
+		clicked_at TIMESTAMPTZ NOT NULL,
+		referrer TEXT NOT NULL,
+		user_agent TEXT NOT NULL,
+		country TEXT NOT NULL
+	)`,
+	`CREATE INDEX clicks_slug_idx ON clicks (slug, clicked_at)`,
+	`ALTER TABLE urls ADD COLUMN expires_at TIMESTAMPTZ`,
+	`CREATE INDEX urls_expires_at_idx ON urls (expires_at) WHERE expires_at IS NOT NULL`,
+	`CREATE INDEX urls_original_url_idx ON urls (original_url)`,
+	`CREATE TABLE api_keys (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		hash TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMPTZ NOT NULL,
+		revoked_at TIMESTAMPTZ
+	)`,
+	`CREATE TABLE tombstones (
+		slug TEXT PRIMARY KEY,
+		deleted_at TIMESTAMPTZ NOT NULL
+	)`,
+	`ALTER TABLE urls ADD COLUMN owner TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX urls_owner_idx ON urls (owner, id)`,
+	`CREATE SEQUENCE slug_seq`,
+	`ALTER TABLE urls ADD COLUMN uses INTEGER NOT NULL DEFAULT 0`,
+	`CREATE TABLE users (
+		id TEXT PRIMARY KEY,
+		email TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL
+	)`,
+	`ALTER TABLE api_keys ADD COLUMN user_id TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE banned_domains (
+		domain TEXT PRIMARY KEY,
+		banned_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE reports (
+		id BIGSERIAL PRIMARY KEY,
+		slug TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		reporter TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX reports_slug_idx ON reports (slug, id)`,
+	`ALTER TABLE urls ADD COLUMN clicks BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE clicks ADD COLUMN variant TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE webhooks (
+		id TEXT PRIMARY KEY,
+		owner TEXT NOT NULL,
+		url TEXT NOT NULL,
+		events TEXT[] NOT NULL,
+		secret TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX webhooks_owner_idx ON webhooks (owner, created_at)`,
+	`CREATE INDEX urls_tags_idx ON urls USING GIN ((document->'tags'))`,
+	`CREATE INDEX urls_search_idx ON urls USING GIN (` + postgresSearchVector + `)`,
+	`CREATE TABLE campaigns (
+		id TEXT PRIMARY KEY,
+		owner TEXT NOT NULL,
+		name TEXT NOT NULL,
+		description TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX campaigns_owner_idx ON campaigns (owner, created_at)`,
+	`CREATE INDEX urls_campaign_idx ON urls (owner, (document->>'campaign'))`,
+	`CREATE TABLE custom_domains (
+		domain TEXT PRIMARY KEY,
+		owner TEXT NOT NULL,
+		token TEXT NOT NULL,
+		verified_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX custom_domains_owner_idx ON custom_domains (owner, created_at)`,
+	`CREATE INDEX urls_deleted_idx ON urls (owner, id) WHERE document ? 'deleted_at'`,
+	`CREATE TABLE click_rollups (
+		slug TEXT NOT NULL,
+		hour TIMESTAMPTZ NOT NULL,
+		referrer TEXT NOT NULL,
+		variant TEXT NOT NULL,
+		clicks BIGINT NOT NULL,
+		PRIMARY KEY (slug, hour, referrer, variant)
+	)`,
+	`CREATE TABLE click_rollup_progress (
+		id INT PRIMARY KEY,
+		rolled_up_until TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX clicks_clicked_at_idx ON clicks (clicked_at)`,
+	`ALTER TABLE clicks ADD COLUMN referrer_domain TEXT NOT NULL DEFAULT '',
+		ADD COLUMN utm_source TEXT NOT NULL DEFAULT '',
+		ADD COLUMN utm_medium TEXT NOT NULL DEFAULT '',
+		ADD COLUMN utm_campaign TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE bot_clicks (
+		slug TEXT NOT NULL,
+		bot TEXT NOT NULL,
+		clicks BIGINT NOT NULL,
+		PRIMARY KEY (slug, bot)
+	)`,
+	`CREATE TABLE visitor_sketches (
+		slug TEXT PRIMARY KEY,
+		registers BYTEA NOT NULL
+	)`,
+	`CREATE TABLE idempotency_keys (
+		owner TEXT NOT NULL,
+		key TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		slug TEXT NOT NULL,
+		status INT NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (owner, key)
+	)`,
+	`CREATE INDEX idempotency_keys_expires_idx ON idempotency_keys (expires_at)`,
+	`CREATE TABLE organizations (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE org_members (
+		org_id TEXT NOT NULL REFERENCES organizations (id) ON DELETE CASCADE,
+		user_id TEXT NOT NULL,
+		email TEXT NOT NULL,
+		role TEXT NOT NULL,
+		added_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (org_id, user_id)
+	)`,
+	`CREATE INDEX org_members_user_idx ON org_members (user_id, added_at)`,
+	`ALTER TABLE api_keys ADD COLUMN monthly_quota INTEGER NOT NULL DEFAULT 0`,
+	`CREATE TABLE key_usage (
+		key_id TEXT NOT NULL,
+		month TEXT NOT NULL,
+		shortens BIGINT NOT NULL DEFAULT 0,
+		redirects BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (key_id, month)
+	)`,
+}
+
+// postgresSearchVector is the full text document of a url, its original url and title split into
+// words on punctuation the way searchWords splits them. List must use the same expression for the
+// search index to be used.
+const postgresSearchVector = `to_tsvector('simple', regexp_replace(lower(original_url || ' ' || COALESCE(document->>'title', '')), '[^[:alnum:]]+', ' ', 'g'))`
+
+// likeEscaper escapes the wildcard characters of a LIKE pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// postgresSortColumns maps list sort fields to columns
+var postgresSortColumns = map[string]string{
+	"created_at":   "id",
+	"slug":         "slug",
+	"original_url": "original_url",
+	"clicks":       "clicks",
+}
+
+// PostgresStore is a Store backed by a postgres database. Urls are kept as json documents with the
+// slug and original url broken out into indexed columns. Click counts live in their own column so
+// they are incremented in place, the count in the document is ignored.
+type PostgresStore struct {
+	db      *sql.DB
+	timeout time.Duration
+}
+
+// NewPostgresStore connects to the postgres database described by dsn and migrates the schema. Each
+// url query is bounded by timeout. At most poolSize connections are opened, 0 does not limit them.
+func NewPostgresStore(dsn string, timeout time.Duration, poolSize int) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// database/sql keeps only 2 idle connections, a busy server would keep reconnecting
+	db.SetMaxIdleConns(defaultIdleConnections)
+	db.SetConnMaxIdleTime(storeConnMaxIdle)
+	if poolSize > 0 {
+		db.SetMaxOpenConns(poolSize)
+		db.SetMaxIdleConns(poolSize)
+	}
+
+	s := &PostgresStore{db: db, timeout: timeout}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// migrate applies any migrations newer than the recorded schema version
+func (s *PostgresStore) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+
+	version := 0
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(postgresMigrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(postgresMigrations[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// context returns a context carrying the deadline for a single store operation, it is cancelled
+// with parent as well
+func (s *PostgresStore) context(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, s.timeout)
+}
+
+// Close closes the database handle
+func (s *PostgresStore) Close() {
+	s.db.Close()
+}
+
+// PoolStats returns the state of the connection pool
+func (s *PostgresStore) PoolStats() PoolStats {
+	stats := s.db.Stats()
+
+	return PoolStats{
+		Open:     stats.OpenConnections,
+		InUse:    stats.InUse,
+		Waits:    stats.WaitCount,
+		WaitTime: stats.WaitDuration,
+	}
+}
+
+// Ping checks that the database is reachable
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	return s.db.PingContext(ctx)
+}
+
+// Save inserts a new url document, returning ErrSlugTaken when the slug is already in use
+func (s *PostgresStore) Save(ctx context.Context, u *URL) error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	js, err := marshalURL(u)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO urls (slug, original_url, document, expires_at, owner) VALUES ($1, $2, $3, $4, $5)`,
+		u.Slug, u.OriginalURL, js, u.ExpiresAt, u.Owner,
+	)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return ErrSlugTaken
+	}
+
+	return err
+}
+
+// SaveMany inserts urls with a single multi row insert, rows whose slug is already in use are skipped
+// and reported as ErrSlugTaken
+func (s *PostgresStore) SaveMany(ctx context.Context, urls []*URL) []error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	errs := make([]error, len(urls))
+	if len(urls) == 0 {
+		return errs
+	}
+
+	values := make([]string, 0, len(urls))
+	args := make([]interface{}, 0, len(urls)*5)
+	for i, u := range urls {
+		js, err := marshalURL(u)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5))
+		args = append(args, u.Slug, u.OriginalURL, js, u.ExpiresAt, u.Owner)
+	}
+
+	if len(values) == 0 {
+		return errs
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		`INSERT INTO urls (slug, original_url, document, expires_at, owner) VALUES `+strings.Join(values, ", ")+
+			` ON CONFLICT (slug) DO NOTHING RETURNING slug`,
+		args...,
+	)
+	if err != nil {
+		return batchErrors(len(urls), err)
+	}
+	defer rows.Close()
+
+	inserted := map[string]bool{}
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			return batchErrors(len(urls), err)
+		}
+
+		inserted[slug] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return batchErrors(len(urls), err)
+	}
+
+	for i, u := range urls {
+		if errs[i] == nil && !inserted[u.Slug] {
+			errs[i] = ErrSlugTaken
+		}
+	}
+
+	return errs
+}
+
+// NextSequence atomically increments and returns the slug sequence, starting at 1
+func (s *PostgresStore) NextSequence() (uint64, error) {
+	var n int64
+	err := s.db.QueryRow(`SELECT nextval('slug_seq')`).Scan(&n)
+
+	return uint64(n), err
+}
+
+// ReserveSequence reserves the next n values of the slug sequence in one query, other sessions
+// drawing from the sequence at the same time may interleave with them
+func (s *PostgresStore) ReserveSequence(n int) ([]uint64, error) {
+	rows, err := s.db.Query(`SELECT nextval('slug_seq') FROM generate_series(1, $1)`, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make([]uint64, 0, n)
+	for rows.Next() {
+		var v int64
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+
+		values = append(values, uint64(v))
+	}
+
+	return values, rows.Err()
+}
+
+// ExistingSlugs returns which of slugs are in use or tombstoned
+func (s *PostgresStore) ExistingSlugs(slugs []string) (map[string]bool, error) {
+	rows, err := s.db.Query(
+		`SELECT slug FROM urls WHERE slug = ANY($1) UNION SELECT slug FROM tombstones WHERE slug = ANY($1)`,
+		pq.Array(slugs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := map[string]bool{}
+	for rows.Next() {
+		slug := ""
+		if err := rows.Scan(&slug); err != nil {
+			return nil, err
+		}
+
+		existing[slug] = true
+	}
+
+	return existing, rows.Err()
+}
+
+// Update replaces the url stored under u.Slug or returns ErrNotFound
+func (s *PostgresStore) Update(ctx context.Context, u *URL) error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	js, err := marshalURL(u)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE urls SET original_url = $2, document = $3, expires_at = $4 WHERE slug = $1`,
+		u.Slug, u.OriginalURL, js, u.ExpiresAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// ResolveSlug returns the url stored under slug for a redirect or ErrNotFound
+func (s *PostgresStore) ResolveSlug(ctx context.Context, slug string) (*URL, error) {
+	return s.FindBySlug(ctx, slug)
+}
+
+// FindBySlug returns the url stored under slug or ErrNotFound
+func (s *PostgresStore) FindBySlug(ctx context.Context, slug string) (*URL, error) {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	js := []byte{}
+	clicks := 0
+	if err := s.db.QueryRowContext(ctx, `SELECT document, clicks FROM urls WHERE slug = $1`, slug).Scan(&js, &clicks); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	u := URL{Slug: slug}
+	if err := unmarshalURL(js, &u); err != nil {
+		return nil, err
+	}
+	u.Clicks = clicks
+
+	return &u, nil
+}
+
+// FindByOriginalURL returns a url owned by owner without an expiry that has not been deleted pointing
+// at original or ErrNotFound
+func (s *PostgresStore) FindByOriginalURL(ctx context.Context, owner, original string) (*URL, error) {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	u := URL{}
+	js := []byte{}
+	clicks := 0
+	err := s.db.QueryRowContext(ctx,
+		`SELECT slug, document, clicks FROM urls WHERE owner = $1 AND original_url = $2 AND expires_at IS NULL
+		AND NOT document ? 'deleted_at' ORDER BY id LIMIT 1`,
+		owner, original,
+	).Scan(&u.Slug, &js, &clicks)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	if err := unmarshalURL(js, &u); err != nil {
+		return nil, err
+	}
+	u.Clicks = clicks
+
+	return &u, nil
+}
+
+// Exists reports whether a url has already been stored under slug, including deleted urls that left
+// a tombstone
+func (s *PostgresStore) Exists(ctx context.Context, slug string) (bool, error) {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	exists := false
+	err := s.db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM urls WHERE slug = $1) OR EXISTS (SELECT 1 FROM tombstones WHERE slug = $1)`,
+		slug,
+	).Scan(&exists)
+
+	return exists, err
+}
+
+// Delete removes the url stored under slug or returns ErrNotFound. When tombstone is set the slug is
+// recorded so it is never reused.
+func (s *PostgresStore) Delete(ctx context.Context, slug string, tombstone bool) error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM urls WHERE slug = $1`, slug)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		tx.Rollback()
+		return err
+	} else if n == 0 {
+		tx.Rollback()
+		return ErrNotFound
+	}
+
+	if tombstone {
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO tombstones (slug, deleted_at) VALUES ($1, $2) ON CONFLICT (slug) DO NOTHING`,
+			slug, time.Now().UTC(),
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// IncrementUses atomically counts a visit to slug or returns ErrNotFound
+func (s *PostgresStore) IncrementUses(ctx context.Context, slug string) (int, error) {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	uses := 0
+	err := s.db.QueryRowContext(ctx, `UPDATE urls SET uses = uses + 1 WHERE slug = $1 RETURNING uses`, slug).Scan(&uses)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+
+	return uses, err
+}
+
+// IncrementClicks atomically counts a redirect through slug or returns ErrNotFound
+func (s *PostgresStore) IncrementClicks(ctx context.Context, slug string) (int, error) {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	clicks := 0
+	err := s.db.QueryRowContext(ctx, `UPDATE urls SET clicks = clicks + 1 WHERE slug = $1 RETURNING clicks`, slug).Scan(&clicks)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+
+	return clicks, err
+}
+
+// List returns the page of urls selected by q and the total number of urls the owner has
+func (s *PostgresStore) List(ctx context.Context, q ListQuery) ([]URL, int, error) {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	conditions, args := []string{}, []interface{}{}
+	if !q.AllOwners {
+		args = append(args, q.Owner)
+		conditions = append(conditions, fmt.Sprintf(`owner = $%d`, len(args)))
+	}
+
+	if q.Search != "" {
+		args = append(args, "%"+likeEscaper.Replace(q.Search)+"%")
+		conditions = append(conditions, fmt.Sprintf(`(slug ILIKE $%d OR original_url ILIKE $%d)`, len(args), len(args)))
+	}
+
+	if q.Tag != "" {
+		args = append(args, q.Tag)
+		conditions = append(conditions, fmt.Sprintf(`document->'tags' ? $%d`, len(args)))
+	}
+
+	if q.Campaign != "" {
+		args = append(args, q.Campaign)
+		conditions = append(conditions, fmt.Sprintf(`document->>'campaign' = $%d`, len(args)))
+	}
+
+	if q.Text != "" {
+		args = append(args, strings.Join(searchWords(q.Text), " "))
+		conditions = append(conditions, fmt.Sprintf(`%s @@ plainto_tsquery('simple', $%d)`, postgresSearchVector, len(args)))
+	}
+
+	if q.Deleted {
+		conditions = append(conditions, `document ? 'deleted_at'`)
+	} else {
+		conditions = append(conditions, `NOT document ? 'deleted_at'`)
+	}
+
+	where := `WHERE ` + strings.Join(conditions, ` AND `)
+
+	total := 0
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM urls `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	field, desc := q.sortField()
+	order := postgresSortColumns[field]
+	if order == "" {
+		order = "id"
+	}
+	if desc {
+		order += " DESC"
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		fmt.Sprintf(`SELECT slug, document, clicks FROM urls %s ORDER BY %s, id OFFSET $%d LIMIT $%d`, where, order, len(args)+1, len(args)+2),
+		append(args, q.Skip, q.Limit)...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	urls := []URL{}
+	for rows.Next() {
+		u := URL{}
+		js := []byte{}
+		clicks := 0
+		if err := rows.Scan(&u.Slug, &js, &clicks); err != nil {
+			return nil, 0, err
+		}
+
+		if err := unmarshalURL(js, &u); err != nil {
+			return nil, 0, err
+		}
+		u.Clicks = clicks
+
+		urls = append(urls, u)
+	}
+
+	return urls, total, rows.Err()
+}
+
+// PurgeExpired removes every url that expired at or before now, returning the number removed. Expired
+// idempotency keys are removed along with them.
+func (s *PostgresStore) PurgeExpired(now time.Time) (int, error) {
+	if _, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE expires_at <= $1`, now); err != nil {
+		return 0, err
+	}
+
+	res, err := s.db.Exec(`DELETE FROM urls WHERE expires_at <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+
+	return int(n), err
+}
+
+// RecordClick stores a single redirect
+func (s *PostgresStore) RecordClick(c *Click) error {
+	_, err := s.db.Exec(
+		`INSERT INTO clicks (slug, clicked_at, referrer, user_agent, country, variant, referrer_domain, utm_source, utm_medium, utm_campaign)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		c.Slug, c.Timestamp, c.Referrer, c.UserAgent, c.Country, c.Variant, c.ReferrerDomain, c.UTMSource, c.UTMMedium, c.UTMCampaign,
+	)
+
+	return err
+}
+
+// postgresClickCounts selects the clicks of slug $1 as rows of (day, referrer, variant, clicks), from
+// the hourly rollups before $2 and counting the clicks recorded since then one by one
+const postgresClickCounts = `SELECT to_char(hour AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, referrer, variant, clicks
+	FROM click_rollups WHERE slug = $1 AND hour < $2
+	UNION ALL
+	SELECT to_char(clicked_at AT TIME ZONE 'UTC', 'YYYY-MM-DD'), referrer, variant, 1
+	FROM clicks WHERE slug = $1 AND clicked_at >= $2`
+
+// Stats summarises the clicks recorded for slug, adding up its hourly rollups and only counting the
+// clicks recorded since the last rollup one by one
+func (s *PostgresStore) Stats(slug string) (*Stats, error) {
+	until, err := s.clickRollupEnd()
+	if err != nil {
+		return nil, err
+	}
+
+	total := 0
+	if err := s.db.QueryRow(`SELECT COALESCE(SUM(clicks), 0) FROM (`+postgresClickCounts+`) c`, slug, until).Scan(&total); err != nil {
+		return nil, err
+	}
+
+	days, err := s.countClicks(
+		`SELECT day, SUM(clicks) FROM (`+postgresClickCounts+`) c GROUP BY day`,
+		slug, until,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	referrers, err := s.countClicks(
+		`SELECT referrer, SUM(clicks) FROM (`+postgresClickCounts+`) c WHERE referrer <> ''
+		GROUP BY referrer ORDER BY SUM(clicks) DESC LIMIT $3`,
+		slug, until, statsTopReferrers,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	variants, err := s.countClicks(
+		`SELECT variant, SUM(clicks) FROM (`+postgresClickCounts+`) c WHERE variant <> '' GROUP BY variant`,
+		slug, until,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return newStats(slug, total, days, referrers, variants), nil
+}
+
+// Clicks returns a page of the clicks recorded for slug from from up to before to, oldest first
+func (s *PostgresStore) Clicks(slug string, from, to time.Time, skip, limit int) ([]Click, error) {
+	rows, err := s.db.Query(
+		`SELECT clicked_at, referrer, user_agent, country, variant, referrer_domain, utm_source, utm_medium, utm_campaign FROM clicks
+		WHERE slug = $1 AND clicked_at >= $2 AND clicked_at < $3 ORDER BY clicked_at, id OFFSET $4 LIMIT $5`,
+		slug, from, to, skip, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clicks := []Click{}
+	for rows.Next() {
+		c := Click{Slug: slug}
+		if err := rows.Scan(&c.Timestamp, &c.Referrer, &c.UserAgent, &c.Country, &c.Variant, &c.ReferrerDomain, &c.UTMSource, &c.UTMMedium, &c.UTMCampaign); err != nil {
+			return nil, err
+		}
+
+		clicks = append(clicks, c)
+	}
+
+	return clicks, rows.Err()
+}
+
+// HourlyClicks counts the clicks recorded for slug in every hour from from up to before to, from the
+// hourly rollups and counting the clicks recorded since the last rollup one by one
+func (s *PostgresStore) HourlyClicks(slug string, from, to time.Time) (map[int64]int, error) {
+	until, err := s.clickRollupEnd()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(
+		`SELECT extract(epoch FROM hour)::bigint, SUM(clicks) FROM (
+			SELECT hour, clicks FROM click_rollups WHERE slug = $1 AND hour >= $2 AND hour < $3 AND hour < $4
+			UNION ALL
+			SELECT date_trunc('hour', clicked_at AT TIME ZONE 'UTC') AT TIME ZONE 'UTC', 1 FROM clicks
+			WHERE slug = $1 AND clicked_at >= $2 AND clicked_at < $3 AND clicked_at >= $4
+		) c GROUP BY 1`,
+		slug, from, to, until,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hours := map[int64]int{}
+	for rows.Next() {
+		hour, clicks := int64(0), 0
+		if err := rows.Scan(&hour, &clicks); err != nil {
+			return nil, err
+		}
+
+		hours[hour] = clicks
+	}
+
+	return hours, rows.Err()
+}
+
+// RecordBotClick counts a redirect through slug served to bot
+func (s *PostgresStore) RecordBotClick(slug, bot string) error {
+	_, err := s.db.Exec(
+		`INSERT INTO bot_clicks (slug, bot, clicks) VALUES ($1, $2, 1)
+		ON CONFLICT (slug, bot) DO UPDATE SET clicks = bot_clicks.clicks + 1`,
+		slug, bot,
+	)
+
+	return err
+}
+
+// BotClicks returns the redirects through slug served to bots, per bot
+func (s *PostgresStore) BotClicks(slug string) (map[string]int, error) {
+	return s.countClicks(`SELECT bot, clicks FROM bot_clicks WHERE slug = $1`, slug)
+}
+
+// AddVisitor adds the hash of a visitor to the unique visitor sketch of slug, raising its register in
+// place so concurrent clicks never overwrite each other
+func (s *PostgresStore) AddVisitor(slug string, visitor uint64) error {
+	index, rank := visitorRegister(visitor)
+	_, err := s.db.Exec(
+		`INSERT INTO visitor_sketches (slug, registers) VALUES ($1, set_byte(decode(repeat('00', $2), 'hex'), $3, $4))
+		ON CONFLICT (slug) DO UPDATE
+		SET registers = set_byte(visitor_sketches.registers, $3, GREATEST(get_byte(visitor_sketches.registers, $3), $4))`,
+		slug, visitorRegisters, index, int(rank),
+	)
+
+	return err
+}
+
+// UniqueVisitors estimates the number of distinct visitors to slug
+func (s *PostgresStore) UniqueVisitors(slug string) (int, error) {
+	registers := []byte{}
+	err := s.db.QueryRow(`SELECT registers FROM visitor_sketches WHERE slug = $1`, slug).Scan(&registers)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return visitorSketch(registers).count(), nil
+}
+
+// EachClick calls fn with every click recorded from from up to before to, oldest first
+func (s *PostgresStore) EachClick(from, to time.Time, fn func(c *Click) error) error {
+	rows, err := s.db.Query(
+		`SELECT slug, clicked_at, referrer, user_agent, country, variant, referrer_domain, utm_source, utm_medium, utm_campaign FROM clicks
+		WHERE clicked_at >= $1 AND clicked_at < $2 ORDER BY clicked_at, id`,
+		from, to,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c := Click{}
+		if err := rows.Scan(&c.Slug, &c.Timestamp, &c.Referrer, &c.UserAgent, &c.Country, &c.Variant, &c.ReferrerDomain, &c.UTMSource, &c.UTMMedium, &c.UTMCampaign); err != nil {
+			return err
+		}
+
+		if err := fn(&c); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// PurgeClicks removes the clicks recorded before before that have been rolled up, so stats keep
+// counting them. Clicks recorded since the last rollup are left for the next purge.
+func (s *PostgresStore) PurgeClicks(before time.Time) (int, error) {
+	until, err := s.clickRollupEnd()
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := s.db.Exec(`DELETE FROM clicks WHERE clicked_at < $1`, earliest(before, until))
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+
+	return int(n), err
+}
+
+// postgresClickFields are the clicks columns CountClicksBy may group by, utm parameters are not rolled
+// up
+var postgresClickFields = map[string]bool{"utm_source": true, "utm_medium": true, "utm_campaign": true}
+
+// CountClicksBy counts the clicks recorded for slug per value of field. Referrers are counted from the
+// hourly rollups and the clicks recorded since the last rollup, utm parameters from every click.
+func (s *PostgresStore) CountClicksBy(slug, field string) (map[string]int, error) {
+	if field == "referrer" {
+		until, err := s.clickRollupEnd()
+		if err != nil {
+			return nil, err
+		}
+
+		return s.countClicks(
+			`SELECT referrer, SUM(clicks) FROM (`+postgresClickCounts+`) c WHERE referrer <> '' GROUP BY referrer`,
+			slug, until,
+		)
+	}
+
+	if !postgresClickFields[field] {
+		return nil, fmt.Errorf("clicks cannot be counted by %q", field)
+	}
+
+	return s.countClicks(`SELECT `+field+`, COUNT(*) FROM clicks WHERE slug = $1 AND `+field+` <> '' GROUP BY 1`, slug)
+}
+
+// clickRollupEnd returns the time click rollups cover clicks up to, the zero time before the first
+// rollup
+func (s *PostgresStore) clickRollupEnd() (time.Time, error) {
+	until := time.Time{}
+	err := s.db.QueryRow(`SELECT rolled_up_until FROM click_rollup_progress WHERE id = 1`).Scan(&until)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+
+	return until, err
+}
+
+// RolledUpUntil returns the time rollups cover clicks up to, the time of the first click when nothing
+// has been rolled up yet and the zero time when no clicks have been recorded
+func (s *PostgresStore) RolledUpUntil() (time.Time, error) {
+	until, err := s.clickRollupEnd()
+	if err != nil || !until.IsZero() {
+		return until, err
+	}
+
+	first := pq.NullTime{}
+	if err := s.db.QueryRow(`SELECT MIN(clicked_at) FROM clicks`).Scan(&first); err != nil {
+		return time.Time{}, err
+	}
+
+	return first.Time, nil
+}
+
+// RollupClicks replaces the rollups of every hour from from up to before to with counts of the clicks
+// recorded in them and records that rollups cover clicks up to to
+func (s *PostgresStore) RollupClicks(from, to time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// the counts are set rather than incremented so an hour rolled up twice is counted once
+	_, err = tx.Exec(
+		`INSERT INTO click_rollups (slug, hour, referrer, variant, clicks)
+		SELECT slug, date_trunc('hour', clicked_at AT TIME ZONE 'UTC') AT TIME ZONE 'UTC', referrer, variant, COUNT(*)
+		FROM clicks WHERE clicked_at >= $1 AND clicked_at < $2 GROUP BY 1, 2, 3, 4
+		ON CONFLICT (slug, hour, referrer, variant) DO UPDATE SET clicks = EXCLUDED.clicks`,
+		from, to,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO click_rollup_progress (id, rolled_up_until) VALUES (1, $1)
+		ON CONFLICT (id) DO UPDATE SET rolled_up_until = GREATEST(click_rollup_progress.rolled_up_until, EXCLUDED.rolled_up_until)`,
+		to,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// countClicks runs a query returning (key, count) rows and collects them into a map
+func (s *PostgresStore) countClicks(query string, args ...interface{}) (map[string]int, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		key := ""
+		count := 0
+		if err := rows.Scan(&key, &count); err != nil {
+			return nil, err
+		}
+
+		counts[key] = count
+	}
+
+	return counts, rows.Err()
+}
+
+// SaveKey inserts a new api key
+func (s *PostgresStore) SaveKey(k *APIKey) error {
+	_, err := s.db.Exec(
+		`INSERT INTO api_keys (id, name, hash, user_id, created_at, revoked_at, monthly_quota) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		k.ID, k.Name, k.Hash, k.UserID, k.CreatedAt, k.RevokedAt, k.MonthlyQuota,
+	)
+
+	return err
+}
+
+// FindKeyByHash returns the key with the given secret hash or ErrNotFound
+func (s *PostgresStore) FindKeyByHash(hash string) (*APIKey, error) {
+	return s.findKey(`hash = $1`, hash)
+}
+
+// FindKeyByID returns the key with id or ErrNotFound
+func (s *PostgresStore) FindKeyByID(id string) (*APIKey, error) {
+	return s.findKey(`id = $1`, id)
+}
+
+// findKey returns the key matching the where clause or ErrNotFound
+func (s *PostgresStore) findKey(where string, args ...interface{}) (*APIKey, error) {
+	k := APIKey{}
+	err := s.db.QueryRow(
+		`SELECT id, name, hash, user_id, created_at, revoked_at, monthly_quota FROM api_keys WHERE `+where,
+		args...,
+	).Scan(&k.ID, &k.Name, &k.Hash, &k.UserID, &k.CreatedAt, &k.RevokedAt, &k.MonthlyQuota)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+// RevokeKey marks the key with id as revoked or returns ErrNotFound
+func (s *PostgresStore) RevokeKey(id string, at time.Time) error {
+	res, err := s.db.Exec(`UPDATE api_keys SET revoked_at = $1 WHERE id = $2`, at, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// SetKeyQuota changes the monthly quota of the key with id or returns ErrNotFound
+func (s *PostgresStore) SetKeyQuota(id string, quota int) error {
+	res, err := s.db.Exec(`UPDATE api_keys SET monthly_quota = $1 WHERE id = $2`, quota, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// CountUsage adds n to the counter kind, shortens or redirects, of key in month and returns its new
+// value
+func (s *PostgresStore) CountUsage(keyID, month, kind string, n int) (int, error) {
+	if kind != usageShortens && kind != usageRedirects {
+		return 0, fmt.Errorf("unknown usage counter %q", kind)
+	}
+
+	count := 0
+	err := s.db.QueryRow(
+		`INSERT INTO key_usage (key_id, month, `+kind+`) VALUES ($1, $2, $3)
+		ON CONFLICT (key_id, month) DO UPDATE SET `+kind+` = key_usage.`+kind+` + EXCLUDED.`+kind+`
+		RETURNING `+kind,
+		keyID, month, n,
+	).Scan(&count)
+
+	return count, err
+}
+
+// KeyUsage returns the shorten calls and redirects counted for key in month
+func (s *PostgresStore) KeyUsage(keyID, month string) (int, int, error) {
+	shortens, redirects := 0, 0
+	err := s.db.QueryRow(`SELECT shortens, redirects FROM key_usage WHERE key_id = $1 AND month = $2`, keyID, month).
+		Scan(&shortens, &redirects)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, 0, err
+	}
+
+	return shortens, redirects, nil
+}
+
+// SaveUser inserts a new user or returns ErrEmailTaken
+func (s *PostgresStore) SaveUser(u *User) error {
+	_, err := s.db.Exec(
+		`INSERT INTO users (id, email, password_hash, created_at) VALUES ($1, $2, $3, $4)`,
+		u.ID, u.Email, u.PasswordHash, u.CreatedAt,
+	)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return ErrEmailTaken
+	}
+
+	return err
+}
+
+// FindUserByEmail returns the user registered with email or ErrNotFound
+func (s *PostgresStore) FindUserByEmail(email string) (*User, error) {
+	return s.findUser(`email = $1`, email)
+}
+
+// FindUserByID returns the user with id or ErrNotFound
+func (s *PostgresStore) FindUserByID(id string) (*User, error) {
+	return s.findUser(`id = $1`, id)
+}
+
+// findUser returns the single user matching the where clause or ErrNotFound
+func (s *PostgresStore) findUser(where string, arg interface{}) (*User, error) {
+	u := User{}
+	err := s.db.QueryRow(`SELECT id, email, password_hash, created_at FROM users WHERE `+where, arg).
+		Scan(&u.ID, &u.Email, &u.PasswordHash, &u.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// BanDomain records domain as banned
+func (s *PostgresStore) BanDomain(domain string, at time.Time) error {
+	_, err := s.db.Exec(
+		`INSERT INTO banned_domains (domain, banned_at) VALUES ($1, $2) ON CONFLICT (domain) DO NOTHING`,
+		domain, at,
+	)
+
+	return err
+}
+
+// UnbanDomain lifts the ban on domain or returns ErrNotFound
+func (s *PostgresStore) UnbanDomain(domain string) error {
+	res, err := s.db.Exec(`DELETE FROM banned_domains WHERE domain = $1`, domain)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// BannedDomains returns every banned domain
+func (s *PostgresStore) BannedDomains() ([]string, error) {
+	rows, err := s.db.Query(`SELECT domain FROM banned_domains ORDER BY domain`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	domains := []string{}
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			return nil, err
+		}
+
+		domains = append(domains, domain)
+	}
+
+	return domains, rows.Err()
+}
+
+// SaveReport inserts a new report
+func (s *PostgresStore) SaveReport(r *Report) error {
+	_, err := s.db.Exec(
+		`INSERT INTO reports (slug, reason, reporter, created_at) VALUES ($1, $2, $3, $4)`,
+		r.Slug, r.Reason, r.Reporter, r.CreatedAt,
+	)
+
+	return err
+}
+
+// CountReporters returns the number of distinct reporters that have flagged slug
+func (s *PostgresStore) CountReporters(slug string) (int, error) {
+	n := 0
+	err := s.db.QueryRow(`SELECT COUNT(DISTINCT reporter) FROM reports WHERE slug = $1`, slug).Scan(&n)
+
+	return n, err
+}
+
+// ListReports returns a page of reports, newest first, for slug or every url when slug is empty
+func (s *PostgresStore) ListReports(slug string, skip, limit int) ([]Report, int, error) {
+	where, args := ``, []interface{}{}
+	if slug != "" {
+		where, args = `WHERE slug = $1`, append(args, slug)
+	}
+
+	total := 0
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM reports `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query(
+		fmt.Sprintf(`SELECT slug, reason, reporter, created_at FROM reports %s ORDER BY id DESC OFFSET $%d LIMIT $%d`, where, len(args)+1, len(args)+2),
+		append(args, skip, limit)...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	reports := []Report{}
+	for rows.Next() {
+		r := Report{}
+		if err := rows.Scan(&r.Slug, &r.Reason, &r.Reporter, &r.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+
+		reports = append(reports, r)
+	}
+
+	return reports, total, rows.Err()
+}
+
+// DeleteReports dismisses every report for slug
+func (s *PostgresStore) DeleteReports(slug string) error {
+	_, err := s.db.Exec(`DELETE FROM reports WHERE slug = $1`, slug)
+
+	return err
+}
+
+// SaveWebhook inserts a new webhook
+func (s *PostgresStore) SaveWebhook(wh *Webhook) error {
+	_, err := s.db.Exec(
+		`INSERT INTO webhooks (id, owner, url, events, secret, created_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+		wh.ID, wh.Owner, wh.URL, pq.Array(wh.Events), wh.Secret, wh.CreatedAt,
+	)
+
+	return err
+}
+
+// ListWebhooks returns the webhooks of owner, or of every owner when owner is empty, oldest first
+func (s *PostgresStore) ListWebhooks(owner string) ([]Webhook, error) {
+	rows, err := s.db.Query(
+		`SELECT id, owner, url, events, secret, created_at FROM webhooks WHERE $1 = '' OR owner = $1 ORDER BY created_at`,
+		owner,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		wh := Webhook{}
+		if err := rows.Scan(&wh.ID, &wh.Owner, &wh.URL, pq.Array(&wh.Events), &wh.Secret, &wh.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		hooks = append(hooks, wh)
+	}
+
+	return hooks, rows.Err()
+}
+
+// DeleteWebhook removes the webhook of owner with id or returns ErrNotFound
+func (s *PostgresStore) DeleteWebhook(owner, id string) error {
+	res, err := s.db.Exec(`DELETE FROM webhooks WHERE owner = $1 AND id = $2`, owner, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// SaveCampaign inserts a new campaign
+func (s *PostgresStore) SaveCampaign(c *Campaign) error {
+	_, err := s.db.Exec(
+		`INSERT INTO campaigns (id, owner, name, description, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		c.ID, c.Owner, c.Name, c.Description, c.CreatedAt,
+	)
+
+	return err
+}
+
+// ListCampaigns returns the campaigns of owner, oldest first
+func (s *PostgresStore) ListCampaigns(owner string) ([]Campaign, error) {
+	rows, err := s.db.Query(`SELECT id, owner, name, description, created_at FROM campaigns WHERE owner = $1 ORDER BY created_at`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	campaigns := []Campaign{}
+	for rows.Next() {
+		c := Campaign{}
+		if err := rows.Scan(&c.ID, &c.Owner, &c.Name, &c.Description, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		campaigns = append(campaigns, c)
+	}
+
+	return campaigns, rows.Err()
+}
+
+// FindCampaign returns the campaign of owner with id or ErrNotFound
+func (s *PostgresStore) FindCampaign(owner, id string) (*Campaign, error) {
+	c := Campaign{}
+	err := s.db.QueryRow(`SELECT id, owner, name, description, created_at FROM campaigns WHERE owner = $1 AND id = $2`, owner, id).
+		Scan(&c.ID, &c.Owner, &c.Name, &c.Description, &c.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// DeleteCampaign removes the campaign of owner with id or returns ErrNotFound
+func (s *PostgresStore) DeleteCampaign(owner, id string) error {
+	res, err := s.db.Exec(`DELETE FROM campaigns WHERE owner = $1 AND id = $2`, owner, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// SaveOrg inserts a new organization
+func (s *PostgresStore) SaveOrg(o *Organization) error {
+	_, err := s.db.Exec(`INSERT INTO organizations (id, name, created_at) VALUES ($1, $2, $3)`, o.ID, o.Name, o.CreatedAt)
+
+	return err
+}
+
+// FindOrg returns the organization with id or ErrNotFound
+func (s *PostgresStore) FindOrg(id string) (*Organization, error) {
+	o := Organization{}
+	err := s.db.QueryRow(`SELECT id, name, created_at FROM organizations WHERE id = $1`, id).Scan(&o.ID, &o.Name, &o.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return &o, nil
+}
+
+// DeleteOrg removes the organization with id and its members or returns ErrNotFound
+func (s *PostgresStore) DeleteOrg(id string) error {
+	res, err := s.db.Exec(`DELETE FROM organizations WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// SaveMember adds a member to an organization or replaces the membership they have
+func (s *PostgresStore) SaveMember(m *Member) error {
+	_, err := s.db.Exec(
+		`INSERT INTO org_members (org_id, user_id, email, role, added_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (org_id, user_id) DO UPDATE SET email = EXCLUDED.email, role = EXCLUDED.role`,
+		m.OrgID, m.UserID, m.Email, m.Role, m.AddedAt,
+	)
+
+	return err
+}
+
+// FindMember returns the membership of user in org or ErrNotFound
+func (s *PostgresStore) FindMember(orgID, userID string) (*Member, error) {
+	m := Member{}
+	err := s.db.QueryRow(`SELECT org_id, user_id, email, role, added_at FROM org_members WHERE org_id = $1 AND user_id = $2`, orgID, userID).
+		Scan(&m.OrgID, &m.UserID, &m.Email, &m.Role, &m.AddedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// ListMembers returns the members of org, oldest first
+func (s *PostgresStore) ListMembers(orgID string) ([]Member, error) {
+	return s.queryMembers(`SELECT org_id, user_id, email, role, added_at FROM org_members WHERE org_id = $1 ORDER BY added_at`, orgID)
+}
+
+// ListMemberships returns the memberships of user, oldest first
+func (s *PostgresStore) ListMemberships(userID string) ([]Member, error) {
+	return s.queryMembers(`SELECT org_id, user_id, email, role, added_at FROM org_members WHERE user_id = $1 ORDER BY added_at`, userID)
+}
+
+// queryMembers returns the memberships selected by query
+func (s *PostgresStore) queryMembers(query string, args ...interface{}) ([]Member, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []Member{}
+	for rows.Next() {
+		m := Member{}
+		if err := rows.Scan(&m.OrgID, &m.UserID, &m.Email, &m.Role, &m.AddedAt); err != nil {
+			return nil, err
+		}
+
+		members = append(members, m)
+	}
+
+	return members, rows.Err()
+}
+
+// RemoveMember removes user from org or returns ErrNotFound
+func (s *PostgresStore) RemoveMember(orgID, userID string) error {
+	res, err := s.db.Exec(`DELETE FROM org_members WHERE org_id = $1 AND user_id = $2`, orgID, userID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// ClaimIdempotencyKey stores k unless its owner already has an unexpired record under its key, which
+// is returned instead
+func (s *PostgresStore) ClaimIdempotencyKey(k *IdempotencyKey) (*IdempotencyKey, error) {
+	if _, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE owner = $1 AND key = $2 AND expires_at <= now()`, k.Owner, k.Key); err != nil {
+		return nil, err
+	}
+
+	res, err := s.db.Exec(
+		`INSERT INTO idempotency_keys (owner, key, fingerprint, slug, status, expires_at) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (owner, key) DO NOTHING`,
+		k.Owner, k.Key, k.Fingerprint, k.Slug, k.Status, k.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 1 {
+		return nil, nil
+	}
+
+	previous := IdempotencyKey{}
+	err = s.db.QueryRow(`SELECT owner, key, fingerprint, slug, status, expires_at FROM idempotency_keys WHERE owner = $1 AND key = $2`, k.Owner, k.Key).
+		Scan(&previous.Owner, &previous.Key, &previous.Fingerprint, &previous.Slug, &previous.Status, &previous.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &previous, nil
+}
+
+// CompleteIdempotencyKey records the url the request under key of owner created and the status it
+// was responded to with
+func (s *PostgresStore) CompleteIdempotencyKey(owner, key, slug string, status int) error {
+	_, err := s.db.Exec(`UPDATE idempotency_keys SET slug = $3, status = $4 WHERE owner = $1 AND key = $2`, owner, key, slug, status)
+
+	return err
+}
+
+// ReleaseIdempotencyKey removes the record under key of owner
+func (s *PostgresStore) ReleaseIdempotencyKey(owner, key string) error {
+	_, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE owner = $1 AND key = $2`, owner, key)
+
+	return err
+}
+
+// SaveCustomDomain inserts a new custom domain, returning ErrCustomDomainTaken when it has already
+// been registered
+func (s *PostgresStore) SaveCustomDomain(d *CustomDomain) error {
+	_, err := s.db.Exec(
+		`INSERT INTO custom_domains (domain, owner, token, verified_at, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		d.Domain, d.Owner, d.Token, d.VerifiedAt, d.CreatedAt,
+	)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return ErrCustomDomainTaken
+	}
+
+	return err
+}
+
+// FindCustomDomain returns the custom domain named domain or ErrNotFound
+func (s *PostgresStore) FindCustomDomain(domain string) (*CustomDomain, error) {
+	d := CustomDomain{}
+	err := s.db.QueryRow(`SELECT domain, owner, token, verified_at, created_at FROM custom_domains WHERE domain = $1`, domain).
+		Scan(&d.Domain, &d.Owner, &d.Token, &d.VerifiedAt, &d.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// ListCustomDomains returns the custom domains of owner, or of every owner when owner is empty, oldest
+// first
+func (s *PostgresStore) ListCustomDomains(owner string) ([]CustomDomain, error) {
+	rows, err := s.db.Query(
+		`SELECT domain, owner, token, verified_at, created_at FROM custom_domains WHERE $1 = '' OR owner = $1 ORDER BY created_at`,
+		owner,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	domains := []CustomDomain{}
+	for rows.Next() {
+		d := CustomDomain{}
+		if err := rows.Scan(&d.Domain, &d.Owner, &d.Token, &d.VerifiedAt, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		domains = append(domains, d)
+	}
+
+	return domains, rows.Err()
+}
+
+// VerifyCustomDomain records that domain was verified at at or returns ErrNotFound
+func (s *PostgresStore) VerifyCustomDomain(domain string, at time.Time) error {
+	res, err := s.db.Exec(`UPDATE custom_domains SET verified_at = $1 WHERE domain = $2`, at, domain)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// DeleteCustomDomain removes the custom domain of owner named domain or returns ErrNotFound
+func (s *PostgresStore) DeleteCustomDomain(owner, domain string) error {
+	res, err := s.db.Exec(`DELETE FROM custom_domains WHERE owner = $1 AND domain = $2`, owner, domain)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,1746 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	redisURLPrefix        = "url:"
+	redisOriginalPrefix   = "original:"
+	redisURLIndex         = "urls"
+	redisTrashIndex       = "trash"
+	redisClicksPrefix     = "clicks:"
+	redisKeyPrefix        = "apikey:"
+	redisKeyIDPrefix      = "apikeyid:"
+	redisTombstonePrefix  = "tombstone:"
+	redisOwnerPrefix      = "owner:"
+	redisSlugSequence     = "sequence:slug"
+	redisUsesPrefix       = "uses:"
+	redisClickCountPrefix = "clickcount:"
+	redisUserPrefix       = "user:"
+	redisUserEmailPrefix  = "useremail:"
+	redisBannedDomains    = "banned_domains"
+	redisReports          = "reports"
+	redisReportsPrefix    = "reports:"
+	redisWebhookPrefix    = "webhook:"
+	redisWebhooks         = "webhooks"
+	redisWebhooksPrefix   = "webhooks:"
+	redisCampaignPrefix   = "campaign:"
+	redisCampaignsPrefix  = "campaigns:"
+	redisOrgPrefix        = "org:"
+	redisOrgMembersPrefix = "orgmembers:"
+	redisUserOrgsPrefix   = "userorgs:"
+	redisDomainPrefix     = "customdomain:"
+	redisDomains          = "customdomains"
+	redisDomainsPrefix    = "customdomains:"
+	redisIdempotentPrefix = "idempotency:"
+	redisUsagePrefix      = "usage:"
+)
+
+// RedisStore is a Store backed by redis. Each url is stored as json under url:<slug>, the set
+// original:<original_url> indexes slugs by destination and the sorted sets urls and
+// owner:<owner>:urls keep creation order for listing, deleted urls waiting to be purged move to the
+// sorted sets trash and owner:<owner>:trash. Clicks are appended to the list clicks:<slug>
+// with per day and per referrer counters kept alongside in clicks:<slug>:days and
+// clicks:<slug>:referrers, per variant counters in clicks:<slug>:variants and per utm parameter
+// counters in clicks:<slug>:utm_source, clicks:<slug>:utm_medium and clicks:<slug>:utm_campaign, redirects served to
+// bots are only counted per bot in clicks:<slug>:bots and unique visitors are estimated by the
+// HyperLogLog clicks:<slug>:visitors. Urls with an expiry
+// are removed by redis, index entries pointing at them are skipped when read. Api keys are stored
+// as json under apikey:<hash> with apikeyid:<id> pointing at the hash. Deleted slugs that must not
+// be reused are kept as tombstone:<slug>. Visits to urls with max clicks are counted in uses:<slug>
+// and every redirect is counted in clickcount:<slug>. Users are stored as json under user:<id> with
+// useremail:<email> pointing at the id. Domains banned by moderators are members of the set
+// banned_domains. Abuse reports are pushed as json onto the list reports and the per url list
+// reports:<slug>, with reports:<slug>:reporters holding the distinct reporters. Webhooks are stored as
+// json under webhook:<id>, the sorted sets webhooks and webhooks:<owner> keep their creation order.
+// Campaigns are stored as json under campaign:<id> with the sorted set campaigns:<owner> keeping their
+// creation order. Organizations are stored as json under org:<id>, the hash orgmembers:<id> holds the
+// json of each member by user id and the sorted set userorgs:<user> keeps the organizations of a user
+// in the order they joined. Custom domains are stored as json under customdomain:<domain>, the sorted sets
+// customdomains and customdomains:<owner> keep their creation order. Idempotency keys are stored as
+// json under idempotency:<owner>:<key> and removed by redis once they expire. The shorten calls and
+// redirects of an api key in a month are counted in the hash usage:<key id>:<month>.
+type RedisStore struct {
+	pool    *redis.Pool
+	timeout time.Duration
+}
+
+// NewRedisStore connects to the redis instance described by dsn, e.g. redis://:password@host:6379/0.
+// Each url operation is bounded by timeout. At most poolSize connections are opened, operations wait
+// for one to be returned once they all are in use, 0 does not limit them.
+func NewRedisStore(dsn string, timeout time.Duration, poolSize int) (*RedisStore, error) {
+	pool := &redis.Pool{
+		MaxIdle:     defaultIdleConnections,
+		IdleTimeout: storeConnMaxIdle,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(dsn)
+		},
+	}
+
+	if poolSize > 0 {
+		// keeping every connection of a busy pool stops it closing and reopening them under load
+		pool.MaxActive, pool.MaxIdle, pool.Wait = poolSize, poolSize, true
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("PING"); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return &RedisStore{pool: pool, timeout: timeout}, nil
+}
+
+// contextConn is a pooled connection whose commands are cancelled with ctx
+type contextConn struct {
+	redis.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Do sends a command and waits for its reply until ctx is done
+func (c *contextConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return redis.DoContext(c.Conn, c.ctx, cmd, args...)
+}
+
+// Receive waits for the reply to a pipelined command until ctx is done
+func (c *contextConn) Receive() (interface{}, error) {
+	return redis.ReceiveContext(c.Conn, c.ctx)
+}
+
+// Close returns the connection to the pool and releases ctx
+func (c *contextConn) Close() error {
+	err := c.Conn.Close()
+	c.cancel()
+
+	return err
+}
+
+// failedConn reports the error that kept a connection from being taken from the pool
+type failedConn struct {
+	err error
+}
+
+// Close does nothing, no connection was taken
+func (c failedConn) Close() error {
+	return nil
+}
+
+// Err returns the error
+func (c failedConn) Err() error {
+	return c.err
+}
+
+// Do returns the error
+func (c failedConn) Do(string, ...interface{}) (interface{}, error) {
+	return nil, c.err
+}
+
+// Send returns the error
+func (c failedConn) Send(string, ...interface{}) error {
+	return c.err
+}
+
+// Flush returns the error
+func (c failedConn) Flush() error {
+	return c.err
+}
+
+// Receive returns the error
+func (c failedConn) Receive() (interface{}, error) {
+	return nil, c.err
+}
+
+// conn takes a connection from the pool for a single store operation, waiting for it and the
+// commands sent on it are bounded by the store's timeout and cancelled with ctx
+func (s *RedisStore) conn(ctx context.Context) redis.Conn {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		cancel()
+		return failedConn{err: err}
+	}
+
+	return &contextConn{Conn: conn, ctx: ctx, cancel: cancel}
+}
+
+// Close closes the connection pool
+func (s *RedisStore) Close() {
+	s.pool.Close()
+}
+
+// PoolStats returns the state of the connection pool
+func (s *RedisStore) PoolStats() PoolStats {
+	stats := s.pool.Stats()
+
+	return PoolStats{
+		Open:     stats.ActiveCount,
+		InUse:    stats.ActiveCount - stats.IdleCount,
+		Waits:    stats.WaitCount,
+		WaitTime: stats.WaitDuration,
+	}
+}
+
+// Ping checks that redis is reachable
+func (s *RedisStore) Ping(ctx context.Context) error {
+	conn := s.conn(ctx)
+	defer conn.Close()
+
+	_, err := conn.Do("PING")
+
+	return err
+}
+
+// Save inserts a new url document, returning ErrSlugTaken when the slug is already in use
+func (s *RedisStore) Save(ctx context.Context, u *URL) error {
+	conn := s.conn(ctx)
+	defer conn.Close()
+
+	js, err := marshalURL(u)
+	if err != nil {
+		return err
+	}
+
+	reply, err := conn.Do("SET", redisURLPrefix+u.Slug, js, "NX")
+	if err != nil {
+		return err
+	}
+
+	if reply == nil {
+		return ErrSlugTaken
+	}
+
+	conn.Send("MULTI")
+	if u.ExpiresAt != nil {
+		conn.Send("PEXPIREAT", redisURLPrefix+u.Slug, u.ExpiresAt.UnixNano()/int64(time.Millisecond))
+	}
+	conn.Send("SADD", redisOriginalPrefix+u.OriginalURL, u.Slug)
+	conn.Send("ZADD", redisURLIndex, time.Now().UnixNano(), u.Slug)
+	conn.Send("ZADD", redisOwnerIndex(u.Owner), time.Now().UnixNano(), u.Slug)
+	_, err = conn.Do("EXEC")
+
+	return err
+}
+
+// SaveMany inserts urls with a single pipeline of SET NX commands followed by one transaction that
+// indexes the urls that were stored
+func (s *RedisStore) SaveMany(ctx context.Context, urls []*URL) []error {
+	conn := s.conn(ctx)
+	defer conn.Close()
+
+	errs := make([]error, len(urls))
+	sent := make([]bool, len(urls))
+
+	for i, u := range urls {
+		js, err := marshalURL(u)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		conn.Send("SET", redisURLPrefix+u.Slug, js, "NX")
+		sent[i] = true
+	}
+
+	if err := conn.Flush(); err != nil {
+		return batchErrors(len(urls), err)
+	}
+
+	for i := range urls {
+		if !sent[i] {
+			continue
+		}
+
+		reply, err := conn.Receive()
+		if err != nil {
+			errs[i] = err
+		} else if reply == nil {
+			errs[i] = ErrSlugTaken
+		}
+	}
+
+	now := time.Now().UnixNano()
+
+	conn.Send("MULTI")
+	for i, u := range urls {
+		if errs[i] != nil {
+			continue
+		}
+
+		if u.ExpiresAt != nil {
+			conn.Send("PEXPIREAT", redisURLPrefix+u.Slug, u.ExpiresAt.UnixNano()/int64(time.Millisecond))
+		}
+		conn.Send("SADD", redisOriginalPrefix+u.OriginalURL, u.Slug)
+		conn.Send("ZADD", redisURLIndex, now, u.Slug)
+		conn.Send("ZADD", redisOwnerIndex(u.Owner), now, u.Slug)
+	}
+
+	if _, err := conn.Do("EXEC"); err != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+
+	return errs
+}
+
+// NextSequence atomically increments and returns the slug sequence, starting at 1
+func (s *RedisStore) NextSequence() (uint64, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return redis.Uint64(conn.Do("INCR", redisSlugSequence))
+}
+
+// ReserveSequence reserves the next n values of the slug sequence with a single INCRBY
+func (s *RedisStore) ReserveSequence(n int) ([]uint64, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	last, err := redis.Uint64(conn.Do("INCRBY", redisSlugSequence, n))
+	if err != nil {
+		return nil, err
+	}
+
+	return consecutive(last-uint64(n)+1, n), nil
+}
+
+// ExistingSlugs returns which of slugs are in use or tombstoned, checking them in one pipeline
+func (s *RedisStore) ExistingSlugs(slugs []string) (map[string]bool, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	for _, slug := range slugs {
+		conn.Send("EXISTS", redisURLPrefix+slug, redisTombstonePrefix+slug)
+	}
+
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	existing := map[string]bool{}
+	for _, slug := range slugs {
+		n, err := redis.Int(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+
+		if n > 0 {
+			existing[slug] = true
+		}
+	}
+
+	return existing, nil
+}
+
+// Update replaces the url stored under u.Slug or returns ErrNotFound
+func (s *RedisStore) Update(ctx context.Context, u *URL) error {
+	existing, err := s.FindBySlug(ctx, u.Slug)
+	if err != nil {
+		return err
+	}
+
+	js, err := marshalURL(u)
+	if err != nil {
+		return err
+	}
+
+	conn := s.conn(ctx)
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("SET", redisURLPrefix+u.Slug, js, "XX")
+	if u.ExpiresAt != nil {
+		conn.Send("PEXPIREAT", redisURLPrefix+u.Slug, u.ExpiresAt.UnixNano()/int64(time.Millisecond))
+	}
+	conn.Send("SREM", redisOriginalPrefix+existing.OriginalURL, u.Slug)
+	conn.Send("SADD", redisOriginalPrefix+u.OriginalURL, u.Slug)
+	if u.Deleted() && !existing.Deleted() {
+		conn.Send("ZREM", redisURLIndex, u.Slug)
+		conn.Send("ZREM", redisOwnerIndex(u.Owner), u.Slug)
+		conn.Send("ZADD", redisTrashIndex, u.DeletedAt.UnixNano(), u.Slug)
+		conn.Send("ZADD", redisOwnerTrash(u.Owner), u.DeletedAt.UnixNano(), u.Slug)
+	} else if !u.Deleted() && existing.Deleted() {
+		conn.Send("ZREM", redisTrashIndex, u.Slug)
+		conn.Send("ZREM", redisOwnerTrash(u.Owner), u.Slug)
+		conn.Send("ZADD", redisURLIndex, u.CreatedAt.UnixNano(), u.Slug)
+		conn.Send("ZADD", redisOwnerIndex(u.Owner), u.CreatedAt.UnixNano(), u.Slug)
+	}
+	_, err = conn.Do("EXEC")
+
+	return err
+}
+
+// ResolveSlug returns the url stored under slug for a redirect or ErrNotFound
+func (s *RedisStore) ResolveSlug(ctx context.Context, slug string) (*URL, error) {
+	return s.FindBySlug(ctx, slug)
+}
+
+// FindBySlug returns the url stored under slug or ErrNotFound
+func (s *RedisStore) FindBySlug(ctx context.Context, slug string) (*URL, error) {
+	conn := s.conn(ctx)
+	defer conn.Close()
+
+	values, err := redis.Values(conn.Do("MGET", redisURLPrefix+slug, redisClickCountPrefix+slug))
+	if err != nil {
+		return nil, err
+	}
+
+	js, _ := values[0].([]byte)
+	if js == nil {
+		return nil, ErrNotFound
+	}
+
+	u := URL{Slug: slug}
+	if err := unmarshalURL(js, &u); err != nil {
+		return nil, err
+	}
+	u.Clicks, _ = redis.Int(values[1], nil)
+
+	return &u, nil
+}
+
+// FindByOriginalURL returns a url owned by owner without an expiry that has not been deleted pointing
+// at original or ErrNotFound
+func (s *RedisStore) FindByOriginalURL(ctx context.Context, owner, original string) (*URL, error) {
+	conn := s.conn(ctx)
+	slugs, err := redis.Strings(conn.Do("SMEMBERS", redisOriginalPrefix+original))
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, slug := range slugs {
+		u, err := s.FindBySlug(ctx, slug)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if u.Owner == owner && u.ExpiresAt == nil && !u.Deleted() {
+			return u, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// Exists reports whether a url has already been stored under slug, including deleted urls that left
+// a tombstone
+func (s *RedisStore) Exists(ctx context.Context, slug string) (bool, error) {
+	conn := s.conn(ctx)
+	defer conn.Close()
+
+	n, err := redis.Int(conn.Do("EXISTS", redisURLPrefix+slug, redisTombstonePrefix+slug))
+
+	return n > 0, err
+}
+
+// Delete removes the url stored under slug or returns ErrNotFound. When tombstone is set the slug is
+// recorded so it is never reused.
+func (s *RedisStore) Delete(ctx context.Context, slug string, tombstone bool) error {
+	u, err := s.FindBySlug(ctx, slug)
+	if err != nil {
+		return err
+	}
+
+	conn := s.conn(ctx)
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("DEL", redisURLPrefix+slug)
+	conn.Send("SREM", redisOriginalPrefix+u.OriginalURL, slug)
+	conn.Send("ZREM", redisURLIndex, slug)
+	conn.Send("ZREM", redisOwnerIndex(u.Owner), slug)
+	conn.Send("ZREM", redisTrashIndex, slug)
+	conn.Send("ZREM", redisOwnerTrash(u.Owner), slug)
+	conn.Send("DEL", redisUsesPrefix+slug, redisClickCountPrefix+slug)
+	if tombstone {
+		conn.Send("SET", redisTombstonePrefix+slug, time.Now().UTC().Format(time.RFC3339))
+	}
+	_, err = conn.Do("EXEC")
+
+	return err
+}
+
+// IncrementUses atomically counts a visit to slug
+func (s *RedisStore) IncrementUses(ctx context.Context, slug string) (int, error) {
+	conn := s.conn(ctx)
+	defer conn.Close()
+
+	return redis.Int(conn.Do("INCR", redisUsesPrefix+slug))
+}
+
+// IncrementClicks atomically counts a redirect through slug
+func (s *RedisStore) IncrementClicks(ctx context.Context, slug string) (int, error) {
+	conn := s.conn(ctx)
+	defer conn.Close()
+
+	return redis.Int(conn.Do("INCR", redisClickCountPrefix+slug))
+}
+
+// List returns the page of urls selected by q and the total number of urls the owner has. Urls
+// listed by creation date are paged by redis, any other order, a search or a tag loads all of the
+// owner's urls.
+func (s *RedisStore) List(ctx context.Context, q ListQuery) ([]URL, int, error) {
+	conn := s.conn(ctx)
+	defer conn.Close()
+
+	index := redisOwnerIndex(q.Owner)
+	switch {
+	case q.AllOwners && q.Deleted:
+		index = redisTrashIndex
+	case q.AllOwners:
+		index = redisURLIndex
+	case q.Deleted:
+		index = redisOwnerTrash(q.Owner)
+	}
+
+	total, err := redis.Int(conn.Do("ZCARD", index))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	field, desc := q.sortField()
+	if field == "created_at" && !q.filtered() {
+		command := "ZRANGE"
+		if desc {
+			command = "ZREVRANGE"
+		}
+
+		slugs, err := redis.Strings(conn.Do(command, index, q.Skip, q.Skip+q.Limit-1))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		urls, err := s.loadURLs(conn, slugs)
+
+		return urls, total, err
+	}
+
+	slugs, err := redis.Strings(conn.Do("ZRANGE", index, 0, -1))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	urls, err := s.loadURLs(conn, slugs)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if q.filtered() {
+		urls = searchURLs(urls, q)
+		total = len(urls)
+	}
+
+	sortURLs(urls, q)
+
+	return pageURLs(urls, q), total, nil
+}
+
+// loadURLs fetches the urls stored under slugs, skipping any that have expired
+func (s *RedisStore) loadURLs(conn redis.Conn, slugs []string) ([]URL, error) {
+	urls := []URL{}
+	if len(slugs) == 0 {
+		return urls, nil
+	}
+
+	keys := make([]interface{}, len(slugs))
+	counts := make([]interface{}, len(slugs))
+	for i, slug := range slugs {
+		keys[i] = redisURLPrefix + slug
+		counts[i] = redisClickCountPrefix + slug
+	}
+
+	docs, err := redis.ByteSlices(conn.Do("MGET", keys...))
+	if err != nil {
+		return nil, err
+	}
+
+	clicks, err := redis.Values(conn.Do("MGET", counts...))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, js := range docs {
+		if js == nil {
+			continue
+		}
+
+		u := URL{Slug: slugs[i]}
+		if err := unmarshalURL(js, &u); err != nil {
+			return nil, err
+		}
+		u.Clicks, _ = redis.Int(clicks[i], nil)
+
+		urls = append(urls, u)
+	}
+
+	return urls, nil
+}
+
+// redisOwnerIndex is the key of the sorted set listing the slugs created by owner
+func redisOwnerIndex(owner string) string {
+	return redisOwnerPrefix + owner + ":urls"
+}
+
+// redisOwnerTrash is the key of the sorted set listing the deleted slugs of owner
+func redisOwnerTrash(owner string) string {
+	return redisOwnerPrefix + owner + ":trash"
+}
+
+// RecordClick stores a single redirect
+func (s *RedisStore) RecordClick(c *Click) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	js, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	key := redisClicksPrefix + c.Slug
+
+	conn.Send("MULTI")
+	conn.Send("RPUSH", key, js)
+	conn.Send("HINCRBY", key+":days", c.Timestamp.UTC().Format(statsDayFormat), 1)
+	if c.Referrer != "" {
+		conn.Send("ZINCRBY", key+":referrers", 1, c.Referrer)
+	}
+	if c.Variant != "" {
+		conn.Send("HINCRBY", key+":variants", c.Variant, 1)
+	}
+	for field, value := range map[string]string{"utm_source": c.UTMSource, "utm_medium": c.UTMMedium, "utm_campaign": c.UTMCampaign} {
+		if value != "" {
+			conn.Send("ZINCRBY", key+":"+field, 1, value)
+		}
+	}
+	_, err = conn.Do("EXEC")
+
+	return err
+}
+
+// Stats summarises the clicks recorded for slug
+func (s *RedisStore) Stats(slug string) (*Stats, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	key := redisClicksPrefix + slug
+
+	total, err := redis.Int(conn.Do("LLEN", key))
+	if err != nil {
+		return nil, err
+	}
+
+	days, err := redis.IntMap(conn.Do("HGETALL", key+":days"))
+	if err != nil {
+		return nil, err
+	}
+
+	referrers, err := redis.IntMap(conn.Do("ZREVRANGE", key+":referrers", 0, statsTopReferrers-1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+
+	variants, err := redis.IntMap(conn.Do("HGETALL", key+":variants"))
+	if err != nil {
+		return nil, err
+	}
+
+	return newStats(slug, total, days, referrers, variants), nil
+}
+
+// redisClickBatch is the number of clicks read from a click list at a time
+const redisClickBatch = 1000
+
+// eachClick calls fn with every click recorded for slug, oldest first, until fn returns false
+func (s *RedisStore) eachClick(slug string, fn func(c *Click) bool) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	for start := 0; ; start += redisClickBatch {
+		docs, err := redis.ByteSlices(conn.Do("LRANGE", redisClicksPrefix+slug, start, start+redisClickBatch-1))
+		if err != nil {
+			return err
+		}
+
+		for _, js := range docs {
+			c := Click{}
+			if err := json.Unmarshal(js, &c); err != nil {
+				return err
+			}
+
+			if !fn(&c) {
+				return nil
+			}
+		}
+
+		if len(docs) < redisClickBatch {
+			return nil
+		}
+	}
+}
+
+// Clicks returns a page of the clicks recorded for slug from from up to before to, oldest first. The
+// click list is read from its start, it is not indexed by time.
+func (s *RedisStore) Clicks(slug string, from, to time.Time, skip, limit int) ([]Click, error) {
+	clicks := []Click{}
+	err := s.eachClick(slug, func(c *Click) bool {
+		if c.Timestamp.Before(from) || !c.Timestamp.Before(to) {
+			return true
+		}
+
+		if skip > 0 {
+			skip--
+			return true
+		}
+
+		clicks = append(clicks, *c)
+
+		return len(clicks) < limit
+	})
+
+	return clicks, err
+}
+
+// HourlyClicks counts the clicks recorded for slug in every hour from from up to before to, reading
+// the whole click list
+func (s *RedisStore) HourlyClicks(slug string, from, to time.Time) (map[int64]int, error) {
+	hours := map[int64]int{}
+	err := s.eachClick(slug, func(c *Click) bool {
+		if !c.Timestamp.Before(from) && c.Timestamp.Before(to) {
+			hours[c.Timestamp.UTC().Truncate(time.Hour).Unix()]++
+		}
+
+		return true
+	})
+
+	return hours, err
+}
+
+// RecordBotClick counts a redirect through slug served to bot
+func (s *RedisStore) RecordBotClick(slug, bot string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HINCRBY", redisClicksPrefix+slug+":bots", bot, 1)
+
+	return err
+}
+
+// BotClicks returns the redirects through slug served to bots, per bot
+func (s *RedisStore) BotClicks(slug string) (map[string]int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return redis.IntMap(conn.Do("HGETALL", redisClicksPrefix+slug+":bots"))
+}
+
+// AddVisitor adds the hash of a visitor to the unique visitor sketch of slug, a HyperLogLog redis
+// keeps itself
+func (s *RedisStore) AddVisitor(slug string, visitor uint64) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PFADD", redisClicksPrefix+slug+":visitors", strconv.FormatUint(visitor, 16))
+
+	return err
+}
+
+// UniqueVisitors estimates the number of distinct visitors to slug
+func (s *RedisStore) UniqueVisitors(slug string) (int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return redis.Int(conn.Do("PFCOUNT", redisClicksPrefix+slug+":visitors"))
+}
+
+// PurgeClicks removes the clicks recorded before before from the click list of every slug, stats are
+// read from counters that keep counting them
+func (s *RedisStore) PurgeClicks(before time.Time) (int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	purged := 0
+	err := s.eachClickList(func(slug string) error {
+		// clicks are appended as they are recorded, the old ones are at the start of the list
+		n := 0
+		err := s.eachClick(slug, func(c *Click) bool {
+			if !c.Timestamp.Before(before) {
+				return false
+			}
+
+			n++
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		if n > 0 {
+			if _, err := conn.Do("LTRIM", redisClicksPrefix+slug, n, -1); err != nil {
+				return err
+			}
+			purged += n
+		}
+
+		return nil
+	})
+
+	return purged, err
+}
+
+// EachClick calls fn with every click recorded from from up to before to, reading each click list up
+// to the first click recorded after to
+func (s *RedisStore) EachClick(from, to time.Time, fn func(c *Click) error) error {
+	return s.eachClickList(func(slug string) error {
+		var err error
+		readErr := s.eachClick(slug, func(c *Click) bool {
+			if !c.Timestamp.Before(to) {
+				return false
+			}
+
+			if !c.Timestamp.Before(from) {
+				err = fn(c)
+			}
+
+			return err == nil
+		})
+		if readErr != nil {
+			return readErr
+		}
+
+		return err
+	})
+}
+
+// eachClickList calls fn with the slug of every click list, stopping at the first error
+func (s *RedisStore) eachClickList(fn func(slug string) error) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	for cursor := 0; ; {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", redisClicksPrefix+"*", "COUNT", redisClickBatch))
+		if err != nil {
+			return err
+		}
+
+		keys := []string{}
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			// the counters kept alongside a click list are named clicks:<slug>:<counter>
+			slug := strings.TrimPrefix(key, redisClicksPrefix)
+			if strings.Contains(slug, ":") {
+				continue
+			}
+
+			if err := fn(slug); err != nil {
+				return err
+			}
+		}
+
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// CountClicksBy counts the clicks recorded for slug per value of field from its counters, clicks
+// recorded before utm counters were kept are not counted
+func (s *RedisStore) CountClicksBy(slug, field string) (map[string]int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	key := redisClicksPrefix + slug + ":" + field
+	if field == "referrer" {
+		key = redisClicksPrefix + slug + ":referrers"
+	}
+
+	return redis.IntMap(conn.Do("ZRANGE", key, 0, -1, "WITHSCORES"))
+}
+
+// SaveKey inserts a new api key
+func (s *RedisStore) SaveKey(k *APIKey) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	js, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("SET", redisKeyPrefix+k.Hash, js)
+	conn.Send("SET", redisKeyIDPrefix+k.ID, k.Hash)
+	_, err = conn.Do("EXEC")
+
+	return err
+}
+
+// FindKeyByHash returns the key with the given secret hash or ErrNotFound
+func (s *RedisStore) FindKeyByHash(hash string) (*APIKey, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	js, err := redis.Bytes(conn.Do("GET", redisKeyPrefix+hash))
+	if err != nil {
+		if err == redis.ErrNil {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	k := APIKey{Hash: hash}
+	if err := json.Unmarshal(js, &k); err != nil {
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+// RevokeKey marks the key with id as revoked or returns ErrNotFound
+func (s *RedisStore) RevokeKey(id string, at time.Time) error {
+	conn := s.pool.Get()
+	hash, err := redis.String(conn.Do("GET", redisKeyIDPrefix+id))
+	conn.Close()
+	if err != nil {
+		if err == redis.ErrNil {
+			return ErrNotFound
+		}
+
+		return err
+	}
+
+	k, err := s.FindKeyByHash(hash)
+	if err != nil {
+		return err
+	}
+
+	k.RevokedAt = &at
+
+	return s.SaveKey(k)
+}
+
+// FindKeyByID returns the key with id or ErrNotFound
+func (s *RedisStore) FindKeyByID(id string) (*APIKey, error) {
+	conn := s.pool.Get()
+	hash, err := redis.String(conn.Do("GET", redisKeyIDPrefix+id))
+	conn.Close()
+	if err != nil {
+		if err == redis.ErrNil {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return s.FindKeyByHash(hash)
+}
+
+// SetKeyQuota changes the monthly quota of the key with id or returns ErrNotFound
+func (s *RedisStore) SetKeyQuota(id string, quota int) error {
+	k, err := s.FindKeyByID(id)
+	if err != nil {
+		return err
+	}
+
+	k.MonthlyQuota = quota
+
+	return s.SaveKey(k)
+}
+
+// CountUsage adds n to the counter kind, shortens or redirects, of key in month and returns its new
+// value
+func (s *RedisStore) CountUsage(keyID, month, kind string, n int) (int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return redis.Int(conn.Do("HINCRBY", redisUsagePrefix+keyID+":"+month, kind, n))
+}
+
+// KeyUsage returns the shorten calls and redirects counted for key in month
+func (s *RedisStore) KeyUsage(keyID, month string) (int, int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	counts, err := redis.IntMap(conn.Do("HGETALL", redisUsagePrefix+keyID+":"+month))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return counts[usageShortens], counts[usageRedirects], nil
+}
+
+// SaveUser inserts a new user or returns ErrEmailTaken
+func (s *RedisStore) SaveUser(u *User) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	js, err := marshalUser(u)
+	if err != nil {
+		return err
+	}
+
+	reply, err := conn.Do("SET", redisUserEmailPrefix+u.Email, u.ID, "NX")
+	if err != nil {
+		return err
+	}
+
+	if reply == nil {
+		return ErrEmailTaken
+	}
+
+	_, err = conn.Do("SET", redisUserPrefix+u.ID, js)
+
+	return err
+}
+
+// FindUserByEmail returns the user registered with email or ErrNotFound
+func (s *RedisStore) FindUserByEmail(email string) (*User, error) {
+	conn := s.pool.Get()
+	id, err := redis.String(conn.Do("GET", redisUserEmailPrefix+email))
+	conn.Close()
+	if err != nil {
+		if err == redis.ErrNil {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return s.FindUserByID(id)
+}
+
+// FindUserByID returns the user with id or ErrNotFound
+func (s *RedisStore) FindUserByID(id string) (*User, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	js, err := redis.Bytes(conn.Do("GET", redisUserPrefix+id))
+	if err != nil {
+		if err == redis.ErrNil {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	u := User{}
+	if err := unmarshalUser(js, &u); err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// BanDomain records domain as banned
+func (s *RedisStore) BanDomain(domain string, at time.Time) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SADD", redisBannedDomains, domain)
+
+	return err
+}
+
+// UnbanDomain lifts the ban on domain or returns ErrNotFound
+func (s *RedisStore) UnbanDomain(domain string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(conn.Do("SREM", redisBannedDomains, domain))
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// BannedDomains returns every banned domain
+func (s *RedisStore) BannedDomains() ([]string, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	domains, err := redis.Strings(conn.Do("SMEMBERS", redisBannedDomains))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(domains)
+
+	return domains, nil
+}
+
+// SaveReport inserts a new report
+func (s *RedisStore) SaveReport(r *Report) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	js, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("LPUSH", redisReports, js)
+	conn.Send("LPUSH", redisReportsPrefix+r.Slug, js)
+	conn.Send("SADD", redisReportsPrefix+r.Slug+":reporters", r.Reporter)
+	_, err = conn.Do("EXEC")
+
+	return err
+}
+
+// CountReporters returns the number of distinct reporters that have flagged slug
+func (s *RedisStore) CountReporters(slug string) (int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return redis.Int(conn.Do("SCARD", redisReportsPrefix+slug+":reporters"))
+}
+
+// ListReports returns a page of reports, newest first, for slug or every url when slug is empty
+func (s *RedisStore) ListReports(slug string, skip, limit int) ([]Report, int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	list := redisReports
+	if slug != "" {
+		list = redisReportsPrefix + slug
+	}
+
+	total, err := redis.Int(conn.Do("LLEN", list))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	docs, err := redis.ByteSlices(conn.Do("LRANGE", list, skip, skip+limit-1))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	reports := make([]Report, len(docs))
+	for i, js := range docs {
+		if err := json.Unmarshal(js, &reports[i]); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return reports, total, nil
+}
+
+// DeleteReports dismisses every report for slug
+func (s *RedisStore) DeleteReports(slug string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	docs, err := redis.ByteSlices(conn.Do("LRANGE", redisReportsPrefix+slug, 0, -1))
+	if err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	for _, js := range docs {
+		conn.Send("LREM", redisReports, 1, js)
+	}
+	conn.Send("DEL", redisReportsPrefix+slug, redisReportsPrefix+slug+":reporters")
+	_, err = conn.Do("EXEC")
+
+	return err
+}
+
+// SaveWebhook inserts a new webhook
+func (s *RedisStore) SaveWebhook(wh *Webhook) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	js, err := marshalWebhook(wh)
+	if err != nil {
+		return err
+	}
+
+	score := wh.CreatedAt.UnixNano()
+
+	conn.Send("MULTI")
+	conn.Send("SET", redisWebhookPrefix+wh.ID, js)
+	conn.Send("ZADD", redisWebhooks, score, wh.ID)
+	conn.Send("ZADD", redisWebhooksPrefix+wh.Owner, score, wh.ID)
+	_, err = conn.Do("EXEC")
+
+	return err
+}
+
+// ListWebhooks returns the webhooks of owner, or of every owner when owner is empty, oldest first
+func (s *RedisStore) ListWebhooks(owner string) ([]Webhook, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	index := redisWebhooks
+	if owner != "" {
+		index = redisWebhooksPrefix + owner
+	}
+
+	ids, err := redis.Strings(conn.Do("ZRANGE", index, 0, -1))
+	if err != nil || len(ids) == 0 {
+		return []Webhook{}, err
+	}
+
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = redisWebhookPrefix + id
+	}
+
+	docs, err := redis.ByteSlices(conn.Do("MGET", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := []Webhook{}
+	for _, js := range docs {
+		if js == nil {
+			continue
+		}
+
+		wh := Webhook{}
+		if err := unmarshalWebhook(js, &wh); err != nil {
+			return nil, err
+		}
+
+		hooks = append(hooks, wh)
+	}
+
+	return hooks, nil
+}
+
+// DeleteWebhook removes the webhook of owner with id or returns ErrNotFound
+func (s *RedisStore) DeleteWebhook(owner, id string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(conn.Do("ZREM", redisWebhooksPrefix+owner, id))
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	conn.Send("MULTI")
+	conn.Send("ZREM", redisWebhooks, id)
+	conn.Send("DEL", redisWebhookPrefix+id)
+	_, err = conn.Do("EXEC")
+
+	return err
+}
+
+// SaveCampaign inserts a new campaign
+func (s *RedisStore) SaveCampaign(c *Campaign) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	js, err := marshalCampaign(c)
+	if err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("SET", redisCampaignPrefix+c.ID, js)
+	conn.Send("ZADD", redisCampaignsPrefix+c.Owner, c.CreatedAt.UnixNano(), c.ID)
+	_, err = conn.Do("EXEC")
+
+	return err
+}
+
+// ListCampaigns returns the campaigns of owner, oldest first
+func (s *RedisStore) ListCampaigns(owner string) ([]Campaign, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	ids, err := redis.Strings(conn.Do("ZRANGE", redisCampaignsPrefix+owner, 0, -1))
+	if err != nil || len(ids) == 0 {
+		return []Campaign{}, err
+	}
+
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = redisCampaignPrefix + id
+	}
+
+	docs, err := redis.ByteSlices(conn.Do("MGET", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	campaigns := []Campaign{}
+	for _, js := range docs {
+		if js == nil {
+			continue
+		}
+
+		c := Campaign{}
+		if err := unmarshalCampaign(js, &c); err != nil {
+			return nil, err
+		}
+
+		campaigns = append(campaigns, c)
+	}
+
+	return campaigns, nil
+}
+
+// FindCampaign returns the campaign of owner with id or ErrNotFound
+func (s *RedisStore) FindCampaign(owner, id string) (*Campaign, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	js, err := redis.Bytes(conn.Do("GET", redisCampaignPrefix+id))
+	if err != nil {
+		if err == redis.ErrNil {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	c := Campaign{}
+	if err := unmarshalCampaign(js, &c); err != nil {
+		return nil, err
+	}
+
+	// other owners' campaigns are reported as missing
+	if c.Owner != owner {
+		return nil, ErrNotFound
+	}
+
+	return &c, nil
+}
+
+// DeleteCampaign removes the campaign of owner with id or returns ErrNotFound
+func (s *RedisStore) DeleteCampaign(owner, id string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(conn.Do("ZREM", redisCampaignsPrefix+owner, id))
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	_, err = conn.Do("DEL", redisCampaignPrefix+id)
+
+	return err
+}
+
+// SaveOrg inserts a new organization
+func (s *RedisStore) SaveOrg(o *Organization) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	js, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("SET", redisOrgPrefix+o.ID, js)
+
+	return err
+}
+
+// FindOrg returns the organization with id or ErrNotFound
+func (s *RedisStore) FindOrg(id string) (*Organization, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	js, err := redis.Bytes(conn.Do("GET", redisOrgPrefix+id))
+	if err != nil {
+		if err == redis.ErrNil {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	o := Organization{}
+	if err := json.Unmarshal(js, &o); err != nil {
+		return nil, err
+	}
+
+	return &o, nil
+}
+
+// DeleteOrg removes the organization with id and its members or returns ErrNotFound
+func (s *RedisStore) DeleteOrg(id string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	users, err := redis.Strings(conn.Do("HKEYS", redisOrgMembersPrefix+id))
+	if err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("DEL", redisOrgPrefix+id, redisOrgMembersPrefix+id)
+	for _, user := range users {
+		conn.Send("ZREM", redisUserOrgsPrefix+user, id)
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+
+	if n, _ := redis.Int(replies[0], nil); n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// SaveMember adds a member to an organization or replaces the membership they have
+func (s *RedisStore) SaveMember(m *Member) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	js, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("HSET", redisOrgMembersPrefix+m.OrgID, m.UserID, js)
+	conn.Send("ZADD", redisUserOrgsPrefix+m.UserID, m.AddedAt.UnixNano(), m.OrgID)
+	_, err = conn.Do("EXEC")
+
+	return err
+}
+
+// FindMember returns the membership of user in org or ErrNotFound
+func (s *RedisStore) FindMember(orgID, userID string) (*Member, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	js, err := redis.Bytes(conn.Do("HGET", redisOrgMembersPrefix+orgID, userID))
+	if err != nil {
+		if err == redis.ErrNil {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	m := Member{}
+	if err := json.Unmarshal(js, &m); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// ListMembers returns the members of org, oldest first
+func (s *RedisStore) ListMembers(orgID string) ([]Member, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	docs, err := redis.ByteSlices(conn.Do("HVALS", redisOrgMembersPrefix+orgID))
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalMembers(docs)
+}
+
+// ListMemberships returns the memberships of user, oldest first
+func (s *RedisStore) ListMemberships(userID string) ([]Member, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	ids, err := redis.Strings(conn.Do("ZRANGE", redisUserOrgsPrefix+userID, 0, -1))
+	if err != nil || len(ids) == 0 {
+		return []Member{}, err
+	}
+
+	conn.Send("MULTI")
+	for _, id := range ids {
+		conn.Send("HGET", redisOrgMembersPrefix+id, userID)
+	}
+	docs, err := redis.ByteSlices(conn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalMembers(docs)
+}
+
+// RemoveMember removes user from org or returns ErrNotFound
+func (s *RedisStore) RemoveMember(orgID, userID string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("HDEL", redisOrgMembersPrefix+orgID, userID)
+	conn.Send("ZREM", redisUserOrgsPrefix+userID, orgID)
+	n, err := redis.Ints(conn.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+
+	if n[0] == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// unmarshalMembers decodes the json of members, skipping missing ones, oldest first
+func unmarshalMembers(docs [][]byte) ([]Member, error) {
+	members := []Member{}
+	for _, js := range docs {
+		if js == nil {
+			continue
+		}
+
+		m := Member{}
+		if err := json.Unmarshal(js, &m); err != nil {
+			return nil, err
+		}
+
+		members = append(members, m)
+	}
+
+	sort.Slice(members, func(i, j int) bool { return members[i].AddedAt.Before(members[j].AddedAt) })
+
+	return members, nil
+}
+
+// ClaimIdempotencyKey stores k unless its owner already has an unexpired record under its key, which
+// is returned instead
+func (s *RedisStore) ClaimIdempotencyKey(k *IdempotencyKey) (*IdempotencyKey, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	js, err := json.Marshal(k)
+	if err != nil {
+		return nil, err
+	}
+
+	key := redisIdempotentPrefix + k.Owner + ":" + k.Key
+	ttl := int(time.Until(k.ExpiresAt).Seconds()) + 1
+	if _, err := redis.String(conn.Do("SET", key, js, "NX", "EX", ttl)); err == nil {
+		return nil, nil
+	} else if err != redis.ErrNil {
+		return nil, err
+	}
+
+	js, err = redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		// it expired in between, the caller may retry
+		return nil, ErrStoreUnavailable
+	} else if err != nil {
+		return nil, err
+	}
+
+	previous := IdempotencyKey{}
+	if err := json.Unmarshal(js, &previous); err != nil {
+		return nil, err
+	}
+
+	return &previous, nil
+}
+
+// CompleteIdempotencyKey records the url the request under key of owner created and the status it
+// was responded to with
+func (s *RedisStore) CompleteIdempotencyKey(owner, key, slug string, status int) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	js, err := redis.Bytes(conn.Do("GET", redisIdempotentPrefix+owner+":"+key))
+	if err == redis.ErrNil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	k := IdempotencyKey{}
+	if err := json.Unmarshal(js, &k); err != nil {
+		return err
+	}
+
+	k.Slug, k.Status = slug, status
+	if js, err = json.Marshal(k); err != nil {
+		return err
+	}
+
+	ttl := int(time.Until(k.ExpiresAt).Seconds()) + 1
+	_, err = conn.Do("SET", redisIdempotentPrefix+owner+":"+key, js, "XX", "EX", ttl)
+
+	return err
+}
+
+// ReleaseIdempotencyKey removes the record under key of owner
+func (s *RedisStore) ReleaseIdempotencyKey(owner, key string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", redisIdempotentPrefix+owner+":"+key)
+
+	return err
+}
+
+// SaveCustomDomain inserts a new custom domain, returning ErrCustomDomainTaken when it has already
+// been registered
+func (s *RedisStore) SaveCustomDomain(d *CustomDomain) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	js, err := marshalCustomDomain(d)
+	if err != nil {
+		return err
+	}
+
+	if _, err := redis.String(conn.Do("SET", redisDomainPrefix+d.Domain, js, "NX")); err == redis.ErrNil {
+		return ErrCustomDomainTaken
+	} else if err != nil {
+		return err
+	}
+
+	score := d.CreatedAt.UnixNano()
+
+	conn.Send("MULTI")
+	conn.Send("ZADD", redisDomains, score, d.Domain)
+	conn.Send("ZADD", redisDomainsPrefix+d.Owner, score, d.Domain)
+	_, err = conn.Do("EXEC")
+
+	return err
+}
+
+// FindCustomDomain returns the custom domain named domain or ErrNotFound
+func (s *RedisStore) FindCustomDomain(domain string) (*CustomDomain, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	js, err := redis.Bytes(conn.Do("GET", redisDomainPrefix+domain))
+	if err != nil {
+		if err == redis.ErrNil {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	d := CustomDomain{}
+	if err := unmarshalCustomDomain(js, &d); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// ListCustomDomains returns the custom domains of owner, or of every owner when owner is empty, oldest
+// first
+func (s *RedisStore) ListCustomDomains(owner string) ([]CustomDomain, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	index := redisDomains
+	if owner != "" {
+		index = redisDomainsPrefix + owner
+	}
+
+	names, err := redis.Strings(conn.Do("ZRANGE", index, 0, -1))
+	if err != nil || len(names) == 0 {
+		return []CustomDomain{}, err
+	}
+
+	args := make([]interface{}, len(names))
+	for i, name := range names {
+		args[i] = redisDomainPrefix + name
+	}
+
+	docs, err := redis.ByteSlices(conn.Do("MGET", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	domains := []CustomDomain{}
+	for _, js := range docs {
+		if js == nil {
+			continue
+		}
+
+		d := CustomDomain{}
+		if err := unmarshalCustomDomain(js, &d); err != nil {
+			return nil, err
+		}
+
+		domains = append(domains, d)
+	}
+
+	return domains, nil
+}
+
+// VerifyCustomDomain records that domain was verified at at or returns ErrNotFound
+func (s *RedisStore) VerifyCustomDomain(domain string, at time.Time) error {
+	d, err := s.FindCustomDomain(domain)
+	if err != nil {
+		return err
+	}
+
+	d.VerifiedAt = &at
+	js, err := marshalCustomDomain(d)
+	if err != nil {
+		return err
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("SET", redisDomainPrefix+domain, js, "XX")
+
+	return err
+}
+
+// DeleteCustomDomain removes the custom domain of owner named domain or returns ErrNotFound
+func (s *RedisStore) DeleteCustomDomain(owner, domain string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(conn.Do("ZREM", redisDomainsPrefix+owner, domain))
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	conn.Send("MULTI")
+	conn.Send("ZREM", redisDomains, domain)
+	conn.Send("DEL", redisDomainPrefix+domain)
+	_, err = conn.Do("EXEC")
+
+	return err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// maxTags bounds the number of tags a url may carry
+const maxTags = 10
+
+// maxTagLength bounds the length of a single tag
+const maxTagLength = 32
+
+// ErrInvalidTags is returned for tags that are empty, too long or contain anything but letters,
+// digits, dashes and underscores
+var ErrInvalidTags = codedError("invalid_tags", "tags", "Tags must be at most 10 labels of up to 32 letters, digits, dashes or underscores")
+
+// validTags lower cases tags and drops duplicates, returning nil when there are none so untagged urls
+// are stored without the field
+func validTags(tags []string) ([]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	if len(tags) > maxTags {
+		return nil, ErrInvalidTags
+	}
+
+	valid := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = normalizeTag(tag)
+		if !validTag(tag) {
+			return nil, ErrInvalidTags
+		}
+
+		if !seen[tag] {
+			seen[tag] = true
+			valid = append(valid, tag)
+		}
+	}
+
+	return valid, nil
+}
+
+// normalizeTag returns the form tag is stored and matched in
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// validTag reports whether a normalized tag may be stored
+func validTag(tag string) bool {
+	if tag == "" || len(tag) > maxTagLength {
+		return false
+	}
+
+	for _, c := range tag {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '-' && c != '_' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hasTag reports whether u has been tagged with tag
+func (u *URL) hasTag(tag string) bool {
+	for _, t := range u.Tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// searchWords splits s into the lower cased words that full text search matches, urls are split on
+// their punctuation so a search for a domain or path segment finds them
+func searchWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+}
+
+// matchesText reports whether every word of text appears in u's original url or title, for stores
+// without a full text index
+func matchesText(u *URL, text string) bool {
+	words := map[string]bool{}
+	for _, word := range searchWords(u.OriginalURL + " " + u.Title) {
+		words[word] = true
+	}
+
+	for _, word := range searchWords(text) {
+		if !words[word] {
+			return false
+		}
+	}
+
+	return true
+}
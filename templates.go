@@ -0,0 +1,23 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+)
+
+// templateFiles holds the html pages so the binary can be run from any directory
+//
+//go:embed index.html preview.html password.html error.html dashboard.html docs.html
+var templateFiles embed.FS
+
+// templates are parsed once at startup and looked up by file name
+var templates = template.Must(template.ParseFS(templateFiles, "*.html"))
+
+// ErrorPage is rendered by error.html
+type ErrorPage struct {
+	Host       string
+	Status     int
+	StatusText string
+	Message    string
+	RequestID  string
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dimfeld/httptreemux"
+)
+
+// textParams are accepted by the endpoints that can respond with plain text
+var textParams = []QueryParam{{Name: "format", Type: "string", Description: "text to respond with only the short url as plain text, like Accept: text/plain"}}
+
+// textWriter marks a response written as plain text
+type textWriter struct {
+	http.ResponseWriter
+}
+
+// Unwrap returns the writer w wraps
+func (w *textWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// plainText reports whether responses written to w, or a writer it wraps, are plain text, errors
+// included
+func plainText(w http.ResponseWriter) bool {
+	for ; w != nil; w = unwrapWriter(w) {
+		if _, ok := w.(*textWriter); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wantsText reports whether the client asked for a plain text response with ?format=text or an Accept
+// header that gives text/plain a higher quality than application/json
+func wantsText(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "text" {
+		return true
+	}
+
+	accept := strings.Join(r.Header.Values("Accept"), ",")
+
+	return acceptQuality(accept, "text/plain") > acceptQuality(accept, "application/json")
+}
+
+// acceptQuality returns the quality the media ranges of an Accept header give mediaType, taken from
+// the most specific range that matches it, 0 when none does
+func acceptQuality(accept, mediaType string) float64 {
+	quality, specificity := 0.0, -1
+	for _, mediaRange := range strings.Split(accept, ",") {
+		rangeType, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+
+		s := rangeSpecificity(rangeType, mediaType)
+		if s <= specificity {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+
+		quality, specificity = q, s
+	}
+
+	return quality
+}
+
+// rangeSpecificity returns how specifically mediaRange matches mediaType, 2 for the type itself, 1
+// for its type/* range, 0 for */* and -1 when the range does not match
+func rangeSpecificity(mediaRange, mediaType string) int {
+	switch {
+	case mediaRange == mediaType:
+		return 2
+	case mediaRange == "*/*":
+		return 0
+	case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+		return 1
+	}
+
+	return -1
+}
+
+// PlainText writes the responses of next as plain text
+func (h *Handlers) PlainText(next httptreemux.HandlerFunc) httptreemux.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		next(&textWriter{ResponseWriter: w}, r, params)
+	}
+}
+
+// TextOnRequest writes the responses of next as plain text when the client asks for it, and as json
+// otherwise
+func (h *Handlers) TextOnRequest(next httptreemux.HandlerFunc) httptreemux.HandlerFunc {
+	plain := h.PlainText(next)
+
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		w.Header().Add("Vary", "Accept")
+
+		if wantsText(r) {
+			plain(w, r, params)
+			return
+		}
+
+		next(w, r, params)
+	}
+}
+
+// writeText writes text on a line of its own as a plain text response
+func (h *Handlers) writeText(w http.ResponseWriter, text string, status int) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+
+	io.WriteString(w, text+"\n")
+}
+
+// respondShortened writes the url a shorten request created or found, only its short url when the
+// response is plain text
+func (h *Handlers) respondShortened(w http.ResponseWriter, u *URL, status int) {
+	if plainText(w) {
+		h.writeText(w, u.ShortURL, status)
+		return
+	}
+
+	h.RespondJSON(w, u, status)
+}
+
+// respondBatch writes the results of a batch, as plain text one line per entry in the same order with
+// the short url or the status and error of the entry
+func (h *Handlers) respondBatch(w http.ResponseWriter, results []BatchResult) {
+	if !plainText(w) {
+		h.RespondJSON(w, results, http.StatusOK)
+		return
+	}
+
+	lines := make([]string, len(results))
+	for i, result := range results {
+		if result.URL != nil {
+			lines[i] = result.URL.ShortURL
+		} else {
+			lines[i] = fmt.Sprintf("%d %s", result.Status, result.Error)
+		}
+	}
+
+	h.writeText(w, strings.Join(lines, "\n"), http.StatusOK)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dimfeld/httptreemux"
+)
+
+func TestWantsText(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		accept []string
+		want   bool
+	}{
+		{"no preference", "", nil, false},
+		{"format query", "format=text", nil, true},
+		{"text only", "", []string{"text/plain"}, true},
+		{"json only", "", []string{"application/json"}, false},
+		{"anything", "", []string{"*/*"}, false},
+		{"browser", "", []string{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"}, false},
+		{"text preferred", "", []string{"application/json;q=0.5, text/plain"}, true},
+		{"json preferred", "", []string{"text/plain;q=0.5, application/json"}, false},
+		{"equal quality", "", []string{"text/plain, application/json"}, false},
+		{"text refused", "", []string{"text/plain;q=0, */*"}, false},
+		{"any text", "", []string{"text/*"}, true},
+		{"specific range wins", "", []string{"text/*;q=0.1, text/plain;q=0.9, */*;q=0.5"}, true},
+		{"parameters", "", []string{"text/plain; charset=utf-8; q=0.8, application/json; q=0.4"}, true},
+		{"invalid quality", "", []string{"text/plain;q=high, application/json;q=0.5"}, false},
+		{"split headers", "", []string{"application/json;q=0.1", "text/plain"}, true},
+		{"malformed range", "", []string{"text/plain;;, application/json"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/shorten?"+tt.query, nil)
+			for _, accept := range tt.accept {
+				r.Header.Add("Accept", accept)
+			}
+
+			if got := wantsText(r); got != tt.want {
+				t.Errorf("wantsText = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTextOnRequestCoversRouteMiddleware(t *testing.T) {
+	tests := []struct {
+		name   string
+		open   bool
+		body   string
+		status int
+	}{
+		{"read only", true, `{"url": "https://example.com"}`, http.StatusServiceUnavailable},
+		{"body too large", false, `{"url": "https://example.com/` + strings.Repeat("a", 64) + `"}`, http.StatusRequestEntityTooLarge},
+		{"shortened", false, `{"url": "https://example.com"}`, http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestHandlers(t)
+			h.breaker = NewCircuitBreaker(1, time.Minute)
+			if tt.open {
+				h.breaker.record(errors.New("store down"))
+			}
+
+			mux := httptreemux.New()
+			h.apiRoute(mux, Operation{Method: "POST", Path: "/shorten", MaxBody: 48, Text: true}, h.Shorten)
+
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/shorten", strings.NewReader(tt.body))
+			r.Header.Set("Accept", "text/plain")
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+				t.Errorf("Content-Type = %q, want text/plain: %s", got, w.Body)
+			}
+			if tt.open && w.Header().Get("Retry-After") == "" {
+				t.Error("read only response has no Retry-After")
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// defaultAutocertCache is the directory certificates issued by Let's Encrypt are kept in when
+// URL_AUTOCERT_CACHE is unset, so restarts do not request new ones
+const defaultAutocertCache = "autocert-cache"
+
+// defaultAutocertHTTPPort answers Let's Encrypt's http-01 challenges and redirects plain http
+// requests to https
+const defaultAutocertHTTPPort = "80"
+
+// listenAndServe serves requests on server, over tls when a certificate and key or autocert domains
+// are configured. Autocert obtains certificates for the verified custom domains of domains as well and
+// starts a plain http listener for challenges and redirects, errors from either listener are sent to
+// errs.
+func listenAndServe(server *http.Server, c *Config, domains *ShortDomains, errs chan<- error) {
+	switch {
+	case c.TLSCert != "":
+		errs <- server.ListenAndServeTLS(c.TLSCert, c.TLSKey)
+	case len(c.AutocertDomains) > 0:
+		whitelist := autocert.HostWhitelist(c.AutocertDomains...)
+		m := &autocert.Manager{
+			Prompt: autocert.AcceptTOS,
+			HostPolicy: func(ctx context.Context, host string) error {
+				if d := domains.Lookup(host); d != nil && d.Owner != "" {
+					return nil
+				}
+
+				return whitelist(ctx, host)
+			},
+			Cache: autocert.DirCache(c.AutocertCache),
+			Email: c.AutocertEmail,
+		}
+
+		go func() {
+			errs <- http.ListenAndServe(listenAddr(c, c.AutocertHTTPPort), m.HTTPHandler(nil))
+		}()
+
+		server.TLSConfig = m.TLSConfig()
+		errs <- server.ListenAndServeTLS("", "")
+	default:
+		errs <- server.ListenAndServe()
+	}
+}
@@ -0,0 +1,168 @@
+// Command loadtest sends requests to a running shortener at a constant rate and reports the
+// latencies and statuses it saw, e.g.
+//
+//	loadtest -url http://localhost:8080/px4OAI11 -rate 500 -duration 30s -max-p99 50ms
+//
+// Redirects are not followed, so only the shortener is measured. It exits with status 1 when the
+// 99th percentile latency exceeds -max-p99 or more than -max-errors of the requests fail, so it can
+// guard releases against performance regressions.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// result is the outcome of a single request
+type result struct {
+	status  int
+	latency time.Duration
+	err     error
+}
+
+func main() {
+	target := flag.String("url", "", "url requested, usually a short url")
+	method := flag.String("method", http.MethodGet, "request method")
+	rate := flag.Int("rate", 100, "requests sent per second")
+	duration := flag.Duration("duration", 10*time.Second, "how long requests are sent for")
+	workers := flag.Int("workers", 50, "maximum number of requests in flight")
+	timeout := flag.Duration("timeout", 5*time.Second, "timeout of each request")
+	maxP99 := flag.Duration("max-p99", 0, "fail when the 99th percentile latency exceeds it, 0 never fails")
+	maxErrors := flag.Float64("max-errors", 0.01, "fail when more than this share of the requests fail")
+	flag.Parse()
+
+	if *target == "" || *rate < 1 || *workers < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	client := &http.Client{
+		Timeout: *timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Transport: &http.Transport{MaxIdleConnsPerHost: *workers},
+	}
+
+	results := run(client, *method, *target, *rate, *duration, *workers)
+	if !report(results, *duration, *maxP99, *maxErrors) {
+		os.Exit(1)
+	}
+}
+
+// run sends rate requests a second for duration with at most workers in flight, requests that would
+// exceed workers are skipped and show up as a lower achieved rate
+func run(client *http.Client, method, target string, rate int, duration time.Duration, workers int) []result {
+	var mu sync.Mutex
+	results := []result{}
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, workers)
+
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+
+	for deadline := time.Now().Add(duration); time.Now().Before(deadline); <-ticker.C {
+		select {
+		case slots <- struct{}{}:
+		default:
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			r := send(client, method, target)
+
+			mu.Lock()
+			results = append(results, r)
+			mu.Unlock()
+		}()
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// send makes one request and measures how long the response took
+func send(client *http.Client, method, target string) result {
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return result{err: err}
+	}
+	req.Header.Set("User-Agent", "loadtest")
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return result{latency: time.Since(start), err: err}
+	}
+	resp.Body.Close()
+
+	return result{status: resp.StatusCode, latency: time.Since(start)}
+}
+
+// report prints the statuses and latency percentiles of results, returning false when they exceed the
+// thresholds
+func report(results []result, duration, maxP99 time.Duration, maxErrors float64) bool {
+	if len(results) == 0 {
+		fmt.Println("no requests were sent")
+		return false
+	}
+
+	statuses := map[string]int{}
+	latencies := []time.Duration{}
+	failed := 0
+	for _, r := range results {
+		switch {
+		case r.err != nil:
+			statuses["error"]++
+			failed++
+		case r.status >= http.StatusInternalServerError:
+			statuses[fmt.Sprint(r.status)]++
+			failed++
+		default:
+			statuses[fmt.Sprint(r.status)]++
+		}
+
+		latencies = append(latencies, r.latency)
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+
+	codes := []string{}
+	for code, n := range statuses {
+		codes = append(codes, fmt.Sprintf("%s:%d", code, n))
+	}
+	sort.Strings(codes)
+
+	errorShare := float64(failed) / float64(len(results))
+	fmt.Printf("requests  %d (%.1f/s)\n", len(results), float64(len(results))/duration.Seconds())
+	fmt.Printf("statuses  %s\n", strings.Join(codes, " "))
+	fmt.Printf("errors    %.2f%%\n", errorShare*100)
+	fmt.Printf("latency   p50 %v  p90 %v  p99 %v  max %v\n", percentile(0.5), percentile(0.9), percentile(0.99), latencies[len(latencies)-1])
+
+	ok := true
+	if maxP99 > 0 && percentile(0.99) > maxP99 {
+		fmt.Printf("p99 latency %v exceeds %v\n", percentile(0.99), maxP99)
+		ok = false
+	}
+
+	if errorShare > maxErrors {
+		fmt.Printf("error rate %.2f%% exceeds %.2f%%\n", errorShare*100, maxErrors*100)
+		ok = false
+	}
+
+	return ok
+}
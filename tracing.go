@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// requestIDHeader carries the id of a request, it is honored on incoming requests and set on every
+// response
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the length of request ids accepted from clients
+const maxRequestIDLength = 128
+
+// requestIDChars are the characters accepted in request ids sent by clients
+const requestIDChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.:/+="
+
+// serviceName identifies the spans of the shortener
+const serviceName = "fcc-url-shortener"
+
+// tracerName is the instrumentation scope of the spans recorded by the shortener
+const tracerName = "github.com/jcloutz/fcc-url-shortener"
+
+// requestID returns the id the client or load balancer sent with r, or a new random id when it sent
+// none or one that is unsafe to log
+func requestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" || len(id) > maxRequestIDLength {
+		return newRequestID()
+	}
+
+	for _, c := range id {
+		if !strings.ContainsRune(requestIDChars, c) {
+			return newRequestID()
+		}
+	}
+
+	return id
+}
+
+// newRequestID generates a random request id
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// newTracerProvider exports spans to the otlp/http collector at endpoint. Requests that arrive with
+// a traceparent header follow the sampling decision of the caller, ratio of the remaining traces are
+// sampled.
+func newTracerProvider(endpoint string, ratio float64) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider, nil
+}
+
+// Trace records a server span for every request handled by next, continuing the trace of the caller
+// when it sent a traceparent header. Instrumented routes rename the span after their handler.
+func (h *Handlers) Trace(next http.Handler) http.Handler {
+	propagator := otel.GetTextMapPropagator()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := h.tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				attribute.String("http.request.id", w.Header().Get(requestIDHeader)),
+			),
+		)
+		defer span.End()
+
+		logTrace(r, span.SpanContext())
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(sw.status))
+		if sw.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	})
+}
+
+// tracedStore records a span for each store operation as a child of the span in the operation's ctx
+type tracedStore struct {
+	Store
+	tracer trace.Tracer
+}
+
+// start begins the span of the store operation op
+func (s *tracedStore) start(ctx context.Context, op string, attrs ...attribute.KeyValue) trace.Span {
+	_, span := s.tracer.Start(ctx, "store."+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+
+	return span
+}
+
+// endSpan finishes span, marking it failed for errors other than ErrNotFound
+func endSpan(span trace.Span, err error) {
+	if err != nil && err != ErrNotFound {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// Save inserts a new url document
+func (s *tracedStore) Save(ctx context.Context, u *URL) (err error) {
+	span := s.start(ctx, "save", attribute.String("slug", u.Slug))
+	defer func() { endSpan(span, err) }()
+
+	return s.Store.Save(ctx, u)
+}
+
+// SaveMany inserts urls in a single round trip
+func (s *tracedStore) SaveMany(ctx context.Context, urls []*URL) []error {
+	span := s.start(ctx, "save_many", attribute.Int("urls", len(urls)))
+	defer span.End()
+
+	return s.Store.SaveMany(ctx, urls)
+}
+
+// Update replaces the url stored under u.Slug or returns ErrNotFound
+func (s *tracedStore) Update(ctx context.Context, u *URL) (err error) {
+	span := s.start(ctx, "update", attribute.String("slug", u.Slug))
+	defer func() { endSpan(span, err) }()
+
+	return s.Store.Update(ctx, u)
+}
+
+// IncrementUses atomically counts a visit to the url stored under slug
+func (s *tracedStore) IncrementUses(ctx context.Context, slug string) (uses int, err error) {
+	span := s.start(ctx, "increment_uses", attribute.String("slug", slug))
+	defer func() { endSpan(span, err) }()
+
+	return s.Store.IncrementUses(ctx, slug)
+}
+
+// IncrementClicks atomically counts a redirect through the url stored under slug
+func (s *tracedStore) IncrementClicks(ctx context.Context, slug string) (clicks int, err error) {
+	span := s.start(ctx, "increment_clicks", attribute.String("slug", slug))
+	defer func() { endSpan(span, err) }()
+
+	return s.Store.IncrementClicks(ctx, slug)
+}
+
+// ResolveSlug returns the url stored under slug for a redirect or ErrNotFound
+func (s *tracedStore) ResolveSlug(ctx context.Context, slug string) (u *URL, err error) {
+	span := s.start(ctx, "resolve_slug", attribute.String("slug", slug))
+	defer func() { endSpan(span, err) }()
+
+	return s.Store.ResolveSlug(ctx, slug)
+}
+
+// FindBySlug returns the url stored under slug or ErrNotFound
+func (s *tracedStore) FindBySlug(ctx context.Context, slug string) (u *URL, err error) {
+	span := s.start(ctx, "find_by_slug", attribute.String("slug", slug))
+	defer func() { endSpan(span, err) }()
+
+	return s.Store.FindBySlug(ctx, slug)
+}
+
+// FindByOriginalURL returns a url owned by owner without an expiry pointing at original or
+// ErrNotFound
+func (s *tracedStore) FindByOriginalURL(ctx context.Context, owner, original string) (u *URL, err error) {
+	span := s.start(ctx, "find_by_original_url")
+	defer func() { endSpan(span, err) }()
+
+	return s.Store.FindByOriginalURL(ctx, owner, original)
+}
+
+// Exists reports whether a url has already been stored under slug, including deleted urls that left
+// a tombstone
+func (s *tracedStore) Exists(ctx context.Context, slug string) (exists bool, err error) {
+	span := s.start(ctx, "exists", attribute.String("slug", slug))
+	defer func() { endSpan(span, err) }()
+
+	return s.Store.Exists(ctx, slug)
+}
+
+// Delete removes the url stored under slug or returns ErrNotFound
+func (s *tracedStore) Delete(ctx context.Context, slug string, tombstone bool) (err error) {
+	span := s.start(ctx, "delete", attribute.String("slug", slug))
+	defer func() { endSpan(span, err) }()
+
+	return s.Store.Delete(ctx, slug, tombstone)
+}
+
+// List returns the page of urls selected by q and the total number of urls the owner has
+func (s *tracedStore) List(ctx context.Context, q ListQuery) (urls []URL, total int, err error) {
+	span := s.start(ctx, "list")
+	defer func() { endSpan(span, err) }()
+
+	return s.Store.List(ctx, q)
+}
+
+// Ping checks that the backing database is reachable
+func (s *tracedStore) Ping(ctx context.Context) (err error) {
+	span := s.start(ctx, "ping")
+	defer func() { endSpan(span, err) }()
+
+	return s.Store.Ping(ctx)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// defaultDeleteRetentionDays is how long deleted urls can be restored before they are purged
+const defaultDeleteRetentionDays = 30
+
+// trashPurgeInterval is how often deleted urls past the retention window are purged
+const trashPurgeInterval = time.Hour
+
+// ErrNotDeleted is returned when restoring a url that has not been deleted
+var ErrNotDeleted = codedError("not_deleted", "", "That url has not been deleted")
+
+// Deleted reports whether the url has been deleted and is waiting in the trash to be purged
+func (u *URL) Deleted() bool {
+	return u.DeletedAt != nil
+}
+
+// purgeDeleted permanently removes urls that were deleted more than retention ago every interval, it
+// never returns
+func purgeDeleted(store Store, retention, interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := purgeTrash(store, time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("Unable to purge deleted urls: %v", err)
+		}
+
+		if n > 0 {
+			log.Printf("Purged %d deleted urls", n)
+		}
+	}
+}
+
+// purgeTrash removes every url deleted at or before cutoff and tombstones its slug, returning the
+// number removed
+func purgeTrash(store Store, cutoff time.Time) (int, error) {
+	purged := 0
+
+	// purged urls drop out of the next page, only the ones still in their retention window are skipped
+	for skip := 0; ; {
+		urls, _, err := store.List(context.Background(), ListQuery{AllOwners: true, Deleted: true, Sort: "created_at", Skip: skip, Limit: maxPerPage})
+		if err != nil {
+			return purged, err
+		}
+
+		for i := range urls {
+			if urls[i].DeletedAt.After(cutoff) {
+				skip++
+				continue
+			}
+
+			if err := store.Delete(context.Background(), urls[i].Slug, true); err != nil && err != ErrNotFound {
+				return purged, err
+			}
+			purged++
+		}
+
+		if len(urls) < maxPerPage {
+			return purged, nil
+		}
+	}
+}
+
+// RestoreURL brings back one of the caller's deleted urls before it is purged
+func (h *Handlers) RestoreURL(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	slug := h.canonicalSlug(params["slug"])
+	logSlug(r, slug)
+
+	u, err := h.store.FindBySlug(r.Context(), slug)
+	if err != nil || u.Owner != requestOwner(r) {
+		if err == nil || err == ErrNotFound {
+			h.RespondError(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		h.RespondError(w, ErrUnableToUpdateURL, http.StatusInternalServerError)
+		return
+	}
+
+	if !u.Deleted() {
+		h.RespondError(w, ErrNotDeleted, http.StatusConflict)
+		return
+	}
+
+	u.DeletedAt = nil
+	if err := h.store.Update(r.Context(), u); err != nil {
+		h.RespondError(w, ErrUnableToUpdateURL, http.StatusInternalServerError)
+		return
+	}
+
+	h.RespondJSON(w, u, http.StatusOK)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 8
+
+// User is an account that owns urls, it authenticates with session tokens or api keys minted for it
+type User struct {
+	ID           string    `json:"id" bson:"user_id"`
+	Email        string    `json:"email" bson:"email"`
+	PasswordHash string    `json:"-" bson:"password_hash"`
+	CreatedAt    time.Time `json:"created_at" bson:"created_at"`
+}
+
+// Credentials is the json body accepted when registering and logging in
+type Credentials struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// UserStore defines the persistence operations for user accounts
+type UserStore interface {
+	// SaveUser inserts a new user or returns ErrEmailTaken
+	SaveUser(u *User) error
+	// FindUserByEmail returns the user registered with email or ErrNotFound
+	FindUserByEmail(email string) (*User, error)
+	// FindUserByID returns the user with id or ErrNotFound
+	FindUserByID(id string) (*User, error)
+}
+
+// userDocument is the json encoding used by stores that keep users as json documents, it includes the
+// password hash that is hidden from api responses
+type userDocument struct {
+	*User
+	PasswordHash string `json:"password_hash"`
+}
+
+// marshalUser encodes u as a stored json document
+func marshalUser(u *User) ([]byte, error) {
+	return json.Marshal(userDocument{User: u, PasswordHash: u.PasswordHash})
+}
+
+// unmarshalUser decodes a stored json document into u
+func unmarshalUser(js []byte, u *User) error {
+	doc := userDocument{User: u}
+	if err := json.Unmarshal(js, &doc); err != nil {
+		return err
+	}
+
+	u.PasswordHash = doc.PasswordHash
+
+	return nil
+}
+
+// normalizeEmail returns the form emails are stored and looked up in
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// NewUser validates c and creates the user to store with a bcrypt hash of the password
+func NewUser(c Credentials) (*User, error) {
+	email := normalizeEmail(c.Email)
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		return nil, ErrInvalidCredentials
+	}
+
+	if len(c.Password) < minPasswordLength {
+		return nil, ErrInvalidCredentials
+	}
+
+	id, err := newUserID()
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(c.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	return &User{
+		ID:           id,
+		Email:        email,
+		PasswordHash: string(hash),
+		CreatedAt:    time.Now().UTC(),
+	}, nil
+}
+
+// newUserID returns a random id for a new user
+func newUserID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// Register creates a user account
+func (h *Handlers) Register(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	c := Credentials{}
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		h.respondBodyError(w, err, ErrInvalidRequest)
+		return
+	}
+
+	u, err := NewUser(c)
+	if err != nil {
+		if err == ErrInvalidCredentials {
+			h.RespondError(w, ErrInvalidCredentials, http.StatusBadRequest)
+			return
+		}
+
+		h.RespondError(w, ErrUnableToCreateUser, http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.users.SaveUser(u); err != nil {
+		if err == ErrEmailTaken {
+			h.RespondError(w, ErrEmailTaken, http.StatusConflict)
+			return
+		}
+
+		h.RespondError(w, ErrUnableToCreateUser, http.StatusInternalServerError)
+		return
+	}
+
+	h.RespondJSON(w, u, http.StatusCreated)
+}
+
+// Login checks a user's email and password and issues a session token for the user
+func (h *Handlers) Login(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	c := Credentials{}
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		h.respondBodyError(w, err, ErrInvalidRequest)
+		return
+	}
+
+	u, err := h.authenticate(c)
+	if err != nil {
+		if err == ErrLoginFailed {
+			h.RespondError(w, ErrLoginFailed, http.StatusUnauthorized)
+			return
+		}
+
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	token, expires, err := h.tokens.Issue(u.ID, time.Now())
+	if err != nil {
+		h.RespondError(w, ErrUnableToCreateToken, http.StatusInternalServerError)
+		return
+	}
+
+	h.RespondJSON(w, TokenResponse{Token: token, ExpiresAt: expires.UTC()}, http.StatusOK)
+}
+
+// authenticate returns the user c's email belongs to when the password matches, or ErrLoginFailed
+func (h *Handlers) authenticate(c Credentials) (*User, error) {
+	u, err := h.users.FindUserByEmail(normalizeEmail(c.Email))
+	if err != nil && err != ErrNotFound {
+		return nil, ErrStoreUnavailable
+	}
+
+	// unknown emails are checked against a dummy hash so they take as long to reject as a bad password
+	hash := dummyPasswordHash
+	if u != nil {
+		hash = []byte(u.PasswordHash)
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(c.Password)) != nil || u == nil {
+		return nil, ErrLoginFailed
+	}
+
+	return u, nil
+}
+
+// CreateUserAPIKey mints a long lived api key that acts on behalf of the current user, for scripts
+// that cannot log in
+func (h *Handlers) CreateUserAPIKey(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	userID := requestUserID(r)
+	if userID == "" {
+		h.RespondError(w, ErrUserNotFound, http.StatusNotFound)
+		return
+	}
+
+	req := NewAPIKeyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		h.respondBodyError(w, err, ErrInvalidRequest)
+		return
+	}
+
+	k, secret, err := GenerateAPIKey(req.Name)
+	if err != nil {
+		h.RespondError(w, ErrUnableToCreateKey, http.StatusInternalServerError)
+		return
+	}
+	k.UserID = userID
+	k.MonthlyQuota = h.keyQuota
+
+	if err := h.keys.SaveKey(k); err != nil {
+		h.RespondError(w, ErrUnableToCreateKey, http.StatusInternalServerError)
+		return
+	}
+
+	h.RespondJSON(w, NewAPIKeyResponse{APIKey: *k, Key: secret}, http.StatusCreated)
+}
+
+// CurrentUser responds with the user the caller's token or api key belongs to
+func (h *Handlers) CurrentUser(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	userID := requestUserID(r)
+	if userID == "" {
+		h.RespondError(w, ErrUserNotFound, http.StatusNotFound)
+		return
+	}
+
+	u, err := h.users.FindUserByID(userID)
+	if err != nil {
+		if err == ErrNotFound {
+			h.RespondError(w, ErrUserNotFound, http.StatusNotFound)
+			return
+		}
+
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	h.RespondJSON(w, u, http.StatusOK)
+}
+
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// maxUTMLength bounds the length of a recorded utm parameter
+const maxUTMLength = 200
+
+// defaultBreakdownEntries is the number of values a breakdown lists unless limit is passed
+const defaultBreakdownEntries = 10
+
+// maxBreakdownEntries bounds the limit of a breakdown
+const maxBreakdownEntries = 100
+
+// clickBreakdowns are the click fields stats can be broken down by, referrer_domain is counted from
+// the referrers so clicks recorded before their domain was stored are included
+var clickBreakdowns = map[string]bool{
+	"referrer":        true,
+	"referrer_domain": true,
+	"utm_source":      true,
+	"utm_medium":      true,
+	"utm_campaign":    true,
+}
+
+// ErrInvalidBreakdown is returned for a breakdown by an unknown field or with an invalid limit
+var ErrInvalidBreakdown = codedError("invalid_breakdown", "by", "by must be one of referrer, referrer_domain, utm_source, utm_medium or utm_campaign and limit between 1 and 100")
+
+// BreakdownEntry is the number of clicks that had a single value
+type BreakdownEntry struct {
+	Value  string `json:"value"`
+	Clicks int    `json:"clicks"`
+}
+
+// Breakdown is the clicks of a url counted per value of one of their fields, clicks without a value
+// are left out
+type Breakdown struct {
+	Slug    string           `json:"slug"`
+	By      string           `json:"by"`
+	Total   int              `json:"total"`
+	Entries []BreakdownEntry `json:"entries"`
+}
+
+// referrerDomain returns the host of referrer without its port or a leading www, the empty string
+// when referrer is not a url
+func referrerDomain(referrer string) string {
+	u, err := url.Parse(referrer)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimPrefix(domainHost(u.Host), "www.")
+}
+
+// utmParam returns the utm parameter name of the query a visitor followed a short url with
+func utmParam(query url.Values, name string) string {
+	value := strings.TrimSpace(query.Get(name))
+	if len(value) > maxUTMLength {
+		value = value[:maxUTMLength]
+	}
+
+	return value
+}
+
+// clickField returns the value of the field of c named by a breakdown
+func clickField(c *Click, field string) string {
+	switch field {
+	case "referrer":
+		return c.Referrer
+	case "referrer_domain":
+		return referrerDomain(c.Referrer)
+	case "utm_source":
+		return c.UTMSource
+	case "utm_medium":
+		return c.UTMMedium
+	case "utm_campaign":
+		return c.UTMCampaign
+	}
+
+	return ""
+}
+
+// countClicksBy counts clicks per value of field, for stores that cannot aggregate themselves
+func countClicksBy(clicks []Click, field string) map[string]int {
+	counts := map[string]int{}
+	for i := range clicks {
+		if value := clickField(&clicks[i], field); value != "" {
+			counts[value]++
+		}
+	}
+
+	return counts
+}
+
+// StatsBreakdown responds with the values of a click field, such as the referrer domain or utm
+// campaign, that brought a url the most clicks
+func (h *Handlers) StatsBreakdown(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	slug := h.canonicalSlug(params["slug"])
+	logSlug(r, slug)
+
+	by := r.URL.Query().Get("by")
+	limit, err := queryInt(r.URL.Query().Get("limit"), defaultBreakdownEntries)
+	if !clickBreakdowns[by] || err != nil || limit < 1 || limit > maxBreakdownEntries {
+		h.RespondError(w, ErrInvalidBreakdown, http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.store.FindBySlug(r.Context(), slug); err != nil {
+		h.RespondError(w, ErrNotFound, http.StatusNotFound)
+		return
+	}
+
+	field := by
+	if by == "referrer_domain" {
+		field = "referrer"
+	}
+
+	counts, err := h.clicks.CountClicksBy(slug, field)
+	if err != nil {
+		h.RespondError(w, ErrUnableToLoadStats, http.StatusInternalServerError)
+		return
+	}
+
+	if by == "referrer_domain" {
+		domains := map[string]int{}
+		for referrer, clicks := range counts {
+			if domain := referrerDomain(referrer); domain != "" {
+				domains[domain] += clicks
+			}
+		}
+		counts = domains
+	}
+
+	breakdown := Breakdown{Slug: slug, By: by, Entries: []BreakdownEntry{}}
+	for value, clicks := range counts {
+		breakdown.Total += clicks
+		breakdown.Entries = append(breakdown.Entries, BreakdownEntry{Value: value, Clicks: clicks})
+	}
+
+	sort.Slice(breakdown.Entries, func(i, j int) bool {
+		if breakdown.Entries[i].Clicks == breakdown.Entries[j].Clicks {
+			return breakdown.Entries[i].Value < breakdown.Entries[j].Value
+		}
+
+		return breakdown.Entries[i].Clicks > breakdown.Entries[j].Clicks
+	})
+	if len(breakdown.Entries) > limit {
+		breakdown.Entries = breakdown.Entries[:limit]
+	}
+
+	h.RespondJSON(w, breakdown, http.StatusOK)
+}
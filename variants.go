@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+)
+
+// maxVariants bounds how many destinations a url can split its traffic between
+const maxVariants = 10
+
+// Variant is one of the weighted destinations of a split test
+type Variant struct {
+	Name   string `json:"name" bson:"name"`
+	URL    string `json:"url" bson:"url"`
+	Weight int    `json:"weight" bson:"weight"`
+}
+
+// VariantClicks is the number of clicks a single variant of a url was served for
+type VariantClicks struct {
+	Variant string `json:"variant" bson:"_id"`
+	Clicks  int    `json:"clicks" bson:"clicks"`
+}
+
+// validVariants checks that variants splits traffic between at least two urls that may be shortened.
+// Unnamed variants are named A, B, C and so on by position and weights default to 1.
+func (h *Handlers) validVariants(variants []Variant) ([]Variant, error) {
+	if len(variants) == 0 {
+		return nil, nil
+	}
+
+	if len(variants) < 2 || len(variants) > maxVariants {
+		return nil, ErrInvalidVariants
+	}
+
+	valid := make([]Variant, len(variants))
+	names := map[string]bool{}
+	for i, v := range variants {
+		v.Name = strings.TrimSpace(v.Name)
+		if v.Name == "" {
+			v.Name = string(rune('A' + i))
+		}
+
+		if v.Weight == 0 {
+			v.Weight = 1
+		}
+
+		if v.Weight < 0 || names[v.Name] {
+			return nil, ErrInvalidVariants
+		}
+
+		destination, err := h.NormalizeURL(v.URL)
+		if err != nil {
+			return nil, err
+		}
+		v.URL = destination
+
+		names[v.Name] = true
+		valid[i] = v
+	}
+
+	return valid, nil
+}
+
+// pickVariant chooses one of variants at random in proportion to its weight
+func pickVariant(variants []Variant) Variant {
+	total := 0
+	for _, v := range variants {
+		total += v.Weight
+	}
+
+	n := rand.Intn(total)
+	for _, v := range variants {
+		if n < v.Weight {
+			return v
+		}
+
+		n -= v.Weight
+	}
+
+	return variants[len(variants)-1]
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"net/http"
+)
+
+// visitorPrecision is the number of hash bits that pick a register of a visitor sketch, 2^14
+// registers estimate unique visitors to within about 0.8% and match the sketches redis keeps
+const visitorPrecision = 14
+
+// visitorRegisters is the number of registers in a visitor sketch
+const visitorRegisters = 1 << visitorPrecision
+
+// visitorHash identifies the visitor behind r by their ip and user agent without storing either, only
+// the sketch register it lands in is kept
+func (h *Handlers) visitorHash(r *http.Request) uint64 {
+	sum := sha256.Sum256([]byte(h.clientIP(r) + "\n" + r.UserAgent()))
+
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// visitorRegister returns the register a visitor hash updates and the value it raises it to, one more
+// than the number of leading zeros after the register bits
+func visitorRegister(visitor uint64) (int, byte) {
+	index := int(visitor >> (64 - visitorPrecision))
+	rest := visitor<<visitorPrecision | 1<<(visitorPrecision-1)
+
+	return index, byte(bits.LeadingZeros64(rest) + 1)
+}
+
+// visitorSketch is a HyperLogLog sketch estimating the number of distinct visitors added to it from
+// one byte per register
+type visitorSketch []byte
+
+// newVisitorSketch returns a sketch no visitor has been added to
+func newVisitorSketch() visitorSketch {
+	return make(visitorSketch, visitorRegisters)
+}
+
+// add records a visitor hash
+func (s visitorSketch) add(visitor uint64) {
+	index, rank := visitorRegister(visitor)
+	if rank > s[index] {
+		s[index] = rank
+	}
+}
+
+// count estimates the number of distinct visitors added
+func (s visitorSketch) count() int {
+	m := float64(len(s))
+	sum, zeros := 0.0, 0
+	for _, rank := range s {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+
+	// with few visitors most registers are still empty, counting them is more accurate
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return int(estimate + 0.5)
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Events webhooks can subscribe to
+const (
+	EventLinkCreated   = "link.created"
+	EventLinkExpired   = "link.expired"
+	EventLinkMilestone = "link.milestone"
+	EventLinkFlagged   = "link.flagged"
+)
+
+// webhookEvents are the events a webhook may subscribe to
+var webhookEvents = []string{EventLinkCreated, EventLinkExpired, EventLinkMilestone, EventLinkFlagged}
+
+const maxWebhooksPerOwner = 10
+const webhookTimeout = 10 * time.Second
+
+// webhookMaxAttempts is how many times a delivery is tried before it is dropped, retries back off
+// from webhookRetryDelay doubling each time
+const webhookMaxAttempts = 6
+const webhookRetryDelay = 5 * time.Second
+
+// webhookQueueSize bounds the deliveries waiting for a worker, events beyond it are dropped
+const webhookQueueSize = 1000
+const webhookWorkers = 4
+
+// webhookExpiryInterval is how often urls about to expire are looked up so link.expired is sent on time
+const webhookExpiryInterval = time.Minute
+
+// defaultWebhookMilestones are the click counts link.milestone is sent at
+const defaultWebhookMilestones = "100,1000,10000"
+
+var (
+	ErrInvalidWebhook      = codedError("invalid_webhook", "", "A webhook needs an http or https url and at least one of link.created, link.expired, link.milestone or link.flagged")
+	ErrTooManyWebhooks     = codedError("too_many_webhooks", "", "At most 10 webhooks may be registered")
+	ErrWebhookNotFound     = codedError("webhook_not_found", "", "Unable to locate a webhook with that id")
+	ErrUnableToSaveWebhook = codedError("webhook_save_failed", "", "Unable to save webhook")
+)
+
+// Webhook is an endpoint that is sent the events it subscribed to for the urls of its owner. The
+// secret signs every delivery and is only returned when the webhook is created.
+type Webhook struct {
+	ID        string    `json:"id" bson:"webhook_id"`
+	Owner     string    `json:"-" bson:"owner"`
+	URL       string    `json:"url" bson:"url"`
+	Events    []string  `json:"events" bson:"events"`
+	Secret    string    `json:"-" bson:"secret"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+// WebhookRequest is the json body accepted when registering a webhook
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// NewWebhookResponse is returned when a webhook is registered, it is the only time the secret is visible
+type NewWebhookResponse struct {
+	Webhook
+	Secret string `json:"secret"`
+}
+
+// WebhookEvent is the json body posted to webhooks. Clicks is set for link.milestone and Report for
+// link.flagged.
+type WebhookEvent struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+	URL       *URL      `json:"url"`
+	Clicks    int       `json:"clicks,omitempty"`
+	Report    *Report   `json:"report,omitempty"`
+}
+
+// WebhookStore defines the persistence operations for webhooks
+type WebhookStore interface {
+	// SaveWebhook inserts a new webhook
+	SaveWebhook(wh *Webhook) error
+	// ListWebhooks returns the webhooks of owner, or of every owner when owner is empty, oldest first
+	ListWebhooks(owner string) ([]Webhook, error)
+	// DeleteWebhook removes the webhook of owner with id or returns ErrNotFound
+	DeleteWebhook(owner, id string) error
+}
+
+// webhookDocument is the json encoding used by stores that keep webhooks as json documents, it
+// includes the owner and secret that are hidden from api responses
+type webhookDocument struct {
+	*Webhook
+	Owner  string `json:"owner"`
+	Secret string `json:"secret"`
+}
+
+// marshalWebhook encodes wh as a stored json document
+func marshalWebhook(wh *Webhook) ([]byte, error) {
+	return json.Marshal(webhookDocument{Webhook: wh, Owner: wh.Owner, Secret: wh.Secret})
+}
+
+// unmarshalWebhook decodes a stored json document into wh
+func unmarshalWebhook(js []byte, wh *Webhook) error {
+	doc := webhookDocument{Webhook: wh}
+	if err := json.Unmarshal(js, &doc); err != nil {
+		return err
+	}
+
+	wh.Owner = doc.Owner
+	wh.Secret = doc.Secret
+
+	return nil
+}
+
+// Subscribed reports whether wh is sent event
+func (wh *Webhook) Subscribed(event string) bool {
+	for _, e := range wh.Events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// webhookDelivery is an event waiting to be posted to one webhook
+type webhookDelivery struct {
+	hook    Webhook
+	event   string
+	id      string
+	body    []byte
+	attempt int
+}
+
+// WebhookNotifier posts events to the webhooks subscribed to them. Deliveries are queued and sent by
+// a pool of workers so events never hold up the request that caused them.
+type WebhookNotifier struct {
+	store      WebhookStore
+	client     *http.Client
+	queue      chan webhookDelivery
+	milestones map[int]bool
+
+	mu sync.Mutex
+	// scannedUntil is the end of the window the last expiry scan scheduled link.expired for
+	scannedUntil time.Time
+}
+
+// NewWebhookNotifier creates a notifier sending link.milestone at each of milestones clicks and starts
+// its workers
+func NewWebhookNotifier(store WebhookStore, milestones []int) *WebhookNotifier {
+	n := &WebhookNotifier{
+		store:      store,
+		client:     egress.Client(webhookTimeout),
+		queue:      make(chan webhookDelivery, webhookQueueSize),
+		milestones: map[int]bool{},
+	}
+
+	for _, m := range milestones {
+		n.milestones[m] = true
+	}
+
+	for i := 0; i < webhookWorkers; i++ {
+		go n.work()
+	}
+
+	return n
+}
+
+// Milestone reports whether a url reaching clicks should send link.milestone
+func (n *WebhookNotifier) Milestone(clicks int) bool {
+	return n.milestones[clicks]
+}
+
+// Notify queues event for every webhook of owner subscribed to it. It looks the webhooks up off the
+// caller's goroutine, failures are only logged.
+func (n *WebhookNotifier) Notify(owner string, e WebhookEvent) {
+	if owner == "" {
+		return
+	}
+
+	e.CreatedAt = time.Now().UTC()
+	id, err := webhookID()
+	if err != nil {
+		log.Printf("Unable to create %s event: %v", e.Event, err)
+		return
+	}
+	e.ID = id
+
+	go func() {
+		hooks, err := n.store.ListWebhooks(owner)
+		if err != nil {
+			log.Printf("Unable to load webhooks for %s: %v", owner, err)
+			return
+		}
+
+		var body []byte
+		for _, wh := range hooks {
+			if !wh.Subscribed(e.Event) {
+				continue
+			}
+
+			if body == nil {
+				if body, err = json.Marshal(e); err != nil {
+					log.Printf("Unable to encode %s event: %v", e.Event, err)
+					return
+				}
+			}
+
+			n.enqueue(webhookDelivery{hook: wh, event: e.Event, id: e.ID, body: body})
+		}
+	}()
+}
+
+// enqueue hands d to the workers, dropping it when the queue is full
+func (n *WebhookNotifier) enqueue(d webhookDelivery) {
+	select {
+	case n.queue <- d:
+	default:
+		log.Printf("Webhook queue full, dropping %s event %s for %s", d.event, d.id, d.hook.URL)
+	}
+}
+
+// work sends queued deliveries, it never returns
+func (n *WebhookNotifier) work() {
+	for d := range n.queue {
+		n.deliver(d)
+	}
+}
+
+// deliver posts d once. Network errors, 429s and server errors are retried with exponential backoff
+// until webhookMaxAttempts is reached, any other response ends the delivery.
+func (n *WebhookNotifier) deliver(d webhookDelivery) {
+	d.attempt++
+
+	status, err := n.post(d)
+	if err == nil && status < 300 {
+		return
+	}
+
+	if err == nil && status != http.StatusTooManyRequests && status < 500 {
+		log.Printf("Webhook %s rejected %s event %s with status %d", d.hook.URL, d.event, d.id, status)
+		return
+	}
+
+	if d.attempt >= webhookMaxAttempts {
+		log.Printf("Giving up on %s event %s for webhook %s after %d attempts", d.event, d.id, d.hook.URL, d.attempt)
+		return
+	}
+
+	time.AfterFunc(webhookRetryDelay<<uint(d.attempt-1), func() { n.enqueue(d) })
+}
+
+// post sends d to its webhook, returning the response status
+func (n *WebhookNotifier) post(d webhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, d.hook.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "fcc-url-shortener-webhooks")
+	req.Header.Set("X-Webhook-Event", d.event)
+	req.Header.Set("X-Webhook-ID", d.id)
+	req.Header.Set("X-Webhook-Attempt", strconv.Itoa(d.attempt))
+	req.Header.Set("X-Webhook-Signature", signWebhook(d.hook.Secret, d.body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+// signWebhook returns the signature header of body, the hex hmac-sha256 of the body keyed with the
+// webhook's secret
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookID returns a random id for webhooks and events
+func webhookID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// expireLater sends link.expired for u once it expires. Urls created after the last expiry scan that
+// expire before the next one are scheduled when they are created, later scans pick up the rest.
+func (n *WebhookNotifier) expireLater(u *URL) {
+	n.mu.Lock()
+	scannedUntil := n.scannedUntil
+	n.mu.Unlock()
+
+	if u.ExpiresAt != nil && u.ExpiresAt.Before(scannedUntil) {
+		n.scheduleExpiry(*u)
+	}
+}
+
+// scheduleExpiry sends link.expired for u when it expires
+func (n *WebhookNotifier) scheduleExpiry(u URL) {
+	time.AfterFunc(time.Until(*u.ExpiresAt), func() {
+		n.Notify(u.Owner, WebhookEvent{Event: EventLinkExpired, URL: &u})
+	})
+}
+
+// watchExpiries schedules link.expired for the urls of owners subscribed to it that expire before the
+// next check, every interval. Stores remove expired urls themselves so the event carries the url as
+// it was looked up. It never returns.
+func watchExpiries(store Store, n *WebhookNotifier, interval time.Duration) {
+	for now := time.Now(); ; now = <-time.After(interval) {
+		if err := scheduleExpiries(store, n, now, now.Add(interval)); err != nil {
+			log.Printf("Unable to look up expiring urls for webhooks: %v", err)
+		}
+	}
+}
+
+// scheduleExpiries sends link.expired for each subscribed url expiring in [from, until) once it expires
+func scheduleExpiries(store Store, n *WebhookNotifier, from, until time.Time) error {
+	hooks, err := n.store.ListWebhooks("")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		n.mu.Lock()
+		n.scannedUntil = until
+		n.mu.Unlock()
+	}()
+
+	owners := map[string]bool{}
+	for _, wh := range hooks {
+		if wh.Subscribed(EventLinkExpired) {
+			owners[wh.Owner] = true
+		}
+	}
+
+	for owner := range owners {
+		for skip := 0; ; skip += maxPerPage {
+			urls, _, err := store.List(context.Background(), ListQuery{Owner: owner, Sort: "created_at", Skip: skip, Limit: maxPerPage})
+			if err != nil {
+				return err
+			}
+
+			for _, u := range urls {
+				if u.ExpiresAt != nil && !u.ExpiresAt.Before(from) && u.ExpiresAt.Before(until) {
+					n.scheduleExpiry(u)
+				}
+			}
+
+			if len(urls) < maxPerPage {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// notify sends event for u to its owner's webhooks when webhooks are enabled, newly created urls
+// that expire soon are also scheduled for link.expired
+func (h *Handlers) notify(event string, u *URL) {
+	if h.webhooks == nil || u == nil {
+		return
+	}
+
+	h.webhooks.Notify(u.Owner, WebhookEvent{Event: event, URL: u})
+	if event == EventLinkCreated {
+		h.webhooks.expireLater(u)
+	}
+}
+
+// CreateWebhook registers a webhook for the caller's urls, the response holds the secret its
+// deliveries are signed with
+func (h *Handlers) CreateWebhook(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	req := WebhookRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validWebhook(req) {
+		h.respondBodyError(w, err, ErrInvalidWebhook)
+		return
+	}
+
+	owner := requestOwner(r)
+	hooks, err := h.webhooks.store.ListWebhooks(owner)
+	if err != nil {
+		h.RespondError(w, ErrUnableToSaveWebhook, http.StatusInternalServerError)
+		return
+	}
+
+	if len(hooks) >= maxWebhooksPerOwner {
+		h.RespondError(w, ErrTooManyWebhooks, http.StatusConflict)
+		return
+	}
+
+	id, err := webhookID()
+	if err != nil {
+		h.RespondError(w, ErrUnableToSaveWebhook, http.StatusInternalServerError)
+		return
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		h.RespondError(w, ErrUnableToSaveWebhook, http.StatusInternalServerError)
+		return
+	}
+
+	wh := Webhook{
+		ID:        id,
+		Owner:     owner,
+		URL:       req.URL,
+		Events:    req.Events,
+		Secret:    hex.EncodeToString(secret),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err := h.webhooks.store.SaveWebhook(&wh); err != nil {
+		h.RespondError(w, ErrUnableToSaveWebhook, http.StatusInternalServerError)
+		return
+	}
+
+	h.RespondJSON(w, NewWebhookResponse{Webhook: wh, Secret: wh.Secret}, http.StatusCreated)
+}
+
+// ListWebhooks responds with the caller's webhooks
+func (h *Handlers) ListWebhooks(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	hooks, err := h.webhooks.store.ListWebhooks(requestOwner(r))
+	if err != nil {
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	h.RespondJSON(w, hooks, http.StatusOK)
+}
+
+// DeleteWebhook removes one of the caller's webhooks
+func (h *Handlers) DeleteWebhook(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if err := h.webhooks.store.DeleteWebhook(requestOwner(r), params["id"]); err != nil {
+		if err == ErrNotFound {
+			h.RespondError(w, ErrWebhookNotFound, http.StatusNotFound)
+			return
+		}
+
+		h.RespondError(w, ErrStoreUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validWebhook reports whether req names an absolute http or https url and only known events
+func validWebhook(req WebhookRequest) bool {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(req.Events) == 0 {
+		return false
+	}
+
+	for _, e := range req.Events {
+		known := false
+		for _, k := range webhookEvents {
+			known = known || e == k
+		}
+
+		if !known {
+			return false
+		}
+	}
+
+	return true
+}